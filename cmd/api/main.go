@@ -18,7 +18,12 @@ func main() {
 	addr := "0.0.0.0:" + port
 	log.Println("Starting server on", addr)
 
-	app := app.NewApplication(app.NewConfig(addr))
+	cfg, err := app.LoadConfig(addr)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	app := app.NewApplication(cfg)
 
 	dsn := os.Getenv("DATABASE_URL")
 	if dsn == "" {
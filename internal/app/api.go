@@ -1,11 +1,14 @@
 package app
 
 import (
+	"context"
 	"database/sql"
 	"log"
 	"net/http"
+	"slices"
 	"time"
 
+	"github.com/VicAlexandre/pds-backend/internal/auth"
 	"github.com/VicAlexandre/pds-backend/internal/handlers"
 	"github.com/VicAlexandre/pds-backend/internal/models"
 	"github.com/VicAlexandre/pds-backend/internal/services"
@@ -19,53 +22,188 @@ type Application struct {
 	config Config
 }
 
-type Config struct {
-	addr string
-}
-
 func (app *Application) Mount(conn *sql.DB) http.Handler {
 	r := chi.NewRouter()
 
-	/* cors handler */
+	/* models */
+	userModel := &models.UserModel{
+		DB: conn,
+	}
+
+	tokenModel := &models.JWTModel{
+		DB:   conn,
+		Keys: app.config.keys,
+	}
+
+	refreshTokenModel := &models.RefreshTokenModel{
+		DB: conn,
+	}
+
+	apostilaModel := &models.ApostilaModel{
+		DB: conn,
+	}
+
+	passwordResetModel := &models.PasswordResetModel{
+		DB: conn,
+	}
+
+	mfaModel := &models.MFAModel{
+		DB: conn,
+	}
+
+	identityModel := &models.IdentityModel{
+		DB: conn,
+	}
+
+	roleModel := &models.RoleModel{
+		DB: conn,
+	}
+
+	patModel := &models.PersonalAccessTokenModel{
+		DB: conn,
+	}
+
+	sessionModel := &models.SessionModel{
+		DB: conn,
+	}
+
+	auditModel := &models.AuditEventModel{
+		DB: conn,
+	}
+
+	dataExportModel := &models.DataExportModel{
+		DB: conn,
+	}
+
+	deletionRequestModel := &models.DeletionRequestModel{
+		DB: conn,
+	}
+
+	organizationModel := &models.OrganizationModel{
+		DB: conn,
+	}
+
+	authMiddleware := auth.NewMiddleware(tokenModel, patModel, sessionModel, app.config.cookies)
+
+	/* services */
+	auditService := services.NewAuditService(auditModel)
+
+	var attemptStore services.AttemptStore = services.NewMemoryAttemptStore()
+	if app.config.attemptStore == "postgres" {
+		attemptStore = &models.LoginAttemptModel{DB: conn}
+	}
+
+	loginLimiter := services.NewLoginLimiter(attemptStore)
+	passwordService := services.NewPasswordService(app.config.passwordHasher, app.config.passwordPolicy)
+	authzService := services.NewAuthzService(roleModel, userModel, auditService)
+	mfaService := services.NewMFAService(mfaModel, userModel)
+	emailVerificationService := services.NewEmailVerificationService(userModel, tokenModel, app.config.mailer, app.config.baseURL)
+
+	passwordResetService := services.NewPasswordResetService(userModel, passwordResetModel, refreshTokenModel, patModel, loginLimiter, app.config.mailer, app.config.baseURL, passwordService, auditService)
+
+	organizationService := services.NewOrganizationService(organizationModel, userModel, apostilaModel, auditService)
+
+	authService := services.NewAuthService(userModel, tokenModel, refreshTokenModel, emailVerificationService, loginLimiter, mfaService, authzService, sessionModel, passwordService, auditService)
+
+	/* cors handler, deployment admins can register the origins of organization frontends */
+	allowedOrigins := []string{"https://apostilab.onrender.com", "http://localhost:5173"}
+	allowOrigin := func(r *http.Request, origin string) bool {
+		return slices.Contains(allowedOrigins, origin) || organizationService.AllowedOrigin(r.Context(), origin)
+	}
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"https://apostilab.onrender.com", "http://localhost:5173"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		AllowOriginFunc:  allowOrigin,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "X-Auth-Mode", "X-Organization", "If-Match", "If-None-Match"},
+		ExposedHeaders:   []string{"Link", "X-CSRF-Token", "ETag"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 
 	/* middleware */
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(auth.RealIP(app.config.trustedProxies))
+	r.Use(auth.StoreClientIP)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Timeout(60 * time.Second))
 
-	/* models */
-	userModel := &models.UserModel{
-		DB: conn,
+	/* handlers */
+	authHandler := &handlers.AuthHandler{
+		AuthService:              authService,
+		EmailVerificationService: emailVerificationService,
+		Cookies:                  app.config.cookies,
 	}
 
-	tokenModel := &models.JWTModel{}
+	oidcHandler := &handlers.OIDCHandler{
+		OIDCService: services.NewOIDCService(app.config.oidcProviders, identityModel, userModel, authService),
+		Cookies:     app.config.cookies,
+	}
 
-	apostilaModel := &models.ApostilaModel{
-		DB: conn,
+	meHandler := handlers.NewMeHandler(services.NewUserService(userModel, identityModel, refreshTokenModel, emailVerificationService, passwordService, auditService, app.config.mailer, app.config.baseURL))
+
+	apostilaService := services.NewApostilaService(apostilaModel, userModel, emailVerificationService, app.config.verificationPolicy, authzService, auditService, organizationService, app.config.mailer, app.config.baseURL)
+
+	/* thins out old autosaves from the revision history */
+	go apostilaService.RunRevisionRetention(context.Background(), time.Hour)
+
+	apostilasHandler := &handlers.ApostilasHandler{
+		ApostilaService: apostilaService,
 	}
 
-	/* handlers */
-	authHandler := &handlers.AuthHandler{
-		AuthService: services.NewAuthService(userModel, tokenModel),
+	/* revoking a share closes the collaborative sessions it allowed */
+	apostilaService.Collab = services.NewCollabHub(apostilaService)
+
+	collabHandler := &handlers.CollabHandler{
+		Hub:         apostilaService.Collab,
+		Auth:        authMiddleware,
+		CheckOrigin: allowOrigin,
+	}
+
+	mfaHandler := &handlers.MFAHandler{
+		MFAService: mfaService,
 	}
 
-	meHandler := handlers.NewMeHandler(services.NewUserService(userModel))
+	privacyService := services.NewPrivacyService(userModel, roleModel, identityModel, sessionModel, patModel, apostilaModel, deletionRequestModel, loginLimiter, passwordService, app.config.mailer, app.config.baseURL, app.config.deletionGrace, auditService, organizationModel, dataExportModel)
 
-	apostilasHandler := &handlers.ApostilasHandler{
-		ApostilaService: services.NewApostilaService(apostilaModel, userModel, tokenModel),
+	/* erases the accounts whose deletion grace period is over */
+	go privacyService.RunErasure(context.Background(), time.Hour)
+
+	privacyHandler := &handlers.PrivacyHandler{
+		PrivacyService: privacyService,
+	}
+
+	passwordResetHandler := &handlers.PasswordResetHandler{
+		PasswordResetService: passwordResetService,
+	}
+
+	patHandler := &handlers.PersonalAccessTokenHandler{
+		PersonalAccessTokenService: services.NewPersonalAccessTokenService(patModel),
+	}
+
+	sessionHandler := &handlers.SessionHandler{
+		SessionService: services.NewSessionService(sessionModel),
+	}
+
+	adminHandler := &handlers.AdminHandler{
+		AuthzService:     authzService,
+		UserAdminService: services.NewUserAdminService(userModel, refreshTokenModel, passwordResetService, privacyService, auditService),
+	}
+
+	organizationHandler := &handlers.OrganizationHandler{
+		OrganizationService: organizationService,
+	}
+
+	auditHandler := &handlers.AuditHandler{
+		AuditService: auditService,
+	}
+
+	jwksHandler := &handlers.JWKSHandler{
+		Keys: app.config.keys,
 	}
 
 	/* routes */
+	r.Get("/.well-known/jwks.json", jwksHandler.ServeJWKS)
+
 	r.Route("/v1", func(r chi.Router) {
 		/* health check route */
 		r.Get("/health", handlers.HealthCheckHandler)
@@ -74,28 +212,115 @@ func (app *Application) Mount(conn *sql.DB) http.Handler {
 		r.Route("/auth", func(r chi.Router) {
 			r.Post("/register", authHandler.Register)
 			r.Post("/login", authHandler.Login)
+			r.Post("/login/mfa", authHandler.LoginMFA)
+			r.Post("/refresh", authHandler.Refresh)
 			r.Post("/logout", authHandler.Logout)
+			r.Post("/verify-email", authHandler.VerifyEmail)
+			r.With(authMiddleware.Authenticate, auth.RequireSession).Post("/verify-email/resend", authHandler.ResendVerification)
+
+			r.Get("/oidc/providers", oidcHandler.ListProviders)
+			r.Get("/oidc/{provider}/authorize", oidcHandler.Authorize)
+			r.Post("/oidc/{provider}/callback", oidcHandler.Callback)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(authMiddleware.Authenticate)
+
+			/* routes open to personal access tokens with the matching scope */
+			r.With(auth.RequireScope(services.ScopeRead)).Get("/me", meHandler.FetchUserData)
+
+			/* apostila routes, X-Organization or ?organization= picks the workspace */
+			r.Group(func(r chi.Router) {
+				r.Use(auth.ResolveOrganization(organizationService))
+
+				r.With(auth.RequireScope(services.ScopeRead)).Get("/apostilas", apostilasHandler.ListApostilas)
+				r.With(auth.RequireScope(services.ScopeWrite)).Post("/apostilas", apostilasHandler.AddApostila)
+				r.With(auth.RequireScope(services.ScopeWrite)).Delete("/apostilas", apostilasHandler.DeleteApostila)
+				r.With(auth.RequireScope(services.ScopeWrite)).Put("/apostilas/edit", apostilasHandler.EditApostila)
+				r.With(auth.RequireScope(services.ScopeRead)).Get("/apostilas/edited_html", apostilasHandler.GetEditedApostilaHTML)
+				r.With(auth.RequireScope(services.ScopeRead)).Get("/apostilas/search", apostilasHandler.SearchApostilas)
+				r.With(auth.RequireScope(services.ScopeRead)).Get("/apostilas/shared", apostilasHandler.ListSharedApostilas)
+				r.With(auth.RequireScope(services.ScopeRead)).Get("/apostilas/{id}", apostilasHandler.GetApostila)
+				r.With(auth.RequireScope(services.ScopeWrite)).Patch("/apostilas/{id}", apostilasHandler.UpdateApostila)
+				r.With(auth.RequireScope(services.ScopeRead)).Get("/apostilas/{id}/revisions", apostilasHandler.ListRevisions)
+				r.With(auth.RequireScope(services.ScopeRead)).Get("/apostilas/{id}/revisions/diff", apostilasHandler.DiffRevisions)
+				r.With(auth.RequireScope(services.ScopeRead)).Get("/apostilas/{id}/revisions/{revision}", apostilasHandler.GetRevision)
+				r.With(auth.RequireScope(services.ScopeWrite)).Post("/apostilas/{id}/revisions/{revision}/restore", apostilasHandler.RestoreRevision)
+				r.With(auth.RequireScope(services.ScopeWrite)).Get("/apostilas/{id}/collab", collabHandler.Connect)
+				r.With(auth.RequireScope(services.ScopeRead)).Get("/apostilas/{id}/permissions", apostilasHandler.ListPermissions)
+				r.With(auth.RequireScope(services.ScopeWrite)).Post("/apostilas/{id}/permissions", apostilasHandler.ShareApostila)
+				r.With(auth.RequireScope(services.ScopeWrite)).Patch("/apostilas/{id}/permissions/{user_id}", apostilasHandler.UpdatePermission)
+				r.With(auth.RequireScope(services.ScopeWrite)).Delete("/apostilas/{id}/permissions/{user_id}", apostilasHandler.RevokePermission)
+				r.With(auth.RequireScope(services.ScopeWrite)).Delete("/apostilas/{id}/invites/{invite}", apostilasHandler.RevokeInvite)
+			})
+			r.With(auth.RequireScope(services.ScopeRender)).Post("/apostilas/render_pdf", apostilasHandler.RenderApostilaPDF)
+			r.With(auth.RequireScope(services.ScopeWrite)).Post("/apostila-invites/accept", apostilasHandler.AcceptInvite)
+
+			r.Group(func(r chi.Router) {
+				r.Use(auth.RequireSession)
+
+				/* user management routes */
+				r.Patch("/me", meHandler.UpdateCurrentUser)
+				r.Delete("/me", privacyHandler.RequestDeletion)
+				r.Patch("/me/password", meHandler.ChangePassword)
+
+				r.Post("/me/export", privacyHandler.RequestExport)
+				r.Get("/me/export", privacyHandler.ExportStatus)
+				r.Get("/me/export/download", privacyHandler.DownloadExport)
+				r.Get("/me/deletion-request", privacyHandler.DeletionStatus)
+				r.Post("/me/deletion-request", privacyHandler.RequestDeletion)
+				r.Delete("/me/deletion-request", privacyHandler.CancelDeletion)
+
+				r.Post("/me/mfa/enroll", mfaHandler.Enroll)
+				r.Post("/me/mfa/activate", mfaHandler.Activate)
+				r.Delete("/me/mfa", mfaHandler.Disable)
+
+				r.Get("/me/tokens", patHandler.ListTokens)
+				r.Post("/me/tokens", patHandler.CreateToken)
+				r.Delete("/me/tokens/{id}", patHandler.RevokeToken)
+
+				r.Get("/me/sessions", sessionHandler.ListSessions)
+				r.Delete("/me/sessions", sessionHandler.RevokeOtherSessions)
+				r.Delete("/me/sessions/{id}", sessionHandler.RevokeSession)
+
+				/* organization routes */
+				r.Get("/organizations", organizationHandler.ListMine)
+				r.Get("/organizations/{slug}", organizationHandler.Get)
+				r.Patch("/organizations/{slug}", organizationHandler.Update)
+				r.Get("/organizations/{slug}/members", organizationHandler.ListMembers)
+				r.Post("/organizations/{slug}/members", organizationHandler.AddMember)
+				r.Patch("/organizations/{slug}/members/{user_id}", organizationHandler.UpdateMember)
+				r.Delete("/organizations/{slug}/members/{user_id}", organizationHandler.RemoveMember)
+
+				/* admin routes */
+				r.Route("/admin", func(r chi.Router) {
+					r.Use(auth.RequirePermission(authzService, services.PermUserAdmin))
+
+					r.Get("/roles", adminHandler.ListRoles)
+
+					r.Get("/users", adminHandler.ListUsers)
+					r.Delete("/users/{id}", adminHandler.DeleteUser)
+					r.Post("/users/{id}/disable", adminHandler.DisableUser)
+					r.Post("/users/{id}/enable", adminHandler.EnableUser)
+					r.Post("/users/{id}/password-reset", adminHandler.ForcePasswordReset)
+					r.Get("/users/{id}/roles", adminHandler.ListUserRoles)
+					r.Post("/users/{id}/roles", adminHandler.GrantRole)
+					r.Delete("/users/{id}/roles/{role}", adminHandler.RevokeRole)
+
+					r.Post("/organizations", organizationHandler.Create)
+					r.Delete("/organizations/{slug}", organizationHandler.Delete)
+					r.Put("/organizations/{slug}/quotas", organizationHandler.SetQuotas)
+					r.Put("/organizations/{slug}/origins", organizationHandler.SetAllowedOrigins)
+
+					r.Get("/audit-events", auditHandler.ListEvents)
+				})
+			})
 		})
-		//
-		// /* user management routes */
-		// r.Group(func(r chi.Router) {
-		// 	r.Use(app.authMiddleware)
-		//
-		r.Get("/me", meHandler.FetchUserData)
-		// 	r.Patch("/me", app.updateCurrentUserHandler)
-		// 	r.Delete("/me", app.deleteCurrentUserHandler)
-		//
-		// 	r.Patch("/me/password", app.changePasswordHandler)
-		// })
-		//
-		// r.Post("/forgot-password", app.forgotPasswordHandler)
-		// r.Post("/reset-password", app.resetPasswordHandler)
-		//
-		r.Post("/apostilas", apostilasHandler.AddApostila)
-		r.Delete("/apostilas", apostilasHandler.DeleteApostila)
-		r.Put("/apostilas/edit", apostilasHandler.EditApostila)
-		r.Get("/apostilas/edited_html", apostilasHandler.GetEditedApostilaHTML)
-		r.Post("/apostilas/render_pdf", apostilasHandler.RenderApostilaPDF)
+
+		r.Get("/organizations/{slug}/branding", organizationHandler.Branding)
+
+		r.Post("/forgot-password", passwordResetHandler.ForgotPassword)
+		r.Post("/reset-password", passwordResetHandler.ResetPassword)
 	})
 
 	return r
@@ -112,14 +337,6 @@ func (app *Application) Run(mux http.Handler) error {
 	return srv.ListenAndServe()
 }
 
-func NewConfig(addr string) Config {
-	cfg := Config{
-		addr: addr,
-	}
-
-	return cfg
-}
-
 func NewApplication(cfg Config) Application {
 	app := Application{
 		config: cfg,
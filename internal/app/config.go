@@ -0,0 +1,352 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VicAlexandre/pds-backend/internal/auth"
+	"github.com/VicAlexandre/pds-backend/internal/mailer"
+	"github.com/VicAlexandre/pds-backend/internal/models"
+	"github.com/VicAlexandre/pds-backend/internal/oidc"
+	"github.com/VicAlexandre/pds-backend/internal/password"
+	"github.com/VicAlexandre/pds-backend/internal/services"
+)
+
+type Config struct {
+	addr               string
+	keys               *models.KeySet
+	mailer             mailer.Mailer
+	baseURL            string
+	verificationPolicy services.EmailVerificationPolicy
+	attemptStore       string
+	oidcProviders      map[string]*oidc.Provider
+	passwordHasher     *password.Hasher
+	passwordPolicy     *password.Policy
+	cookies            auth.CookieConfig
+	deletionGrace      time.Duration
+	trustedProxies     auth.TrustedProxies
+}
+
+/* LoadConfig reads everything besides the listen address from the environment */
+func LoadConfig(addr string) (Config, error) {
+	keys, err := LoadSigningKeys()
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to load JWT signing keys: %w", err)
+	}
+
+	m, err := LoadMailer()
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to configure mailer: %w", err)
+	}
+
+	baseURL := os.Getenv("APP_BASE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:5173"
+	}
+
+	policy := services.EmailVerificationPolicy(os.Getenv("EMAIL_VERIFICATION_POLICY"))
+	switch policy {
+	case "":
+		policy = services.EmailVerificationOff
+	case services.EmailVerificationOff, services.EmailVerificationEnforce:
+	default:
+		return Config{}, fmt.Errorf("invalid EMAIL_VERIFICATION_POLICY %q", policy)
+	}
+
+	/* memory is fine for a single instance, several instances need to share the counters */
+	attemptStore := os.Getenv("LOGIN_ATTEMPT_STORE")
+	switch attemptStore {
+	case "":
+		attemptStore = "memory"
+	case "memory", "postgres":
+	default:
+		return Config{}, fmt.Errorf("invalid LOGIN_ATTEMPT_STORE %q", attemptStore)
+	}
+
+	providers, err := LoadOIDCProviders()
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to load OIDC providers: %w", err)
+	}
+
+	hasher, err := LoadPasswordHasher()
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to configure password hashing: %w", err)
+	}
+
+	passwordPolicy, err := LoadPasswordPolicy()
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to load password policy: %w", err)
+	}
+
+	cookies, err := LoadCookieConfig()
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to configure auth cookies: %w", err)
+	}
+
+	/* without it the client IP is the peer address, proxy headers are ignored */
+	trustedProxies, err := auth.ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+
+	/* LGPD does not set a number, 15 days gives time to notice a request one did not make */
+	graceDays := 15
+	if raw := os.Getenv("ACCOUNT_DELETION_GRACE_DAYS"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return Config{}, fmt.Errorf("invalid ACCOUNT_DELETION_GRACE_DAYS %q", raw)
+		}
+		graceDays = n
+	}
+
+	cfg := Config{
+		addr:               addr,
+		keys:               keys,
+		mailer:             m,
+		baseURL:            strings.TrimRight(baseURL, "/"),
+		verificationPolicy: policy,
+		attemptStore:       attemptStore,
+		oidcProviders:      providers,
+		passwordHasher:     hasher,
+		passwordPolicy:     passwordPolicy,
+		cookies:            cookies,
+		deletionGrace:      time.Duration(graceDays) * 24 * time.Hour,
+		trustedProxies:     trustedProxies,
+	}
+
+	return cfg, nil
+}
+
+/* LoadMailer uses SMTP when SMTP_HOST is set and falls back to LogMailer otherwise */
+func LoadMailer() (mailer.Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "Apostilab <no-reply@apostilab.local>"
+	}
+
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		log.Println("SMTP_HOST not set, emails will be written to MAIL_DIR or the log")
+		return &mailer.LogMailer{Dir: os.Getenv("MAIL_DIR"), From: from}, nil
+	}
+
+	port := 587
+	if p := os.Getenv("SMTP_PORT"); p != "" {
+		var err error
+		if port, err = strconv.Atoi(p); err != nil {
+			return nil, fmt.Errorf("invalid SMTP_PORT %q", p)
+		}
+	}
+
+	return &mailer.SMTPMailer{
+		Host:     host,
+		Port:     port,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     from,
+	}, nil
+}
+
+/*
+ * LoadSigningKeys reads JWT_SIGNING_KEYS, a comma separated list of kid=alg:path
+ * entries, e.g. "2025-08=EdDSA:/keys/ed25519.pem,2025-01=RS256:/keys/old.pub.pem".
+ * JWT_ACTIVE_KEY picks the key used to sign new tokens and defaults to the first
+ * entry; the others only verify tokens issued before the rotation.
+ */
+func LoadSigningKeys() (*models.KeySet, error) {
+	spec := os.Getenv("JWT_SIGNING_KEYS")
+	if spec == "" {
+		/* each restart and each replica would sign with its own key, only fine when running locally */
+		if os.Getenv("APP_ENV") != "development" {
+			return nil, fmt.Errorf("JWT_SIGNING_KEYS is required outside APP_ENV=development")
+		}
+
+		log.Println("JWT_SIGNING_KEYS not set, using an ephemeral Ed25519 key")
+		key, err := models.GenerateEd25519Key("dev")
+		if err != nil {
+			return nil, err
+		}
+
+		return models.NewKeySet(key.ID, key)
+	}
+
+	var keys []*models.SigningKey
+	for _, entry := range strings.Split(spec, ",") {
+		kid, rest, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid JWT_SIGNING_KEYS entry %q", entry)
+		}
+
+		alg, path, ok := strings.Cut(rest, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid JWT_SIGNING_KEYS entry %q", entry)
+		}
+
+		key, err := models.LoadSigningKey(kid, alg, path)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	activeID := os.Getenv("JWT_ACTIVE_KEY")
+	if activeID == "" {
+		activeID = keys[0].ID
+	}
+
+	return models.NewKeySet(activeID, keys...)
+}
+
+/*
+ * LoadOIDCProviders reads the JSON list in OIDC_PROVIDERS_FILE. ${VAR} references are
+ * expanded from the environment so client secrets can stay out of the file.
+ */
+func LoadOIDCProviders() (map[string]*oidc.Provider, error) {
+	providers := map[string]*oidc.Provider{}
+
+	path := os.Getenv("OIDC_PROVIDERS_FILE")
+	if path == "" {
+		return providers, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []oidc.ProviderConfig
+	if err := json.Unmarshal([]byte(os.ExpandEnv(string(raw))), &configs); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	for _, c := range configs {
+		if c.Name == "" || c.Issuer == "" || c.ClientID == "" || c.RedirectURL == "" {
+			return nil, fmt.Errorf("provider %q needs name, issuer, client_id and redirect_url", c.Name)
+		}
+
+		if _, dup := providers[c.Name]; dup {
+			return nil, fmt.Errorf("duplicate provider %q", c.Name)
+		}
+
+		providers[c.Name] = oidc.NewProvider(c)
+	}
+
+	return providers, nil
+}
+
+/*
+ * LoadPasswordHasher reads the Argon2id parameters. Raising them later is safe,
+ * existing hashes keep verifying and are upgraded on the next login.
+ */
+func LoadPasswordHasher() (*password.Hasher, error) {
+	params := password.DefaultParams
+
+	for _, v := range []struct {
+		env string
+		dst *uint32
+	}{
+		{"ARGON2_MEMORY_KIB", &params.Memory},
+		{"ARGON2_ITERATIONS", &params.Iterations},
+	} {
+		raw := os.Getenv(v.env)
+		if raw == "" {
+			continue
+		}
+
+		n, err := strconv.ParseUint(raw, 10, 32)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid %s %q", v.env, raw)
+		}
+		*v.dst = uint32(n)
+	}
+
+	if raw := os.Getenv("ARGON2_PARALLELISM"); raw != "" {
+		n, err := strconv.ParseUint(raw, 10, 8)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid ARGON2_PARALLELISM %q", raw)
+		}
+		params.Parallelism = uint8(n)
+	}
+
+	return password.NewHasher(params), nil
+}
+
+/* LoadPasswordPolicy adds PASSWORD_DENYLIST_FILE, if set, to the embedded denylist */
+func LoadPasswordPolicy() (*password.Policy, error) {
+	minLength := 8
+	if raw := os.Getenv("PASSWORD_MIN_LENGTH"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid PASSWORD_MIN_LENGTH %q", raw)
+		}
+		minLength = n
+	}
+
+	policy := password.NewPolicy(minLength)
+
+	if path := os.Getenv("PASSWORD_DENYLIST_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		if err := policy.AddDenylist(f); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+
+	return policy, nil
+}
+
+/* LoadCookieConfig enables the browser cookie mode, it is off unless AUTH_COOKIES is set */
+func LoadCookieConfig() (auth.CookieConfig, error) {
+	cfg := auth.CookieConfig{
+		Domain:   os.Getenv("COOKIE_DOMAIN"),
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	for _, v := range []struct {
+		env string
+		dst *bool
+	}{
+		{"AUTH_COOKIES", &cfg.Enabled},
+		{"COOKIE_SECURE", &cfg.Secure},
+	} {
+		raw := os.Getenv(v.env)
+		if raw == "" {
+			continue
+		}
+
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return auth.CookieConfig{}, fmt.Errorf("invalid %s %q", v.env, raw)
+		}
+		*v.dst = b
+	}
+
+	switch raw := os.Getenv("COOKIE_SAMESITE"); strings.ToLower(raw) {
+	case "", "lax":
+	case "strict":
+		cfg.SameSite = http.SameSiteStrictMode
+	case "none":
+		cfg.SameSite = http.SameSiteNoneMode
+	default:
+		return auth.CookieConfig{}, fmt.Errorf("invalid COOKIE_SAMESITE %q", raw)
+	}
+
+	/* browsers drop SameSite=None cookies that are not Secure */
+	if cfg.SameSite == http.SameSiteNoneMode && !cfg.Secure {
+		return auth.CookieConfig{}, fmt.Errorf("COOKIE_SAMESITE=none requires COOKIE_SECURE")
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,102 @@
+package app
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func writeEd25519Key(t *testing.T, dir, name string) string {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadSigningKeys(t *testing.T) {
+	dir := t.TempDir()
+	current := writeEd25519Key(t, dir, "current.pem")
+	previous := writeEd25519Key(t, dir, "previous.pem")
+	spec := "2025-08=EdDSA:" + current + ", 2025-01=EdDSA:" + previous
+
+	tests := []struct {
+		name       string
+		spec       string
+		active     string
+		env        string
+		wantErr    bool
+		wantKids   []string
+		wantActive string
+	}{
+		{name: "missing outside development", wantErr: true},
+		{name: "missing in production", env: "production", wantErr: true},
+		{name: "ephemeral key in development", env: "development", wantKids: []string{"dev"}, wantActive: "dev"},
+		{name: "first entry signs by default", spec: spec, wantKids: []string{"2025-08", "2025-01"}, wantActive: "2025-08"},
+		{name: "active key picked by id", spec: spec, active: "2025-01", wantKids: []string{"2025-08", "2025-01"}, wantActive: "2025-01"},
+		{name: "unknown active key", spec: spec, active: "2024-01", wantErr: true},
+		{name: "entry without alg", spec: "2025-08=" + current, wantErr: true},
+		{name: "entry without kid", spec: "EdDSA:" + current, wantErr: true},
+		{name: "missing file", spec: "2025-08=EdDSA:" + filepath.Join(dir, "nope.pem"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("JWT_SIGNING_KEYS", tt.spec)
+		t.Setenv("JWT_ACTIVE_KEY", tt.active)
+		t.Setenv("APP_ENV", tt.env)
+
+		ks, err := LoadSigningKeys()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: LoadSigningKeys succeeded, want an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: LoadSigningKeys: %v", tt.name, err)
+			continue
+		}
+
+		kids := map[string]bool{}
+		for _, k := range ks.JWKS().Keys {
+			kids[k.Kid] = true
+		}
+		for _, kid := range tt.wantKids {
+			if !kids[kid] {
+				t.Errorf("%s: key %s missing from the set", tt.name, kid)
+			}
+		}
+
+		token, err := ks.Sign(jwt.RegisteredClaims{Subject: "1"})
+		if err != nil {
+			t.Errorf("%s: Sign: %v", tt.name, err)
+			continue
+		}
+		parsed, _, err := jwt.NewParser().ParseUnverified(token, &jwt.RegisteredClaims{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kid := parsed.Header["kid"]; kid != tt.wantActive {
+			t.Errorf("%s: signed with %v, want %s", tt.name, kid, tt.wantActive)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/VicAlexandre/pds-backend/internal/models"
+)
+
+type contextKey int
+
+const (
+	claimsKey contextKey = iota
+	clientIPKey
+	organizationKey
+)
+
+func WithClaims(ctx context.Context, claims *models.Claims) context.Context {
+	return context.WithValue(ctx, claimsKey, claims)
+}
+
+/* ClaimsFromContext returns the claims stored by Middleware.Authenticate */
+func ClaimsFromContext(ctx context.Context) (*models.Claims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*models.Claims)
+	return claims, ok && claims != nil
+}
+
+func UserIDFromContext(ctx context.Context) (int64, bool) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return 0, false
+	}
+
+	return claims.UserID, true
+}
+
+/* StoreClientIP must run after RealIP, it lets services read the IP without the request */
+func StoreClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey, ClientIP(r))))
+	})
+}
+
+func ClientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey).(string)
+	return ip
+}
+
+/* OrganizationIDFromContext is the workspace chosen by ResolveOrganization, nil for the personal one */
+func OrganizationIDFromContext(ctx context.Context) *int64 {
+	id, ok := ctx.Value(organizationKey).(int64)
+	if !ok {
+		return nil
+	}
+
+	return &id
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/VicAlexandre/pds-backend/internal/models"
+)
+
+const (
+	AccessTokenCookie  = "access_token"
+	RefreshTokenCookie = "refresh_token"
+	CSRFCookie         = "csrf_token"
+
+	/* clients opt into cookie mode per request with "X-Auth-Mode: cookie" */
+	AuthModeHeader = "X-Auth-Mode"
+	CSRFHeader     = "X-CSRF-Token"
+
+	/* the refresh token is only sent to the endpoints that consume it */
+	refreshCookiePath = "/v1/auth"
+)
+
+/* CookieConfig is the browser session mode, Bearer tokens keep working when it is enabled */
+type CookieConfig struct {
+	Enabled  bool
+	Domain   string
+	Secure   bool
+	SameSite http.SameSite
+}
+
+func (c CookieConfig) Requested(r *http.Request) bool {
+	return c.Enabled && strings.EqualFold(r.Header.Get(AuthModeHeader), "cookie")
+}
+
+/*
+ * SetTokens stores both tokens in HttpOnly cookies and issues a new CSRF token. The
+ * CSRF token also goes out in a response header, since a front end on another site
+ * cannot read cookies set for the API's domain.
+ */
+func (c CookieConfig) SetTokens(w http.ResponseWriter, token *models.Token) error {
+	csrf, err := models.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, c.cookie(AccessTokenCookie, token.AccessToken, "/", token.ExpiresAt, true))
+	http.SetCookie(w, c.cookie(RefreshTokenCookie, token.RefreshToken, refreshCookiePath, token.RefreshExpiresAt, true))
+	http.SetCookie(w, c.cookie(CSRFCookie, csrf, "/", token.RefreshExpiresAt, false))
+	w.Header().Set(CSRFHeader, csrf)
+
+	return nil
+}
+
+func (c CookieConfig) Clear(w http.ResponseWriter) {
+	expired := time.Unix(0, 0)
+
+	http.SetCookie(w, c.cookie(AccessTokenCookie, "", "/", expired, true))
+	http.SetCookie(w, c.cookie(RefreshTokenCookie, "", refreshCookiePath, expired, true))
+	http.SetCookie(w, c.cookie(CSRFCookie, "", "/", expired, false))
+}
+
+func (c CookieConfig) cookie(name, value, path string, expires time.Time, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   c.Domain,
+		Expires:  expires,
+		Secure:   c.Secure,
+		HttpOnly: httpOnly,
+		SameSite: c.SameSite,
+	}
+}
+
+/* ValidCSRF is the double-submit check: the header must repeat the csrf_token cookie */
+func ValidCSRF(r *http.Request) bool {
+	cookie, err := r.Cookie(CSRFCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+
+	header := r.Header.Get(CSRFHeader)
+
+	return header != "" && subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) == 1
+}
+
+func IsSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/VicAlexandre/pds-backend/internal/models"
+)
+
+/*
+ * TestAuthenticateCSRF only sends tokens that fail to parse, so a request that gets past
+ * the CSRF check ends in 401 and one stopped by it in 403, without a database.
+ */
+func TestAuthenticateCSRF(t *testing.T) {
+	tests := []struct {
+		name     string
+		cookies  bool
+		method   string
+		bearer   bool
+		cookie   bool
+		csrf     string
+		header   string
+		wantCode int
+	}{
+		{name: "cookie without csrf header", cookies: true, method: http.MethodPost, cookie: true, csrf: "abc", wantCode: http.StatusForbidden},
+		{name: "cookie with mismatched csrf header", cookies: true, method: http.MethodDelete, cookie: true, csrf: "abc", header: "abd", wantCode: http.StatusForbidden},
+		{name: "cookie with header but no csrf cookie", cookies: true, method: http.MethodPut, cookie: true, header: "abc", wantCode: http.StatusForbidden},
+		{name: "cookie without any csrf token", cookies: true, method: http.MethodPatch, cookie: true, wantCode: http.StatusForbidden},
+		{name: "cookie with matching csrf header", cookies: true, method: http.MethodPost, cookie: true, csrf: "abc", header: "abc", wantCode: http.StatusUnauthorized},
+		{name: "cookie on a safe method", cookies: true, method: http.MethodGet, cookie: true, wantCode: http.StatusUnauthorized},
+		{name: "bearer on an unsafe method", cookies: true, method: http.MethodPost, bearer: true, wantCode: http.StatusUnauthorized},
+		{name: "bearer with a cookie and no csrf header", cookies: true, method: http.MethodPost, bearer: true, cookie: true, csrf: "abc", wantCode: http.StatusUnauthorized},
+		{name: "cookie mode disabled", cookies: false, method: http.MethodPost, cookie: true, wantCode: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		m := NewMiddleware(&models.JWTModel{Keys: &models.KeySet{}}, nil, nil, CookieConfig{Enabled: tt.cookies})
+		handler := m.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("%s: request reached the handler", tt.name)
+		}))
+
+		r := httptest.NewRequest(tt.method, "/v1/apostilas", nil)
+		if tt.bearer {
+			r.Header.Set("Authorization", "Bearer not-a-jwt")
+		}
+		if tt.cookie {
+			r.AddCookie(&http.Cookie{Name: AccessTokenCookie, Value: "not-a-jwt"})
+		}
+		if tt.csrf != "" {
+			r.AddCookie(&http.Cookie{Name: CSRFCookie, Value: tt.csrf})
+		}
+		if tt.header != "" {
+			r.Header.Set(CSRFHeader, tt.header)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.wantCode)
+		}
+	}
+}
+
+/* the CSRF token is readable by scripts and repeated in a header, the tokens are not */
+func TestCookieConfigSetTokens(t *testing.T) {
+	c := CookieConfig{Enabled: true, Secure: true, SameSite: http.SameSiteLaxMode}
+	w := httptest.NewRecorder()
+
+	err := c.SetTokens(w, &models.Token{
+		AccessToken:      "access",
+		RefreshToken:     "refresh",
+		ExpiresAt:        time.Now().Add(time.Minute),
+		RefreshExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := map[string]*http.Cookie{}
+	for _, cookie := range w.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+
+	access, refresh, csrf := cookies[AccessTokenCookie], cookies[RefreshTokenCookie], cookies[CSRFCookie]
+	if access == nil || refresh == nil || csrf == nil {
+		t.Fatalf("missing cookies: %v", cookies)
+	}
+
+	if !access.HttpOnly || !refresh.HttpOnly || csrf.HttpOnly {
+		t.Error("tokens must be HttpOnly and the CSRF token readable")
+	}
+	if refresh.Path != refreshCookiePath {
+		t.Errorf("refresh token path %q, want %q", refresh.Path, refreshCookiePath)
+	}
+	if csrf.Value == "" || w.Header().Get(CSRFHeader) != csrf.Value {
+		t.Errorf("CSRF header %q does not repeat the cookie %q", w.Header().Get(CSRFHeader), csrf.Value)
+	}
+	if !access.Secure || access.SameSite != http.SameSiteLaxMode {
+		t.Error("cookie attributes not applied")
+	}
+}
@@ -0,0 +1,269 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/VicAlexandre/pds-backend/internal/models"
+	"github.com/google/uuid"
+)
+
+type Middleware struct {
+	TokenModel               *models.JWTModel
+	PersonalAccessTokenModel *models.PersonalAccessTokenModel
+	SessionModel             *models.SessionModel
+	Cookies                  CookieConfig
+}
+
+func NewMiddleware(tokenModel *models.JWTModel, personalAccessTokenModel *models.PersonalAccessTokenModel, sessionModel *models.SessionModel, cookies CookieConfig) *Middleware {
+	return &Middleware{
+		TokenModel:               tokenModel,
+		PersonalAccessTokenModel: personalAccessTokenModel,
+		SessionModel:             sessionModel,
+		Cookies:                  cookies,
+	}
+}
+
+/* BearerToken extracts the token from an "Authorization: Bearer <token>" header */
+func BearerToken(r *http.Request) (string, bool) {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" || parts[1] == "" {
+		return "", false
+	}
+
+	return parts[1], true
+}
+
+/*
+ * ClientIP returns the address resolved by RealIP, which leaves a bare IP in RemoteAddr
+ * when a trusted proxy named the client and host:port otherwise.
+ */
+func ClientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+
+	return r.RemoteAddr
+}
+
+/*
+ * Authenticate validates the bearer token once and stores its claims in the request context.
+ * The token is either an access token JWT or a personal access token. Without an
+ * Authorization header the access_token cookie is used, and then every unsafe method
+ * must carry the CSRF token, since browsers attach cookies to cross-site requests.
+ */
+func (m *Middleware) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := BearerToken(r)
+		if !ok && m.Cookies.Enabled {
+			if cookie, err := r.Cookie(AccessTokenCookie); err == nil && cookie.Value != "" {
+				if !IsSafeMethod(r.Method) && !ValidCSRF(r) {
+					http.Error(w, "invalid CSRF token", http.StatusForbidden)
+					return
+				}
+
+				token, ok = cookie.Value, true
+			}
+		}
+
+		if !ok {
+			unauthorized(w, "missing or malformed authorization header")
+			return
+		}
+
+		claims, err := m.parseToken(r, token)
+		if err != nil {
+			log.Println("Error parsing bearer token: ", err)
+			unauthorized(w, "unauthorized")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
+	})
+}
+
+/* access tokens are only accepted while their session is active, so revoking a session logs it out right away */
+func (m *Middleware) parseToken(r *http.Request, token string) (*models.Claims, error) {
+	if !models.IsPersonalAccessToken(token) {
+		claims, err := m.TokenModel.ParseJWT(r.Context(), token)
+		if err != nil {
+			return nil, err
+		}
+
+		sessionID, err := uuid.Parse(claims.SessionID)
+		if err != nil {
+			return nil, models.ErrSessionNotFound
+		}
+
+		if err := m.SessionModel.Authenticate(r.Context(), sessionID, ClientIP(r)); err != nil {
+			return nil, err
+		}
+
+		return claims, nil
+	}
+
+	pat, err := m.PersonalAccessTokenModel.Authenticate(r.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.Claims{
+		UserID:                pat.UserID,
+		PersonalAccessTokenID: pat.ID,
+		Scopes:                pat.Scopes,
+	}, nil
+}
+
+/*
+ * StillValid tells if the login behind claims, a session or a personal access token,
+ * is still active and its account enabled. Authenticate only checks that once per
+ * request, connections that stay open ask again with it.
+ */
+func (m *Middleware) StillValid(ctx context.Context, claims *models.Claims) (bool, error) {
+	if claims.IsPersonalAccessToken() {
+		return m.PersonalAccessTokenModel.IsActive(ctx, claims.PersonalAccessTokenID)
+	}
+
+	sessionID, err := uuid.Parse(claims.SessionID)
+	if err != nil {
+		return false, nil
+	}
+
+	return m.SessionModel.IsActive(ctx, sessionID)
+}
+
+/* RequireScope must run after Authenticate, it only restricts personal access tokens */
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := ClaimsFromContext(r.Context())
+			if !ok {
+				unauthorized(w, "unauthorized")
+				return
+			}
+
+			if !claims.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="insufficient_scope", scope="`+scope+`"`)
+				http.Error(w, "insufficient scope", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+/*
+ * RequireSession keeps personal access tokens away from account management, so a
+ * token leaked from a CI job cannot change the password or mint more tokens.
+ */
+func RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := ClaimsFromContext(r.Context())
+		if !ok {
+			unauthorized(w, "unauthorized")
+			return
+		}
+
+		if claims.IsPersonalAccessToken() {
+			http.Error(w, "personal access tokens cannot be used here", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+/* Authorizer is implemented by services.AuthzService */
+type Authorizer interface {
+	Can(ctx context.Context, userID int64, permission string) (bool, error)
+}
+
+/* RequirePermission must run after Authenticate, it answers 403 when the user lacks the permission */
+func RequirePermission(authz Authorizer, permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := UserIDFromContext(r.Context())
+			if !ok {
+				unauthorized(w, "unauthorized")
+				return
+			}
+
+			allowed, err := authz.Can(r.Context(), userID, permission)
+			if err != nil {
+				log.Println("Error checking permission: ", err)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			if !allowed {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func unauthorized(w http.ResponseWriter, msg string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	http.Error(w, msg, http.StatusUnauthorized)
+}
+
+/*
+ * OrganizationHeader selects the organization workspace by slug, without it the personal
+ * workspace is used. OrganizationParam does the same where browsers cannot set headers,
+ * as on a WebSocket handshake.
+ */
+const (
+	OrganizationHeader = "X-Organization"
+	OrganizationParam  = "organization"
+)
+
+/* OrganizationResolver is implemented by services.OrganizationService */
+type OrganizationResolver interface {
+	ResolveMembership(ctx context.Context, userID int64, slug string) (orgID int64, ok bool, err error)
+}
+
+/*
+ * ResolveOrganization must run after Authenticate. It answers 404 for organizations
+ * the user is not a member of, so slugs of other schools cannot be probed.
+ */
+func ResolveOrganization(resolver OrganizationResolver) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			slug := r.Header.Get(OrganizationHeader)
+			if slug == "" {
+				slug = r.URL.Query().Get(OrganizationParam)
+			}
+			if slug == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			userID, ok := UserIDFromContext(r.Context())
+			if !ok {
+				unauthorized(w, "unauthorized")
+				return
+			}
+
+			orgID, ok, err := resolver.ResolveMembership(r.Context(), userID, slug)
+			if err != nil {
+				log.Println("Error resolving organization: ", err)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			if !ok {
+				http.Error(w, "organization not found", http.StatusNotFound)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), organizationKey, orgID)))
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+/* TrustedProxies are the peers allowed to say who the client is through X-Forwarded-For or X-Real-IP */
+type TrustedProxies []netip.Prefix
+
+func (t TrustedProxies) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range t {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+ * RealIP replaces chi's middleware.RealIP, which believes the headers from anyone, so a
+ * new X-Forwarded-For per request would get around the per-IP login lockout. The headers
+ * are only read when the connection comes from a trusted proxy, and X-Forwarded-For is
+ * walked from the right, the entries on the left being whatever the client sent.
+ */
+func RealIP(trusted TrustedProxies) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ip, ok := trusted.clientIP(r); ok {
+				r.RemoteAddr = ip
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (t TrustedProxies) clientIP(r *http.Request) (string, bool) {
+	peer, err := netip.ParseAddr(ClientIP(r))
+	if err != nil || !t.contains(peer) {
+		return "", false
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				return "", false
+			}
+
+			if i == 0 || !t.contains(addr) {
+				return addr.Unmap().String(), true
+			}
+		}
+	}
+
+	if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return addr.Unmap().String(), true
+	}
+
+	return "", false
+}
+
+/* ParseTrustedProxies reads a comma separated list of IPs and CIDR ranges */
+func ParseTrustedProxies(spec string) (TrustedProxies, error) {
+	var trusted TrustedProxies
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, &net.ParseError{Type: "IP address", Text: entry}
+			}
+			trusted = append(trusted, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, &net.ParseError{Type: "CIDR address", Text: entry}
+		}
+		trusted = append(trusted, prefix.Masked())
+	}
+
+	return trusted, nil
+}
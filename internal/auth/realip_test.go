@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatalf("ParseTrustedProxies: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		realIP     string
+		want       string
+	}{
+		{name: "no proxy", remoteAddr: "203.0.113.5:4000", want: "203.0.113.5"},
+		{name: "spoofed header from the internet", remoteAddr: "203.0.113.5:4000", xff: "198.51.100.1", want: "203.0.113.5"},
+		{name: "spoofed real ip from the internet", remoteAddr: "203.0.113.5:4000", realIP: "198.51.100.1", want: "203.0.113.5"},
+		{name: "trusted proxy", remoteAddr: "10.1.2.3:4000", xff: "198.51.100.1", want: "198.51.100.1"},
+		{name: "trusted single ip", remoteAddr: "192.168.1.1:4000", xff: "198.51.100.1", want: "198.51.100.1"},
+		{name: "client prepends a fake hop", remoteAddr: "10.1.2.3:4000", xff: "1.2.3.4, 198.51.100.1", want: "198.51.100.1"},
+		{name: "chain of trusted proxies", remoteAddr: "10.1.2.3:4000", xff: "198.51.100.1, 10.9.9.9", want: "198.51.100.1"},
+		{name: "every hop trusted", remoteAddr: "10.1.2.3:4000", xff: "10.2.2.2, 10.9.9.9", want: "10.2.2.2"},
+		{name: "garbage hop", remoteAddr: "10.1.2.3:4000", xff: "nonsense", want: "10.1.2.3"},
+		{name: "real ip from trusted proxy", remoteAddr: "10.1.2.3:4000", realIP: "198.51.100.1", want: "198.51.100.1"},
+		{name: "untrusted neighbour of a trusted ip", remoteAddr: "192.168.1.2:4000", xff: "198.51.100.1", want: "192.168.1.2"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+
+		var got string
+		RealIP(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = ClientIP(r)
+		})).ServeHTTP(httptest.NewRecorder(), r)
+
+		if got != tt.want {
+			t.Errorf("%s: client IP = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	if trusted, err := ParseTrustedProxies(""); err != nil || len(trusted) != 0 {
+		t.Errorf(`ParseTrustedProxies("") = %v, %v, want no proxies`, trusted, err)
+	}
+
+	for _, spec := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0.1, nope/8"} {
+		if _, err := ParseTrustedProxies(spec); err == nil {
+			t.Errorf("ParseTrustedProxies(%q) succeeded, want an error", spec)
+		}
+	}
+}
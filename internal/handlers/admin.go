@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/VicAlexandre/pds-backend/internal/models"
+	"github.com/VicAlexandre/pds-backend/internal/services"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultUserPageSize = 50
+	maxUserPageSize     = 200
+)
+
+type AdminHandler struct {
+	AuthzService     *services.AuthzService
+	UserAdminService *services.UserAdminService
+}
+
+func (h *AdminHandler) ListRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := h.AuthzService.ListRoles(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(roles)
+}
+
+func (h *AdminHandler) ListUserRoles(w http.ResponseWriter, r *http.Request) {
+	userID, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	roles, err := h.AuthzService.UserRoles(r.Context(), userID)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(roles)
+}
+
+func (h *AdminHandler) GrantRole(w http.ResponseWriter, r *http.Request) {
+	userID, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input services.GrantRoleInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.AuthzService.GrantRole(r.Context(), userID, input); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AdminHandler) RevokeRole(w http.ResponseWriter, r *http.Request) {
+	userID, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.AuthzService.RevokeRole(r.Context(), userID, chi.URLParam(r, "role")); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/* ListUsers searches name and email with q, filters with status=active|disabled and pages with before_id */
+func (h *AdminHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseUserFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	users, err := h.UserAdminService.List(r.Context(), filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var next *int64
+	if len(users) == filter.Limit {
+		next = &users[len(users)-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"users":          users,
+		"next_before_id": next,
+	})
+}
+
+func (h *AdminHandler) DisableUser(w http.ResponseWriter, r *http.Request) {
+	h.userAction(w, r, h.UserAdminService.Disable)
+}
+
+func (h *AdminHandler) EnableUser(w http.ResponseWriter, r *http.Request) {
+	h.userAction(w, r, h.UserAdminService.Enable)
+}
+
+func (h *AdminHandler) ForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	h.userAction(w, r, h.UserAdminService.ForcePasswordReset)
+}
+
+func (h *AdminHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	h.userAction(w, r, h.UserAdminService.Delete)
+}
+
+func (h *AdminHandler) userAction(w http.ResponseWriter, r *http.Request, action func(context.Context, int64) error) {
+	userID, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	if err := action(r.Context(), userID); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func parseUserFilter(r *http.Request) (models.UserFilter, error) {
+	q := r.URL.Query()
+
+	filter := models.UserFilter{
+		Query: strings.TrimSpace(q.Get("q")),
+		Limit: defaultUserPageSize,
+	}
+
+	switch status := q.Get("status"); status {
+	case "":
+	case "active", "disabled":
+		disabled := status == "disabled"
+		filter.Disabled = &disabled
+	default:
+		return filter, fmt.Errorf("invalid status %q, use active or disabled", status)
+	}
+
+	if v := q.Get("before_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id < 1 {
+			return filter, fmt.Errorf("invalid before_id %q", v)
+		}
+		filter.BeforeID = id
+	}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxUserPageSize {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxUserPageSize)
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
+
+func userIDParam(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return 0, false
+	}
+
+	return userID, true
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrRoleRequired):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, models.ErrUserNotFound),
+		errors.Is(err, models.ErrRoleNotFound),
+		errors.Is(err, services.ErrRoleNotAssigned):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, services.ErrLastAdmin),
+		errors.Is(err, services.ErrSelfAction):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
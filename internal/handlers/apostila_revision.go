@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/VicAlexandre/pds-backend/internal/auth"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultRevisionPageSize = 50
+	maxRevisionPageSize     = 200
+)
+
+/* ListRevisions answers newest first without the HTML, paged with before_id and limit */
+func (h *ApostilasHandler) ListRevisions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := apostilaIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+
+	var beforeID int64
+	if v := q.Get("before_id"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			http.Error(w, fmt.Sprintf("invalid before_id %q", v), http.StatusBadRequest)
+			return
+		}
+		beforeID = n
+	}
+
+	limit := defaultRevisionPageSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxRevisionPageSize {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxRevisionPageSize), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	revisions, err := h.ApostilaService.ListRevisions(r.Context(), id, userID, auth.OrganizationIDFromContext(r.Context()), beforeID, limit)
+	if err != nil {
+		writeApostilaError(w, err)
+		return
+	}
+
+	var next *int64
+	if len(revisions) == limit {
+		next = &revisions[len(revisions)-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"revisions":      revisions,
+		"next_before_id": next,
+	})
+}
+
+func (h *ApostilasHandler) GetRevision(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := apostilaIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	revisionID, ok := revisionIDParam(w, chi.URLParam(r, "revision"), "revision")
+	if !ok {
+		return
+	}
+
+	revision, err := h.ApostilaService.GetRevision(r.Context(), id, revisionID, userID, auth.OrganizationIDFromContext(r.Context()))
+	if err != nil {
+		writeApostilaError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revision)
+}
+
+/* DiffRevisions compares ?from= with ?to=, both revision ids of the same apostila */
+func (h *ApostilasHandler) DiffRevisions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := apostilaIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	fromID, ok := revisionIDParam(w, r.URL.Query().Get("from"), "from")
+	if !ok {
+		return
+	}
+
+	toID, ok := revisionIDParam(w, r.URL.Query().Get("to"), "to")
+	if !ok {
+		return
+	}
+
+	diff, err := h.ApostilaService.DiffRevisions(r.Context(), id, fromID, toID, userID, auth.OrganizationIDFromContext(r.Context()))
+	if err != nil {
+		writeApostilaError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
+
+/* RestoreRevision honours If-Match like a save, a stale editor cannot restore over newer work */
+func (h *ApostilasHandler) RestoreRevision(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := apostilaIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	revisionID, ok := revisionIDParam(w, chi.URLParam(r, "revision"), "revision")
+	if !ok {
+		return
+	}
+
+	expected, err := ifMatchVersion(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	version, err := h.ApostilaService.RestoreRevision(r.Context(), id, revisionID, expected, userID, auth.OrganizationIDFromContext(r.Context()))
+	if err != nil {
+		writeApostilaError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", versionETag(version))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"version": version})
+}
+
+func revisionIDParam(w http.ResponseWriter, v string, name string) (int64, bool) {
+	revisionID, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || revisionID < 1 {
+		http.Error(w, fmt.Sprintf("invalid %s %q", name, v), http.StatusBadRequest)
+		return 0, false
+	}
+
+	return revisionID, true
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/VicAlexandre/pds-backend/internal/auth"
+	"github.com/VicAlexandre/pds-backend/internal/services"
+	"github.com/go-chi/chi/v5"
+)
+
+/* ListPermissions is for the owner: who the apostila is shared with and the pending invites */
+func (h *ApostilasHandler) ListPermissions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := apostilaIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	sharing, err := h.ApostilaService.ListPermissions(r.Context(), id, userID, auth.OrganizationIDFromContext(r.Context()))
+	if err != nil {
+		writeApostilaError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sharing)
+}
+
+func (h *ApostilasHandler) ShareApostila(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := apostilaIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input services.ShareApostilaInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.ApostilaService.ShareApostila(r.Context(), id, input, userID, auth.OrganizationIDFromContext(r.Context()))
+	if err != nil {
+		writeApostilaError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *ApostilasHandler) UpdatePermission(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := apostilaIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	memberID, ok := memberIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input services.UpdatePermissionInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.ApostilaService.UpdatePermission(r.Context(), id, memberID, input, userID, auth.OrganizationIDFromContext(r.Context())); err != nil {
+		writeApostilaError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/* RevokePermission also lets a user drop an apostila shared with them, with their own id */
+func (h *ApostilasHandler) RevokePermission(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := apostilaIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	memberID, ok := memberIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.ApostilaService.RevokePermission(r.Context(), id, memberID, userID, auth.OrganizationIDFromContext(r.Context())); err != nil {
+		writeApostilaError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *ApostilasHandler) RevokeInvite(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := apostilaIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	inviteID, ok := revisionIDParam(w, chi.URLParam(r, "invite"), "invite id")
+	if !ok {
+		return
+	}
+
+	if err := h.ApostilaService.RevokeInvite(r.Context(), id, inviteID, userID, auth.OrganizationIDFromContext(r.Context())); err != nil {
+		writeApostilaError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/* AcceptInvite answers the id of the apostila, the frontend opens it next */
+func (h *ApostilasHandler) AcceptInvite(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var input services.AcceptInviteInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	invite, err := h.ApostilaService.AcceptInvite(r.Context(), input, userID)
+	if err != nil {
+		writeApostilaError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"apostila_id": invite.ApostilaID,
+		"level":       invite.Level,
+	})
+}
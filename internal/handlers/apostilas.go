@@ -1,56 +1,213 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/VicAlexandre/pds-backend/internal/auth"
+	"github.com/VicAlexandre/pds-backend/internal/models"
 	"github.com/VicAlexandre/pds-backend/internal/services"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultApostilaPageSize = 50
+	maxApostilaPageSize     = 200
+	defaultSearchPageSize   = 20
+	maxSearchPageSize       = 50
 )
 
 type ApostilasHandler struct {
 	ApostilaService *services.ApostilaService
 }
 
-func extractToken(r *http.Request) (string, error) {
-	ctx := r.Context()
+/* receives the id of a new apostila, authenticated user via jwt token and prints the id and jwt data */
+func (h *ApostilasHandler) AddApostila(w http.ResponseWriter, r *http.Request) {
+	var input services.AddApostilaInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
 
-	req := r.WithContext(ctx)
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-	authHeader := req.Header.Get("Authorization")
-	if authHeader == "" {
-		log.Println("Authorization header missing: ", authHeader)
-		return "", http.ErrNoCookie
+	apostila, err := h.ApostilaService.AddApostila(r.Context(), input, userID, auth.OrganizationIDFromContext(r.Context()))
+	if errors.Is(err, services.ErrEmailNotVerified) || errors.Is(err, services.ErrForbidden) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, services.ErrApostilaQuotaExceeded) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	parts := strings.SplitN(authHeader, " ", 2)
+	json.NewEncoder(w).Encode(apostila)
+}
 
-	token := parts[1]
+/*
+ * ListApostilas sorts with sort=created_at|updated_at and order=asc|desc, filters with
+ * subject, tag, created_after, created_before, updated_after, updated_before and has_content, and pages
+ * with the opaque cursor of the previous response.
+ */
+func (h *ApostilasHandler) ListApostilas(w http.ResponseWriter, r *http.Request) {
+	h.listApostilas(w, r, h.ApostilaService.ListApostilas)
+}
 
-	return token, nil
+/* ListSharedApostilas takes the same filters and cursor as ListApostilas */
+func (h *ApostilasHandler) ListSharedApostilas(w http.ResponseWriter, r *http.Request) {
+	h.listApostilas(w, r, h.ApostilaService.ListSharedApostilas)
 }
 
-/* receives the id of a new apostila, authenticated user via jwt token and prints the id and jwt data */
-func (h *ApostilasHandler) AddApostila(w http.ResponseWriter, r *http.Request) {
-	var input services.AddApostilaInput
-	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
-		http.Error(w, "Invalid input", http.StatusBadRequest)
+func (h *ApostilasHandler) listApostilas(w http.ResponseWriter, r *http.Request, list func(ctx context.Context, userID int64, orgID *int64, filter models.ApostilaFilter) ([]models.ApostilaSummary, error)) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	token, err := extractToken(r)
+	filter, err := parseApostilaFilter(r)
 	if err != nil {
-		http.Error(w, "authorization header missing", http.StatusUnauthorized)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	apostila, err := h.ApostilaService.AddApostila(r.Context(), input, token)
+	apostilas, err := list(r.Context(), userID, auth.OrganizationIDFromContext(r.Context()), filter)
+	if errors.Is(err, services.ErrForbidden) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	var next *string
+	if len(apostilas) == filter.Limit {
+		cursor := filter.Cursor(apostilas[len(apostilas)-1]).Encode()
+		next = &cursor
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"apostilas":   apostilas,
+		"next_cursor": next,
+	})
+}
+
+/* SearchApostilas takes q in web search syntax and pages with limit and offset, results come best first */
+func (h *ApostilasHandler) SearchApostilas(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+
+	limit := defaultSearchPageSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSearchPageSize {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxSearchPageSize), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	offset := 0
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid offset %q", v), http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	results, err := h.ApostilaService.SearchApostilas(r.Context(), userID, auth.OrganizationIDFromContext(r.Context()), q.Get("q"), limit, offset)
+	if err != nil {
+		writeApostilaError(w, err)
+		return
+	}
+
+	var next *int
+	if len(results) == limit {
+		n := offset + limit
+		next = &n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"results":     results,
+		"next_offset": next,
+	})
+}
+
+func (h *ApostilasHandler) GetApostila(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := apostilaIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	apostila, err := h.ApostilaService.GetApostila(r.Context(), id, userID, auth.OrganizationIDFromContext(r.Context()))
+	if err != nil {
+		writeApostilaError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", versionETag(apostila.Version))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apostila)
+}
+
+/* UpdateApostila changes the metadata, the HTML is still saved through PUT /apostilas/edit */
+func (h *ApostilasHandler) UpdateApostila(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := apostilaIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input services.UpdateApostilaInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	apostila, err := h.ApostilaService.UpdateApostila(r.Context(), id, input, userID, auth.OrganizationIDFromContext(r.Context()))
+	if err != nil {
+		writeApostilaError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(apostila)
 }
 
@@ -61,18 +218,27 @@ func (h *ApostilasHandler) GetEditedApostilaHTML(w http.ResponseWriter, r *http.
 		return
 	}
 
-	token, err := extractToken(r)
-	if err != nil {
-		http.Error(w, "authorization header missing", http.StatusUnauthorized)
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	htmlContent, err := h.ApostilaService.GetEditedApostilaHTML(r.Context(), id, token)
+	htmlContent, err := h.ApostilaService.GetEditedApostilaHTML(r.Context(), id, userID, auth.OrganizationIDFromContext(r.Context()))
+	if errors.Is(err, services.ErrForbidden) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	/* an apostila that was not found answers an empty file without a version, as it always did */
+	if htmlContent.Version > 0 && notModified(w, r, editedHTMLETag(htmlContent)) {
+		return
+	}
+
 	json.NewEncoder(w).Encode(htmlContent)
 }
 
@@ -83,15 +249,42 @@ func (h *ApostilasHandler) EditApostila(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	token, err := extractToken(r)
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	/* If-Match takes precedence over the version in the body */
+	expected, err := ifMatchVersion(r)
 	if err != nil {
-		http.Error(w, "authorization header missing", http.StatusUnauthorized)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if expected != nil {
+		input.Version = expected
+	}
 
-	h.ApostilaService.EditApostila(r.Context(), input, token)
+	version, err := h.ApostilaService.EditApostila(r.Context(), input, userID, auth.OrganizationIDFromContext(r.Context()))
+	if writeVersionConflict(w, err) {
+		return
+	}
+	if errors.Is(err, services.ErrEmailNotVerified) || errors.Is(err, services.ErrForbidden) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, models.ErrApostilaNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("ETag", versionETag(version))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"version": version})
 }
 
 func (h *ApostilasHandler) RenderApostilaPDF(w http.ResponseWriter, r *http.Request) {
@@ -101,7 +294,17 @@ func (h *ApostilasHandler) RenderApostilaPDF(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	pdf, err := h.ApostilaService.RenderApostilaPDF(r.Context(), input)
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	pdf, err := h.ApostilaService.RenderApostilaPDF(r.Context(), input, userID)
+	if errors.Is(err, services.ErrForbidden) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -125,13 +328,17 @@ func (h *ApostilasHandler) DeleteApostila(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	token, err := extractToken(r)
-	if err != nil {
-		http.Error(w, "authorization header missing", http.StatusUnauthorized)
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	err = h.ApostilaService.DeleteApostila(r.Context(), input, token)
+	err := h.ApostilaService.DeleteApostila(r.Context(), input, userID, auth.OrganizationIDFromContext(r.Context()))
+	if errors.Is(err, services.ErrEmailNotVerified) || errors.Is(err, services.ErrForbidden) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -139,3 +346,109 @@ func (h *ApostilasHandler) DeleteApostila(w http.ResponseWriter, r *http.Request
 
 	w.WriteHeader(http.StatusOK)
 }
+
+func parseApostilaFilter(r *http.Request) (models.ApostilaFilter, error) {
+	q := r.URL.Query()
+
+	filter := models.ApostilaFilter{
+		Sort:    models.ApostilaSortUpdated,
+		Subject: strings.TrimSpace(q.Get("subject")),
+		Tag:     strings.ToLower(strings.TrimSpace(q.Get("tag"))),
+		Limit:   defaultApostilaPageSize,
+	}
+
+	switch sort := q.Get("sort"); sort {
+	case "":
+	case models.ApostilaSortCreated, models.ApostilaSortUpdated:
+		filter.Sort = sort
+	default:
+		return filter, fmt.Errorf("invalid sort %q, use created_at or updated_at", sort)
+	}
+
+	switch order := q.Get("order"); order {
+	case "", "desc":
+	case "asc":
+		filter.Ascending = true
+	default:
+		return filter, fmt.Errorf("invalid order %q, use asc or desc", order)
+	}
+
+	for _, t := range []struct {
+		name string
+		dst  **time.Time
+	}{
+		{"created_after", &filter.CreatedAfter},
+		{"created_before", &filter.CreatedBefore},
+		{"updated_after", &filter.UpdatedAfter},
+		{"updated_before", &filter.UpdatedBefore},
+	} {
+		v := q.Get(t.name)
+		if v == "" {
+			continue
+		}
+
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s %q, use RFC 3339", t.name, v)
+		}
+		*t.dst = &parsed
+	}
+
+	if v := q.Get("has_content"); v != "" {
+		hasContent, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid has_content %q", v)
+		}
+		filter.HasContent = &hasContent
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		cursor, err := models.DecodeApostilaCursor(v)
+		if err != nil {
+			return filter, err
+		}
+		filter.After = cursor
+	}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxApostilaPageSize {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxApostilaPageSize)
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
+
+func apostilaIDParam(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid apostila id", http.StatusBadRequest)
+		return uuid.Nil, false
+	}
+
+	return id, true
+}
+
+func writeApostilaError(w http.ResponseWriter, err error) {
+	if writeValidationError(w, err) || writeVersionConflict(w, err) {
+		return
+	}
+
+	switch {
+	case errors.Is(err, models.ErrApostilaNotFound),
+		errors.Is(err, models.ErrRevisionNotFound),
+		errors.Is(err, models.ErrPermissionNotFound),
+		errors.Is(err, models.ErrInviteNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, services.ErrInvalidInviteToken):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, services.ErrEmailNotVerified),
+		errors.Is(err, services.ErrInviteOtherEmail),
+		errors.Is(err, services.ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VicAlexandre/pds-backend/internal/models"
+	"github.com/VicAlexandre/pds-backend/internal/services"
+)
+
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+)
+
+type AuditHandler struct {
+	AuditService *services.AuditService
+}
+
+/*
+ * ListEvents answers a page of JSON by default. format=csv and format=jsonl export
+ * every matching event instead, unless a limit is given.
+ */
+func (h *AuditHandler) ListEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		if filter.Limit == 0 {
+			filter.Limit = defaultAuditPageSize
+		}
+		h.writeJSONPage(w, r, filter)
+	case "csv":
+		h.writeCSV(w, r, filter)
+	case "jsonl":
+		h.writeJSONLines(w, r, filter)
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+	}
+}
+
+func (h *AuditHandler) writeJSONPage(w http.ResponseWriter, r *http.Request, filter models.AuditFilter) {
+	events := []*models.AuditEvent{}
+	err := h.AuditService.Each(r.Context(), filter, func(e *models.AuditEvent) error {
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	/* the next page starts below the oldest event of this one */
+	var next *int64
+	if len(events) == filter.Limit {
+		next = &events[len(events)-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"events":         events,
+		"next_before_id": next,
+	})
+}
+
+func (h *AuditHandler) writeJSONLines(w http.ResponseWriter, r *http.Request, filter models.AuditFilter) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit-events.jsonl"`)
+
+	enc := json.NewEncoder(w)
+	err := h.AuditService.Each(r.Context(), filter, func(e *models.AuditEvent) error {
+		return enc.Encode(e)
+	})
+	if err != nil {
+		/* the status line is already sent, the truncated file is all we can give */
+		log.Println("Error exporting audit events: ", err)
+	}
+}
+
+func (h *AuditHandler) writeCSV(w http.ResponseWriter, r *http.Request, filter models.AuditFilter) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit-events.csv"`)
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "occurred_at", "actor_id", "action", "target_type", "target_id", "ip", "request_id", "outcome", "metadata"})
+
+	err := h.AuditService.Each(r.Context(), filter, func(e *models.AuditEvent) error {
+		actorID := ""
+		if e.ActorID != nil {
+			actorID = strconv.FormatInt(*e.ActorID, 10)
+		}
+
+		metadata := ""
+		if len(e.Metadata) > 0 {
+			b, err := json.Marshal(e.Metadata)
+			if err != nil {
+				return err
+			}
+			metadata = string(b)
+		}
+
+		return cw.Write([]string{
+			strconv.FormatInt(e.ID, 10),
+			e.OccurredAt.UTC().Format(time.RFC3339),
+			actorID,
+			csvSafe(e.Action),
+			csvSafe(e.TargetType),
+			csvSafe(e.TargetID),
+			csvSafe(e.IP),
+			csvSafe(e.RequestID),
+			e.Outcome,
+			csvSafe(metadata),
+		})
+	})
+	cw.Flush()
+
+	if err == nil {
+		err = cw.Error()
+	}
+	if err != nil {
+		log.Println("Error exporting audit events: ", err)
+	}
+}
+
+/* csvSafe keeps user supplied values (e.g. an email in metadata) from being read as spreadsheet formulas */
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+
+	return s
+}
+
+func parseAuditFilter(r *http.Request) (models.AuditFilter, error) {
+	q := r.URL.Query()
+
+	filter := models.AuditFilter{
+		Action:     q.Get("action"),
+		TargetType: q.Get("target_type"),
+		TargetID:   q.Get("target_id"),
+		Outcome:    q.Get("outcome"),
+	}
+
+	if v := q.Get("actor_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("invalid actor_id %q", v)
+		}
+		filter.ActorID = &id
+	}
+
+	for _, t := range []struct {
+		name string
+		dst  **time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		v := q.Get(t.name)
+		if v == "" {
+			continue
+		}
+
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s %q, use RFC 3339", t.name, v)
+		}
+		*t.dst = &parsed
+	}
+
+	if v := q.Get("before_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id < 1 {
+			return filter, fmt.Errorf("invalid before_id %q", v)
+		}
+		filter.BeforeID = id
+	}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxAuditPageSize {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxAuditPageSize)
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
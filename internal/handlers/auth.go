@@ -2,13 +2,19 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"strconv"
 
+	"github.com/VicAlexandre/pds-backend/internal/auth"
 	"github.com/VicAlexandre/pds-backend/internal/services"
 )
 
 type AuthHandler struct {
-	AuthService *services.AuthService
+	AuthService              *services.AuthService
+	EmailVerificationService *services.EmailVerificationService
+	Cookies                  auth.CookieConfig
 }
 
 func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
@@ -18,13 +24,23 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := h.AuthService.Register(r.Context(), input)
+	input.SessionInfo = sessionInfo(r)
+
+	tokens, err := h.AuthService.Register(r.Context(), input)
+	if writeValidationError(w, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	json.NewEncoder(w).Encode(user)
+	if err := deliverTokens(w, h.Cookies, tokens, h.Cookies.Requested(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(tokens)
 }
 
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
@@ -34,20 +50,192 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tokens, err := h.AuthService.Login(r.Context(), input)
+	input.SessionInfo = sessionInfo(r)
+
+	result, err := h.AuthService.Login(r.Context(), input)
+
+	var locked *services.LockedError
+	if errors.As(err, &locked) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(locked.RetryAfter.Seconds())))
+		http.Error(w, locked.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if errors.Is(err, services.ErrAccountDisabled) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := deliverTokens(w, h.Cookies, result.Token, h.Cookies.Requested(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *AuthHandler) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	var input services.LoginMFAInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	input.SessionInfo = sessionInfo(r)
+
+	tokens, err := h.AuthService.LoginMFA(r.Context(), input)
+
+	var locked *services.LockedError
+	if errors.As(err, &locked) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(locked.RetryAfter.Seconds())))
+		http.Error(w, locked.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if errors.Is(err, services.ErrAccountDisabled) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
+	if err := deliverTokens(w, h.Cookies, tokens, h.Cookies.Requested(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(tokens)
+}
+
+/* in cookie mode the body can be empty, the refresh token then comes from its cookie */
+func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	var input services.RefreshInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	fromCookie := false
+	if input.RefreshToken == "" {
+		input.RefreshToken, fromCookie = refreshTokenCookie(r, h.Cookies)
+	}
+
+	if fromCookie && !auth.ValidCSRF(r) {
+		http.Error(w, "invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	tokens, err := h.AuthService.Refresh(r.Context(), input)
+	if errors.Is(err, services.ErrInvalidRefreshToken) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, services.ErrAccountDisabled) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := deliverTokens(w, h.Cookies, tokens, fromCookie || h.Cookies.Requested(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	json.NewEncoder(w).Encode(tokens)
 }
 
+/* the body is optional so clients that only hold an access token can still log out */
 func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
-	if err := h.AuthService.Logout(r.Context()); err != nil {
+	var input services.LogoutInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	fromCookie := false
+	if input.RefreshToken == "" {
+		input.RefreshToken, fromCookie = refreshTokenCookie(r, h.Cookies)
+	}
+
+	accessToken, ok := auth.BearerToken(r)
+	if !ok && h.Cookies.Enabled {
+		if cookie, err := r.Cookie(auth.AccessTokenCookie); err == nil && cookie.Value != "" {
+			accessToken, fromCookie = cookie.Value, true
+		}
+	}
+
+	if fromCookie && !auth.ValidCSRF(r) {
+		http.Error(w, "invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	if err := h.AuthService.Logout(r.Context(), accessToken, input); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if fromCookie || h.Cookies.Requested(r) {
+		h.Cookies.Clear(w)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AuthHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var input services.VerifyEmailInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.EmailVerificationService.Verify(r.Context(), input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
+
+func (h *AuthHandler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	err := h.EmailVerificationService.Resend(r.Context(), userID)
+	switch {
+	case errors.Is(err, services.ErrVerificationThrottled):
+		w.Header().Set("Retry-After", strconv.Itoa(int(services.VerificationResendCooldown.Seconds())))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	case errors.Is(err, services.ErrEmailAlreadyVerified):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+/* the user agent is only shown back to the user, a long one is cut instead of stored whole */
+func sessionInfo(r *http.Request) services.SessionInfo {
+	userAgent := r.UserAgent()
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+
+	return services.SessionInfo{
+		IP:        auth.ClientIP(r),
+		UserAgent: userAgent,
+	}
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/VicAlexandre/pds-backend/internal/auth"
+	"github.com/VicAlexandre/pds-backend/internal/services"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+const (
+	collabMaxMessageBytes = 1 << 20
+	collabWriteWait       = 10 * time.Second
+	collabPingPeriod      = 25 * time.Second
+	collabPongWait        = 60 * time.Second
+)
+
+/*
+ * CollabHandler serves the WebSocket of the collaborative editor. CheckOrigin is the
+ * CORS policy: browsers send cookies on cross-site WebSocket handshakes and CORS does
+ * not apply to them, so the origin must be checked here.
+ */
+type CollabHandler struct {
+	Hub         *services.CollabHub
+	Auth        *auth.Middleware
+	CheckOrigin func(r *http.Request, origin string) bool
+}
+
+/*
+ * Connect joins the room before upgrading, so a missing apostila or a denied user still
+ * get a plain HTTP error. The connection then runs on its own goroutines: the request
+ * and its context end when Connect returns.
+ */
+func (h *CollabHandler) Connect(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" && !h.CheckOrigin(r, origin) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	/* the socket outlives the request, the room checks the login again while it is open */
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	credential := func(ctx context.Context) (bool, error) {
+		return h.Auth.StillValid(ctx, claims)
+	}
+
+	id, ok := apostilaIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	resume := services.CollabResume{Room: r.URL.Query().Get("room")}
+	if since := r.URL.Query().Get("since"); since != "" {
+		rev, err := strconv.Atoi(since)
+		if err != nil || rev < 0 {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+		resume.Rev = rev
+	}
+
+	session, err := h.Hub.Join(r.Context(), id, userID, auth.OrganizationIDFromContext(r.Context()), resume, credential)
+	if err != nil {
+		if errors.Is(err, services.ErrCollabRoomFull) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeApostilaError(w, err)
+		return
+	}
+
+	conn, _, _, err := ws.UpgradeHTTP(r, w)
+	if err != nil {
+		log.Println("Error upgrading collab connection: ", err)
+		session.Leave()
+		return
+	}
+
+	c := &collabConn{Conn: conn, session: session}
+	go c.writeLoop()
+	go c.readLoop()
+}
+
+/* collabConn serializes the writes of the write loop and the control frame replies of the read loop */
+type collabConn struct {
+	net.Conn
+	session *services.CollabSession
+	mu      sync.Mutex
+}
+
+func (c *collabConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Conn.SetWriteDeadline(time.Now().Add(collabWriteWait))
+	return c.Conn.Write(p)
+}
+
+/* writeFrame writes the frame in one call, a control reply cannot land between its header and payload */
+func (c *collabConn) writeFrame(f ws.Frame) error {
+	frame, err := ws.CompileFrame(f)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Write(frame)
+	return err
+}
+
+func (c *collabConn) readLoop() {
+	defer c.session.Leave()
+	defer c.Close()
+
+	control := wsutil.ControlFrameHandler(c, ws.StateServerSide)
+	rd := wsutil.Reader{
+		Source:         c.Conn,
+		State:          ws.StateServerSide,
+		CheckUTF8:      true,
+		MaxFrameSize:   collabMaxMessageBytes,
+		OnIntermediate: control,
+	}
+
+	for {
+		c.SetReadDeadline(time.Now().Add(collabPongWait))
+
+		hdr, err := rd.NextFrame()
+		if err != nil {
+			return
+		}
+
+		if hdr.OpCode.IsControl() {
+			if err := control(hdr, &rd); err != nil {
+				return
+			}
+			continue
+		}
+
+		if hdr.OpCode != ws.OpText {
+			c.writeFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusUnsupportedData, "text frames only")))
+			return
+		}
+
+		data, err := io.ReadAll(io.LimitReader(&rd, collabMaxMessageBytes+1))
+		if err != nil {
+			return
+		}
+		if len(data) > collabMaxMessageBytes {
+			c.writeFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusMessageTooBig, "")))
+			return
+		}
+
+		c.session.Handle(data)
+	}
+}
+
+/* writeLoop ends when the session is dropped, a client that fell behind is told to reconnect */
+func (c *collabConn) writeLoop() {
+	defer c.Close()
+
+	ticker := time.NewTicker(collabPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg, ok := <-c.session.Send():
+			if !ok {
+				c.writeFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusGoingAway, "reconnect")))
+				return
+			}
+			if err := c.writeFrame(ws.NewTextFrame(msg)); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := c.writeFrame(ws.NewPingFrame(nil)); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/VicAlexandre/pds-backend/internal/auth"
+	"github.com/VicAlexandre/pds-backend/internal/models"
+)
+
+/*
+ * deliverTokens moves the tokens from the response body into cookies when the client
+ * asked for cookie mode, so scripts on the page never see them.
+ */
+func deliverTokens(w http.ResponseWriter, cookies auth.CookieConfig, token *models.Token, inCookies bool) error {
+	if token == nil || !inCookies {
+		return nil
+	}
+
+	if err := cookies.SetTokens(w, token); err != nil {
+		return err
+	}
+
+	token.AccessToken, token.RefreshToken = "", ""
+
+	return nil
+}
+
+/* refreshTokenCookie returns the refresh token cookie, which only counts alongside a valid CSRF token */
+func refreshTokenCookie(r *http.Request, cookies auth.CookieConfig) (string, bool) {
+	if !cookies.Enabled {
+		return "", false
+	}
+
+	cookie, err := r.Cookie(auth.RefreshTokenCookie)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+
+	return cookie.Value, true
+}
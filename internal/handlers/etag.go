@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/VicAlexandre/pds-backend/internal/models"
+)
+
+/* versionETag is the strong ETag of an apostila version, the version number in quotes */
+func versionETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+/*
+ * editedHTMLETag also covers the metadata sent along with the html, which changes without
+ * a new version: "7-<hash>". If-Match only looks at the version, the metadata does not
+ * take part in a save.
+ */
+func editedHTMLETag(content *models.EditedApostilaHTML) string {
+	metadata, _ := json.Marshal(content.Metadata)
+	sum := sha256.Sum256(metadata)
+
+	return `"` + strconv.FormatInt(content.Version, 10) + "-" + hex.EncodeToString(sum[:8]) + `"`
+}
+
+/*
+ * ifMatchVersion reads the version an If-Match header expects. No header and "*" mean
+ * any version. Weak tags are accepted since the version is all they carry, and so are
+ * the tags of editedHTMLETag, whose metadata hash is ignored.
+ */
+func ifMatchVersion(r *http.Request) (*int64, error) {
+	v := strings.TrimSpace(r.Header.Get("If-Match"))
+	if v == "" || v == "*" {
+		return nil, nil
+	}
+
+	if strings.Contains(v, ",") {
+		return nil, errors.New("If-Match must name a single version")
+	}
+
+	tag := strings.TrimPrefix(v, "W/")
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return nil, fmt.Errorf("invalid If-Match %q", v)
+	}
+
+	number, _, _ := strings.Cut(tag[1:len(tag)-1], "-")
+	version, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || version < 1 {
+		return nil, fmt.Errorf("invalid If-Match %q", v)
+	}
+
+	return &version, nil
+}
+
+/* notModified reports whether If-None-Match already names the etag, then the 304 is written */
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+
+	for _, v := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == etag || v == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+
+	return false
+}
+
+/* writeVersionConflict answers 412 with the current version so the editor can offer to merge or reload */
+func writeVersionConflict(w http.ResponseWriter, err error) bool {
+	var conflict *models.VersionConflictError
+	if !errors.As(err, &conflict) {
+		return false
+	}
+
+	w.Header().Set("ETag", versionETag(conflict.Current))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusPreconditionFailed)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error":   models.ErrVersionConflict.Error(),
+		"version": conflict.Current,
+	})
+
+	return true
+}
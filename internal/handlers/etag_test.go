@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/VicAlexandre/pds-backend/internal/models"
+)
+
+func TestVersionETag(t *testing.T) {
+	if got := versionETag(42); got != `"42"` {
+		t.Errorf(`versionETag(42) = %s, want "42"`, got)
+	}
+}
+
+func TestIfMatchVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    int64
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "no header", header: "", wantNil: true},
+		{name: "any version", header: "*", wantNil: true},
+		{name: "any version with spaces", header: " * ", wantNil: true},
+		{name: "strong tag", header: `"7"`, want: 7},
+		{name: "strong tag with spaces", header: ` "7" `, want: 7},
+		{name: "weak tag", header: `W/"7"`, want: 7},
+		{name: "list", header: `"7", "8"`, wantErr: true},
+		{name: "list with any", header: `*, "7"`, wantErr: true},
+		{name: "unquoted", header: "7", wantErr: true},
+		{name: "missing closing quote", header: `"7`, wantErr: true},
+		{name: "only quotes", header: `""`, wantErr: true},
+		{name: "single quote", header: `"`, wantErr: true},
+		{name: "not a number", header: `"abc"`, wantErr: true},
+		{name: "zero", header: `"0"`, wantErr: true},
+		{name: "negative", header: `"-1"`, wantErr: true},
+		{name: "lowercase weak prefix", header: `w/"7"`, wantErr: true},
+		{name: "overflow", header: `"99999999999999999999"`, wantErr: true},
+		{name: "edited html tag", header: `"7-0123456789abcdef"`, want: 7},
+		{name: "edited html tag without version", header: `"-0123456789abcdef"`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPut, "/", nil)
+		if tt.header != "" {
+			r.Header.Set("If-Match", tt.header)
+		}
+
+		got, err := ifMatchVersion(r)
+
+		switch {
+		case tt.wantErr:
+			if err == nil {
+				t.Errorf("%s: ifMatchVersion(%q) = %v, want an error", tt.name, tt.header, deref(got))
+			}
+		case err != nil:
+			t.Errorf("%s: ifMatchVersion(%q) returned %v", tt.name, tt.header, err)
+		case tt.wantNil:
+			if got != nil {
+				t.Errorf("%s: ifMatchVersion(%q) = %d, want nil", tt.name, tt.header, *got)
+			}
+		case got == nil || *got != tt.want:
+			t.Errorf("%s: ifMatchVersion(%q) = %v, want %d", tt.name, tt.header, deref(got), tt.want)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{"no header", "", false},
+		{"same version", `"7"`, true},
+		{"other version", `"6"`, false},
+		{"weak tag", `W/"7"`, true},
+		{"any", "*", true},
+		{"list with the version", `"5", "6", "7"`, true},
+		{"list with a weak match", `"5",W/"7"`, true},
+		{"list without the version", `"5", "6"`, false},
+		{"unquoted", "7", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			r.Header.Set("If-None-Match", tt.header)
+		}
+		w := httptest.NewRecorder()
+
+		got := notModified(w, r, versionETag(7))
+		if got != tt.want {
+			t.Errorf("%s: notModified(%q) = %v, want %v", tt.name, tt.header, got, tt.want)
+		}
+
+		if etag := w.Header().Get("ETag"); etag != `"7"` {
+			t.Errorf("%s: ETag = %s, want \"7\"", tt.name, etag)
+		}
+
+		wantStatus := http.StatusOK
+		if tt.want {
+			wantStatus = http.StatusNotModified
+		}
+		if w.Code != wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, wantStatus)
+		}
+	}
+}
+
+func TestEditedHTMLETagCoversMetadata(t *testing.T) {
+	content := &models.EditedApostilaHTML{
+		HTML:     "<h1>Frações</h1>",
+		Version:  7,
+		Metadata: &models.ApostilaMetadata{Title: "Frações", Tags: []string{"matemática"}},
+	}
+
+	before := editedHTMLETag(content)
+	if !strings.HasPrefix(before, `"7-`) {
+		t.Errorf(`editedHTMLETag = %s, want it to start with "7-`, before)
+	}
+	if again := editedHTMLETag(content); again != before {
+		t.Errorf("editedHTMLETag is not stable: %s, then %s", before, again)
+	}
+
+	/* a metadata PATCH keeps the version */
+	content.Metadata = &models.ApostilaMetadata{Title: "Frações e decimais", Tags: []string{"matemática", "6º ano"}}
+	after := editedHTMLETag(content)
+	if after == before {
+		t.Fatalf("editedHTMLETag = %s before and after the metadata changed", after)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("If-None-Match", before)
+	w := httptest.NewRecorder()
+	if notModified(w, r, after) {
+		t.Error("notModified answered 304 for the etag of the old metadata")
+	}
+	if etag := w.Header().Get("ETag"); etag != after {
+		t.Errorf("ETag = %s, want %s", etag, after)
+	}
+
+	r.Header.Set("If-Match", after)
+	if got, err := ifMatchVersion(r); err != nil || got == nil || *got != 7 {
+		t.Errorf("ifMatchVersion(%s) = %v, %v, want 7", after, deref(got), err)
+	}
+}
+
+func TestWriteVersionConflict(t *testing.T) {
+	w := httptest.NewRecorder()
+	err := fmt.Errorf("saving: %w", &models.VersionConflictError{Current: 8})
+
+	if !writeVersionConflict(w, err) {
+		t.Fatal("writeVersionConflict did not recognize the conflict")
+	}
+
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("status = %d, want 412", w.Code)
+	}
+	if etag := w.Header().Get("ETag"); etag != `"8"` {
+		t.Errorf(`ETag = %s, want "8"`, etag)
+	}
+
+	var body struct {
+		Version int64 `json:"version"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Version != 8 {
+		t.Errorf("body version = %d, %v, want 8", body.Version, err)
+	}
+
+	if writeVersionConflict(httptest.NewRecorder(), errors.New("other")) {
+		t.Error("writeVersionConflict handled an unrelated error")
+	}
+}
+
+func deref(v *int64) any {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
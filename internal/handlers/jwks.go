@@ -0,0 +1,19 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/VicAlexandre/pds-backend/internal/models"
+)
+
+type JWKSHandler struct {
+	Keys *models.KeySet
+}
+
+/* publishes the public signing keys so other services can verify our tokens */
+func (h *JWKSHandler) ServeJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(h.Keys.JWKS())
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/VicAlexandre/pds-backend/internal/auth"
+	"github.com/VicAlexandre/pds-backend/internal/services"
+	"github.com/go-chi/chi/v5"
+)
+
+type OIDCHandler struct {
+	OIDCService *services.OIDCService
+	Cookies     auth.CookieConfig
+}
+
+func (h *OIDCHandler) ListProviders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.OIDCService.ListProviders())
+}
+
+/* redirects the browser to the provider, which sends it back to the front end's redirect_url */
+func (h *OIDCHandler) Authorize(w http.ResponseWriter, r *http.Request) {
+	url, err := h.OIDCService.AuthorizationURL(r.Context(), chi.URLParam(r, "provider"))
+	if errors.Is(err, services.ErrUnknownProvider) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+/* the front end posts the code and state it received on its redirect_url */
+func (h *OIDCHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	var input services.OIDCCallbackInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	input.SessionInfo = sessionInfo(r)
+
+	result, err := h.OIDCService.Callback(r.Context(), chi.URLParam(r, "provider"), input)
+	switch {
+	case errors.Is(err, services.ErrUnknownProvider):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, services.ErrOIDCLoginFailed), errors.Is(err, services.ErrUnverifiedEmail):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case errors.Is(err, services.ErrUnverifiedLocal):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, services.ErrAccountDisabled):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := deliverTokens(w, h.Cookies, result.Token, h.Cookies.Requested(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/VicAlexandre/pds-backend/internal/auth"
+	"github.com/VicAlexandre/pds-backend/internal/models"
+	"github.com/VicAlexandre/pds-backend/internal/services"
+	"github.com/go-chi/chi/v5"
+)
+
+type OrganizationHandler struct {
+	OrganizationService *services.OrganizationService
+}
+
+func (h *OrganizationHandler) ListMine(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	orgs, err := h.OrganizationService.ListMine(r.Context(), userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orgs)
+}
+
+func (h *OrganizationHandler) Get(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	org, err := h.OrganizationService.Get(r.Context(), userID, chi.URLParam(r, "slug"))
+	if err != nil {
+		writeOrganizationError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(org)
+}
+
+func (h *OrganizationHandler) Update(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var input services.UpdateOrganizationInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	org, err := h.OrganizationService.Update(r.Context(), userID, chi.URLParam(r, "slug"), input)
+	if err != nil {
+		writeOrganizationError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(org)
+}
+
+/* Branding is public so the frontend can theme the login page of a school */
+func (h *OrganizationHandler) Branding(w http.ResponseWriter, r *http.Request) {
+	branding, err := h.OrganizationService.Branding(r.Context(), chi.URLParam(r, "slug"))
+	if err != nil {
+		writeOrganizationError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(branding)
+}
+
+func (h *OrganizationHandler) ListMembers(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	members, err := h.OrganizationService.ListMembers(r.Context(), userID, chi.URLParam(r, "slug"))
+	if err != nil {
+		writeOrganizationError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+func (h *OrganizationHandler) AddMember(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var input services.AddMemberInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.OrganizationService.AddMember(r.Context(), userID, chi.URLParam(r, "slug"), input); err != nil {
+		writeOrganizationError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *OrganizationHandler) UpdateMember(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	memberID, ok := memberIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input services.UpdateMemberInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.OrganizationService.UpdateMember(r.Context(), userID, chi.URLParam(r, "slug"), memberID, input); err != nil {
+		writeOrganizationError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *OrganizationHandler) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	memberID, ok := memberIDParam(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.OrganizationService.RemoveMember(r.Context(), userID, chi.URLParam(r, "slug"), memberID); err != nil {
+		writeOrganizationError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/* Create is mounted under /admin, the caller becomes the first admin of the organization */
+func (h *OrganizationHandler) Create(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var input services.CreateOrganizationInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	org, err := h.OrganizationService.Create(r.Context(), userID, input)
+	if err != nil {
+		writeOrganizationError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(org)
+}
+
+func (h *OrganizationHandler) SetQuotas(w http.ResponseWriter, r *http.Request) {
+	var quotas models.Quotas
+	if err := json.NewDecoder(r.Body).Decode(&quotas); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.OrganizationService.SetQuotas(r.Context(), chi.URLParam(r, "slug"), quotas); err != nil {
+		writeOrganizationError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *OrganizationHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	if err := h.OrganizationService.Delete(r.Context(), chi.URLParam(r, "slug")); err != nil {
+		writeOrganizationError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *OrganizationHandler) SetAllowedOrigins(w http.ResponseWriter, r *http.Request) {
+	var input services.SetAllowedOriginsInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.OrganizationService.SetAllowedOrigins(r.Context(), chi.URLParam(r, "slug"), input); err != nil {
+		writeOrganizationError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func memberIDParam(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	memberID, err := strconv.ParseInt(chi.URLParam(r, "user_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return 0, false
+	}
+
+	return memberID, true
+}
+
+func writeOrganizationError(w http.ResponseWriter, err error) {
+	if writeValidationError(w, err) {
+		return
+	}
+
+	switch {
+	case errors.Is(err, models.ErrOrganizationNotFound),
+		errors.Is(err, models.ErrUserNotFound),
+		errors.Is(err, models.ErrNotMember):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, services.ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, models.ErrDuplicateSlug),
+		errors.Is(err, models.ErrAlreadyMember),
+		errors.Is(err, models.ErrMemberQuotaExceeded),
+		errors.Is(err, models.ErrOrganizationNotEmpty),
+		errors.Is(err, services.ErrLastOrgAdmin):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
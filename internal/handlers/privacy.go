@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/VicAlexandre/pds-backend/internal/auth"
+	"github.com/VicAlexandre/pds-backend/internal/models"
+	"github.com/VicAlexandre/pds-backend/internal/services"
+)
+
+type PrivacyHandler struct {
+	PrivacyService *services.PrivacyService
+}
+
+/* RequestExport answers 202 with the pending export, the archive is built in the background */
+func (h *PrivacyHandler) RequestExport(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	export, err := h.PrivacyService.RequestExport(r.Context(), userID)
+	if err != nil {
+		writePrivacyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(export)
+}
+
+func (h *PrivacyHandler) ExportStatus(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	export, err := h.PrivacyService.ExportStatus(r.Context(), userID)
+	if err != nil {
+		writePrivacyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(export)
+}
+
+func (h *PrivacyHandler) DownloadExport(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	archive, err := h.PrivacyService.ExportArchive(r.Context(), userID)
+	if err != nil {
+		writePrivacyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="apostilab-dados-%s.zip"`, time.Now().Format("2006-01-02")))
+	w.Header().Set("Content-Length", strconv.Itoa(len(archive)))
+	w.Write(archive)
+}
+
+func (h *PrivacyHandler) RequestDeletion(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var input services.DeleteUserInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	request, err := h.PrivacyService.RequestDeletion(r.Context(), userID, input)
+	if err != nil {
+		writePrivacyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(request)
+}
+
+func (h *PrivacyHandler) DeletionStatus(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	request, err := h.PrivacyService.DeletionStatus(r.Context(), userID)
+	if err != nil {
+		writePrivacyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(request)
+}
+
+func (h *PrivacyHandler) CancelDeletion(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.PrivacyService.CancelDeletion(r.Context(), userID); err != nil {
+		writePrivacyError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writePrivacyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrInvalidPassword):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, models.ErrDeletionRequestNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, models.ErrDeletionAlreadyPending),
+		errors.Is(err, models.ErrDataExportInProgress):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, models.ErrDataExportNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
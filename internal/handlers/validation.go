@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/VicAlexandre/pds-backend/internal/services"
+)
+
+/* writeValidationError answers 422 with the per-field messages and reports whether err was one */
+func writeValidationError(w http.ResponseWriter, err error) bool {
+	var verr *services.ValidationError
+	if !errors.As(err, &verr) {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(verr)
+
+	return true
+}
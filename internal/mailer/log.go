@@ -0,0 +1,44 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+ * LogMailer is meant for local development: with Dir set every message is written
+ * there as a .eml file, otherwise the plain text body goes to the log.
+ */
+type LogMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	if m.Dir == "" {
+		log.Printf("Mail to %s: %s\n%s", msg.To, msg.Subject, msg.Text)
+		return nil
+	}
+
+	body, err := buildMIME(m.From, msg)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return fmt.Errorf("LogMailer.Send: %w", err)
+	}
+
+	name := filepath.Join(m.Dir, fmt.Sprintf("%d.eml", time.Now().UnixNano()))
+	if err := os.WriteFile(name, body, 0o644); err != nil {
+		return fmt.Errorf("LogMailer.Send: %w", err)
+	}
+
+	log.Println("Mail to", msg.To, "written to", name)
+
+	return nil
+}
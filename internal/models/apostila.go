@@ -3,39 +3,230 @@ package models
 import (
 	"context"
 	"database/sql"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 type Apostila struct {
-	Id         uuid.UUID `json:"id"`
-	UserID     int64     `json:"user_id"`
-	EditedHTML string    `json:"edited_raw_html"`
-	CreatedAt  string    `json:"created_at"`
-	EditedAt   string    `json:"edited_at"`
+	Id             uuid.UUID `json:"id"`
+	UserID         int64     `json:"user_id"`
+	OrganizationID *int64    `json:"organization_id"`
+	EditedHTML     string    `json:"edited_raw_html"`
+	CreatedAt      string    `json:"created_at"`
+	EditedAt       string    `json:"edited_at"`
 }
 
+const (
+	ApostilaSortCreated = "created_at"
+	ApostilaSortUpdated = "updated_at"
+)
+
+var (
+	ErrInvalidCursor    = errors.New("invalid cursor")
+	ErrApostilaNotFound = errors.New("apostila not found")
+	ErrVersionConflict  = errors.New("apostila was changed by another save")
+)
+
+/* VersionConflictError is ErrVersionConflict with the version the apostila is at now */
+type VersionConflictError struct {
+	Current int64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("%s, current version is %d", ErrVersionConflict, e.Current)
+}
+
+func (e *VersionConflictError) Is(target error) bool {
+	return target == ErrVersionConflict
+}
+
+/*
+ * ApostilaMetadata describes an apostila for listings. Title is the one set by the
+ * author or, while none is set, the first heading of the HTML.
+ */
+type ApostilaMetadata struct {
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Subject     string   `json:"subject"`
+	GradeLevel  string   `json:"grade_level"`
+	Language    string   `json:"language"`
+	Tags        []string `json:"tags"`
+}
+
+/* ApostilaMetadataUpdate leaves nil fields untouched, an empty Title goes back to the heading */
+type ApostilaMetadataUpdate struct {
+	Title       *string
+	Description *string
+	Subject     *string
+	GradeLevel  *string
+	Language    *string
+	Tags        *[]string
+}
+
+/* ApostilaSummary is a list entry, the HTML body is left out and only fetched one apostila at a time */
+type ApostilaSummary struct {
+	Id             uuid.UUID `json:"id"`
+	OrganizationID *int64    `json:"organization_id"`
+	OwnerID        int64     `json:"owner_id"`
+	ApostilaMetadata
+	HasContent bool      `json:"has_content"`
+	Version    int64     `json:"version"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+
+	/* Access is what the user asking may do, OwnerName is only filled in for apostilas shared with them */
+	Access    string `json:"access,omitempty"`
+	OwnerName string `json:"owner_name,omitempty"`
+}
+
+const apostilaSummaryColumns = `
+	a.id, a.organization_id, a.user_id,
+	COALESCE(NULLIF(a.title, ''), a.heading), a.description, a.subject, a.grade_level, a.language,
+	ARRAY(SELECT t.tag FROM apostila_tags t WHERE t.apostila_id = a.id ORDER BY t.tag),
+	COALESCE(a.edited_html, '') <> '', a.version, a.created_at, a.updated_at`
+
+/*
+ * ApostilaCursor is the position after the last item of a page. It is tied to the sort
+ * column, a cursor from a created_at listing means nothing for an updated_at one.
+ */
+type ApostilaCursor struct {
+	At time.Time
+	Id uuid.UUID
+}
+
+func (c ApostilaCursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.At.UTC().Format(time.RFC3339Nano) + "," + c.Id.String()))
+}
+
+func DecodeApostilaCursor(s string) (*ApostilaCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	at, id, ok := strings.Cut(string(raw), ",")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+
+	var c ApostilaCursor
+	if c.At, err = time.Parse(time.RFC3339Nano, at); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if c.Id, err = uuid.Parse(id); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+/* ApostilaFilter zero values mean no filter, Sort defaults to the last edit, newest first */
+type ApostilaFilter struct {
+	Sort          string
+	Ascending     bool
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	UpdatedAfter  *time.Time
+	UpdatedBefore *time.Time
+	HasContent    *bool
+	Subject       string
+	Tag           string
+	After         *ApostilaCursor
+	Limit         int
+
+	/* Shared lists the apostilas shared with the user instead of the ones they own */
+	Shared bool
+}
+
+/* Cursor returns the position after summary for the sort column of filter */
+func (f ApostilaFilter) Cursor(summary ApostilaSummary) ApostilaCursor {
+	if f.Sort == ApostilaSortCreated {
+		return ApostilaCursor{At: summary.CreatedAt, Id: summary.Id}
+	}
+
+	return ApostilaCursor{At: summary.UpdatedAt, Id: summary.Id}
+}
+
+/*
+ * ApostilaContent is what a save writes, Heading and Text are derived from HTML by the
+ * caller. Autosave and RestoredFrom only describe the revision the save leaves behind.
+ * A nil ExpectedVersion saves over whatever is there.
+ */
+type ApostilaContent struct {
+	HTML            string
+	Heading         string
+	Text            string
+	Autosave        bool
+	RestoredFrom    *int64
+	ExpectedVersion *int64
+}
+
+/*
+ * ApostilaSearchResult is a summary with its rank and a fragment of the text around the
+ * matches. The fragment is plain text with the matches between SnippetStart and SnippetStop.
+ */
+type ApostilaSearchResult struct {
+	ApostilaSummary
+	Rank    float64 `json:"rank"`
+	Snippet string  `json:"snippet"`
+}
+
+/* snippet markers are control characters, which the extracted text never contains */
+const (
+	SnippetStart = "\x02"
+	SnippetStop  = "\x03"
+)
+
+/*
+ * refreshSearchVector must run after every write to the title, heading, metadata, tags
+ * or text of an apostila. It reads the committed row, which an UPDATE ... SET cannot.
+ */
+const refreshSearchVector = `
+	UPDATE apostilas a
+	SET search_vector =
+		setweight(to_tsvector('portuguese_unaccent', COALESCE(NULLIF(a.title, ''), a.heading)), 'A') ||
+		setweight(to_tsvector('portuguese_unaccent', a.subject || ' ' ||
+			array_to_string(ARRAY(SELECT t.tag FROM apostila_tags t WHERE t.apostila_id = a.id), ' ')), 'B') ||
+		setweight(to_tsvector('portuguese_unaccent', a.description), 'C') ||
+		setweight(to_tsvector('portuguese_unaccent', a.content_text), 'D')
+	WHERE a.id = $1
+`
+
 type EditedApostilaHTML struct {
-	HTML string `json:"file"`
+	HTML     string            `json:"file"`
+	Version  int64             `json:"version"`
+	Metadata *ApostilaMetadata `json:"metadata,omitempty"`
 }
 
+/*
+ * orgID is the tenant of every query: nil is the user's personal workspace, otherwise
+ * the organization workspace the request was made in. An apostila is only visible in
+ * the workspace it was created in, to its owner and the users it was shared with.
+ * Queries by id let in any permission level, the service checks the level an action needs.
+ */
 type ApostilaModel struct {
 	DB *sql.DB
 }
 
-func (m *ApostilaModel) Insert(ctx context.Context, id uuid.UUID, userID int64) (*Apostila, error) {
+func (m *ApostilaModel) Insert(ctx context.Context, id uuid.UUID, userID int64, orgID *int64) (*Apostila, error) {
 	query := `
-		INSERT INTO apostilas (id, user_id, created_at)
-		VALUES ($1, $2, NOW())
-		RETURNING id, user_id, created_at
+		INSERT INTO apostilas (id, user_id, organization_id, created_at)
+		VALUES ($1, $2, $3, NOW())
+		RETURNING id, user_id, organization_id, created_at
 	`
 
 	var apostila Apostila
-	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(
+	err := m.DB.QueryRowContext(ctx, query, id, userID, orgID).Scan(
 		&apostila.Id,
 		&apostila.UserID,
+		&apostila.OrganizationID,
 		&apostila.CreatedAt,
 	)
 	if err != nil {
@@ -45,61 +236,442 @@ func (m *ApostilaModel) Insert(ctx context.Context, id uuid.UUID, userID int64)
 	return &apostila, nil
 }
 
-func (m *ApostilaModel) UpdateEditedHTMLByID(ctx context.Context, id uuid.UUID, editedHTML string, userID int64) error {
+/*
+ * UpdateEditedHTMLByID also records the revision and refreshes the search index, in the
+ * same transaction. userID is the author of the revision.
+ */
+func (m *ApostilaModel) UpdateEditedHTMLByID(ctx context.Context, id uuid.UUID, content ApostilaContent, userID int64, orgID *int64) (int64, error) {
 	query := `
 		UPDATE apostilas
-		SET edited_html = $1, updated_at = NOW()
-		WHERE id = $2 AND user_id = $3
+		SET edited_html = $1, heading = $2, content_text = $3, updated_at = NOW(), version = version + 1
+		WHERE id = $4 AND organization_id IS NOT DISTINCT FROM $6 AND ` + accessibleBy("apostilas", 5) + `
+			AND ($7::bigint IS NULL OR version = $7)
+		RETURNING version
 	`
 
-	result, err := m.DB.ExecContext(ctx, query, editedHTML, id, userID)
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
-		log.Println("Error executing update:", err)
-		return fmt.Errorf("UpdateEditedHTMLByID: %w", err)
+		return 0, fmt.Errorf("UpdateEditedHTMLByID: %w", err)
 	}
+	defer tx.Rollback()
 
-	rowsAffected, err := result.RowsAffected()
+	var version int64
+	err = tx.QueryRowContext(ctx, query, content.HTML, content.Heading, content.Text, id, userID, orgID, content.ExpectedVersion).Scan(&version)
+	if err == sql.ErrNoRows {
+		log.Println("No rows were updated")
+		return 0, m.versionConflict(ctx, tx, id, userID, orgID)
+	}
 	if err != nil {
-		log.Println("Error getting rows affected:", err)
-		return fmt.Errorf("UpdateEditedHTMLByID: failed to get rows affected: %w", err)
+		log.Println("Error executing update:", err)
+		return 0, fmt.Errorf("UpdateEditedHTMLByID: %w", err)
 	}
 
-	if rowsAffected == 0 {
-		log.Println("No rows were updated")
-		return sql.ErrNoRows
+	if err := insertRevision(ctx, tx, id, userID, content); err != nil {
+		return 0, fmt.Errorf("UpdateEditedHTMLByID: %w", err)
 	}
 
-	log.Println("Rows affected:", rowsAffected)
+	if _, err := tx.ExecContext(ctx, refreshSearchVector, id); err != nil {
+		return 0, fmt.Errorf("UpdateEditedHTMLByID: %w", err)
+	}
 
-	return nil
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("UpdateEditedHTMLByID: %w", err)
+	}
+
+	return version, nil
 }
 
-func (m *ApostilaModel) GetEditedHTMLByID(ctx context.Context, id uuid.UUID, userId int64) (*EditedApostilaHTML, error) {
+/* versionConflict tells why a save matched no row: the apostila is not there, or it moved past the expected version */
+func (m *ApostilaModel) versionConflict(ctx context.Context, tx *sql.Tx, id uuid.UUID, userID int64, orgID *int64) error {
+	query := `SELECT version FROM apostilas a WHERE a.id = $1 AND a.organization_id IS NOT DISTINCT FROM $3 AND ` + accessibleBy("a", 2)
+
+	var current int64
+	err := tx.QueryRowContext(ctx, query, id, userID, orgID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return ErrApostilaNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("UpdateEditedHTMLByID: %w", err)
+	}
+
+	return &VersionConflictError{Current: current}
+}
+
+func (m *ApostilaModel) GetEditedHTMLByID(ctx context.Context, id uuid.UUID, userId int64, orgID *int64) (*EditedApostilaHTML, error) {
 	query := `
-	SELECT edited_html 
-	FROM apostilas 
-	WHERE id = $1 AND user_id = $2
+	SELECT COALESCE(edited_html, ''), version, COALESCE(NULLIF(title, ''), heading), description, subject, grade_level, language,
+		ARRAY(SELECT t.tag FROM apostila_tags t WHERE t.apostila_id = a.id ORDER BY t.tag)
+	FROM apostilas a
+	WHERE a.id = $1 AND a.organization_id IS NOT DISTINCT FROM $3 AND ` + accessibleBy("a", 2) + `
 	`
 
 	var editedApostilaHTML EditedApostilaHTML
-	err := m.DB.QueryRowContext(ctx, query, id, userId).Scan(&editedApostilaHTML.HTML)
+	var metadata ApostilaMetadata
+	err := m.DB.QueryRowContext(ctx, query, id, userId, orgID).Scan(
+		&editedApostilaHTML.HTML,
+		&editedApostilaHTML.Version,
+		&metadata.Title,
+		&metadata.Description,
+		&metadata.Subject,
+		&metadata.GradeLevel,
+		&metadata.Language,
+		pq.Array(&metadata.Tags),
+	)
 	if err != nil {
 		editedApostilaHTML.HTML = ""
+	} else {
+		if metadata.Tags == nil {
+			metadata.Tags = []string{}
+		}
+		editedApostilaHTML.Metadata = &metadata
 	}
 
 	return &editedApostilaHTML, nil
 }
 
-func (m *ApostilaModel) Delete(ctx context.Context, id uuid.UUID, userID int64) error {
+func (m *ApostilaModel) Delete(ctx context.Context, id uuid.UUID, userID int64, orgID *int64) error {
 	query := `
 	DELETE FROM apostilas
-	WHERE id = $1 AND user_id = $2
+	WHERE id = $1 AND user_id = $2 AND organization_id IS NOT DISTINCT FROM $3
 	`
 
-	err := m.DB.QueryRowContext(ctx, query, id, userID).Err()
+	err := m.DB.QueryRowContext(ctx, query, id, userID, orgID).Err()
 	if err != nil {
 		return fmt.Errorf("ApostilaModel.Delete: %w", err)
 	}
 
 	return nil
 }
+
+/*
+ * ListAllByUser returns every apostila of the user with its HTML, oldest first. It is
+ * the one query not scoped to a workspace: the data export covers all of them.
+ */
+func (m *ApostilaModel) ListAllByUser(ctx context.Context, userID int64) ([]Apostila, error) {
+	query := `
+		SELECT id, user_id, organization_id, COALESCE(edited_html, ''), created_at, COALESCE(updated_at, created_at)
+		FROM apostilas
+		WHERE user_id = $1
+		ORDER BY created_at, id
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("ApostilaModel.ListAllByUser: %w", err)
+	}
+	defer rows.Close()
+
+	apostilas := []Apostila{}
+	for rows.Next() {
+		var apostila Apostila
+		err := rows.Scan(
+			&apostila.Id,
+			&apostila.UserID,
+			&apostila.OrganizationID,
+			&apostila.EditedHTML,
+			&apostila.CreatedAt,
+			&apostila.EditedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("ApostilaModel.ListAllByUser: %w", err)
+		}
+		apostilas = append(apostilas, apostila)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ApostilaModel.ListAllByUser: %w", err)
+	}
+
+	return apostilas, nil
+}
+
+func (m *ApostilaModel) CountInOrganization(ctx context.Context, orgID int64) (int, error) {
+	var n int
+	if err := m.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM apostilas WHERE organization_id = $1`, orgID).Scan(&n); err != nil {
+		return 0, fmt.Errorf("ApostilaModel.CountInOrganization: %w", err)
+	}
+
+	return n, nil
+}
+
+/*
+ * ListByUser pages through the apostilas a user owns in a workspace, or the ones shared
+ * with them when filter.Shared is set, with a keyset cursor on the sort
+ * column and id, so pages stay stable while apostilas are created or edited.
+ */
+func (m *ApostilaModel) ListByUser(ctx context.Context, userID int64, orgID *int64, filter ApostilaFilter) ([]ApostilaSummary, error) {
+	column := ApostilaSortUpdated
+	if filter.Sort == ApostilaSortCreated {
+		column = ApostilaSortCreated
+	}
+
+	args := []any{userID}
+	where := []string{"a.user_id = $1"}
+	columns := apostilaSummaryColumns
+	if filter.Shared {
+		where[0] = "p.user_id = $1"
+		columns += ", p.level, u.name"
+	}
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+
+	/* IS NOT DISTINCT FROM cannot use the index, so the workspace is matched explicitly */
+	if orgID == nil {
+		where = append(where, "a.organization_id IS NULL")
+	} else {
+		add("a.organization_id = $%d", *orgID)
+	}
+
+	if filter.CreatedAfter != nil {
+		add("a.created_at >= $%d", *filter.CreatedAfter)
+	}
+	if filter.CreatedBefore != nil {
+		add("a.created_at < $%d", *filter.CreatedBefore)
+	}
+	if filter.UpdatedAfter != nil {
+		add("a.updated_at >= $%d", *filter.UpdatedAfter)
+	}
+	if filter.UpdatedBefore != nil {
+		add("a.updated_at < $%d", *filter.UpdatedBefore)
+	}
+	if filter.HasContent != nil {
+		if *filter.HasContent {
+			where = append(where, "COALESCE(a.edited_html, '') <> ''")
+		} else {
+			where = append(where, "COALESCE(a.edited_html, '') = ''")
+		}
+	}
+	if filter.Subject != "" {
+		add("a.subject = $%d", filter.Subject)
+	}
+	if filter.Tag != "" {
+		add("EXISTS (SELECT 1 FROM apostila_tags t WHERE t.apostila_id = a.id AND t.tag = $%d)", filter.Tag)
+	}
+
+	direction, cmp := "DESC", "<"
+	if filter.Ascending {
+		direction, cmp = "ASC", ">"
+	}
+
+	if filter.After != nil {
+		args = append(args, filter.After.At, filter.After.Id)
+		where = append(where, fmt.Sprintf("(a.%s, a.id) %s ($%d, $%d)", column, cmp, len(args)-1, len(args)))
+	}
+
+	args = append(args, filter.Limit)
+	from := "apostilas a"
+	if filter.Shared {
+		from += " JOIN apostila_permissions p ON p.apostila_id = a.id JOIN users u ON u.id = a.user_id"
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM %s
+		WHERE %s
+		ORDER BY a.%s %s, a.id %s
+		LIMIT $%d
+	`, columns, from, strings.Join(where, " AND "), column, direction, direction, len(args))
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("ApostilaModel.ListByUser: %w", err)
+	}
+	defer rows.Close()
+
+	apostilas := []ApostilaSummary{}
+	for rows.Next() {
+		var access, ownerName string
+		var extra []any
+		if filter.Shared {
+			extra = []any{&access, &ownerName}
+		}
+
+		apostila, err := scanApostilaSummary(rows, extra...)
+		if err != nil {
+			return nil, fmt.Errorf("ApostilaModel.ListByUser: %w", err)
+		}
+		apostila.Access, apostila.OwnerName = access, ownerName
+		apostilas = append(apostilas, *apostila)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ApostilaModel.ListByUser: %w", err)
+	}
+
+	return apostilas, nil
+}
+
+func (m *ApostilaModel) FindByID(ctx context.Context, id uuid.UUID, userID int64, orgID *int64) (*ApostilaSummary, error) {
+	query := `
+		SELECT ` + apostilaSummaryColumns + `
+		FROM apostilas a
+		WHERE a.id = $1 AND a.organization_id IS NOT DISTINCT FROM $3 AND ` + accessibleBy("a", 2) + `
+	`
+
+	apostila, err := scanApostilaSummary(m.DB.QueryRowContext(ctx, query, id, userID, orgID))
+	if err == sql.ErrNoRows {
+		return nil, ErrApostilaNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ApostilaModel.FindByID: %w", err)
+	}
+
+	return apostila, nil
+}
+
+/* UpdateMetadata counts as an edit for updated_at, the tags are replaced as a whole */
+func (m *ApostilaModel) UpdateMetadata(ctx context.Context, id uuid.UUID, userID int64, orgID *int64, update ApostilaMetadataUpdate) error {
+	args := []any{id, userID, orgID}
+	set := []string{"updated_at = NOW()"}
+	add := func(expr string, arg any) {
+		args = append(args, arg)
+		set = append(set, fmt.Sprintf(expr, len(args)))
+	}
+
+	if update.Title != nil {
+		add("title = NULLIF($%d, '')", *update.Title)
+	}
+	if update.Description != nil {
+		add("description = $%d", *update.Description)
+	}
+	if update.Subject != nil {
+		add("subject = $%d", *update.Subject)
+	}
+	if update.GradeLevel != nil {
+		add("grade_level = $%d", *update.GradeLevel)
+	}
+	if update.Language != nil {
+		add("language = $%d", *update.Language)
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("ApostilaModel.UpdateMetadata: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf(`
+		UPDATE apostilas
+		SET %s
+		WHERE id = $1 AND organization_id IS NOT DISTINCT FROM $3 AND %s
+	`, strings.Join(set, ", "), accessibleBy("apostilas", 2))
+
+	result, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("ApostilaModel.UpdateMetadata: %w", err)
+	}
+
+	if err := expectOneRow(result, "ApostilaModel.UpdateMetadata"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrApostilaNotFound
+		}
+		return err
+	}
+
+	if update.Tags != nil {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM apostila_tags WHERE apostila_id = $1`, id); err != nil {
+			return fmt.Errorf("ApostilaModel.UpdateMetadata: %w", err)
+		}
+
+		query := `INSERT INTO apostila_tags (apostila_id, tag) SELECT $1, unnest($2::text[])`
+		if _, err := tx.ExecContext(ctx, query, id, pq.Array(*update.Tags)); err != nil {
+			return fmt.Errorf("ApostilaModel.UpdateMetadata: %w", err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, refreshSearchVector, id); err != nil {
+		return fmt.Errorf("ApostilaModel.UpdateMetadata: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ApostilaModel.UpdateMetadata: %w", err)
+	}
+
+	return nil
+}
+
+/* scanApostilaSummary reads apostilaSummaryColumns, extra are the columns selected after them */
+func scanApostilaSummary(row rowScanner, extra ...any) (*ApostilaSummary, error) {
+	var apostila ApostilaSummary
+	dest := []any{
+		&apostila.Id,
+		&apostila.OrganizationID,
+		&apostila.OwnerID,
+		&apostila.Title,
+		&apostila.Description,
+		&apostila.Subject,
+		&apostila.GradeLevel,
+		&apostila.Language,
+		pq.Array(&apostila.Tags),
+		&apostila.HasContent,
+		&apostila.Version,
+		&apostila.CreatedAt,
+		&apostila.UpdatedAt,
+	}
+
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+
+	if apostila.Tags == nil {
+		apostila.Tags = []string{}
+	}
+
+	return &apostila, nil
+}
+
+/*
+ * SearchByUser ranks the apostilas of a workspace the user owns or was shared with against a web search style query
+ * (frações decimais, "regra de três", -porcentagem). The snippets are only
+ * built for the page being returned, ts_headline reads the whole text.
+ */
+func (m *ApostilaModel) SearchByUser(ctx context.Context, userID int64, orgID *int64, q string, limit, offset int) ([]ApostilaSearchResult, error) {
+	workspace := "a.organization_id IS NULL"
+	args := []any{userID, q, limit, offset}
+	if orgID != nil {
+		workspace = "a.organization_id = $5"
+		args = append(args, *orgID)
+	}
+
+	query := `
+		WITH q AS (SELECT websearch_to_tsquery('portuguese_unaccent', $2) AS query),
+		ranked AS (
+			SELECT a.id, ts_rank(a.search_vector, q.query) AS rank
+			FROM apostilas a, q
+			WHERE ` + accessibleBy("a", 1) + ` AND ` + workspace + ` AND a.search_vector @@ q.query
+			ORDER BY rank DESC, a.id
+			LIMIT $3 OFFSET $4
+		)
+		SELECT ` + apostilaSummaryColumns + `, r.rank,
+			ts_headline('portuguese_unaccent', a.content_text, q.query,
+				'StartSel=' || chr(2) || ', StopSel=' || chr(3) || ', MaxWords=30, MinWords=10, MaxFragments=2')
+		FROM ranked r
+		JOIN apostilas a ON a.id = r.id, q
+		ORDER BY r.rank DESC, a.id
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("ApostilaModel.SearchByUser: %w", err)
+	}
+	defer rows.Close()
+
+	results := []ApostilaSearchResult{}
+	for rows.Next() {
+		var result ApostilaSearchResult
+		summary, err := scanApostilaSummary(rows, &result.Rank, &result.Snippet)
+		if err != nil {
+			return nil, fmt.Errorf("ApostilaModel.SearchByUser: %w", err)
+		}
+		result.ApostilaSummary = *summary
+		results = append(results, result)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ApostilaModel.SearchByUser: %w", err)
+	}
+
+	return results, nil
+}
@@ -0,0 +1,402 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+/*
+ * An apostila is shared with a user at one of the permission levels, each one allowing
+ * what the ones before it do. Commenters read like viewers until comments exist. The
+ * owner is whoever created the apostila and is not a row of apostila_permissions.
+ */
+const (
+	PermissionViewer    = "viewer"
+	PermissionCommenter = "commenter"
+	PermissionEditor    = "editor"
+	AccessOwner         = "owner"
+)
+
+var (
+	ErrPermissionNotFound = errors.New("permission not found")
+	ErrInviteNotFound     = errors.New("invite not found")
+	ErrInviteInvalid      = errors.New("invite is invalid or expired")
+	ErrInviteOtherEmail   = errors.New("invite was sent to another email")
+)
+
+var accessRank = map[string]int{
+	PermissionViewer:    1,
+	PermissionCommenter: 2,
+	PermissionEditor:    3,
+	AccessOwner:         4,
+}
+
+/* ValidPermission tells if level can be granted, ownership cannot */
+func ValidPermission(level string) bool {
+	return level != AccessOwner && accessRank[level] > 0
+}
+
+/* AccessAtLeast tells if access, a permission level or AccessOwner, allows what level does */
+func AccessAtLeast(access, level string) bool {
+	return accessRank[access] > 0 && accessRank[access] >= accessRank[level]
+}
+
+/*
+ * accessibleBy matches the apostilas alias that the user in placeholder $n owns or
+ * was granted any permission on. The workspace is matched by the caller.
+ */
+func accessibleBy(alias string, n int) string {
+	return fmt.Sprintf(`(%[1]s.user_id = $%[2]d OR EXISTS (
+		SELECT 1 FROM apostila_permissions p WHERE p.apostila_id = %[1]s.id AND p.user_id = $%[2]d))`, alias, n)
+}
+
+type ApostilaPermission struct {
+	UserID    int64     `json:"user_id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Level     string    `json:"level"`
+	GrantedBy *int64    `json:"granted_by"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+/* ApostilaInvite is a permission waiting for someone without an account, the token went by email */
+type ApostilaInvite struct {
+	ID         int64     `json:"id"`
+	ApostilaID uuid.UUID `json:"apostila_id"`
+	Email      string    `json:"email"`
+	Level      string    `json:"level"`
+	InvitedBy  *int64    `json:"invited_by"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+/* SharedPermission is a permission the user holds, for the data export */
+type SharedPermission struct {
+	ApostilaID uuid.UUID `json:"apostila_id"`
+	Level      string    `json:"level"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+/* AccessLevel returns AccessOwner or the permission level of the user, ErrApostilaNotFound when they have none */
+func (m *ApostilaModel) AccessLevel(ctx context.Context, id uuid.UUID, userID int64, orgID *int64) (string, error) {
+	query := `
+		SELECT CASE WHEN a.user_id = $2 THEN 'owner' ELSE p.level END
+		FROM apostilas a
+		LEFT JOIN apostila_permissions p ON p.apostila_id = a.id AND p.user_id = $2
+		WHERE a.id = $1 AND a.organization_id IS NOT DISTINCT FROM $3
+			AND (a.user_id = $2 OR p.user_id IS NOT NULL)
+	`
+
+	var access string
+	err := m.DB.QueryRowContext(ctx, query, id, userID, orgID).Scan(&access)
+	if err == sql.ErrNoRows {
+		return "", ErrApostilaNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("ApostilaModel.AccessLevel: %w", err)
+	}
+
+	return access, nil
+}
+
+func (m *ApostilaModel) ListPermissions(ctx context.Context, id uuid.UUID) ([]ApostilaPermission, error) {
+	query := `
+		SELECT p.user_id, u.name, u.email, p.level, p.granted_by, p.created_at, p.updated_at
+		FROM apostila_permissions p
+		JOIN users u ON u.id = p.user_id
+		WHERE p.apostila_id = $1
+		ORDER BY u.name, p.user_id
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, fmt.Errorf("ApostilaModel.ListPermissions: %w", err)
+	}
+	defer rows.Close()
+
+	permissions := []ApostilaPermission{}
+	for rows.Next() {
+		var p ApostilaPermission
+		if err := rows.Scan(&p.UserID, &p.Name, &p.Email, &p.Level, &p.GrantedBy, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("ApostilaModel.ListPermissions: %w", err)
+		}
+		permissions = append(permissions, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ApostilaModel.ListPermissions: %w", err)
+	}
+
+	return permissions, nil
+}
+
+/* GrantPermission shares the apostila with the user, or changes the level they already have. Name and Email are left empty */
+func (m *ApostilaModel) GrantPermission(ctx context.Context, id uuid.UUID, userID int64, level string, grantedBy int64) (*ApostilaPermission, error) {
+	query := `
+		INSERT INTO apostila_permissions (apostila_id, user_id, level, granted_by)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (apostila_id, user_id) DO UPDATE
+		SET level = EXCLUDED.level, granted_by = EXCLUDED.granted_by, updated_at = NOW()
+		RETURNING user_id, level, granted_by, created_at, updated_at
+	`
+
+	var p ApostilaPermission
+	err := m.DB.QueryRowContext(ctx, query, id, userID, level, grantedBy).Scan(&p.UserID, &p.Level, &p.GrantedBy, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("ApostilaModel.GrantPermission: %w", err)
+	}
+
+	return &p, nil
+}
+
+/* UpdatePermissionByEmail changes the level of the user with the email, ErrPermissionNotFound when they hold none. It returns their id */
+func (m *ApostilaModel) UpdatePermissionByEmail(ctx context.Context, id uuid.UUID, email, level string, grantedBy int64) (int64, error) {
+	query := `
+		UPDATE apostila_permissions p
+		SET level = $3, granted_by = $4, updated_at = NOW()
+		FROM users u
+		WHERE p.apostila_id = $1 AND p.user_id = u.id AND lower(u.email) = $2
+		RETURNING p.user_id
+	`
+
+	var userID int64
+	err := m.DB.QueryRowContext(ctx, query, id, NormalizeEmail(email), level, grantedBy).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrPermissionNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("ApostilaModel.UpdatePermissionByEmail: %w", err)
+	}
+
+	return userID, nil
+}
+
+func (m *ApostilaModel) UpdatePermission(ctx context.Context, id uuid.UUID, userID int64, level string, grantedBy int64) error {
+	query := `
+		UPDATE apostila_permissions
+		SET level = $3, granted_by = $4, updated_at = NOW()
+		WHERE apostila_id = $1 AND user_id = $2
+	`
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID, level, grantedBy)
+	if err != nil {
+		return fmt.Errorf("ApostilaModel.UpdatePermission: %w", err)
+	}
+
+	if err := expectOneRow(result, "ApostilaModel.UpdatePermission"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrPermissionNotFound
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (m *ApostilaModel) RevokePermission(ctx context.Context, id uuid.UUID, userID int64) error {
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM apostila_permissions WHERE apostila_id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return fmt.Errorf("ApostilaModel.RevokePermission: %w", err)
+	}
+
+	if err := expectOneRow(result, "ApostilaModel.RevokePermission"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrPermissionNotFound
+		}
+		return err
+	}
+
+	return nil
+}
+
+/* ListPermissionsOfUser returns what was shared with the user across every workspace */
+func (m *ApostilaModel) ListPermissionsOfUser(ctx context.Context, userID int64) ([]SharedPermission, error) {
+	query := `
+		SELECT apostila_id, level, created_at
+		FROM apostila_permissions
+		WHERE user_id = $1
+		ORDER BY created_at, apostila_id
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("ApostilaModel.ListPermissionsOfUser: %w", err)
+	}
+	defer rows.Close()
+
+	permissions := []SharedPermission{}
+	for rows.Next() {
+		var p SharedPermission
+		if err := rows.Scan(&p.ApostilaID, &p.Level, &p.CreatedAt); err != nil {
+			return nil, fmt.Errorf("ApostilaModel.ListPermissionsOfUser: %w", err)
+		}
+		permissions = append(permissions, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ApostilaModel.ListPermissionsOfUser: %w", err)
+	}
+
+	return permissions, nil
+}
+
+/* ListInvites returns the invites still pending, expired ones are left out */
+func (m *ApostilaModel) ListInvites(ctx context.Context, id uuid.UUID) ([]ApostilaInvite, error) {
+	query := `
+		SELECT id, apostila_id, email, level, invited_by, created_at, expires_at
+		FROM apostila_invites
+		WHERE apostila_id = $1 AND expires_at > NOW()
+		ORDER BY created_at, id
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, fmt.Errorf("ApostilaModel.ListInvites: %w", err)
+	}
+	defer rows.Close()
+
+	invites := []ApostilaInvite{}
+	for rows.Next() {
+		invite, err := scanInvite(rows)
+		if err != nil {
+			return nil, fmt.Errorf("ApostilaModel.ListInvites: %w", err)
+		}
+		invites = append(invites, *invite)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ApostilaModel.ListInvites: %w", err)
+	}
+
+	return invites, nil
+}
+
+/* CreateInvite replaces an earlier invite of the same email, so only the newest link works */
+func (m *ApostilaModel) CreateInvite(ctx context.Context, id uuid.UUID, email, level, tokenHash string, invitedBy int64, expiresAt time.Time) (*ApostilaInvite, error) {
+	query := `
+		INSERT INTO apostila_invites (apostila_id, email, level, token_hash, invited_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (apostila_id, lower(email)) DO UPDATE
+		SET email = EXCLUDED.email, level = EXCLUDED.level, token_hash = EXCLUDED.token_hash,
+			invited_by = EXCLUDED.invited_by, created_at = NOW(), expires_at = EXCLUDED.expires_at
+		RETURNING id, apostila_id, email, level, invited_by, created_at, expires_at
+	`
+
+	invite, err := scanInvite(m.DB.QueryRowContext(ctx, query, id, email, level, tokenHash, invitedBy, expiresAt))
+	if err != nil {
+		return nil, fmt.Errorf("ApostilaModel.CreateInvite: %w", err)
+	}
+
+	return invite, nil
+}
+
+func (m *ApostilaModel) RevokeInvite(ctx context.Context, id uuid.UUID, inviteID int64) error {
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM apostila_invites WHERE apostila_id = $1 AND id = $2`, id, inviteID)
+	if err != nil {
+		return fmt.Errorf("ApostilaModel.RevokeInvite: %w", err)
+	}
+
+	if err := expectOneRow(result, "ApostilaModel.RevokeInvite"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInviteNotFound
+		}
+		return err
+	}
+
+	return nil
+}
+
+/*
+ * AcceptInvite turns the invite into a permission for the user and deletes it, so the
+ * link works once. Only the account with the email of the invite can accept it, any
+ * other gets ErrInviteOtherEmail and the invite stays. A higher level the user already
+ * has is kept, and the owner gets no permission on their own apostila. It returns the
+ * invite that was accepted.
+ */
+func (m *ApostilaModel) AcceptInvite(ctx context.Context, tokenHash string, userID int64) (*ApostilaInvite, error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ApostilaModel.AcceptInvite: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT i.id, i.apostila_id, i.email, i.level, i.invited_by, i.created_at, i.expires_at,
+			lower(i.email) = lower(u.email)
+		FROM apostila_invites i
+		JOIN users u ON u.id = $2
+		WHERE i.token_hash = $1 AND i.expires_at > NOW()
+		FOR UPDATE OF i
+	`
+
+	var invite ApostilaInvite
+	var sameEmail bool
+	err = tx.QueryRowContext(ctx, query, tokenHash, userID).Scan(
+		&invite.ID,
+		&invite.ApostilaID,
+		&invite.Email,
+		&invite.Level,
+		&invite.InvitedBy,
+		&invite.CreatedAt,
+		&invite.ExpiresAt,
+		&sameEmail,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrInviteInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ApostilaModel.AcceptInvite: %w", err)
+	}
+
+	if !sameEmail {
+		return nil, ErrInviteOtherEmail
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM apostila_invites WHERE id = $1`, invite.ID); err != nil {
+		return nil, fmt.Errorf("ApostilaModel.AcceptInvite: %w", err)
+	}
+
+	query = `
+		INSERT INTO apostila_permissions (apostila_id, user_id, level, granted_by)
+		SELECT $1, $2, $3, $4
+		WHERE NOT EXISTS (SELECT 1 FROM apostilas WHERE id = $1 AND user_id = $2)
+		ON CONFLICT (apostila_id, user_id) DO UPDATE
+		SET level = EXCLUDED.level, granted_by = EXCLUDED.granted_by, updated_at = NOW()
+		WHERE array_position(ARRAY['viewer', 'commenter', 'editor'], EXCLUDED.level) >
+			array_position(ARRAY['viewer', 'commenter', 'editor'], apostila_permissions.level)
+	`
+
+	if _, err := tx.ExecContext(ctx, query, invite.ApostilaID, userID, invite.Level, invite.InvitedBy); err != nil {
+		return nil, fmt.Errorf("ApostilaModel.AcceptInvite: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("ApostilaModel.AcceptInvite: %w", err)
+	}
+
+	return &invite, nil
+}
+
+func scanInvite(row rowScanner) (*ApostilaInvite, error) {
+	var invite ApostilaInvite
+	err := row.Scan(
+		&invite.ID,
+		&invite.ApostilaID,
+		&invite.Email,
+		&invite.Level,
+		&invite.InvitedBy,
+		&invite.CreatedAt,
+		&invite.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &invite, nil
+}
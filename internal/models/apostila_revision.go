@@ -0,0 +1,182 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrRevisionNotFound = errors.New("revision not found")
+
+/* ApostilaRevision is an immutable copy of the HTML left by a save, HTML is only filled when one revision is fetched */
+type ApostilaRevision struct {
+	ID           int64     `json:"id"`
+	ApostilaID   uuid.UUID `json:"apostila_id"`
+	AuthorID     *int64    `json:"author_id"`
+	AuthorName   string    `json:"author_name"`
+	ContentHash  string    `json:"content_hash"`
+	Size         int       `json:"size"`
+	Autosave     bool      `json:"autosave"`
+	RestoredFrom *int64    `json:"restored_from"`
+	CreatedAt    time.Time `json:"created_at"`
+	HTML         string    `json:"html,omitempty"`
+}
+
+const revisionColumns = `
+	r.id, r.apostila_id, r.author_id, COALESCE(u.name, ''), r.content_hash, octet_length(r.html),
+	r.autosave, r.restored_from, r.created_at`
+
+/*
+ * insertRevision runs inside the save. A save that does not change the HTML leaves no
+ * revision, so an editor autosaving an idle document does not fill the history.
+ */
+func insertRevision(ctx context.Context, tx *sql.Tx, apostilaID uuid.UUID, authorID int64, content ApostilaContent) error {
+	sum := sha256.Sum256([]byte(content.HTML))
+
+	query := `
+		INSERT INTO apostila_revisions (apostila_id, author_id, html, content_hash, autosave, restored_from)
+		SELECT $1, $2, $3, $4, $5, $6
+		WHERE NOT EXISTS (
+			SELECT 1 FROM (
+				SELECT content_hash FROM apostila_revisions WHERE apostila_id = $1 ORDER BY id DESC LIMIT 1
+			) head
+			WHERE head.content_hash = $4
+		)
+	`
+
+	_, err := tx.ExecContext(ctx, query, apostilaID, authorID, content.HTML, hex.EncodeToString(sum[:]), content.Autosave, content.RestoredFrom)
+	return err
+}
+
+/* ListRevisions pages newest first with beforeID, revisions of apostilas outside the workspace are not found */
+func (m *ApostilaModel) ListRevisions(ctx context.Context, apostilaID uuid.UUID, userID int64, orgID *int64, beforeID int64, limit int) ([]ApostilaRevision, error) {
+	if err := m.exists(ctx, apostilaID, userID, orgID); err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT ` + revisionColumns + `
+		FROM apostila_revisions r
+		LEFT JOIN users u ON u.id = r.author_id
+		WHERE r.apostila_id = $1 AND ($2::bigint = 0 OR r.id < $2::bigint)
+		ORDER BY r.id DESC
+		LIMIT $3
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, apostilaID, beforeID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("ApostilaModel.ListRevisions: %w", err)
+	}
+	defer rows.Close()
+
+	revisions := []ApostilaRevision{}
+	for rows.Next() {
+		revision, err := scanRevision(rows)
+		if err != nil {
+			return nil, fmt.Errorf("ApostilaModel.ListRevisions: %w", err)
+		}
+		revisions = append(revisions, *revision)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ApostilaModel.ListRevisions: %w", err)
+	}
+
+	return revisions, nil
+}
+
+func (m *ApostilaModel) GetRevision(ctx context.Context, apostilaID uuid.UUID, revisionID int64, userID int64, orgID *int64) (*ApostilaRevision, error) {
+	if err := m.exists(ctx, apostilaID, userID, orgID); err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT ` + revisionColumns + `, r.html
+		FROM apostila_revisions r
+		LEFT JOIN users u ON u.id = r.author_id
+		WHERE r.apostila_id = $1 AND r.id = $2
+	`
+
+	var html string
+	revision, err := scanRevision(m.DB.QueryRowContext(ctx, query, apostilaID, revisionID), &html)
+	if err == sql.ErrNoRows {
+		return nil, ErrRevisionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ApostilaModel.GetRevision: %w", err)
+	}
+	revision.HTML = html
+
+	return revision, nil
+}
+
+/*
+ * ThinAutosaves keeps the newest autosave of each hour for autosaves older than
+ * hourlyBefore, and of each day for those older than dailyBefore. Manual saves and
+ * restores are never deleted, and neither is the newest revision of an apostila since
+ * it is always the newest of its bucket.
+ */
+func (m *ApostilaModel) ThinAutosaves(ctx context.Context, hourlyBefore, dailyBefore time.Time) (int64, error) {
+	query := `
+		DELETE FROM apostila_revisions r
+		USING (
+			SELECT id, ROW_NUMBER() OVER (
+				PARTITION BY apostila_id, date_trunc(CASE WHEN created_at < $2 THEN 'day' ELSE 'hour' END, created_at)
+				ORDER BY id DESC
+			) AS n
+			FROM apostila_revisions
+			WHERE autosave AND created_at < $1
+		) old
+		WHERE r.id = old.id AND old.n > 1
+	`
+
+	result, err := m.DB.ExecContext(ctx, query, hourlyBefore, dailyBefore)
+	if err != nil {
+		return 0, fmt.Errorf("ApostilaModel.ThinAutosaves: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+/* exists answers ErrApostilaNotFound unless the user can open the apostila in the workspace */
+func (m *ApostilaModel) exists(ctx context.Context, id uuid.UUID, userID int64, orgID *int64) error {
+	query := `SELECT EXISTS(SELECT 1 FROM apostilas a WHERE a.id = $1 AND a.organization_id IS NOT DISTINCT FROM $3 AND ` + accessibleBy("a", 2) + `)`
+
+	var ok bool
+	if err := m.DB.QueryRowContext(ctx, query, id, userID, orgID).Scan(&ok); err != nil {
+		return fmt.Errorf("ApostilaModel.exists: %w", err)
+	}
+
+	if !ok {
+		return ErrApostilaNotFound
+	}
+
+	return nil
+}
+
+func scanRevision(row rowScanner, extra ...any) (*ApostilaRevision, error) {
+	var revision ApostilaRevision
+	dest := []any{
+		&revision.ID,
+		&revision.ApostilaID,
+		&revision.AuthorID,
+		&revision.AuthorName,
+		&revision.ContentHash,
+		&revision.Size,
+		&revision.Autosave,
+		&revision.RestoredFrom,
+		&revision.CreatedAt,
+	}
+
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+
+	return &revision, nil
+}
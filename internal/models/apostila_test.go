@@ -0,0 +1,74 @@
+package models
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestApostilaCursorRoundTrip(t *testing.T) {
+	id := uuid.MustParse("0b9c3c5e-8f1e-4d7a-9a51-2f7c8d6e4b10")
+	sp := time.FixedZone("BRT", -3*60*60)
+
+	tests := []ApostilaCursor{
+		{At: time.Date(2025, 3, 14, 15, 9, 26, 535897932, time.UTC), Id: id},
+		{At: time.Date(2025, 3, 14, 12, 9, 26, 0, sp), Id: id},
+		{At: time.Unix(0, 0), Id: uuid.Nil},
+	}
+
+	for _, c := range tests {
+		encoded := c.Encode()
+		got, err := DecodeApostilaCursor(encoded)
+		if err != nil {
+			t.Errorf("DecodeApostilaCursor(%q): %v", encoded, err)
+			continue
+		}
+		if !got.At.Equal(c.At) || got.Id != c.Id {
+			t.Errorf("round trip of %v, %s gave %v, %s", c.At, c.Id, got.At, got.Id)
+		}
+	}
+}
+
+func TestDecodeApostilaCursorRejectsTampering(t *testing.T) {
+	raw := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	valid := ApostilaCursor{At: time.Date(2025, 3, 14, 15, 9, 26, 0, time.UTC), Id: uuid.New()}.Encode()
+
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"empty", ""},
+		{"not base64", "not a cursor!"},
+		{"truncated", valid[:len(valid)-4]},
+		{"no separator", raw("2025-03-14T15:09:26Z")},
+		{"bad time", raw("yesterday,0b9c3c5e-8f1e-4d7a-9a51-2f7c8d6e4b10")},
+		{"bad id", raw("2025-03-14T15:09:26Z,42")},
+		{"sql in id", raw("2025-03-14T15:09:26Z,' OR 1=1 --")},
+		{"extra field", raw("2025-03-14T15:09:26Z,0b9c3c5e-8f1e-4d7a-9a51-2f7c8d6e4b10,1")},
+	}
+
+	for _, tt := range tests {
+		if c, err := DecodeApostilaCursor(tt.cursor); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("%s: DecodeApostilaCursor = %+v, %v, want ErrInvalidCursor", tt.name, c, err)
+		}
+	}
+}
+
+/* the cursor follows the sort column, so a created_at listing does not resume at an updated_at position */
+func TestApostilaFilterCursor(t *testing.T) {
+	summary := ApostilaSummary{
+		Id:        uuid.New(),
+		CreatedAt: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		UpdatedAt: time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	if c := (ApostilaFilter{Sort: ApostilaSortCreated}).Cursor(summary); !c.At.Equal(summary.CreatedAt) || c.Id != summary.Id {
+		t.Errorf("created_at cursor = %+v", c)
+	}
+	if c := (ApostilaFilter{}).Cursor(summary); !c.At.Equal(summary.UpdatedAt) || c.Id != summary.Id {
+		t.Errorf("default cursor = %+v", c)
+	}
+}
@@ -0,0 +1,167 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+ * AuditEvent is one row of the append-only audit_events table. actor_id has no
+ * foreign key on purpose, events must outlive the accounts they mention.
+ */
+type AuditEvent struct {
+	ID         int64          `json:"id"`
+	OccurredAt time.Time      `json:"occurred_at"`
+	ActorID    *int64         `json:"actor_id"`
+	Action     string         `json:"action"`
+	TargetType string         `json:"target_type,omitempty"`
+	TargetID   string         `json:"target_id,omitempty"`
+	IP         string         `json:"ip,omitempty"`
+	RequestID  string         `json:"request_id,omitempty"`
+	Outcome    string         `json:"outcome"`
+	Metadata   map[string]any `json:"metadata,omitempty"`
+}
+
+/* zero values are not filtered on; BeforeID pages backwards from the newest event */
+type AuditFilter struct {
+	ActorID    *int64
+	Action     string
+	TargetType string
+	TargetID   string
+	Outcome    string
+	From       *time.Time
+	To         *time.Time
+	BeforeID   int64
+	Limit      int
+}
+
+type AuditEventModel struct {
+	DB *sql.DB
+}
+
+func (m *AuditEventModel) Insert(ctx context.Context, event *AuditEvent) error {
+	metadata, err := json.Marshal(event.Metadata)
+	if err != nil || event.Metadata == nil {
+		metadata = []byte("{}")
+	}
+
+	query := `
+		INSERT INTO audit_events (occurred_at, actor_id, action, target_type, target_id, ip, request_id, outcome, metadata)
+		VALUES (NOW(), $1, $2, NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, ''), $7, $8)
+		RETURNING id, occurred_at
+	`
+
+	err = m.DB.QueryRowContext(ctx, query,
+		event.ActorID,
+		event.Action,
+		event.TargetType,
+		event.TargetID,
+		event.IP,
+		event.RequestID,
+		event.Outcome,
+		metadata,
+	).Scan(&event.ID, &event.OccurredAt)
+	if err != nil {
+		return fmt.Errorf("AuditEventModel.Insert: %w", err)
+	}
+
+	return nil
+}
+
+/* Each streams the matching events newest first, so exports never hold the whole log in memory */
+func (m *AuditEventModel) Each(ctx context.Context, filter AuditFilter, fn func(*AuditEvent) error) error {
+	var (
+		where []string
+		args  []any
+	)
+
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+
+	if filter.ActorID != nil {
+		add("actor_id = $%d", *filter.ActorID)
+	}
+	if filter.Action != "" {
+		add("action = $%d", filter.Action)
+	}
+	if filter.TargetType != "" {
+		add("target_type = $%d", filter.TargetType)
+	}
+	if filter.TargetID != "" {
+		add("target_id = $%d", filter.TargetID)
+	}
+	if filter.Outcome != "" {
+		add("outcome = $%d", filter.Outcome)
+	}
+	if filter.From != nil {
+		add("occurred_at >= $%d", *filter.From)
+	}
+	if filter.To != nil {
+		add("occurred_at < $%d", *filter.To)
+	}
+	if filter.BeforeID > 0 {
+		add("id < $%d", filter.BeforeID)
+	}
+
+	query := `
+		SELECT id, occurred_at, actor_id, action, COALESCE(target_type, ''), COALESCE(target_id, ''),
+			COALESCE(ip, ''), COALESCE(request_id, ''), outcome, metadata
+		FROM audit_events
+	`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("AuditEventModel.Each: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			event    AuditEvent
+			metadata []byte
+		)
+
+		err := rows.Scan(
+			&event.ID,
+			&event.OccurredAt,
+			&event.ActorID,
+			&event.Action,
+			&event.TargetType,
+			&event.TargetID,
+			&event.IP,
+			&event.RequestID,
+			&event.Outcome,
+			&metadata,
+		)
+		if err != nil {
+			return fmt.Errorf("AuditEventModel.Each: %w", err)
+		}
+
+		if err := json.Unmarshal(metadata, &event.Metadata); err != nil {
+			return fmt.Errorf("AuditEventModel.Each: %w", err)
+		}
+
+		if err := fn(&event); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("AuditEventModel.Each: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrDataExportNotFound   = errors.New("no data export requested")
+	ErrDataExportInProgress = errors.New("data export already in progress")
+)
+
+const (
+	DataExportPending = "pending"
+	DataExportReady   = "ready"
+	DataExportFailed  = "failed"
+)
+
+/* DataExport is the archive of a user's data, built in the background; the archive itself is read apart */
+type DataExport struct {
+	UserID      int64      `json:"-"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	RequestedAt time.Time  `json:"requested_at"`
+	FinishedAt  *time.Time `json:"finished_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+}
+
+/* DataExportModel keeps one export per user, a new request replaces the previous one */
+type DataExportModel struct {
+	DB *sql.DB
+}
+
+/*
+ * Start marks a new export as pending. A pending one younger than staleAfter is still
+ * being built and is left alone; an older one was lost with its process and is restarted.
+ */
+func (m *DataExportModel) Start(ctx context.Context, userID int64, staleAfter time.Duration) (*DataExport, error) {
+	query := `
+		INSERT INTO data_exports (user_id, status, requested_at)
+		VALUES ($1, 'pending', NOW())
+		ON CONFLICT (user_id) DO UPDATE
+		SET status = 'pending', error = NULL, archive = NULL, requested_at = NOW(), finished_at = NULL, expires_at = NULL
+		WHERE data_exports.status <> 'pending' OR data_exports.requested_at < NOW() - make_interval(secs => $2)
+		RETURNING user_id, status, COALESCE(error, ''), requested_at, finished_at, expires_at
+	`
+
+	export, err := scanDataExport(m.DB.QueryRowContext(ctx, query, userID, staleAfter.Seconds()))
+	if err == sql.ErrNoRows {
+		return nil, ErrDataExportInProgress
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DataExportModel.Start: %w", err)
+	}
+
+	return export, nil
+}
+
+/* Finish and Fail only touch the export started at requestedAt, never one that replaced it */
+func (m *DataExportModel) Finish(ctx context.Context, export *DataExport, archive []byte, expiresAt time.Time) error {
+	query := `
+		UPDATE data_exports
+		SET status = 'ready', archive = $3, finished_at = NOW(), expires_at = $4
+		WHERE user_id = $1 AND requested_at = $2 AND status = 'pending'
+	`
+
+	result, err := m.DB.ExecContext(ctx, query, export.UserID, export.RequestedAt, archive, expiresAt)
+	if err != nil {
+		return fmt.Errorf("DataExportModel.Finish: %w", err)
+	}
+
+	return expectOneRow(result, "DataExportModel.Finish")
+}
+
+func (m *DataExportModel) Fail(ctx context.Context, export *DataExport, reason string) error {
+	query := `
+		UPDATE data_exports
+		SET status = 'failed', error = $3, finished_at = NOW()
+		WHERE user_id = $1 AND requested_at = $2 AND status = 'pending'
+	`
+
+	result, err := m.DB.ExecContext(ctx, query, export.UserID, export.RequestedAt, reason)
+	if err != nil {
+		return fmt.Errorf("DataExportModel.Fail: %w", err)
+	}
+
+	return expectOneRow(result, "DataExportModel.Fail")
+}
+
+func (m *DataExportModel) FindByUser(ctx context.Context, userID int64) (*DataExport, error) {
+	query := `
+		SELECT user_id, status, COALESCE(error, ''), requested_at, finished_at, expires_at
+		FROM data_exports
+		WHERE user_id = $1 AND (expires_at IS NULL OR expires_at > NOW())
+	`
+
+	export, err := scanDataExport(m.DB.QueryRowContext(ctx, query, userID))
+	if err == sql.ErrNoRows {
+		return nil, ErrDataExportNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DataExportModel.FindByUser: %w", err)
+	}
+
+	return export, nil
+}
+
+/* Archive returns the zip of a ready export that has not expired */
+func (m *DataExportModel) Archive(ctx context.Context, userID int64) ([]byte, error) {
+	query := `
+		SELECT archive
+		FROM data_exports
+		WHERE user_id = $1 AND status = 'ready' AND expires_at > NOW()
+	`
+
+	var archive []byte
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&archive)
+	if err == sql.ErrNoRows {
+		return nil, ErrDataExportNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DataExportModel.Archive: %w", err)
+	}
+
+	return archive, nil
+}
+
+func (m *DataExportModel) DeleteExpired(ctx context.Context) error {
+	if _, err := m.DB.ExecContext(ctx, `DELETE FROM data_exports WHERE expires_at <= NOW()`); err != nil {
+		return fmt.Errorf("DataExportModel.DeleteExpired: %w", err)
+	}
+
+	return nil
+}
+
+func scanDataExport(row rowScanner) (*DataExport, error) {
+	var export DataExport
+	err := row.Scan(
+		&export.UserID,
+		&export.Status,
+		&export.Error,
+		&export.RequestedAt,
+		&export.FinishedAt,
+		&export.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &export, nil
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrDeletionRequestNotFound = errors.New("no pending deletion request")
+	ErrDeletionAlreadyPending  = errors.New("account deletion already requested")
+)
+
+/* DeletionRequest is an account waiting out its grace period before being erased */
+type DeletionRequest struct {
+	UserID       int64     `json:"-"`
+	RequestedAt  time.Time `json:"requested_at"`
+	ScheduledFor time.Time `json:"scheduled_for"`
+}
+
+type DeletionRequestModel struct {
+	DB *sql.DB
+}
+
+func (m *DeletionRequestModel) Insert(ctx context.Context, userID int64, scheduledFor time.Time) (*DeletionRequest, error) {
+	query := `
+		INSERT INTO account_deletion_requests (user_id, requested_at, scheduled_for)
+		VALUES ($1, NOW(), $2)
+		RETURNING user_id, requested_at, scheduled_for
+	`
+
+	var request DeletionRequest
+	err := m.DB.QueryRowContext(ctx, query, userID, scheduledFor).Scan(
+		&request.UserID,
+		&request.RequestedAt,
+		&request.ScheduledFor,
+	)
+	if isUniqueViolation(err) {
+		return nil, ErrDeletionAlreadyPending
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DeletionRequestModel.Insert: %w", err)
+	}
+
+	return &request, nil
+}
+
+func (m *DeletionRequestModel) FindByUser(ctx context.Context, userID int64) (*DeletionRequest, error) {
+	query := `
+		SELECT user_id, requested_at, scheduled_for
+		FROM account_deletion_requests
+		WHERE user_id = $1
+	`
+
+	var request DeletionRequest
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&request.UserID,
+		&request.RequestedAt,
+		&request.ScheduledFor,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrDeletionRequestNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("DeletionRequestModel.FindByUser: %w", err)
+	}
+
+	return &request, nil
+}
+
+func (m *DeletionRequestModel) Delete(ctx context.Context, userID int64) error {
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM account_deletion_requests WHERE user_id = $1`, userID)
+	if err != nil {
+		return fmt.Errorf("DeletionRequestModel.Delete: %w", err)
+	}
+
+	if err := expectOneRow(result, "DeletionRequestModel.Delete"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrDeletionRequestNotFound
+		}
+		return err
+	}
+
+	return nil
+}
+
+/* ListDue returns the users whose grace period is over, the oldest schedule first */
+func (m *DeletionRequestModel) ListDue(ctx context.Context, limit int) ([]int64, error) {
+	query := `
+		SELECT user_id
+		FROM account_deletion_requests
+		WHERE scheduled_for <= NOW()
+		ORDER BY scheduled_for
+		LIMIT $1
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("DeletionRequestModel.ListDue: %w", err)
+	}
+	defer rows.Close()
+
+	userIDs := []int64{}
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("DeletionRequestModel.ListDue: %w", err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("DeletionRequestModel.ListDue: %w", err)
+	}
+
+	return userIDs, nil
+}
@@ -0,0 +1,154 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrIdentityNotFound   = errors.New("identity not found")
+	ErrLoginStateNotFound = errors.New("login state not found or expired")
+)
+
+/* Identity links a users row to an account at an external OIDC provider */
+type Identity struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type OIDCLoginState struct {
+	Provider     string
+	CodeVerifier string
+	Nonce        string
+}
+
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+func (m *IdentityModel) FindByProviderSubject(ctx context.Context, provider, subject string) (*Identity, error) {
+	query := `
+		SELECT id, user_id, provider, subject, COALESCE(email, ''), created_at
+		FROM user_identities
+		WHERE provider = $1 AND subject = $2
+	`
+
+	var identity Identity
+	err := m.DB.QueryRowContext(ctx, query, provider, subject).Scan(
+		&identity.ID,
+		&identity.UserID,
+		&identity.Provider,
+		&identity.Subject,
+		&identity.Email,
+		&identity.CreatedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrIdentityNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("IdentityModel.FindByProviderSubject: %w", err)
+	}
+
+	return &identity, nil
+}
+
+func (m *IdentityModel) ListByUser(ctx context.Context, userID int64) ([]Identity, error) {
+	query := `
+		SELECT id, user_id, provider, subject, COALESCE(email, ''), created_at
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY id
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("IdentityModel.ListByUser: %w", err)
+	}
+	defer rows.Close()
+
+	identities := []Identity{}
+	for rows.Next() {
+		var identity Identity
+		err := rows.Scan(
+			&identity.ID,
+			&identity.UserID,
+			&identity.Provider,
+			&identity.Subject,
+			&identity.Email,
+			&identity.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("IdentityModel.ListByUser: %w", err)
+		}
+		identities = append(identities, identity)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("IdentityModel.ListByUser: %w", err)
+	}
+
+	return identities, nil
+}
+
+func (m *IdentityModel) Insert(ctx context.Context, userID int64, provider, subject, email string) error {
+	query := `
+		INSERT INTO user_identities (user_id, provider, subject, email, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (provider, subject) DO NOTHING
+	`
+
+	if _, err := m.DB.ExecContext(ctx, query, userID, provider, subject, email); err != nil {
+		return fmt.Errorf("IdentityModel.Insert: %w", err)
+	}
+
+	return nil
+}
+
+func (m *IdentityModel) SaveLoginState(ctx context.Context, stateHash string, state OIDCLoginState, expiresAt time.Time) error {
+	/* abandoned logins are cleaned up whenever a new one starts */
+	if _, err := m.DB.ExecContext(ctx, `DELETE FROM oidc_login_states WHERE expires_at < NOW()`); err != nil {
+		return fmt.Errorf("IdentityModel.SaveLoginState: %w", err)
+	}
+
+	query := `
+		INSERT INTO oidc_login_states (state_hash, provider, code_verifier, nonce, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+
+	if _, err := m.DB.ExecContext(ctx, query, stateHash, state.Provider, state.CodeVerifier, state.Nonce, expiresAt); err != nil {
+		return fmt.Errorf("IdentityModel.SaveLoginState: %w", err)
+	}
+
+	return nil
+}
+
+/* ConsumeLoginState deletes the state as it reads it, so a callback can be completed only once */
+func (m *IdentityModel) ConsumeLoginState(ctx context.Context, stateHash string) (*OIDCLoginState, error) {
+	query := `
+		DELETE FROM oidc_login_states
+		WHERE state_hash = $1 AND expires_at > NOW()
+		RETURNING provider, code_verifier, nonce
+	`
+
+	var state OIDCLoginState
+	err := m.DB.QueryRowContext(ctx, query, stateHash).Scan(&state.Provider, &state.CodeVerifier, &state.Nonce)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrLoginStateNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("IdentityModel.ConsumeLoginState: %w", err)
+	}
+
+	return &state, nil
+}
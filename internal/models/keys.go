@@ -0,0 +1,205 @@
+package models
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+/*
+ * SigningKey is one entry of the key set. A key loaded from a public key file can
+ * only verify tokens, which is how a retired key is kept around until every token
+ * it signed has expired.
+ */
+type SigningKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	signKey   any
+	verifyKey any
+}
+
+type KeySet struct {
+	active *SigningKey
+	keys   map[string]*SigningKey
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func NewKeySet(activeID string, keys ...*SigningKey) (*KeySet, error) {
+	ks := &KeySet{keys: make(map[string]*SigningKey, len(keys))}
+
+	for _, k := range keys {
+		if _, dup := ks.keys[k.ID]; dup {
+			return nil, fmt.Errorf("duplicate signing key id %q", k.ID)
+		}
+		ks.keys[k.ID] = k
+	}
+
+	active, ok := ks.keys[activeID]
+	if !ok {
+		return nil, fmt.Errorf("active signing key %q not found", activeID)
+	}
+
+	if active.signKey == nil {
+		return nil, fmt.Errorf("active signing key %q has no private key", activeID)
+	}
+
+	ks.active = active
+
+	return ks, nil
+}
+
+/* GenerateEd25519Key creates a throwaway key, only meant for local development */
+func GenerateEd25519Key(kid string) (*SigningKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningKey{
+		ID:        kid,
+		Method:    jwt.SigningMethodEdDSA,
+		signKey:   priv,
+		verifyKey: pub,
+	}, nil
+}
+
+/*
+ * LoadSigningKey reads a key from disk. EdDSA and RS256 expect a PEM file holding
+ * either a private key (sign and verify) or a public key (verify only). HS256
+ * expects the raw shared secret.
+ */
+func LoadSigningKey(kid, alg, path string) (*SigningKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadSigningKey %s: %w", kid, err)
+	}
+
+	key := &SigningKey{ID: kid}
+
+	switch alg {
+	case jwt.SigningMethodHS256.Alg():
+		secret := []byte(strings.TrimSpace(string(raw)))
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("LoadSigningKey %s: HS256 secret must be at least 32 bytes", kid)
+		}
+		key.Method = jwt.SigningMethodHS256
+		key.signKey = secret
+		key.verifyKey = secret
+
+	case jwt.SigningMethodEdDSA.Alg():
+		key.Method = jwt.SigningMethodEdDSA
+		if priv, err := jwt.ParseEdPrivateKeyFromPEM(raw); err == nil {
+			key.signKey = priv
+			key.verifyKey = priv.(ed25519.PrivateKey).Public()
+		} else if pub, err := jwt.ParseEdPublicKeyFromPEM(raw); err == nil {
+			key.verifyKey = pub
+		} else {
+			return nil, fmt.Errorf("LoadSigningKey %s: not an Ed25519 PEM key", kid)
+		}
+
+	case jwt.SigningMethodRS256.Alg():
+		key.Method = jwt.SigningMethodRS256
+		if priv, err := jwt.ParseRSAPrivateKeyFromPEM(raw); err == nil {
+			key.signKey = priv
+			key.verifyKey = &priv.PublicKey
+		} else if pub, err := jwt.ParseRSAPublicKeyFromPEM(raw); err == nil {
+			key.verifyKey = pub
+		} else {
+			return nil, fmt.Errorf("LoadSigningKey %s: not an RSA PEM key", kid)
+		}
+
+	default:
+		return nil, fmt.Errorf("LoadSigningKey %s: unsupported algorithm %q", kid, alg)
+	}
+
+	return key, nil
+}
+
+/* Sign signs the claims with the active key and sets the kid header */
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.active.Method, claims)
+	token.Header["kid"] = ks.active.ID
+
+	return token.SignedString(ks.active.signKey)
+}
+
+/* Keyfunc picks the verification key from the kid header, refusing algorithm mismatches */
+func (ks *KeySet) Keyfunc(t *jwt.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	if t.Method.Alg() != key.Method.Alg() {
+		return nil, errors.New("signing method does not match key")
+	}
+
+	return key.verifyKey, nil
+}
+
+func (ks *KeySet) Algorithms() []string {
+	seen := map[string]bool{}
+	var algs []string
+	for _, k := range ks.keys {
+		if !seen[k.Method.Alg()] {
+			seen[k.Method.Alg()] = true
+			algs = append(algs, k.Method.Alg())
+		}
+	}
+
+	return algs
+}
+
+/* JWKS returns the public half of every asymmetric key, shared secrets are never published */
+func (ks *KeySet) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+
+	for _, k := range ks.keys {
+		switch pub := k.verifyKey.(type) {
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "OKP",
+				Kid: k.ID,
+				Use: "sig",
+				Alg: k.Method.Alg(),
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(pub),
+			})
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "RSA",
+				Kid: k.ID,
+				Use: "sig",
+				Alg: k.Method.Alg(),
+				N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		}
+	}
+
+	return set
+}
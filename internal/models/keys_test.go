@@ -0,0 +1,209 @@
+package models
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+/* writePEM stores der as a PEM file in a temporary directory and returns its path */
+func writePEM(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func ed25519Files(t *testing.T) (privPath, pubPath string, pub ed25519.PublicKey) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return writePEM(t, "ed25519.pem", "PRIVATE KEY", privDER), writePEM(t, "ed25519.pub.pem", "PUBLIC KEY", pubDER), pub
+}
+
+func rsaFiles(t *testing.T) (privPath, pubPath string) {
+	t.Helper()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubDER, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return writePEM(t, "rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(priv)), writePEM(t, "rsa.pub.pem", "PUBLIC KEY", pubDER)
+}
+
+func mustLoadKey(t *testing.T, kid, alg, path string) *SigningKey {
+	t.Helper()
+
+	key, err := LoadSigningKey(kid, alg, path)
+	if err != nil {
+		t.Fatalf("LoadSigningKey(%s): %v", kid, err)
+	}
+
+	return key
+}
+
+func testClaims() jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{Subject: "1", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))}
+}
+
+func verify(ks *KeySet, token string) error {
+	_, err := jwt.ParseWithClaims(token, &jwt.RegisteredClaims{}, ks.Keyfunc, jwt.WithValidMethods(ks.Algorithms()))
+	return err
+}
+
+/* after a rotation the new key signs, and tokens of the retired key still verify with its public half */
+func TestKeySetRotation(t *testing.T) {
+	newPriv, _, _ := ed25519Files(t)
+	oldPriv, oldPub := rsaFiles(t)
+
+	before, err := NewKeySet("old", mustLoadKey(t, "old", "RS256", oldPriv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, err := before.Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := NewKeySet("new", mustLoadKey(t, "new", "EdDSA", newPriv), mustLoadKey(t, "old", "RS256", oldPub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newToken, err := after.Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, _, err := jwt.NewParser().ParseUnverified(newToken, &jwt.RegisteredClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := parsed.Header["kid"]; kid != "new" || parsed.Method.Alg() != "EdDSA" {
+		t.Errorf("new token signed with kid %v and %s, want new and EdDSA", kid, parsed.Method.Alg())
+	}
+
+	if err := verify(after, newToken); err != nil {
+		t.Errorf("token of the active key: %v", err)
+	}
+	if err := verify(after, oldToken); err != nil {
+		t.Errorf("token of the previous key: %v", err)
+	}
+
+	dropped, err := NewKeySet("new", mustLoadKey(t, "new", "EdDSA", newPriv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(dropped, oldToken); err == nil {
+		t.Error("token of a key no longer in the set verified")
+	}
+}
+
+/* a token that names a known kid but another algorithm must not be checked with that key */
+func TestKeySetRejectsAlgorithmMismatch(t *testing.T) {
+	edPriv, _, _ := ed25519Files(t)
+	secretPath := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretPath, []byte("0123456789abcdef0123456789abcdef"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ks, err := NewKeySet("ed", mustLoadKey(t, "ed", "EdDSA", edPriv), mustLoadKey(t, "hs", "HS256", secretPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims())
+	forged.Header["kid"] = "ed"
+	token, err := forged.SignedString([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verify(ks, token); err == nil {
+		t.Error("HS256 token with the kid of an EdDSA key verified")
+	}
+}
+
+func TestNewKeySetErrors(t *testing.T) {
+	edPriv, edPub, _ := ed25519Files(t)
+
+	if _, err := NewKeySet("pub", mustLoadKey(t, "pub", "EdDSA", edPub)); err == nil {
+		t.Error("verify-only active key accepted")
+	}
+	if _, err := NewKeySet("missing", mustLoadKey(t, "a", "EdDSA", edPriv)); err == nil {
+		t.Error("unknown active key accepted")
+	}
+	if _, err := NewKeySet("a", mustLoadKey(t, "a", "EdDSA", edPriv), mustLoadKey(t, "a", "EdDSA", edPub)); err == nil {
+		t.Error("duplicate kid accepted")
+	}
+}
+
+func TestKeySetJWKS(t *testing.T) {
+	edPriv, _, edPub := ed25519Files(t)
+	_, rsaPub := rsaFiles(t)
+	secretPath := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretPath, []byte("0123456789abcdef0123456789abcdef"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ks, err := NewKeySet("new", mustLoadKey(t, "new", "EdDSA", edPriv), mustLoadKey(t, "old", "RS256", rsaPub), mustLoadKey(t, "hs", "HS256", secretPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := map[string]JWK{}
+	for _, k := range ks.JWKS().Keys {
+		keys[k.Kid] = k
+	}
+
+	if len(keys) != 2 {
+		t.Fatalf("JWKS has %d keys, want the 2 asymmetric ones: %+v", len(keys), keys)
+	}
+	if _, ok := keys["hs"]; ok {
+		t.Error("JWKS publishes the HS256 secret")
+	}
+
+	ed := keys["new"]
+	if ed.Kty != "OKP" || ed.Crv != "Ed25519" || ed.Alg != "EdDSA" || ed.Use != "sig" {
+		t.Errorf("Ed25519 JWK = %+v", ed)
+	}
+	if x, err := base64.RawURLEncoding.DecodeString(ed.X); err != nil || !edPub.Equal(ed25519.PublicKey(x)) {
+		t.Errorf("Ed25519 JWK x does not decode to the public key")
+	}
+
+	rs := keys["old"]
+	if rs.Kty != "RSA" || rs.Alg != "RS256" || rs.N == "" || rs.E != "AQAB" {
+		t.Errorf("RSA JWK = %+v", rs)
+	}
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+/* LoginAttempts is the failure counter kept per account and per client IP */
+type LoginAttempts struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+/* LoginAttemptModel keeps the counters in Postgres so every instance sees the same numbers */
+type LoginAttemptModel struct {
+	DB *sql.DB
+}
+
+func (m *LoginAttemptModel) Get(ctx context.Context, key string, window time.Duration) (LoginAttempts, error) {
+	query := `
+		SELECT failures, last_failure_at
+		FROM login_attempts
+		WHERE key = $1 AND last_failure_at >= NOW() - make_interval(secs => $2)
+	`
+
+	var attempts LoginAttempts
+	err := m.DB.QueryRowContext(ctx, query, key, window.Seconds()).Scan(&attempts.Failures, &attempts.LastFailure)
+
+	if err == sql.ErrNoRows {
+		return LoginAttempts{}, nil
+	}
+
+	if err != nil {
+		return LoginAttempts{}, fmt.Errorf("LoginAttemptModel.Get: %w", err)
+	}
+
+	return attempts, nil
+}
+
+/* Increment starts counting from one again when the last failure is older than window */
+func (m *LoginAttemptModel) Increment(ctx context.Context, key string, window time.Duration) (LoginAttempts, error) {
+	query := `
+		INSERT INTO login_attempts (key, failures, last_failure_at)
+		VALUES ($1, 1, NOW())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE
+				WHEN login_attempts.last_failure_at < NOW() - make_interval(secs => $2) THEN 1
+				ELSE login_attempts.failures + 1
+			END,
+			last_failure_at = NOW()
+		RETURNING failures, last_failure_at
+	`
+
+	var attempts LoginAttempts
+	err := m.DB.QueryRowContext(ctx, query, key, window.Seconds()).Scan(&attempts.Failures, &attempts.LastFailure)
+	if err != nil {
+		return LoginAttempts{}, fmt.Errorf("LoginAttemptModel.Increment: %w", err)
+	}
+
+	return attempts, nil
+}
+
+func (m *LoginAttemptModel) Reset(ctx context.Context, key string) error {
+	if _, err := m.DB.ExecContext(ctx, `DELETE FROM login_attempts WHERE key = $1`, key); err != nil {
+		return fmt.Errorf("LoginAttemptModel.Reset: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrMFANotFound = errors.New("mfa not configured")
+
+type MFA struct {
+	UserID       int64
+	Secret       string
+	EnabledAt    *time.Time
+	LastUsedStep int64
+	CreatedAt    time.Time
+}
+
+type MFAModel struct {
+	DB *sql.DB
+}
+
+/* SavePendingSecret starts (or restarts) an enrollment, it never touches an enabled setup */
+func (m *MFAModel) SavePendingSecret(ctx context.Context, userID int64, secret string) error {
+	query := `
+		INSERT INTO user_mfa (user_id, secret, created_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (user_id) DO UPDATE SET secret = $2, last_used_step = 0, created_at = NOW()
+		WHERE user_mfa.enabled_at IS NULL
+	`
+
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return fmt.Errorf("MFAModel.SavePendingSecret: %w", err)
+	}
+
+	return expectOneRow(result, "MFAModel.SavePendingSecret")
+}
+
+func (m *MFAModel) FindByUserID(ctx context.Context, userID int64) (*MFA, error) {
+	query := `
+		SELECT user_id, secret, enabled_at, last_used_step, created_at
+		FROM user_mfa
+		WHERE user_id = $1
+	`
+
+	var mfa MFA
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&mfa.UserID,
+		&mfa.Secret,
+		&mfa.EnabledAt,
+		&mfa.LastUsedStep,
+		&mfa.CreatedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrMFANotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("MFAModel.FindByUserID: %w", err)
+	}
+
+	return &mfa, nil
+}
+
+/* ConsumeStep records a used time step, returning false if it (or a later one) was already used */
+func (m *MFAModel) ConsumeStep(ctx context.Context, userID int64, step int64) (bool, error) {
+	query := `
+		UPDATE user_mfa
+		SET last_used_step = $2
+		WHERE user_id = $1 AND last_used_step < $2
+	`
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, fmt.Errorf("MFAModel.ConsumeStep: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("MFAModel.ConsumeStep: failed to get rows affected: %w", err)
+	}
+
+	return rowsAffected == 1, nil
+}
+
+/* Enable turns on MFA and replaces any previous recovery codes */
+func (m *MFAModel) Enable(ctx context.Context, userID int64, recoveryCodeHashes []string) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("MFAModel.Enable: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE user_mfa SET enabled_at = NOW() WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("MFAModel.Enable: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("MFAModel.Enable: %w", err)
+	}
+
+	for _, hash := range recoveryCodeHashes {
+		_, err := tx.ExecContext(ctx, `INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hash)
+		if err != nil {
+			return fmt.Errorf("MFAModel.Enable: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+/* UseRecoveryCode burns a recovery code, each one works exactly once */
+func (m *MFAModel) UseRecoveryCode(ctx context.Context, userID int64, codeHash string) (bool, error) {
+	query := `
+		UPDATE mfa_recovery_codes
+		SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`
+
+	result, err := m.DB.ExecContext(ctx, query, userID, codeHash)
+	if err != nil {
+		return false, fmt.Errorf("MFAModel.UseRecoveryCode: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("MFAModel.UseRecoveryCode: failed to get rows affected: %w", err)
+	}
+
+	return rowsAffected > 0, nil
+}
+
+func (m *MFAModel) Disable(ctx context.Context, userID int64) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("MFAModel.Disable: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("MFAModel.Disable: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_mfa WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("MFAModel.Disable: %w", err)
+	}
+
+	return tx.Commit()
+}
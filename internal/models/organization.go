@@ -0,0 +1,426 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+/* roles inside an organization, independent of the global roles in user_roles */
+const (
+	OrgRoleAdmin   = "admin"
+	OrgRoleTeacher = "teacher"
+	OrgRoleStudent = "student"
+)
+
+var (
+	ErrOrganizationNotFound = errors.New("organization not found")
+	ErrDuplicateSlug        = errors.New("organization slug already in use")
+	ErrNotMember            = errors.New("user is not a member of this organization")
+	ErrAlreadyMember        = errors.New("user is already a member of this organization")
+	ErrMemberQuotaExceeded  = errors.New("organization member limit reached")
+	ErrOrganizationNotEmpty = errors.New("organization still has apostilas")
+)
+
+/* Branding is stored as JSONB, the front end themes itself with it */
+type Branding struct {
+	LogoURL        string `json:"logo_url,omitempty"`
+	PrimaryColor   string `json:"primary_color,omitempty"`
+	SecondaryColor string `json:"secondary_color,omitempty"`
+}
+
+/* a nil quota means unlimited */
+type Quotas struct {
+	MaxApostilas *int `json:"max_apostilas"`
+	MaxMembers   *int `json:"max_members"`
+}
+
+type Organization struct {
+	ID             int64     `json:"id"`
+	Slug           string    `json:"slug"`
+	Name           string    `json:"name"`
+	AllowedOrigins []string  `json:"allowed_origins"`
+	Branding       Branding  `json:"branding"`
+	Quotas         Quotas    `json:"quotas"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+/* OrganizationMembership is an organization as seen by one of its members */
+type OrganizationMembership struct {
+	Organization
+	Role string `json:"role"`
+}
+
+type OrganizationMember struct {
+	UserID   int64     `json:"user_id"`
+	Name     string    `json:"name"`
+	Email    string    `json:"email"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+type OrganizationModel struct {
+	DB *sql.DB
+}
+
+const organizationColumns = `o.id, o.slug, o.name, o.allowed_origins, o.branding, o.max_apostilas, o.max_members, o.created_at, o.updated_at`
+
+/* Insert creates the organization with its creator as the first admin */
+func (m *OrganizationModel) Insert(ctx context.Context, slug, name string, creatorID int64) (*Organization, error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("OrganizationModel.Insert: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO organizations AS o (slug, name, created_at, updated_at)
+		VALUES ($1, $2, NOW(), NOW())
+		RETURNING ` + organizationColumns
+
+	org, err := scanOrganization(tx.QueryRowContext(ctx, query, slug, name))
+	if isUniqueViolation(err) {
+		return nil, ErrDuplicateSlug
+	}
+	if err != nil {
+		return nil, fmt.Errorf("OrganizationModel.Insert: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO organization_members (organization_id, user_id, role, created_at)
+		VALUES ($1, $2, $3, NOW())
+	`, org.ID, creatorID, OrgRoleAdmin)
+	if err != nil {
+		return nil, fmt.Errorf("OrganizationModel.Insert: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("OrganizationModel.Insert: %w", err)
+	}
+
+	return org, nil
+}
+
+func (m *OrganizationModel) FindBySlug(ctx context.Context, slug string) (*Organization, error) {
+	query := `SELECT ` + organizationColumns + ` FROM organizations o WHERE o.slug = $1`
+
+	org, err := scanOrganization(m.DB.QueryRowContext(ctx, query, slug))
+	if err == sql.ErrNoRows {
+		return nil, ErrOrganizationNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("OrganizationModel.FindBySlug: %w", err)
+	}
+
+	return org, nil
+}
+
+func (m *OrganizationModel) FindByID(ctx context.Context, id int64) (*Organization, error) {
+	query := `SELECT ` + organizationColumns + ` FROM organizations o WHERE o.id = $1`
+
+	org, err := scanOrganization(m.DB.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrOrganizationNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("OrganizationModel.FindByID: %w", err)
+	}
+
+	return org, nil
+}
+
+func (m *OrganizationModel) ListForUser(ctx context.Context, userID int64) ([]OrganizationMembership, error) {
+	query := `
+		SELECT ` + organizationColumns + `, om.role
+		FROM organizations o
+		JOIN organization_members om ON om.organization_id = o.id
+		WHERE om.user_id = $1
+		ORDER BY o.name
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("OrganizationModel.ListForUser: %w", err)
+	}
+	defer rows.Close()
+
+	memberships := []OrganizationMembership{}
+	for rows.Next() {
+		var membership OrganizationMembership
+		org, err := scanOrganization(rows, &membership.Role)
+		if err != nil {
+			return nil, fmt.Errorf("OrganizationModel.ListForUser: %w", err)
+		}
+		membership.Organization = *org
+		memberships = append(memberships, membership)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("OrganizationModel.ListForUser: %w", err)
+	}
+
+	return memberships, nil
+}
+
+func (m *OrganizationModel) Update(ctx context.Context, org *Organization) error {
+	branding, err := json.Marshal(org.Branding)
+	if err != nil {
+		return fmt.Errorf("OrganizationModel.Update: %w", err)
+	}
+
+	query := `
+		UPDATE organizations
+		SET name = $1, branding = $2, updated_at = NOW()
+		WHERE id = $3
+	`
+
+	result, err := m.DB.ExecContext(ctx, query, org.Name, branding, org.ID)
+	if err != nil {
+		return fmt.Errorf("OrganizationModel.Update: %w", err)
+	}
+
+	return expectOneRow(result, "OrganizationModel.Update")
+}
+
+func (m *OrganizationModel) UpdateAllowedOrigins(ctx context.Context, id int64, origins []string) error {
+	query := `
+		UPDATE organizations
+		SET allowed_origins = $1, updated_at = NOW()
+		WHERE id = $2
+	`
+
+	result, err := m.DB.ExecContext(ctx, query, pq.Array(origins), id)
+	if err != nil {
+		return fmt.Errorf("OrganizationModel.UpdateAllowedOrigins: %w", err)
+	}
+
+	return expectOneRow(result, "OrganizationModel.UpdateAllowedOrigins")
+}
+
+func (m *OrganizationModel) UpdateQuotas(ctx context.Context, id int64, quotas Quotas) error {
+	query := `
+		UPDATE organizations
+		SET max_apostilas = $1, max_members = $2, updated_at = NOW()
+		WHERE id = $3
+	`
+
+	result, err := m.DB.ExecContext(ctx, query, quotas.MaxApostilas, quotas.MaxMembers, id)
+	if err != nil {
+		return fmt.Errorf("OrganizationModel.UpdateQuotas: %w", err)
+	}
+
+	return expectOneRow(result, "OrganizationModel.UpdateQuotas")
+}
+
+/*
+ * Delete removes the organization and its memberships. Apostilas are not deleted with it,
+ * the foreign key restricts the delete, so they have to be deleted or moved out first.
+ */
+func (m *OrganizationModel) Delete(ctx context.Context, id int64) error {
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM organizations WHERE id = $1`, id)
+	if isForeignKeyViolation(err) {
+		return ErrOrganizationNotEmpty
+	}
+	if err != nil {
+		return fmt.Errorf("OrganizationModel.Delete: %w", err)
+	}
+
+	if err := expectOneRow(result, "OrganizationModel.Delete"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOrganizationNotFound
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (m *OrganizationModel) MemberRole(ctx context.Context, orgID, userID int64) (string, error) {
+	query := `SELECT role FROM organization_members WHERE organization_id = $1 AND user_id = $2`
+
+	var role string
+	err := m.DB.QueryRowContext(ctx, query, orgID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrNotMember
+	}
+	if err != nil {
+		return "", fmt.Errorf("OrganizationModel.MemberRole: %w", err)
+	}
+
+	return role, nil
+}
+
+func (m *OrganizationModel) ListMembers(ctx context.Context, orgID int64) ([]OrganizationMember, error) {
+	query := `
+		SELECT u.id, u.name, u.email, om.role, om.created_at
+		FROM organization_members om
+		JOIN users u ON u.id = om.user_id
+		WHERE om.organization_id = $1
+		ORDER BY u.name, u.id
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("OrganizationModel.ListMembers: %w", err)
+	}
+	defer rows.Close()
+
+	members := []OrganizationMember{}
+	for rows.Next() {
+		var member OrganizationMember
+		if err := rows.Scan(&member.UserID, &member.Name, &member.Email, &member.Role, &member.JoinedAt); err != nil {
+			return nil, fmt.Errorf("OrganizationModel.ListMembers: %w", err)
+		}
+		members = append(members, member)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("OrganizationModel.ListMembers: %w", err)
+	}
+
+	return members, nil
+}
+
+/* AddMember checks max_members in the same statement, so parallel invites cannot overshoot it */
+func (m *OrganizationModel) AddMember(ctx context.Context, orgID, userID int64, role string) error {
+	query := `
+		INSERT INTO organization_members (organization_id, user_id, role, created_at)
+		SELECT o.id, $2, $3, NOW()
+		FROM organizations o
+		WHERE o.id = $1 AND (
+			o.max_members IS NULL
+			OR (SELECT COUNT(*) FROM organization_members WHERE organization_id = o.id) < o.max_members
+		)
+	`
+
+	result, err := m.DB.ExecContext(ctx, query, orgID, userID, role)
+	if isUniqueViolation(err) {
+		return ErrAlreadyMember
+	}
+	if isForeignKeyViolation(err) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("OrganizationModel.AddMember: %w", err)
+	}
+
+	if err := expectOneRow(result, "OrganizationModel.AddMember"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrMemberQuotaExceeded
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (m *OrganizationModel) UpdateMemberRole(ctx context.Context, orgID, userID int64, role string) error {
+	query := `UPDATE organization_members SET role = $3 WHERE organization_id = $1 AND user_id = $2`
+
+	result, err := m.DB.ExecContext(ctx, query, orgID, userID, role)
+	if err != nil {
+		return fmt.Errorf("OrganizationModel.UpdateMemberRole: %w", err)
+	}
+
+	if err := expectOneRow(result, "OrganizationModel.UpdateMemberRole"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotMember
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (m *OrganizationModel) RemoveMember(ctx context.Context, orgID, userID int64) error {
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM organization_members WHERE organization_id = $1 AND user_id = $2`, orgID, userID)
+	if err != nil {
+		return fmt.Errorf("OrganizationModel.RemoveMember: %w", err)
+	}
+
+	if err := expectOneRow(result, "OrganizationModel.RemoveMember"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotMember
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (m *OrganizationModel) CountMembersWithRole(ctx context.Context, orgID int64, role string) (int, error) {
+	query := `SELECT COUNT(*) FROM organization_members WHERE organization_id = $1 AND role = $2`
+
+	var n int
+	if err := m.DB.QueryRowContext(ctx, query, orgID, role).Scan(&n); err != nil {
+		return 0, fmt.Errorf("OrganizationModel.CountMembersWithRole: %w", err)
+	}
+
+	return n, nil
+}
+
+/* AllowedOrigins is the union of every organization's CORS origins */
+func (m *OrganizationModel) AllowedOrigins(ctx context.Context) ([]string, error) {
+	query := `SELECT DISTINCT unnest(allowed_origins) FROM organizations`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("OrganizationModel.AllowedOrigins: %w", err)
+	}
+	defer rows.Close()
+
+	origins := []string{}
+	for rows.Next() {
+		var origin string
+		if err := rows.Scan(&origin); err != nil {
+			return nil, fmt.Errorf("OrganizationModel.AllowedOrigins: %w", err)
+		}
+		origins = append(origins, origin)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("OrganizationModel.AllowedOrigins: %w", err)
+	}
+
+	return origins, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+/* scanOrganization reads organizationColumns, followed by any extra columns */
+func scanOrganization(row rowScanner, extra ...any) (*Organization, error) {
+	var (
+		org      Organization
+		branding []byte
+	)
+
+	dest := []any{
+		&org.ID,
+		&org.Slug,
+		&org.Name,
+		pq.Array(&org.AllowedOrigins),
+		&branding,
+		&org.Quotas.MaxApostilas,
+		&org.Quotas.MaxMembers,
+		&org.CreatedAt,
+		&org.UpdatedAt,
+	}
+
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(branding, &org.Branding); err != nil {
+		return nil, err
+	}
+
+	return &org, nil
+}
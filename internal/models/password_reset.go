@@ -0,0 +1,75 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrResetTokenInvalid = errors.New("reset token is invalid or expired")
+
+type PasswordResetModel struct {
+	DB *sql.DB
+}
+
+/*
+ * Insert stores a new token for the email it is mailed to and invalidates any earlier
+ * one still pending for the user
+ */
+func (m *PasswordResetModel) Insert(ctx context.Context, userID int64, email, tokenHash string, expiresAt time.Time) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("PasswordResetModel.Insert: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE password_reset_tokens
+		SET used_at = NOW()
+		WHERE user_id = $1 AND used_at IS NULL
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("PasswordResetModel.Insert: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO password_reset_tokens (user_id, email, token_hash, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+	`, userID, NormalizeEmail(email), tokenHash, expiresAt)
+	if err != nil {
+		return fmt.Errorf("PasswordResetModel.Insert: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+/*
+ * Consume marks the token as used and returns its owner and the email it was mailed to,
+ * so a token works only once. A token sent before the account changed its email is invalid.
+ */
+func (m *PasswordResetModel) Consume(ctx context.Context, tokenHash string) (int64, string, error) {
+	query := `
+		UPDATE password_reset_tokens t
+		SET used_at = NOW()
+		FROM users u
+		WHERE t.token_hash = $1 AND t.used_at IS NULL AND t.expires_at > NOW()
+			AND u.id = t.user_id AND lower(u.email) = t.email
+		RETURNING t.user_id, t.email
+	`
+
+	var userID int64
+	var email string
+	err := m.DB.QueryRowContext(ctx, query, tokenHash).Scan(&userID, &email)
+
+	if err == sql.ErrNoRows {
+		return 0, "", ErrResetTokenInvalid
+	}
+
+	if err != nil {
+		return 0, "", fmt.Errorf("PasswordResetModel.Consume: %w", err)
+	}
+
+	return userID, email, nil
+}
@@ -0,0 +1,212 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+/* the prefix makes leaked tokens easy to spot in logs and by secret scanners */
+const PersonalAccessTokenPrefix = "pds_pat_"
+
+var ErrPersonalAccessTokenNotFound = errors.New("personal access token not found")
+
+type PersonalAccessToken struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"-"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type PersonalAccessTokenModel struct {
+	DB *sql.DB
+}
+
+/* NewPersonalAccessToken returns the raw token, which is shown to the user only once */
+func NewPersonalAccessToken() (string, error) {
+	raw, err := NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	return PersonalAccessTokenPrefix + raw, nil
+}
+
+func IsPersonalAccessToken(raw string) bool {
+	return strings.HasPrefix(raw, PersonalAccessTokenPrefix)
+}
+
+func (m *PersonalAccessTokenModel) Insert(ctx context.Context, userID int64, name, tokenHash string, scopes []string, expiresAt *time.Time) (*PersonalAccessToken, error) {
+	query := `
+		INSERT INTO personal_access_tokens (user_id, name, token_hash, scopes, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, NOW())
+		RETURNING id, user_id, name, scopes, expires_at, last_used_at, created_at
+	`
+
+	var token PersonalAccessToken
+	err := m.DB.QueryRowContext(ctx, query, userID, name, tokenHash, pq.Array(scopes), expiresAt).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Name,
+		pq.Array(&token.Scopes),
+		&token.ExpiresAt,
+		&token.LastUsedAt,
+		&token.CreatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("PersonalAccessTokenModel.Insert: %w", err)
+	}
+
+	return &token, nil
+}
+
+/* ListByUser includes expired tokens so the user can see why a script stopped working */
+func (m *PersonalAccessTokenModel) ListByUser(ctx context.Context, userID int64) ([]PersonalAccessToken, error) {
+	query := `
+		SELECT id, user_id, name, scopes, expires_at, last_used_at, created_at
+		FROM personal_access_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at DESC
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("PersonalAccessTokenModel.ListByUser: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := []PersonalAccessToken{}
+	for rows.Next() {
+		var token PersonalAccessToken
+		err := rows.Scan(
+			&token.ID,
+			&token.UserID,
+			&token.Name,
+			pq.Array(&token.Scopes),
+			&token.ExpiresAt,
+			&token.LastUsedAt,
+			&token.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("PersonalAccessTokenModel.ListByUser: %w", err)
+		}
+		tokens = append(tokens, token)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("PersonalAccessTokenModel.ListByUser: %w", err)
+	}
+
+	return tokens, nil
+}
+
+/* IsActive tells if the token is still usable and its account enabled, without marking it used */
+func (m *PersonalAccessTokenModel) IsActive(ctx context.Context, id int64) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM personal_access_tokens t
+			JOIN users u ON u.id = t.user_id
+			WHERE t.id = $1
+				AND t.revoked_at IS NULL
+				AND (t.expires_at IS NULL OR t.expires_at > NOW())
+				AND u.disabled_at IS NULL
+		)
+	`
+
+	var active bool
+	if err := m.DB.QueryRowContext(ctx, query, id).Scan(&active); err != nil {
+		return false, fmt.Errorf("PersonalAccessTokenModel.IsActive: %w", err)
+	}
+
+	return active, nil
+}
+
+/*
+ * Authenticate looks up a usable token of an enabled account and records its use. last_used_at is only
+ * written once a minute so a busy CI job does not turn every request into a write.
+ */
+func (m *PersonalAccessTokenModel) Authenticate(ctx context.Context, raw string) (*PersonalAccessToken, error) {
+	query := `
+		SELECT t.id, t.user_id, t.name, t.scopes, t.expires_at, t.last_used_at, t.created_at
+		FROM personal_access_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1
+			AND t.revoked_at IS NULL
+			AND (t.expires_at IS NULL OR t.expires_at > NOW())
+			AND u.disabled_at IS NULL
+	`
+
+	var token PersonalAccessToken
+	err := m.DB.QueryRowContext(ctx, query, HashToken(raw)).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Name,
+		pq.Array(&token.Scopes),
+		&token.ExpiresAt,
+		&token.LastUsedAt,
+		&token.CreatedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrPersonalAccessTokenNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("PersonalAccessTokenModel.Authenticate: %w", err)
+	}
+
+	if token.LastUsedAt == nil || time.Since(*token.LastUsedAt) > time.Minute {
+		_, err := m.DB.ExecContext(ctx, `UPDATE personal_access_tokens SET last_used_at = NOW() WHERE id = $1`, token.ID)
+		if err != nil {
+			return nil, fmt.Errorf("PersonalAccessTokenModel.Authenticate: %w", err)
+		}
+	}
+
+	return &token, nil
+}
+
+func (m *PersonalAccessTokenModel) Revoke(ctx context.Context, userID, id int64) error {
+	query := `
+		UPDATE personal_access_tokens
+		SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return fmt.Errorf("PersonalAccessTokenModel.Revoke: %w", err)
+	}
+
+	if err := expectOneRow(result, "PersonalAccessTokenModel.Revoke"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrPersonalAccessTokenNotFound
+		}
+		return err
+	}
+
+	return nil
+}
+
+/* RevokeAllForUser is used when the account may have been compromised, e.g. on password reset */
+func (m *PersonalAccessTokenModel) RevokeAllForUser(ctx context.Context, userID int64) error {
+	query := `
+		UPDATE personal_access_tokens
+		SET revoked_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`
+
+	if _, err := m.DB.ExecContext(ctx, query, userID); err != nil {
+		return fmt.Errorf("PersonalAccessTokenModel.RevokeAllForUser: %w", err)
+	}
+
+	return nil
+}
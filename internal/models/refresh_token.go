@@ -0,0 +1,193 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrRefreshTokenNotFound = errors.New("refresh token not found")
+
+type RefreshToken struct {
+	ID        int64
+	UserID    int64
+	FamilyID  uuid.UUID
+	ExpiresAt time.Time
+	RevokedAt sql.NullTime
+	CreatedAt time.Time
+}
+
+type RefreshTokenModel struct {
+	DB *sql.DB
+}
+
+/* NewOpaqueToken returns a random url-safe token meant to be handed to the client once */
+func NewOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+/* HashToken is used so that opaque tokens are never stored in plain text */
+func HashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *RefreshTokenModel) Insert(ctx context.Context, userID int64, familyID uuid.UUID, tokenHash string, expiresAt time.Time) (*RefreshToken, error) {
+	query := `
+		INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		RETURNING id, user_id, family_id, expires_at, created_at
+	`
+
+	var token RefreshToken
+	err := m.DB.QueryRowContext(ctx, query, userID, familyID, tokenHash, expiresAt).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.FamilyID,
+		&token.ExpiresAt,
+		&token.CreatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("RefreshTokenModel.Insert: %w", err)
+	}
+
+	return &token, nil
+}
+
+func (m *RefreshTokenModel) FindByHash(ctx context.Context, tokenHash string) (*RefreshToken, error) {
+	query := `
+		SELECT id, user_id, family_id, expires_at, revoked_at, created_at
+		FROM refresh_tokens
+		WHERE token_hash = $1
+	`
+
+	var token RefreshToken
+	err := m.DB.QueryRowContext(ctx, query, tokenHash).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.FamilyID,
+		&token.ExpiresAt,
+		&token.RevokedAt,
+		&token.CreatedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrRefreshTokenNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("RefreshTokenModel.FindByHash: %w", err)
+	}
+
+	return &token, nil
+}
+
+/*
+ * Rotate revokes the presented token and issues its successor in the same family.
+ * The update is conditional on revoked_at being NULL so two concurrent refreshes
+ * with the same token cannot both succeed.
+ */
+func (m *RefreshTokenModel) Rotate(ctx context.Context, old *RefreshToken, newHash string, expiresAt time.Time) (*RefreshToken, error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("RefreshTokenModel.Rotate: %w", err)
+	}
+	defer tx.Rollback()
+
+	var next RefreshToken
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		RETURNING id, user_id, family_id, expires_at, created_at
+	`, old.UserID, old.FamilyID, newHash, expiresAt).Scan(
+		&next.ID,
+		&next.UserID,
+		&next.FamilyID,
+		&next.ExpiresAt,
+		&next.CreatedAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("RefreshTokenModel.Rotate: %w", err)
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE refresh_tokens
+		SET revoked_at = NOW(), replaced_by = $1
+		WHERE id = $2 AND revoked_at IS NULL
+	`, next.ID, old.ID)
+	if err != nil {
+		return nil, fmt.Errorf("RefreshTokenModel.Rotate: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("RefreshTokenModel.Rotate: failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return nil, ErrRefreshTokenNotFound
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("RefreshTokenModel.Rotate: %w", err)
+	}
+
+	return &next, nil
+}
+
+func (m *RefreshTokenModel) RevokeFamily(ctx context.Context, familyID uuid.UUID) error {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = NOW()
+		WHERE family_id = $1 AND revoked_at IS NULL
+	`
+
+	if _, err := m.DB.ExecContext(ctx, query, familyID); err != nil {
+		return fmt.Errorf("RefreshTokenModel.RevokeFamily: %w", err)
+	}
+
+	return nil
+}
+
+/* RevokeAllForUser ends every session of the user, e.g. after a password change */
+func (m *RefreshTokenModel) RevokeAllForUser(ctx context.Context, userID int64) error {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`
+
+	if _, err := m.DB.ExecContext(ctx, query, userID); err != nil {
+		return fmt.Errorf("RefreshTokenModel.RevokeAllForUser: %w", err)
+	}
+
+	return nil
+}
+
+/* RevokeAllForUserExcept keeps the caller's own session alive */
+func (m *RefreshTokenModel) RevokeAllForUserExcept(ctx context.Context, userID int64, familyID uuid.UUID) error {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = NOW()
+		WHERE user_id = $1 AND family_id <> $2 AND revoked_at IS NULL
+	`
+
+	if _, err := m.DB.ExecContext(ctx, query, userID, familyID); err != nil {
+		return fmt.Errorf("RefreshTokenModel.RevokeAllForUserExcept: %w", err)
+	}
+
+	return nil
+}
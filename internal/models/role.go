@@ -0,0 +1,224 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+/* DefaultRole is granted to every new account, admins can change it afterwards */
+const DefaultRole = "teacher"
+
+var (
+	ErrRoleNotFound   = errors.New("role not found")
+	ErrLastRoleHolder = errors.New("user is the last one with the role")
+)
+
+type Role struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+type UserRole struct {
+	Name      string    `json:"name"`
+	GrantedAt time.Time `json:"granted_at"`
+}
+
+type RoleModel struct {
+	DB *sql.DB
+}
+
+func (m *RoleModel) List(ctx context.Context) ([]Role, error) {
+	query := `
+		SELECT r.name, COALESCE(array_agg(p.name ORDER BY p.name) FILTER (WHERE p.name IS NOT NULL), '{}')
+		FROM roles r
+		LEFT JOIN role_permissions rp ON rp.role_id = r.id
+		LEFT JOIN permissions p ON p.id = rp.permission_id
+		GROUP BY r.name
+		ORDER BY r.name
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("RoleModel.List: %w", err)
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.Name, pq.Array(&role.Permissions)); err != nil {
+			return nil, fmt.Errorf("RoleModel.List: %w", err)
+		}
+		roles = append(roles, role)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("RoleModel.List: %w", err)
+	}
+
+	return roles, nil
+}
+
+func (m *RoleModel) ListForUser(ctx context.Context, userID int64) ([]UserRole, error) {
+	query := `
+		SELECT r.name, ur.created_at
+		FROM user_roles ur
+		JOIN roles r ON r.id = ur.role_id
+		WHERE ur.user_id = $1
+		ORDER BY r.name
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("RoleModel.ListForUser: %w", err)
+	}
+	defer rows.Close()
+
+	roles := []UserRole{}
+	for rows.Next() {
+		var role UserRole
+		if err := rows.Scan(&role.Name, &role.GrantedAt); err != nil {
+			return nil, fmt.Errorf("RoleModel.ListForUser: %w", err)
+		}
+		roles = append(roles, role)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("RoleModel.ListForUser: %w", err)
+	}
+
+	return roles, nil
+}
+
+func (m *RoleModel) HasPermission(ctx context.Context, userID int64, permission string) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM user_roles ur
+			JOIN role_permissions rp ON rp.role_id = ur.role_id
+			JOIN permissions p ON p.id = rp.permission_id
+			WHERE ur.user_id = $1 AND p.name = $2
+		)
+	`
+
+	var ok bool
+	if err := m.DB.QueryRowContext(ctx, query, userID, permission).Scan(&ok); err != nil {
+		return false, fmt.Errorf("RoleModel.HasPermission: %w", err)
+	}
+
+	return ok, nil
+}
+
+/* Grant is idempotent, granting a role the user already has is not an error */
+func (m *RoleModel) Grant(ctx context.Context, userID int64, role string) error {
+	var roleID int64
+	err := m.DB.QueryRowContext(ctx, `SELECT id FROM roles WHERE name = $1`, role).Scan(&roleID)
+	if err == sql.ErrNoRows {
+		return ErrRoleNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("RoleModel.Grant: %w", err)
+	}
+
+	_, err = m.DB.ExecContext(ctx, `
+		INSERT INTO user_roles (user_id, role_id, created_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT DO NOTHING
+	`, userID, roleID)
+	if isForeignKeyViolation(err) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("RoleModel.Grant: %w", err)
+	}
+
+	return nil
+}
+
+func (m *RoleModel) Revoke(ctx context.Context, userID int64, role string) error {
+	query := `
+		DELETE FROM user_roles
+		WHERE user_id = $1 AND role_id = (SELECT id FROM roles WHERE name = $2)
+	`
+
+	if _, err := m.DB.ExecContext(ctx, query, userID, role); err != nil {
+		return fmt.Errorf("RoleModel.Revoke: %w", err)
+	}
+
+	return nil
+}
+
+/*
+ * RevokeUnlessLast is Revoke for the admin role, it refuses to remove the last holder.
+ * The holders are locked before counting, so two concurrent revokes cannot each see
+ * the other admin and leave none: the second one waits and counts again.
+ */
+func (m *RoleModel) RevokeUnlessLast(ctx context.Context, userID int64, role string) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("RoleModel.RevokeUnlessLast: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := requireOtherHolder(ctx, tx, userID, role); err != nil {
+		return fmt.Errorf("RoleModel.RevokeUnlessLast: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM user_roles
+		WHERE user_id = $1 AND role_id = (SELECT id FROM roles WHERE name = $2)
+	`, userID, role)
+	if err != nil {
+		return fmt.Errorf("RoleModel.RevokeUnlessLast: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+/*
+ * requireOtherHolder locks the enabled holders of the role until tx ends and fails with
+ * ErrLastRoleHolder when userID is the only one. A disabled holder cannot act, so it
+ * does not count, and taking one away never leaves the role without a holder.
+ */
+func requireOtherHolder(ctx context.Context, tx *sql.Tx, userID int64, role string) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT ur.user_id
+		FROM user_roles ur
+		JOIN roles r ON r.id = ur.role_id
+		JOIN users u ON u.id = ur.user_id
+		WHERE r.name = $1 AND u.disabled_at IS NULL
+		FOR UPDATE OF ur, u
+	`, role)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var holders []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		holders = append(holders, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(holders) == 1 && holders[0] == userID {
+		return ErrLastRoleHolder
+	}
+
+	return nil
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
@@ -0,0 +1,212 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+/*
+ * A session is one login on one device. Its id is the refresh token family id, and
+ * it stays active while that family has a usable refresh token, so logout, password
+ * changes and refresh token reuse end it without touching this table.
+ */
+type Session struct {
+	ID         uuid.UUID `json:"id"`
+	UserID     int64     `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Current    bool      `json:"current"`
+}
+
+type SessionModel struct {
+	DB *sql.DB
+}
+
+const activeSession = `
+	s.revoked_at IS NULL AND EXISTS (
+		SELECT 1 FROM refresh_tokens rt
+		WHERE rt.family_id = s.id AND rt.revoked_at IS NULL AND rt.expires_at > NOW()
+	)
+`
+
+func (m *SessionModel) Insert(ctx context.Context, id uuid.UUID, userID int64, userAgent, ip string) error {
+	query := `
+		INSERT INTO sessions (id, user_id, user_agent, ip, created_at, last_seen_at)
+		VALUES ($1, $2, $3, $4, NOW(), NOW())
+	`
+
+	if _, err := m.DB.ExecContext(ctx, query, id, userID, userAgent, ip); err != nil {
+		return fmt.Errorf("SessionModel.Insert: %w", err)
+	}
+
+	return nil
+}
+
+func (m *SessionModel) ListActive(ctx context.Context, userID int64) ([]Session, error) {
+	query := `
+		SELECT s.id, s.user_id, COALESCE(s.user_agent, ''), COALESCE(s.ip, ''), s.created_at, s.last_seen_at
+		FROM sessions s
+		WHERE s.user_id = $1 AND ` + activeSession + `
+		ORDER BY s.last_seen_at DESC
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("SessionModel.ListActive: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.UserAgent,
+			&session.IP,
+			&session.CreatedAt,
+			&session.LastSeenAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("SessionModel.ListActive: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SessionModel.ListActive: %w", err)
+	}
+
+	return sessions, nil
+}
+
+/*
+ * Authenticate runs on every request made with an access token, which is what makes
+ * revocation and disabling an account immediate. last_seen_at is written at most
+ * once a minute per session.
+ */
+func (m *SessionModel) Authenticate(ctx context.Context, id uuid.UUID, ip string) error {
+	query := `
+		SELECT s.last_seen_at
+		FROM sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.id = $1 AND u.disabled_at IS NULL AND ` + activeSession
+
+	var lastSeenAt time.Time
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&lastSeenAt)
+	if err == sql.ErrNoRows {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("SessionModel.Authenticate: %w", err)
+	}
+
+	if time.Since(lastSeenAt) > time.Minute {
+		_, err := m.DB.ExecContext(ctx, `UPDATE sessions SET last_seen_at = NOW(), ip = $2 WHERE id = $1`, id, ip)
+		if err != nil {
+			return fmt.Errorf("SessionModel.Authenticate: %w", err)
+		}
+	}
+
+	return nil
+}
+
+/* IsActive is Authenticate without touching last_seen_at, for connections that outlive their request */
+func (m *SessionModel) IsActive(ctx context.Context, id uuid.UUID) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM sessions s
+			JOIN users u ON u.id = s.user_id
+			WHERE s.id = $1 AND u.disabled_at IS NULL AND ` + activeSession + `
+		)
+	`
+
+	var active bool
+	if err := m.DB.QueryRowContext(ctx, query, id).Scan(&active); err != nil {
+		return false, fmt.Errorf("SessionModel.IsActive: %w", err)
+	}
+
+	return active, nil
+}
+
+/* Revoke ends the session and its refresh token family together */
+func (m *SessionModel) Revoke(ctx context.Context, userID int64, id uuid.UUID) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("SessionModel.Revoke: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE sessions s
+		SET revoked_at = NOW()
+		WHERE s.id = $1 AND s.user_id = $2 AND `+activeSession, id, userID)
+	if err != nil {
+		return fmt.Errorf("SessionModel.Revoke: %w", err)
+	}
+
+	if err := expectOneRow(result, "SessionModel.Revoke"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrSessionNotFound
+		}
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE refresh_tokens
+		SET revoked_at = NOW()
+		WHERE family_id = $1 AND revoked_at IS NULL
+	`, id)
+	if err != nil {
+		return fmt.Errorf("SessionModel.Revoke: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("SessionModel.Revoke: %w", err)
+	}
+
+	return nil
+}
+
+/* RevokeAllExcept signs the user out everywhere but the session making the request */
+func (m *SessionModel) RevokeAllExcept(ctx context.Context, userID int64, currentID uuid.UUID) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("SessionModel.RevokeAllExcept: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE sessions
+		SET revoked_at = NOW()
+		WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL
+	`, userID, currentID)
+	if err != nil {
+		return fmt.Errorf("SessionModel.RevokeAllExcept: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE refresh_tokens
+		SET revoked_at = NOW()
+		WHERE user_id = $1 AND family_id <> $2 AND revoked_at IS NULL
+	`, userID, currentID)
+	if err != nil {
+		return fmt.Errorf("SessionModel.RevokeAllExcept: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("SessionModel.RevokeAllExcept: %w", err)
+	}
+
+	return nil
+}
@@ -1,40 +1,95 @@
 package models
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
-// TODO: move to env variable
-var jwtKey = []byte("verysecretkey")
+/* every token carries an audience so that one kind can never be replayed as another */
+const (
+	accessTokenAudience       = "api"
+	emailVerificationAudience = "email-verification"
+	mfaPendingAudience        = "mfa-pending"
+)
+
+var ErrTokenRevoked = errors.New("token has been revoked")
 
+/*
+ * Roles reflect the user's roles when the token was issued. They let clients adapt
+ * the UI, authorization decisions read the current roles from the database.
+ */
 type Claims struct {
+	UserID    int64    `json:"user_id"`
+	SessionID string   `json:"sid,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	jwt.RegisteredClaims
+
+	/* only set when the request was authenticated with a personal access token */
+	PersonalAccessTokenID int64    `json:"-"`
+	Scopes                []string `json:"-"`
+}
+
+func (c *Claims) IsPersonalAccessToken() bool {
+	return c.PersonalAccessTokenID != 0
+}
+
+/* HasScope is always true for a login session, which is not limited by scopes */
+func (c *Claims) HasScope(scope string) bool {
+	if !c.IsPersonalAccessToken() {
+		return true
+	}
+
+	return slices.Contains(c.Scopes, scope)
+}
+
+type EmailVerificationClaims struct {
+	UserID int64  `json:"user_id"`
+	Email  string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+/* MFAPendingClaims proves the password step of a login, it cannot access the API */
+type MFAPendingClaims struct {
 	UserID int64 `json:"user_id"`
 	jwt.RegisteredClaims
 }
 
 type JWTModel struct {
+	DB   *sql.DB
+	Keys *KeySet
 }
 
 type Token struct {
-	AccessToken string    `json:"access_token"`
-	ExpiresAt   time.Time `json:"expires_at"`
-	IssuedAt    time.Time `json:"issued_at"`
+	AccessToken      string    `json:"access_token,omitempty"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	IssuedAt         time.Time `json:"issued_at"`
+	RefreshToken     string    `json:"refresh_token,omitempty"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
 }
 
-func (m *JWTModel) GenerateJWT(userID int64, duration time.Duration) (*Token, error) {
+/* sessionID ties the access token to the refresh token family it was issued with */
+func (m *JWTModel) GenerateJWT(userID int64, sessionID uuid.UUID, roles []string, duration time.Duration) (*Token, error) {
+	now := time.Now()
 	claims := &Claims{
-		UserID: userID,
+		UserID:    userID,
+		SessionID: sessionID.String(),
+		Roles:     roles,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ID:        uuid.NewString(),
+			Audience:  jwt.ClaimStrings{accessTokenAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(duration)),
+			IssuedAt:  jwt.NewNumericDate(now),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenStr, err := token.SignedString(jwtKey)
+	tokenStr, err := m.Keys.Sign(claims)
 	if err != nil {
 		return nil, err
 	}
@@ -46,12 +101,11 @@ func (m *JWTModel) GenerateJWT(userID int64, duration time.Duration) (*Token, er
 	}, nil
 }
 
-func (m *JWTModel) ParseJWT(tokenStr string) (*Claims, error) {
+func (m *JWTModel) ParseJWT(ctx context.Context, tokenStr string) (*Claims, error) {
 	claims := &Claims{}
 
-	token, err := jwt.ParseWithClaims(tokenStr, claims, func(t *jwt.Token) (any, error) {
-		return jwtKey, nil
-	}, jwt.WithLeeway(5*time.Second))
+	token, err := jwt.ParseWithClaims(tokenStr, claims, m.Keys.Keyfunc,
+		jwt.WithLeeway(5*time.Second), jwt.WithValidMethods(m.Keys.Algorithms()), jwt.WithAudience(accessTokenAudience))
 	if err != nil {
 		return nil, fmt.Errorf("could not parse token: %w", err)
 	}
@@ -60,5 +114,120 @@ func (m *JWTModel) ParseJWT(tokenStr string) (*Claims, error) {
 		return nil, fmt.Errorf("invalid token")
 	}
 
+	revoked, err := m.isRevoked(ctx, claims.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+
 	return claims, nil
 }
+
+/* the email is part of the token so that changing the address invalidates older links */
+func (m *JWTModel) GenerateEmailVerificationToken(userID int64, email string, duration time.Duration) (string, error) {
+	now := time.Now()
+	claims := &EmailVerificationClaims{
+		UserID: userID,
+		Email:  email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{emailVerificationAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(duration)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+
+	return m.Keys.Sign(claims)
+}
+
+func (m *JWTModel) ParseEmailVerificationToken(tokenStr string) (*EmailVerificationClaims, error) {
+	claims := &EmailVerificationClaims{}
+
+	token, err := jwt.ParseWithClaims(tokenStr, claims, m.Keys.Keyfunc,
+		jwt.WithValidMethods(m.Keys.Algorithms()), jwt.WithAudience(emailVerificationAudience))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse token: %w", err)
+	}
+
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	return claims, nil
+}
+
+func (m *JWTModel) GenerateMFAPendingToken(userID int64, duration time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	claims := &MFAPendingClaims{
+		UserID: userID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Audience:  jwt.ClaimStrings{mfaPendingAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(duration)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+
+	tokenStr, err := m.Keys.Sign(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return tokenStr, claims.ExpiresAt.Time, nil
+}
+
+func (m *JWTModel) ParseMFAPendingToken(tokenStr string) (*MFAPendingClaims, error) {
+	claims := &MFAPendingClaims{}
+
+	token, err := jwt.ParseWithClaims(tokenStr, claims, m.Keys.Keyfunc,
+		jwt.WithValidMethods(m.Keys.Algorithms()), jwt.WithAudience(mfaPendingAudience))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse token: %w", err)
+	}
+
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	return claims, nil
+}
+
+/* Revoke denylists the token's jti until it would have expired anyway */
+func (m *JWTModel) Revoke(ctx context.Context, claims *Claims) error {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+
+	/* expired entries are useless once the token itself is expired, so prune them here */
+	if _, err := m.DB.ExecContext(ctx, `DELETE FROM revoked_access_tokens WHERE expires_at < NOW()`); err != nil {
+		return fmt.Errorf("JWTModel.Revoke: %w", err)
+	}
+
+	query := `
+		INSERT INTO revoked_access_tokens (jti, expires_at)
+		VALUES ($1, $2)
+		ON CONFLICT (jti) DO NOTHING
+	`
+
+	if _, err := m.DB.ExecContext(ctx, query, claims.ID, claims.ExpiresAt.Time); err != nil {
+		return fmt.Errorf("JWTModel.Revoke: %w", err)
+	}
+
+	return nil
+}
+
+func (m *JWTModel) isRevoked(ctx context.Context, jti string) (bool, error) {
+	if jti == "" {
+		return false, nil
+	}
+
+	var exists bool
+	err := m.DB.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM revoked_access_tokens WHERE jti = $1)`, jti).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("JWTModel.isRevoked: %w", err)
+	}
+
+	return exists, nil
+}
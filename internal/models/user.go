@@ -4,37 +4,116 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrDuplicateEmail = errors.New("email already in use")
+	ErrUserNotFound   = errors.New("user not found")
 )
 
+/* Password is empty for accounts that only sign in through an OIDC provider */
 type User struct {
-	ID        int64     `json:"id"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  string    `json:"-"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID              int64      `json:"id"`
+	Name            string     `json:"name"`
+	Email           string     `json:"email"`
+	Password        string     `json:"-"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	DisabledAt      *time.Time `json:"disabled_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+/* UserSummary is a row of the admin user list */
+type UserSummary struct {
+	User
+	Roles         []string `json:"roles"`
+	ApostilaCount int      `json:"apostila_count"`
+}
+
+/* Query matches name or email; zero values are not filtered on and BeforeID pages backwards */
+type UserFilter struct {
+	Query    string
+	Disabled *bool
+	BeforeID int64
+	Limit    int
 }
 
 type UserModel struct {
 	DB *sql.DB
 }
 
+/*
+ * NormalizeEmail is how emails are stored and looked up: addresses differing only in
+ * case are the same account, which the unique index on lower(email) enforces.
+ */
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+/* Insert also grants DefaultRole in the same statement, so no account is left without a role */
 func (m *UserModel) Insert(ctx context.Context, name, email, hashedPassword string) (*User, error) {
 	query := `
-		INSERT INTO users (name, email, password, created_at, updated_at)
-		VALUES ($1, $2, $3, NOW(), NOW())
-		RETURNING id, name, email, created_at, updated_at
+		WITH u AS (
+			INSERT INTO users (name, email, password, created_at, updated_at)
+			VALUES ($1, $2, $3, NOW(), NOW())
+			RETURNING id, name, email, email_verified_at, created_at, updated_at
+		), r AS (
+			INSERT INTO user_roles (user_id, role_id)
+			SELECT u.id, roles.id FROM u, roles WHERE roles.name = $4
+		)
+		SELECT id, name, email, email_verified_at, created_at, updated_at FROM u
 	`
 
 	var user User
-	err := m.DB.QueryRowContext(ctx, query, name, email, hashedPassword).Scan(
+	err := m.DB.QueryRowContext(ctx, query, name, NormalizeEmail(email), hashedPassword, DefaultRole).Scan(
 		&user.ID,
 		&user.Name,
 		&user.Email,
+		&user.EmailVerifiedAt,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
+	if isUniqueViolation(err) {
+		return nil, ErrDuplicateEmail
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+/* InsertWithoutPassword creates an SSO-only account, the provider already verified the email */
+func (m *UserModel) InsertWithoutPassword(ctx context.Context, name, email string) (*User, error) {
+	query := `
+		WITH u AS (
+			INSERT INTO users (name, email, password, email_verified_at, created_at, updated_at)
+			VALUES ($1, $2, NULL, NOW(), NOW(), NOW())
+			RETURNING id, name, email, email_verified_at, created_at, updated_at
+		), r AS (
+			INSERT INTO user_roles (user_id, role_id)
+			SELECT u.id, roles.id FROM u, roles WHERE roles.name = $3
+		)
+		SELECT id, name, email, email_verified_at, created_at, updated_at FROM u
+	`
+
+	var user User
+	err := m.DB.QueryRowContext(ctx, query, name, NormalizeEmail(email), DefaultRole).Scan(
+		&user.ID,
+		&user.Name,
+		&user.Email,
+		&user.EmailVerifiedAt,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	)
+	if isUniqueViolation(err) {
+		return nil, ErrDuplicateEmail
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -44,23 +123,25 @@ func (m *UserModel) Insert(ctx context.Context, name, email, hashedPassword stri
 
 func (m *UserModel) FindByEmail(ctx context.Context, email string) (*User, error) {
 	query := `
-		SELECT id, name, email, password, created_at, updated_at
+		SELECT id, name, email, COALESCE(password, ''), email_verified_at, disabled_at, created_at, updated_at
 		FROM users
-		WHERE email = $1
+		WHERE lower(email) = $1
 	`
 
 	var user User
-	err := m.DB.QueryRowContext(ctx, query, email).Scan(
+	err := m.DB.QueryRowContext(ctx, query, NormalizeEmail(email)).Scan(
 		&user.ID,
 		&user.Name,
 		&user.Email,
 		&user.Password,
+		&user.EmailVerifiedAt,
+		&user.DisabledAt,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
 
 	if err == sql.ErrNoRows {
-		return nil, errors.New("user not found")
+		return nil, ErrUserNotFound
 	}
 
 	if err != nil {
@@ -72,7 +153,7 @@ func (m *UserModel) FindByEmail(ctx context.Context, email string) (*User, error
 
 func (m *UserModel) FindByID(ctx context.Context, id int64) (*User, error) {
 	query := `
-		SELECT id, name, email, password, created_at, updated_at
+		SELECT id, name, email, COALESCE(password, ''), email_verified_at, disabled_at, created_at, updated_at
 		FROM users
 		WHERE id = $1
 	`
@@ -83,12 +164,14 @@ func (m *UserModel) FindByID(ctx context.Context, id int64) (*User, error) {
 		&user.Name,
 		&user.Email,
 		&user.Password,
+		&user.EmailVerifiedAt,
+		&user.DisabledAt,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
 
 	if err == sql.ErrNoRows {
-		return nil, errors.New("user not found")
+		return nil, ErrUserNotFound
 	}
 
 	if err != nil {
@@ -97,3 +180,348 @@ func (m *UserModel) FindByID(ctx context.Context, id int64) (*User, error) {
 
 	return &user, nil
 }
+
+func (m *UserModel) UpdatePassword(ctx context.Context, id int64, hashedPassword string) error {
+	query := `
+		UPDATE users
+		SET password = $1, updated_at = NOW()
+		WHERE id = $2
+	`
+
+	result, err := m.DB.ExecContext(ctx, query, hashedPassword, id)
+	if err != nil {
+		return fmt.Errorf("UserModel.UpdatePassword: %w", err)
+	}
+
+	return expectOneRow(result, "UserModel.UpdatePassword")
+}
+
+/*
+ * ResetPassword is UpdatePassword for a reset link: following the link proves control
+ * of the mailbox, so the email is marked verified in the same statement. It only
+ * succeeds while the address is still the one the link was sent to.
+ */
+func (m *UserModel) ResetPassword(ctx context.Context, id int64, email, hashedPassword string) error {
+	query := `
+		UPDATE users
+		SET password = $1, email_verified_at = COALESCE(email_verified_at, NOW()), updated_at = NOW()
+		WHERE id = $2 AND lower(email) = $3
+	`
+
+	result, err := m.DB.ExecContext(ctx, query, hashedPassword, id, NormalizeEmail(email))
+	if err != nil {
+		return fmt.Errorf("UserModel.ResetPassword: %w", err)
+	}
+
+	if err := expectOneRow(result, "UserModel.ResetPassword"); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrResetTokenInvalid
+		}
+		return err
+	}
+
+	return nil
+}
+
+/* MarkEmailVerified only succeeds while the address is still the one the link was sent to */
+func (m *UserModel) MarkEmailVerified(ctx context.Context, id int64, email string) error {
+	query := `
+		UPDATE users
+		SET email_verified_at = COALESCE(email_verified_at, NOW()), updated_at = NOW()
+		WHERE id = $1 AND lower(email) = $2
+	`
+
+	result, err := m.DB.ExecContext(ctx, query, id, NormalizeEmail(email))
+	if err != nil {
+		return fmt.Errorf("UserModel.MarkEmailVerified: %w", err)
+	}
+
+	return expectOneRow(result, "UserModel.MarkEmailVerified")
+}
+
+/*
+ * ClaimVerificationSend records that a verification email is about to be sent.
+ * It returns false when the previous one went out less than cooldown ago, the
+ * check and the update being a single statement so parallel requests cannot race.
+ */
+func (m *UserModel) ClaimVerificationSend(ctx context.Context, id int64, cooldown time.Duration) (bool, error) {
+	query := `
+		UPDATE users
+		SET verification_sent_at = NOW()
+		WHERE id = $1
+		AND (verification_sent_at IS NULL OR verification_sent_at < NOW() - make_interval(secs => $2))
+	`
+
+	result, err := m.DB.ExecContext(ctx, query, id, cooldown.Seconds())
+	if err != nil {
+		return false, fmt.Errorf("UserModel.ClaimVerificationSend: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("UserModel.ClaimVerificationSend: failed to get rows affected: %w", err)
+	}
+
+	return rowsAffected == 1, nil
+}
+
+/*
+ * ClaimPasswordResetSend is ClaimVerificationSend for reset links: it returns false
+ * when the last one went out less than cooldown ago, and then nothing should be sent.
+ */
+func (m *UserModel) ClaimPasswordResetSend(ctx context.Context, id int64, cooldown time.Duration) (bool, error) {
+	query := `
+		UPDATE users
+		SET password_reset_sent_at = NOW()
+		WHERE id = $1
+		AND (password_reset_sent_at IS NULL OR password_reset_sent_at < NOW() - make_interval(secs => $2))
+	`
+
+	result, err := m.DB.ExecContext(ctx, query, id, cooldown.Seconds())
+	if err != nil {
+		return false, fmt.Errorf("UserModel.ClaimPasswordResetSend: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("UserModel.ClaimPasswordResetSend: failed to get rows affected: %w", err)
+	}
+
+	return rowsAffected == 1, nil
+}
+
+/*
+ * UpdateProfile sets name and email in one statement, so a taken email changes nothing.
+ * A new email clears the verification state, the address has to be verified again, and
+ * deletes the reset links mailed to the old one in the same transaction. Verification
+ * links carry the address they were sent to and stop working on their own.
+ */
+func (m *UserModel) UpdateProfile(ctx context.Context, id int64, name, email string) error {
+	email = NormalizeEmail(email)
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("UserModel.UpdateProfile: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users
+		SET name = $2,
+			email = $3,
+			email_verified_at = CASE WHEN email = $3 THEN email_verified_at END,
+			verification_sent_at = CASE WHEN email = $3 THEN verification_sent_at END,
+			updated_at = NOW()
+		WHERE id = $1
+	`
+
+	result, err := tx.ExecContext(ctx, query, id, name, email)
+	if isUniqueViolation(err) {
+		return ErrDuplicateEmail
+	}
+	if err != nil {
+		return fmt.Errorf("UserModel.UpdateProfile: %w", err)
+	}
+
+	if err := expectOneRow(result, "UserModel.UpdateProfile"); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM password_reset_tokens
+		WHERE user_id = $1 AND used_at IS NULL AND email IS DISTINCT FROM $2
+	`, id, email)
+	if err != nil {
+		return fmt.Errorf("UserModel.UpdateProfile: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func (m *UserModel) ClearPassword(ctx context.Context, id int64) error {
+	result, err := m.DB.ExecContext(ctx, `UPDATE users SET password = NULL, updated_at = NOW() WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("UserModel.ClearPassword: %w", err)
+	}
+
+	return expectOneRow(result, "UserModel.ClearPassword")
+}
+
+/* List returns the newest accounts first, with their roles and how many apostilas they own */
+func (m *UserModel) List(ctx context.Context, filter UserFilter) ([]UserSummary, error) {
+	var (
+		where []string
+		args  []any
+	)
+
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+
+	if filter.Query != "" {
+		add("(u.name ILIKE $%[1]d OR u.email ILIKE $%[1]d)", "%"+escapeLike(filter.Query)+"%")
+	}
+	if filter.Disabled != nil {
+		add("(u.disabled_at IS NOT NULL) = $%d", *filter.Disabled)
+	}
+	if filter.BeforeID > 0 {
+		add("u.id < $%d", filter.BeforeID)
+	}
+
+	query := `
+		SELECT u.id, u.name, u.email, u.email_verified_at, u.disabled_at, u.created_at, u.updated_at,
+			COALESCE((
+				SELECT array_agg(r.name ORDER BY r.name)
+				FROM user_roles ur
+				JOIN roles r ON r.id = ur.role_id
+				WHERE ur.user_id = u.id
+			), '{}'),
+			(SELECT COUNT(*) FROM apostilas a WHERE a.user_id = u.id)
+		FROM users u
+	`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY u.id DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("UserModel.List: %w", err)
+	}
+	defer rows.Close()
+
+	users := []UserSummary{}
+	for rows.Next() {
+		var user UserSummary
+		err := rows.Scan(
+			&user.ID,
+			&user.Name,
+			&user.Email,
+			&user.EmailVerifiedAt,
+			&user.DisabledAt,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			pq.Array(&user.Roles),
+			&user.ApostilaCount,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("UserModel.List: %w", err)
+		}
+		users = append(users, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("UserModel.List: %w", err)
+	}
+
+	return users, nil
+}
+
+/* SetDisabled is idempotent, disabling an already disabled account keeps the original date */
+func (m *UserModel) SetDisabled(ctx context.Context, id int64, disabled bool) error {
+	query := `
+		UPDATE users
+		SET disabled_at = CASE WHEN $2 THEN COALESCE(disabled_at, NOW()) END, updated_at = NOW()
+		WHERE id = $1
+	`
+
+	result, err := m.DB.ExecContext(ctx, query, id, disabled)
+	if err != nil {
+		return fmt.Errorf("UserModel.SetDisabled: %w", err)
+	}
+
+	return expectOneRow(result, "UserModel.SetDisabled")
+}
+
+/*
+ * DisableUnlessLast is SetDisabled for an account that may hold role, it refuses to
+ * disable the last enabled holder, locking the holders like RoleModel.RevokeUnlessLast.
+ */
+func (m *UserModel) DisableUnlessLast(ctx context.Context, id int64, role string) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("UserModel.DisableUnlessLast: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := requireOtherHolder(ctx, tx, id, role); err != nil {
+		return fmt.Errorf("UserModel.DisableUnlessLast: %w", err)
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE users
+		SET disabled_at = COALESCE(disabled_at, NOW()), updated_at = NOW()
+		WHERE id = $1
+	`, id)
+	if err != nil {
+		return fmt.Errorf("UserModel.DisableUnlessLast: %w", err)
+	}
+
+	if err := expectOneRow(result, "UserModel.DisableUnlessLast"); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+/*
+ * EraseUnlessLast deletes the account and strips it from the audit log in one
+ * transaction, so the log is never anonymised for an account that stays. The log
+ * loses its id as actor or target, the IPs it acted from and the emails and user ids
+ * in metadata; only audit_events_anonymise may do that. Like DisableUnlessLast it
+ * refuses to remove the last enabled holder of role.
+ */
+func (m *UserModel) EraseUnlessLast(ctx context.Context, id int64, email, role string) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("UserModel.EraseUnlessLast: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := requireOtherHolder(ctx, tx, id, role); err != nil {
+		return fmt.Errorf("UserModel.EraseUnlessLast: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `SELECT audit_events_anonymise($1, $2)`, id, email); err != nil {
+		return fmt.Errorf("UserModel.EraseUnlessLast: %w", err)
+	}
+
+	/* apostilas and tokens go with the user through ON DELETE CASCADE */
+	result, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("UserModel.EraseUnlessLast: %w", err)
+	}
+
+	if err := expectOneRow(result, "UserModel.EraseUnlessLast"); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func expectOneRow(result sql.Result, op string) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: failed to get rows affected: %w", op, err)
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+/* escapeLike makes % and _ in user input match literally in an ILIKE pattern */
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
@@ -0,0 +1,144 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+/* stubIDP serves discovery and JWKS for one Ed25519 key and answers the token endpoint with idToken */
+type stubIDP struct {
+	server  *httptest.Server
+	priv    ed25519.PrivateKey
+	idToken string
+}
+
+func newStubIDP(t *testing.T) *stubIDP {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &stubIDP{priv: priv}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 s.server.URL,
+			"authorization_endpoint": s.server.URL + "/authorize",
+			"token_endpoint":         s.server.URL + "/token",
+			"jwks_uri":               s.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "OKP",
+				"crv": "Ed25519",
+				"kid": "stub",
+				"x":   base64.RawURLEncoding.EncodeToString(pub),
+			}},
+		})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"id_token": s.idToken})
+	})
+
+	s.server = httptest.NewServer(mux)
+	t.Cleanup(s.server.Close)
+
+	return s
+}
+
+func (s *stubIDP) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = "stub"
+
+	raw, err := token.SignedString(s.priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return raw
+}
+
+func TestProviderExchange(t *testing.T) {
+	idp := newStubIDP(t)
+
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":            idp.server.URL,
+			"aud":            "apostilab",
+			"sub":            "123",
+			"exp":            time.Now().Add(time.Minute).Unix(),
+			"nonce":          "nonce",
+			"email":          "professor@ufal.br",
+			"email_verified": true,
+		}
+	}
+	with := func(key string, value any) jwt.MapClaims {
+		claims := valid()
+		claims[key] = value
+		return claims
+	}
+
+	tests := []struct {
+		name         string
+		claims       jwt.MapClaims
+		wantErr      bool
+		wantVerified bool
+	}{
+		{"valid", valid(), false, true},
+		{"nonce mismatch", with("nonce", "other"), true, false},
+		{"wrong audience", with("aud", "someone-else"), true, false},
+		{"wrong issuer", with("iss", "https://evil.example"), true, false},
+		{"expired", with("exp", time.Now().Add(-time.Hour).Unix()), true, false},
+		{"missing subject", with("sub", ""), true, false},
+		{"email_verified string true", with("email_verified", "true"), false, true},
+		{"email_verified string false", with("email_verified", "false"), false, false},
+		{"email_verified bool false", with("email_verified", false), false, false},
+	}
+
+	for _, tt := range tests {
+		idp.idToken = idp.sign(t, tt.claims)
+		p := NewProvider(ProviderConfig{Name: "stub", Issuer: idp.server.URL, ClientID: "apostilab"})
+
+		claims, err := p.Exchange(context.Background(), "code", "verifier", "nonce")
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidIDToken) {
+				t.Errorf("%s: Exchange error = %v, want ErrInvalidIDToken", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Exchange: %v", tt.name, err)
+			continue
+		}
+		if bool(claims.EmailVerified) != tt.wantVerified {
+			t.Errorf("%s: EmailVerified = %v, want %v", tt.name, claims.EmailVerified, tt.wantVerified)
+		}
+	}
+}
+
+/* a discovery document for another issuer must not be trusted */
+func TestProviderRejectsDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newStubIDP(t)
+	p := NewProvider(ProviderConfig{Name: "stub", Issuer: idp.server.URL + "/", ClientID: "apostilab"})
+
+	if _, err := p.Exchange(context.Background(), "code", "verifier", "nonce"); err == nil {
+		t.Error("Exchange accepted a discovery document with a different issuer")
+	}
+}
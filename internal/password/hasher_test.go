@@ -0,0 +1,143 @@
+package password
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+/* cheap parameters keep the tests fast, the format is the same as with DefaultParams */
+var testParams = Params{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestHashVerifyRoundTrip(t *testing.T) {
+	h := NewHasher(testParams)
+
+	encoded, err := h.Hash("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("Hash() = %q, want a PHC argon2id string with the parameters", encoded)
+	}
+
+	ok, needsRehash, err := h.Verify("correct horse battery staple", encoded)
+	if err != nil || !ok || needsRehash {
+		t.Errorf("Verify(right password) = %v, %v, %v, want true, false, nil", ok, needsRehash, err)
+	}
+
+	ok, needsRehash, err = h.Verify("wrong password", encoded)
+	if err != nil || ok || needsRehash {
+		t.Errorf("Verify(wrong password) = %v, %v, %v, want false, false, nil", ok, needsRehash, err)
+	}
+}
+
+func TestHashUsesFreshSalt(t *testing.T) {
+	h := NewHasher(testParams)
+
+	a, _ := h.Hash("same")
+	b, _ := h.Hash("same")
+	if a == b {
+		t.Error("two hashes of the same password are equal, the salt is not random")
+	}
+}
+
+func TestVerifyNeedsRehashOnOtherParams(t *testing.T) {
+	old := NewHasher(testParams)
+	encoded, err := old.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stronger := testParams
+	stronger.Iterations = 2
+	h := NewHasher(stronger)
+
+	ok, needsRehash, err := h.Verify("secret", encoded)
+	if err != nil || !ok || !needsRehash {
+		t.Errorf("Verify() = %v, %v, %v, want true, true, nil", ok, needsRehash, err)
+	}
+
+	if ok, needsRehash, _ := h.Verify("wrong", encoded); ok || needsRehash {
+		t.Errorf("Verify(wrong) = %v, %v, a failed check never asks for a rehash", ok, needsRehash)
+	}
+}
+
+func TestVerifyBcrypt(t *testing.T) {
+	h := NewHasher(testParams)
+
+	legacy, err := bcrypt.GenerateFromPassword([]byte("legacy"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, needsRehash, err := h.Verify("legacy", string(legacy))
+	if err != nil || !ok || !needsRehash {
+		t.Errorf("Verify(bcrypt) = %v, %v, %v, want true, true, nil", ok, needsRehash, err)
+	}
+
+	ok, needsRehash, err = h.Verify("other", string(legacy))
+	if err != nil || ok || needsRehash {
+		t.Errorf("Verify(bcrypt, wrong) = %v, %v, %v, want false, false, nil", ok, needsRehash, err)
+	}
+
+	/* hashes from other bcrypt implementations use the $2b$ and $2y$ prefixes */
+	for _, prefix := range []string{"$2b$", "$2y$"} {
+		encoded := prefix + string(legacy)[4:]
+		if ok, _, err := h.Verify("legacy", encoded); err != nil || !ok {
+			t.Errorf("Verify(%s...) = %v, %v, want a match", prefix, ok, err)
+		}
+	}
+}
+
+func TestVerifyEmptyHash(t *testing.T) {
+	ok, needsRehash, err := NewHasher(testParams).Verify("", "")
+	if ok || needsRehash || err != nil {
+		t.Errorf("Verify(empty hash) = %v, %v, %v, want false, false, nil", ok, needsRehash, err)
+	}
+}
+
+func TestVerifyMalformedHash(t *testing.T) {
+	h := NewHasher(testParams)
+
+	valid, err := h.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(valid, "$")
+
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"plain text", "secret"},
+		{"unknown algorithm", "$argon2i$v=19$m=64,t=1,p=1$" + parts[4] + "$" + parts[5]},
+		{"missing hash", "$argon2id$v=19$m=64,t=1,p=1$" + parts[4]},
+		{"extra field", valid + "$extra"},
+		{"other version", "$argon2id$v=16$m=64,t=1,p=1$" + parts[4] + "$" + parts[5]},
+		{"bad version", "$argon2id$version$m=64,t=1,p=1$" + parts[4] + "$" + parts[5]},
+		{"bad parameters", "$argon2id$v=19$m=64;t=1;p=1$" + parts[4] + "$" + parts[5]},
+		{"zero iterations", "$argon2id$v=19$m=64,t=0,p=1$" + parts[4] + "$" + parts[5]},
+		{"zero parallelism", "$argon2id$v=19$m=64,t=1,p=0$" + parts[4] + "$" + parts[5]},
+		{"parallelism overflow", "$argon2id$v=19$m=64,t=1,p=300$" + parts[4] + "$" + parts[5]},
+		{"salt not base64", "$argon2id$v=19$m=64,t=1,p=1$!!!$" + parts[5]},
+		{"hash not base64", "$argon2id$v=19$m=64,t=1,p=1$" + parts[4] + "$!!!"},
+		{"empty hash", "$argon2id$v=19$m=64,t=1,p=1$" + parts[4] + "$"},
+	}
+
+	for _, tt := range tests {
+		ok, needsRehash, err := h.Verify("secret", tt.encoded)
+		if ok || needsRehash || !errors.Is(err, ErrUnknownHashFormat) {
+			t.Errorf("%s: Verify() = %v, %v, %v, want ErrUnknownHashFormat", tt.name, ok, needsRehash, err)
+		}
+	}
+}
+
+func TestVerifyTruncatedBcrypt(t *testing.T) {
+	ok, _, err := NewHasher(testParams).Verify("secret", "$2b$10$short")
+	if ok || err == nil {
+		t.Errorf("Verify(truncated bcrypt) = %v, %v, want an error", ok, err)
+	}
+}
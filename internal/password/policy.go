@@ -0,0 +1,74 @@
+package password
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+/* MaxLength bounds the work a single login can cost, Argon2id itself has no limit */
+const MaxLength = 256
+
+var (
+	ErrTooShort = errors.New("password is too short")
+	ErrTooLong  = errors.New("password is too long")
+	ErrCommon   = errors.New("password is too common or has appeared in a data breach")
+)
+
+//go:embed denylist.txt
+var defaultDenylist string
+
+type Policy struct {
+	MinLength int
+	denylist  map[string]struct{}
+}
+
+/* NewPolicy starts from the embedded list of common passwords */
+func NewPolicy(minLength int) *Policy {
+	p := &Policy{
+		MinLength: minLength,
+		denylist:  map[string]struct{}{},
+	}
+
+	p.AddDenylist(strings.NewReader(defaultDenylist))
+
+	return p
+}
+
+/* AddDenylist reads one password per line, e.g. a list exported from a breach corpus */
+func (p *Policy) AddDenylist(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p.denylist[strings.ToLower(line)] = struct{}{}
+	}
+
+	return scanner.Err()
+}
+
+/* Check returns one of ErrTooShort, ErrTooLong or ErrCommon, wrapped with details */
+func (p *Policy) Check(password string) error {
+	length := utf8.RuneCountInString(password)
+
+	if length < p.MinLength {
+		return fmt.Errorf("%w: use at least %d characters", ErrTooShort, p.MinLength)
+	}
+
+	if length > MaxLength {
+		return fmt.Errorf("%w: use at most %d characters", ErrTooLong, MaxLength)
+	}
+
+	if _, found := p.denylist[strings.ToLower(password)]; found {
+		return ErrCommon
+	}
+
+	return nil
+}
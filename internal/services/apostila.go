@@ -3,16 +3,34 @@ package services
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"html"
 	"log"
+	"regexp"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/VicAlexandre/pds-backend/internal/mailer"
 	"github.com/VicAlexandre/pds-backend/internal/models"
 	"github.com/chromedp/cdproto/page"
 	"github.com/chromedp/chromedp"
 	"github.com/google/uuid"
 )
 
+const (
+	maxApostilaTitleLength       = 200
+	maxApostilaDescriptionLength = 2000
+	maxApostilaSubjectLength     = 100
+	maxApostilaGradeLevelLength  = 50
+	maxApostilaTags              = 20
+	maxApostilaTagLength         = 40
+	maxSearchQueryLength         = 200
+)
+
+var languagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
 type AddApostilaInput struct {
 	Id string `json:"data"`
 }
@@ -21,12 +39,24 @@ type DeleteApostilaInput struct {
 	Id string `json:"id"`
 }
 
-// EditedApostilaInput receives a 'data' field with the subfield 'id' and 'file' (html content)
+/* EditedApostilaInput holds the html in data.file, autosaves get thinned out and a stale version is a conflict */
 type EditedApostilaInput struct {
 	Data struct {
 		Id   string `json:"id"`
 		Html string `json:"file"`
 	} `json:"data"`
+	Autosave bool   `json:"autosave"`
+	Version  *int64 `json:"version"`
+}
+
+/* UpdateApostilaInput leaves nil fields untouched, an empty title goes back to the first heading */
+type UpdateApostilaInput struct {
+	Title       *string   `json:"title"`
+	Description *string   `json:"description"`
+	Subject     *string   `json:"subject"`
+	GradeLevel  *string   `json:"grade_level"`
+	Language    *string   `json:"language"`
+	Tags        *[]string `json:"tags"`
 }
 
 type RenderPDFInput struct {
@@ -36,23 +66,58 @@ type RenderPDFInput struct {
 }
 
 type ApostilaService struct {
-	ApostilaModel *models.ApostilaModel
-	UserModel     *models.UserModel
-	TokenModel    *models.JWTModel
+	ApostilaModel      *models.ApostilaModel
+	UserModel          *models.UserModel
+	EmailVerification  *EmailVerificationService
+	VerificationPolicy EmailVerificationPolicy
+	Authz              *AuthzService
+	Audit              *AuditService
+	Organizations      *OrganizationService
+	Mailer             mailer.Mailer
+	BaseURL            string
+
+	/* Collab is set once the hub exists, it needs the service too. Sharing changes reach open rooms through it */
+	Collab *CollabHub
 }
 
-func NewApostilaService(apostilaModel *models.ApostilaModel, userModel *models.UserModel, tokenModel *models.JWTModel) *ApostilaService {
+func NewApostilaService(apostilaModel *models.ApostilaModel, userModel *models.UserModel, emailVerification *EmailVerificationService, verificationPolicy EmailVerificationPolicy, authz *AuthzService, audit *AuditService, organizations *OrganizationService, m mailer.Mailer, baseURL string) *ApostilaService {
 	return &ApostilaService{
-		ApostilaModel: apostilaModel,
-		UserModel:     userModel,
-		TokenModel:    tokenModel,
+		ApostilaModel:      apostilaModel,
+		UserModel:          userModel,
+		EmailVerification:  emailVerification,
+		VerificationPolicy: verificationPolicy,
+		Authz:              authz,
+		Audit:              audit,
+		Organizations:      organizations,
+		Mailer:             m,
+		BaseURL:            baseURL,
 	}
 }
 
-func (s *ApostilaService) AddApostila(ctx context.Context, input AddApostilaInput, token string) (*models.Apostila, error) {
-	claims, err := s.TokenModel.ParseJWT(token)
-	if err != nil {
-		log.Println("Error parsing JWT: ", err)
+/*
+ * orgID is the workspace of the request, nil for the personal one. In an organization
+ * workspace students can only read, creating and changing apostilas takes admin or teacher.
+ * On top of that, changing an apostila takes the editor permission unless it is the user's
+ * own, and deleting or sharing it takes ownership.
+ */
+func (s *ApostilaService) AddApostila(ctx context.Context, input AddApostilaInput, userID int64, orgID *int64) (_ *models.Apostila, err error) {
+	defer s.audit(ctx, AuditApostilaCreate, userID, input.Id, &err)
+
+	if err := s.Authz.Require(ctx, userID, PermApostilaEdit); err != nil {
+		return nil, err
+	}
+
+	if err := s.requireWorkspaceRole(ctx, orgID, userID, models.OrgRoleAdmin, models.OrgRoleTeacher); err != nil {
+		return nil, err
+	}
+
+	if orgID != nil {
+		if err := s.Organizations.CheckApostilaQuota(ctx, *orgID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.EmailVerification.RequireVerified(ctx, s.VerificationPolicy, userID); err != nil {
 		return nil, err
 	}
 
@@ -62,7 +127,7 @@ func (s *ApostilaService) AddApostila(ctx context.Context, input AddApostilaInpu
 		return nil, err
 	}
 
-	apostila, err := s.ApostilaModel.Insert(ctx, u, claims.UserID)
+	apostila, err := s.ApostilaModel.Insert(ctx, u, userID, orgID)
 	if err != nil {
 		log.Println("Error inserting apostila: ", err)
 		return nil, err
@@ -73,10 +138,24 @@ func (s *ApostilaService) AddApostila(ctx context.Context, input AddApostilaInpu
 	return apostila, nil
 }
 
-func (s *ApostilaService) GetEditedApostilaHTML(ctx context.Context, id string, token string) (*models.EditedApostilaHTML, error) {
-	claims, err := s.TokenModel.ParseJWT(token)
-	if err != nil {
-		log.Println("Error parsing JWT: ", err)
+/* ListApostilas is open to every member of the workspace, like reading a single apostila */
+func (s *ApostilaService) ListApostilas(ctx context.Context, userID int64, orgID *int64, filter models.ApostilaFilter) ([]models.ApostilaSummary, error) {
+	if err := s.requireWorkspaceRole(ctx, orgID, userID, models.OrgRoleAdmin, models.OrgRoleTeacher, models.OrgRoleStudent); err != nil {
+		return nil, err
+	}
+
+	return s.ApostilaModel.ListByUser(ctx, userID, orgID, filter)
+}
+
+/* ListSharedApostilas lists the apostilas of the workspace other users shared with this one */
+func (s *ApostilaService) ListSharedApostilas(ctx context.Context, userID int64, orgID *int64, filter models.ApostilaFilter) ([]models.ApostilaSummary, error) {
+	filter.Shared = true
+	return s.ListApostilas(ctx, userID, orgID, filter)
+}
+
+/* GetEditedApostilaHTML is open to any permission level, the model only finds apostilas the user can open */
+func (s *ApostilaService) GetEditedApostilaHTML(ctx context.Context, id string, userID int64, orgID *int64) (*models.EditedApostilaHTML, error) {
+	if err := s.requireWorkspaceRole(ctx, orgID, userID, models.OrgRoleAdmin, models.OrgRoleTeacher, models.OrgRoleStudent); err != nil {
 		return nil, err
 	}
 
@@ -86,7 +165,7 @@ func (s *ApostilaService) GetEditedApostilaHTML(ctx context.Context, id string,
 		return nil, err
 	}
 
-	htmlContent, err := s.ApostilaModel.GetEditedHTMLByID(ctx, u, claims.UserID)
+	htmlContent, err := s.ApostilaModel.GetEditedHTMLByID(ctx, u, userID, orgID)
 	if err != nil {
 		log.Println("Error getting edited HTML: ", err)
 		return nil, err
@@ -97,21 +176,194 @@ func (s *ApostilaService) GetEditedApostilaHTML(ctx context.Context, id string,
 	return htmlContent, nil
 }
 
-func (s *ApostilaService) EditApostila(ctx context.Context, input EditedApostilaInput, token string) error {
-	claims, err := s.TokenModel.ParseJWT(token)
-	if err != nil {
-		log.Println("Error parsing JWT: ", err)
-		return err
+/* EditApostila returns the version the apostila is at after the save */
+func (s *ApostilaService) EditApostila(ctx context.Context, input EditedApostilaInput, userID int64, orgID *int64) (_ int64, err error) {
+	defer s.audit(ctx, AuditApostilaEdit, userID, input.Data.Id, &err)
+
+	if err := s.Authz.Require(ctx, userID, PermApostilaEdit); err != nil {
+		return 0, err
+	}
+
+	if err := s.requireWorkspaceRole(ctx, orgID, userID, models.OrgRoleAdmin, models.OrgRoleTeacher); err != nil {
+		return 0, err
+	}
+
+	if err := s.EmailVerification.RequireVerified(ctx, s.VerificationPolicy, userID); err != nil {
+		return 0, err
 	}
 
 	u, err := uuid.Parse(input.Data.Id)
 	if err != nil {
 		fmt.Printf("Error parsing UUID: %v\n", err)
 		fmt.Println("Input ID was: ", input.Data.Id)
-		return err
+		return 0, err
+	}
+
+	if _, err := s.requireAccess(ctx, u, userID, orgID, models.PermissionEditor); err != nil {
+		return 0, err
+	}
+
+	content := models.ApostilaContent{
+		HTML:            input.Data.Html,
+		Heading:         firstHeading(input.Data.Html),
+		Text:            plainText(input.Data.Html),
+		Autosave:        input.Autosave,
+		ExpectedVersion: input.Version,
 	}
 
-	return s.ApostilaModel.UpdateEditedHTMLByID(ctx, u, input.Data.Html, claims.UserID)
+	return s.ApostilaModel.UpdateEditedHTMLByID(ctx, u, content, userID, orgID)
+}
+
+/*
+ * SearchApostilas returns the matches best ranked first. The snippets are HTML escaped
+ * with the matched words in <mark>, the text came from user HTML and is not trusted.
+ */
+func (s *ApostilaService) SearchApostilas(ctx context.Context, userID int64, orgID *int64, q string, limit, offset int) ([]models.ApostilaSearchResult, error) {
+	if err := s.requireWorkspaceRole(ctx, orgID, userID, models.OrgRoleAdmin, models.OrgRoleTeacher, models.OrgRoleStudent); err != nil {
+		return nil, err
+	}
+
+	q = collapseSpaces(q)
+
+	var verr ValidationError
+	if q == "" {
+		verr.Add("q", "informe o que procurar")
+	}
+	if utf8.RuneCountInString(q) > maxSearchQueryLength {
+		verr.Add("q", fmt.Sprintf("use no máximo %d caracteres", maxSearchQueryLength))
+	}
+	if err := verr.Err(); err != nil {
+		return nil, err
+	}
+
+	results, err := s.ApostilaModel.SearchByUser(ctx, userID, orgID, q, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	marks := strings.NewReplacer(models.SnippetStart, "<mark>", models.SnippetStop, "</mark>")
+	for i := range results {
+		results[i].Snippet = marks.Replace(html.EscapeString(results[i].Snippet))
+	}
+
+	return results, nil
+}
+
+func (s *ApostilaService) GetApostila(ctx context.Context, id uuid.UUID, userID int64, orgID *int64) (*models.ApostilaSummary, error) {
+	if err := s.requireWorkspaceRole(ctx, orgID, userID, models.OrgRoleAdmin, models.OrgRoleTeacher, models.OrgRoleStudent); err != nil {
+		return nil, err
+	}
+
+	access, err := s.requireAccess(ctx, id, userID, orgID, models.PermissionViewer)
+	if err != nil {
+		return nil, err
+	}
+
+	apostila, err := s.ApostilaModel.FindByID(ctx, id, userID, orgID)
+	if err != nil {
+		return nil, err
+	}
+	apostila.Access = access
+
+	return apostila, nil
+}
+
+func (s *ApostilaService) UpdateApostila(ctx context.Context, id uuid.UUID, input UpdateApostilaInput, userID int64, orgID *int64) (_ *models.ApostilaSummary, err error) {
+	defer s.audit(ctx, AuditApostilaUpdate, userID, id.String(), &err)
+
+	if err := s.Authz.Require(ctx, userID, PermApostilaEdit); err != nil {
+		return nil, err
+	}
+
+	if err := s.requireWorkspaceRole(ctx, orgID, userID, models.OrgRoleAdmin, models.OrgRoleTeacher); err != nil {
+		return nil, err
+	}
+
+	if err := s.EmailVerification.RequireVerified(ctx, s.VerificationPolicy, userID); err != nil {
+		return nil, err
+	}
+
+	access, err := s.requireAccess(ctx, id, userID, orgID, models.PermissionEditor)
+	if err != nil {
+		return nil, err
+	}
+
+	update, err := validateApostilaUpdate(input)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.ApostilaModel.UpdateMetadata(ctx, id, userID, orgID, update); err != nil {
+		return nil, err
+	}
+
+	apostila, err := s.ApostilaModel.FindByID(ctx, id, userID, orgID)
+	if err != nil {
+		return nil, err
+	}
+	apostila.Access = access
+
+	return apostila, nil
+}
+
+/* validateApostilaUpdate trims the text fields and lowercases and dedupes the tags */
+func validateApostilaUpdate(input UpdateApostilaInput) (models.ApostilaMetadataUpdate, error) {
+	var verr ValidationError
+	var update models.ApostilaMetadataUpdate
+
+	text := func(field string, value *string, max int) *string {
+		if value == nil {
+			return nil
+		}
+		v := collapseSpaces(*value)
+		if utf8.RuneCountInString(v) > max {
+			verr.Add(field, fmt.Sprintf("use no máximo %d caracteres", max))
+		}
+		return &v
+	}
+
+	update.Title = text("title", input.Title, maxApostilaTitleLength)
+	update.Subject = text("subject", input.Subject, maxApostilaSubjectLength)
+	update.GradeLevel = text("grade_level", input.GradeLevel, maxApostilaGradeLevelLength)
+
+	if input.Description != nil {
+		v := strings.TrimSpace(*input.Description)
+		if utf8.RuneCountInString(v) > maxApostilaDescriptionLength {
+			verr.Add("description", fmt.Sprintf("use no máximo %d caracteres", maxApostilaDescriptionLength))
+		}
+		update.Description = &v
+	}
+
+	if input.Language != nil {
+		v := strings.TrimSpace(*input.Language)
+		if !languagePattern.MatchString(v) {
+			verr.Add("language", "use um código de idioma como pt-BR ou en")
+		}
+		update.Language = &v
+	}
+
+	if input.Tags != nil {
+		seen := map[string]bool{}
+		tags := []string{}
+		for _, tag := range *input.Tags {
+			tag = strings.ToLower(collapseSpaces(tag))
+			if tag == "" || seen[tag] {
+				continue
+			}
+			if utf8.RuneCountInString(tag) > maxApostilaTagLength {
+				verr.Add("tags", fmt.Sprintf("cada tag pode ter no máximo %d caracteres", maxApostilaTagLength))
+				break
+			}
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+		if len(tags) > maxApostilaTags {
+			verr.Add("tags", fmt.Sprintf("use no máximo %d tags", maxApostilaTags))
+		}
+		update.Tags = &tags
+	}
+
+	return update, verr.Err()
 }
 
 const cleanupScript = `
@@ -155,11 +407,22 @@ const cleanupScript = `
 })();
 `
 
-func (s *ApostilaService) RenderApostilaPDF(ctx context.Context, input RenderPDFInput) ([]byte, error) {
+func (s *ApostilaService) RenderApostilaPDF(ctx context.Context, input RenderPDFInput, userID int64) (_ []byte, err error) {
+	defer s.audit(ctx, AuditApostilaRenderPDF, userID, "", &err)
+
+	if err := s.Authz.Require(ctx, userID, PermApostilaRender); err != nil {
+		return nil, err
+	}
+
+	return renderPDF(ctx, input.Data.Html)
+}
+
+/* renderPDF prints the HTML with headless Chrome, the data export uses it as well */
+func renderPDF(ctx context.Context, html string) ([]byte, error) {
 	cctx, cancel := chromedp.NewContext(ctx)
 	defer cancel()
 
-	htmlB64 := base64.StdEncoding.EncodeToString([]byte(input.Data.Html))
+	htmlB64 := base64.StdEncoding.EncodeToString([]byte(html))
 	dataURL := fmt.Sprintf("data:text/html;base64,%s", htmlB64)
 
 	var pdfBuf []byte
@@ -205,10 +468,18 @@ func (s *ApostilaService) RenderApostilaPDF(ctx context.Context, input RenderPDF
 	return pdfBuf, nil
 }
 
-func (s *ApostilaService) DeleteApostila(ctx context.Context, input DeleteApostilaInput, token string) error {
-	claims, err := s.TokenModel.ParseJWT(token)
-	if err != nil {
-		log.Println("Error parsing JWT: ", err)
+func (s *ApostilaService) DeleteApostila(ctx context.Context, input DeleteApostilaInput, userID int64, orgID *int64) (err error) {
+	defer s.audit(ctx, AuditApostilaDelete, userID, input.Id, &err)
+
+	if err := s.Authz.Require(ctx, userID, PermApostilaEdit); err != nil {
+		return err
+	}
+
+	if err := s.requireWorkspaceRole(ctx, orgID, userID, models.OrgRoleAdmin, models.OrgRoleTeacher); err != nil {
+		return err
+	}
+
+	if err := s.EmailVerification.RequireVerified(ctx, s.VerificationPolicy, userID); err != nil {
 		return err
 	}
 
@@ -218,5 +489,48 @@ func (s *ApostilaService) DeleteApostila(ctx context.Context, input DeleteAposti
 		return err
 	}
 
-	return s.ApostilaModel.Delete(ctx, u, claims.UserID)
+	/* deleting an apostila that is not there stays a no-op, as it always was */
+	if _, err := s.requireAccess(ctx, u, userID, orgID, models.AccessOwner); err != nil && !errors.Is(err, models.ErrApostilaNotFound) {
+		return err
+	}
+
+	return s.ApostilaModel.Delete(ctx, u, userID, orgID)
+}
+
+/*
+ * requireAccess returns what the user may do with the apostila: AccessOwner or their
+ * permission level. It answers ErrApostilaNotFound when they cannot open it, so ids of
+ * other users' apostilas cannot be probed, and ErrForbidden when the level is too low.
+ */
+func (s *ApostilaService) requireAccess(ctx context.Context, id uuid.UUID, userID int64, orgID *int64, level string) (string, error) {
+	access, err := s.ApostilaModel.AccessLevel(ctx, id, userID, orgID)
+	if err != nil {
+		return "", err
+	}
+
+	if !models.AccessAtLeast(access, level) {
+		return "", ErrForbidden
+	}
+
+	return access, nil
+}
+
+/* requireWorkspaceRole passes in the personal workspace, where the global roles alone apply */
+func (s *ApostilaService) requireWorkspaceRole(ctx context.Context, orgID *int64, userID int64, roles ...string) error {
+	if orgID == nil {
+		return nil
+	}
+
+	return s.Organizations.RequireRole(ctx, *orgID, userID, roles...)
+}
+
+/* audit is deferred with a pointer to the named error so it sees how the call ended */
+func (s *ApostilaService) audit(ctx context.Context, action string, userID int64, apostilaID string, err *error) {
+	s.Audit.Record(ctx, AuditEntry{
+		ActorID:    userID,
+		Action:     action,
+		TargetType: "apostila",
+		TargetID:   apostilaID,
+		Err:        *err,
+	})
 }
@@ -0,0 +1,108 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/VicAlexandre/pds-backend/internal/models"
+	"github.com/google/uuid"
+)
+
+/* autosaves are kept one per hour after a day and one per day after a month */
+const (
+	revisionHourlyAfter = 24 * time.Hour
+	revisionDailyAfter  = 30 * 24 * time.Hour
+)
+
+func (s *ApostilaService) ListRevisions(ctx context.Context, id uuid.UUID, userID int64, orgID *int64, beforeID int64, limit int) ([]models.ApostilaRevision, error) {
+	if err := s.requireWorkspaceRole(ctx, orgID, userID, models.OrgRoleAdmin, models.OrgRoleTeacher, models.OrgRoleStudent); err != nil {
+		return nil, err
+	}
+
+	return s.ApostilaModel.ListRevisions(ctx, id, userID, orgID, beforeID, limit)
+}
+
+func (s *ApostilaService) GetRevision(ctx context.Context, id uuid.UUID, revisionID int64, userID int64, orgID *int64) (*models.ApostilaRevision, error) {
+	if err := s.requireWorkspaceRole(ctx, orgID, userID, models.OrgRoleAdmin, models.OrgRoleTeacher, models.OrgRoleStudent); err != nil {
+		return nil, err
+	}
+
+	return s.ApostilaModel.GetRevision(ctx, id, revisionID, userID, orgID)
+}
+
+func (s *ApostilaService) DiffRevisions(ctx context.Context, id uuid.UUID, fromID, toID int64, userID int64, orgID *int64) (*RevisionDiff, error) {
+	from, err := s.GetRevision(ctx, id, fromID, userID, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := s.GetRevision(ctx, id, toID, userID, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RevisionDiff{From: from.ID, To: to.ID, Changes: diffBlocks(from.HTML, to.HTML)}, nil
+}
+
+/*
+ * RestoreRevision saves the HTML of an old revision as a new one, so the history keeps
+ * what was there before the restore and the restore itself can be undone. Like a save,
+ * it returns the new version and fails with a conflict when expectedVersion is stale.
+ */
+func (s *ApostilaService) RestoreRevision(ctx context.Context, id uuid.UUID, revisionID int64, expectedVersion *int64, userID int64, orgID *int64) (_ int64, err error) {
+	defer s.audit(ctx, AuditApostilaRestore, userID, id.String(), &err)
+
+	if err := s.Authz.Require(ctx, userID, PermApostilaEdit); err != nil {
+		return 0, err
+	}
+
+	if err := s.requireWorkspaceRole(ctx, orgID, userID, models.OrgRoleAdmin, models.OrgRoleTeacher); err != nil {
+		return 0, err
+	}
+
+	if err := s.EmailVerification.RequireVerified(ctx, s.VerificationPolicy, userID); err != nil {
+		return 0, err
+	}
+
+	if _, err := s.requireAccess(ctx, id, userID, orgID, models.PermissionEditor); err != nil {
+		return 0, err
+	}
+
+	revision, err := s.ApostilaModel.GetRevision(ctx, id, revisionID, userID, orgID)
+	if err != nil {
+		return 0, err
+	}
+
+	content := models.ApostilaContent{
+		HTML:            revision.HTML,
+		Heading:         firstHeading(revision.HTML),
+		Text:            plainText(revision.HTML),
+		RestoredFrom:    &revision.ID,
+		ExpectedVersion: expectedVersion,
+	}
+
+	return s.ApostilaModel.UpdateEditedHTMLByID(ctx, id, content, userID, orgID)
+}
+
+/* RunRevisionRetention thins out old autosaves every interval until ctx is done */
+func (s *ApostilaService) RunRevisionRetention(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		n, err := s.ApostilaModel.ThinAutosaves(ctx, now.Add(-revisionHourlyAfter), now.Add(-revisionDailyAfter))
+		if err != nil {
+			log.Println("Error thinning apostila revisions: ", err)
+		} else if n > 0 {
+			log.Println("Thinned apostila revisions:", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
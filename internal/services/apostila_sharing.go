@@ -0,0 +1,355 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/VicAlexandre/pds-backend/internal/mailer"
+	"github.com/VicAlexandre/pds-backend/internal/models"
+	"github.com/google/uuid"
+)
+
+const (
+	ApostilaInviteDuration = 14 * 24 * time.Hour
+	permissionLevelMessage = "use viewer, commenter ou editor"
+)
+
+var (
+	ErrInvalidInviteToken = errors.New("invalid or expired invite")
+	ErrInviteOtherEmail   = errors.New("invite was sent to another email")
+)
+
+type ShareApostilaInput struct {
+	Email string `json:"email"`
+	Level string `json:"level"`
+}
+
+type UpdatePermissionInput struct {
+	Level string `json:"level"`
+}
+
+type AcceptInviteInput struct {
+	Token string `json:"token"`
+}
+
+/* ApostilaSharing is who the apostila is shared with, and the invites nobody accepted yet */
+type ApostilaSharing struct {
+	Permissions []models.ApostilaPermission `json:"permissions"`
+	Invites     []models.ApostilaInvite     `json:"invites"`
+}
+
+/*
+ * ShareResult is the same whether the email has an account or not. In the personal
+ * workspace both get the same invite, mailed in the background, and ListPermissions
+ * shows it as pending by email until it is accepted, so sharing cannot be used to find
+ * out who is registered.
+ */
+type ShareResult struct {
+	Email string `json:"email"`
+	Level string `json:"level"`
+}
+
+func (s *ApostilaService) ListPermissions(ctx context.Context, id uuid.UUID, userID int64, orgID *int64) (*ApostilaSharing, error) {
+	if err := s.requireSharing(ctx, id, userID, orgID); err != nil {
+		return nil, err
+	}
+
+	permissions, err := s.ApostilaModel.ListPermissions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	invites, err := s.ApostilaModel.ListInvites(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ApostilaSharing{Permissions: permissions, Invites: invites}, nil
+}
+
+/*
+ * ShareApostila changes the level of someone the apostila is already shared with and
+ * otherwise mails an invite, which only the account with that email can accept. In an
+ * organization the apostila is only shared with members, who get the permission at once:
+ * the owner can tell members apart anyway, and any other email gets the same answer.
+ */
+func (s *ApostilaService) ShareApostila(ctx context.Context, id uuid.UUID, input ShareApostilaInput, userID int64, orgID *int64) (_ *ShareResult, err error) {
+	metadata := map[string]any{"level": input.Level}
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{ActorID: userID, Action: AuditApostilaShare, TargetType: "apostila", TargetID: id.String(), Err: err, Metadata: metadata})
+	}()
+
+	if err := s.requireSharing(ctx, id, userID, orgID); err != nil {
+		return nil, err
+	}
+
+	email := strings.TrimSpace(input.Email)
+
+	var verr ValidationError
+	if !isValidEmail(email) {
+		verr.Add("email", "informe um e-mail válido")
+	}
+	if !models.ValidPermission(input.Level) {
+		verr.Add("level", permissionLevelMessage)
+	}
+	if err := verr.Err(); err != nil {
+		return nil, err
+	}
+
+	if orgID != nil {
+		return s.shareWithMember(ctx, id, email, input.Level, userID, *orgID, metadata)
+	}
+
+	owner, err := s.UserModel.FindByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if models.NormalizeEmail(email) == models.NormalizeEmail(owner.Email) {
+		verr.Add("email", "a apostila já é sua")
+		return nil, verr.Err()
+	}
+
+	/* the owner already sees who holds a permission, changing it reveals nothing */
+	memberID, err := s.ApostilaModel.UpdatePermissionByEmail(ctx, id, email, input.Level, userID)
+	if err == nil {
+		metadata["user_id"] = memberID
+		s.Collab.recheckUser(id, memberID)
+		return &ShareResult{Email: email, Level: input.Level}, nil
+	}
+	if !errors.Is(err, models.ErrPermissionNotFound) {
+		return nil, err
+	}
+
+	invite, err := s.inviteToApostila(ctx, id, email, input.Level, owner)
+	if err != nil {
+		return nil, err
+	}
+	metadata["invite_id"] = invite.ID
+
+	return &ShareResult{Email: email, Level: input.Level}, nil
+}
+
+/* shareWithMember gives a member of the organization the level at once, with a notice by email */
+func (s *ApostilaService) shareWithMember(ctx context.Context, id uuid.UUID, email, level string, userID, orgID int64, metadata map[string]any) (*ShareResult, error) {
+	var verr ValidationError
+
+	/* no account gets the same message as an account outside the organization */
+	user, err := s.UserModel.FindByEmail(ctx, email)
+	if errors.Is(err, models.ErrUserNotFound) {
+		verr.Add("email", "a pessoa não é membro da instituição")
+		return nil, verr.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Organizations.RequireRole(ctx, orgID, user.ID, models.OrgRoleAdmin, models.OrgRoleTeacher, models.OrgRoleStudent)
+	if errors.Is(err, ErrForbidden) {
+		verr.Add("email", "a pessoa não é membro da instituição")
+		return nil, verr.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	metadata["user_id"] = user.ID
+
+	if user.ID == userID {
+		verr.Add("email", "a apostila já é sua")
+		return nil, verr.Err()
+	}
+
+	if _, err := s.ApostilaModel.GrantPermission(ctx, id, user.ID, level, userID); err != nil {
+		return nil, err
+	}
+	s.Collab.recheckUser(id, user.ID)
+
+	s.mailShareAsync(ctx, "apostila_shared", user.Email, id, userID, &orgID, level, s.BaseURL+"/apostilas/"+id.String())
+
+	return &ShareResult{Email: email, Level: level}, nil
+}
+
+/* inviteToApostila mails the invite in the background, like the notice to a member, so mail failures only reach the log */
+func (s *ApostilaService) inviteToApostila(ctx context.Context, id uuid.UUID, email, level string, owner *models.User) (*models.ApostilaInvite, error) {
+	raw, err := models.NewOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	invite, err := s.ApostilaModel.CreateInvite(ctx, id, email, level, models.HashToken(raw), owner.ID, time.Now().Add(ApostilaInviteDuration))
+	if err != nil {
+		return nil, err
+	}
+
+	s.mailShareAsync(ctx, "apostila_invite", email, id, owner.ID, nil, level, s.BaseURL+"/apostilas/invite?token="+raw)
+
+	return invite, nil
+}
+
+func (s *ApostilaService) mailShareAsync(ctx context.Context, template, to string, id uuid.UUID, userID int64, orgID *int64, level, link string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+
+		if err := s.mailShare(ctx, template, to, id, userID, orgID, level, link); err != nil {
+			log.Println("Error sending apostila share email: ", err)
+		}
+	}()
+}
+
+func (s *ApostilaService) mailShare(ctx context.Context, template, to string, id uuid.UUID, userID int64, orgID *int64, level, link string) error {
+	owner, err := s.UserModel.FindByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	apostila, err := s.ApostilaModel.FindByID(ctx, id, userID, orgID)
+	if err != nil {
+		return err
+	}
+
+	title := apostila.Title
+	if title == "" {
+		title = "Apostila sem título"
+	}
+
+	msg, err := mailer.Render(template, to, owner.Name+" compartilhou uma apostila com você", map[string]any{
+		"Owner":     owner.Name,
+		"Title":     title,
+		"Level":     permissionLevelNames[level],
+		"Link":      link,
+		"ExpiresIn": "14 dias",
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.Mailer.Send(ctx, msg)
+}
+
+func (s *ApostilaService) UpdatePermission(ctx context.Context, id uuid.UUID, memberID int64, input UpdatePermissionInput, userID int64, orgID *int64) (err error) {
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{ActorID: userID, Action: AuditApostilaShareUpdate, TargetType: "apostila", TargetID: id.String(), Err: err, Metadata: map[string]any{"user_id": memberID, "level": input.Level}})
+	}()
+
+	if err := s.requireSharing(ctx, id, userID, orgID); err != nil {
+		return err
+	}
+
+	if err := validatePermissionLevel(input.Level); err != nil {
+		return err
+	}
+
+	if err := s.ApostilaModel.UpdatePermission(ctx, id, memberID, input.Level, userID); err != nil {
+		return err
+	}
+
+	s.Collab.recheckUser(id, memberID)
+	return nil
+}
+
+/* RevokePermission is for the owner, or for a user giving up an apostila shared with them */
+func (s *ApostilaService) RevokePermission(ctx context.Context, id uuid.UUID, memberID int64, userID int64, orgID *int64) (err error) {
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{ActorID: userID, Action: AuditApostilaUnshare, TargetType: "apostila", TargetID: id.String(), Err: err, Metadata: map[string]any{"user_id": memberID}})
+	}()
+
+	if memberID == userID {
+		if _, err := s.requireAccess(ctx, id, userID, orgID, models.PermissionViewer); err != nil {
+			return err
+		}
+	} else if err := s.requireSharing(ctx, id, userID, orgID); err != nil {
+		return err
+	}
+
+	if err := s.ApostilaModel.RevokePermission(ctx, id, memberID); err != nil {
+		return err
+	}
+
+	/* the permission was their only way in, an open editor must not keep the room's rights */
+	s.Collab.dropUser(id, memberID)
+	return nil
+}
+
+func (s *ApostilaService) RevokeInvite(ctx context.Context, id uuid.UUID, inviteID int64, userID int64, orgID *int64) (err error) {
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{ActorID: userID, Action: AuditApostilaInviteRevoke, TargetType: "apostila", TargetID: id.String(), Err: err, Metadata: map[string]any{"invite_id": inviteID}})
+	}()
+
+	if err := s.requireSharing(ctx, id, userID, orgID); err != nil {
+		return err
+	}
+
+	return s.ApostilaModel.RevokeInvite(ctx, id, inviteID)
+}
+
+/*
+ * AcceptInvite gives the signed in user the permission of the invite. The link alone is
+ * not enough, a forwarded or leaked one must not work for someone else: the account has
+ * to have the email the invite was sent to and, under the policy, have it verified.
+ */
+func (s *ApostilaService) AcceptInvite(ctx context.Context, input AcceptInviteInput, userID int64) (_ *models.ApostilaInvite, err error) {
+	var target string
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{ActorID: userID, Action: AuditApostilaInviteAccept, TargetType: "apostila", TargetID: target, Err: err})
+	}()
+
+	if input.Token == "" {
+		return nil, ErrInvalidInviteToken
+	}
+
+	if err := s.EmailVerification.RequireVerified(ctx, s.VerificationPolicy, userID); err != nil {
+		return nil, err
+	}
+
+	invite, err := s.ApostilaModel.AcceptInvite(ctx, models.HashToken(input.Token), userID)
+	if errors.Is(err, models.ErrInviteInvalid) {
+		return nil, ErrInvalidInviteToken
+	}
+	if errors.Is(err, models.ErrInviteOtherEmail) {
+		return nil, ErrInviteOtherEmail
+	}
+	if err != nil {
+		return nil, err
+	}
+	target = invite.ApostilaID.String()
+
+	return invite, nil
+}
+
+/* requireSharing lets the owner manage who the apostila is shared with, as long as they could still edit it */
+func (s *ApostilaService) requireSharing(ctx context.Context, id uuid.UUID, userID int64, orgID *int64) error {
+	if err := s.Authz.Require(ctx, userID, PermApostilaEdit); err != nil {
+		return err
+	}
+
+	if err := s.requireWorkspaceRole(ctx, orgID, userID, models.OrgRoleAdmin, models.OrgRoleTeacher); err != nil {
+		return err
+	}
+
+	if err := s.EmailVerification.RequireVerified(ctx, s.VerificationPolicy, userID); err != nil {
+		return err
+	}
+
+	_, err := s.requireAccess(ctx, id, userID, orgID, models.AccessOwner)
+	return err
+}
+
+var permissionLevelNames = map[string]string{
+	models.PermissionViewer:    "leitura",
+	models.PermissionCommenter: "comentários",
+	models.PermissionEditor:    "edição",
+}
+
+func validatePermissionLevel(level string) error {
+	if models.ValidPermission(level) {
+		return nil
+	}
+
+	var verr ValidationError
+	verr.Add("level", permissionLevelMessage)
+	return verr.Err()
+}
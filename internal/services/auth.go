@@ -3,84 +3,445 @@ package services
 import (
 	"context"
 	"errors"
+	"log"
+	"net/mail"
+	"strconv"
+	"strings"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
-
 	"github.com/VicAlexandre/pds-backend/internal/models"
+	"github.com/google/uuid"
 )
 
-const TokenDuration = 60 * time.Minute
+const (
+	TokenDuration        = 15 * time.Minute
+	RefreshTokenDuration = 30 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrInvalidEmail        = errors.New("invalid email address")
+	ErrAccountDisabled     = errors.New("account disabled")
+)
+
+/* SessionInfo describes the device a login comes from, it is set by the handlers */
+type SessionInfo struct {
+	IP        string `json:"-"`
+	UserAgent string `json:"-"`
+}
 
 type RegisterInput struct {
 	Name     string `json:"name"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	SessionInfo
 }
 
 type LoginInput struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	SessionInfo
+}
+
+/*
+ * LoginResult carries the tokens on a plain login. When the account has 2FA on, it
+ * only carries a short-lived mfa_token to be exchanged at /v1/auth/login/mfa.
+ */
+type LoginResult struct {
+	*models.Token
+	MFARequired  bool       `json:"mfa_required,omitempty"`
+	MFAToken     string     `json:"mfa_token,omitempty"`
+	MFAExpiresAt *time.Time `json:"mfa_expires_at,omitempty"`
+}
+
+type LoginMFAInput struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+	SessionInfo
+}
+
+type RefreshInput struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type LogoutInput struct {
+	RefreshToken string `json:"refresh_token"`
 }
 
 type AuthService struct {
-	UserModel  *models.UserModel
-	TokenModel *models.JWTModel
+	UserModel         *models.UserModel
+	TokenModel        *models.JWTModel
+	RefreshTokenModel *models.RefreshTokenModel
+	EmailVerification *EmailVerificationService
+	LoginLimiter      *LoginLimiter
+	MFA               *MFAService
+	Authz             *AuthzService
+	SessionModel      *models.SessionModel
+	Passwords         *PasswordService
+	Audit             *AuditService
 }
 
-func NewAuthService(userModel *models.UserModel, tokenModel *models.JWTModel) *AuthService {
+func NewAuthService(userModel *models.UserModel, tokenModel *models.JWTModel, refreshTokenModel *models.RefreshTokenModel, emailVerification *EmailVerificationService, loginLimiter *LoginLimiter, mfa *MFAService, authz *AuthzService, sessionModel *models.SessionModel, passwords *PasswordService, audit *AuditService) *AuthService {
 	return &AuthService{
-		UserModel:  userModel,
-		TokenModel: tokenModel,
+		UserModel:         userModel,
+		TokenModel:        tokenModel,
+		RefreshTokenModel: refreshTokenModel,
+		EmailVerification: emailVerification,
+		LoginLimiter:      loginLimiter,
+		MFA:               mfa,
+		Authz:             authz,
+		SessionModel:      sessionModel,
+		Passwords:         passwords,
+		Audit:             audit,
 	}
 }
 
-func (s *AuthService) Register(ctx context.Context, input RegisterInput) (*models.Token, error) {
-	if input.Email == "" || input.Password == "" || input.Name == "" {
-		return nil, errors.New("name, email and password required")
-	}
+func (s *AuthService) Register(ctx context.Context, input RegisterInput) (_ *models.Token, err error) {
+	var userID int64
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{
+			ActorID:    userID,
+			Action:     AuditRegister,
+			TargetType: "user",
+			TargetID:   auditID(userID),
+			Err:        err,
+			Metadata:   map[string]any{"email": input.Email},
+		})
+	}()
 
-	hashed, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
-	if err != nil {
+	v := &ValidationError{}
+	if strings.TrimSpace(input.Name) == "" {
+		v.Add("name", "informe o nome")
+	}
+	if !isValidEmail(input.Email) {
+		v.Add("email", "informe um e-mail válido")
+	}
+	s.Passwords.check(v, "password", input.Password)
+	if err := v.Err(); err != nil {
 		return nil, err
 	}
 
-	user, err := s.UserModel.Insert(ctx, input.Name, input.Email, string(hashed))
+	hashed, err := s.Passwords.Hash(input.Password)
 	if err != nil {
 		return nil, err
 	}
 
-	token, err := s.TokenModel.GenerateJWT(user.ID, TokenDuration)
+	user, err := s.UserModel.Insert(ctx, input.Name, input.Email, hashed)
 	if err != nil {
 		return nil, err
 	}
+	userID = user.ID
 
-	return token, nil
+	s.EmailVerification.SendAsync(ctx, user)
+
+	return s.issueTokens(ctx, user.ID, input.SessionInfo)
 }
 
-func (s *AuthService) Login(ctx context.Context, input LoginInput) (*models.Token, error) {
+/* a failed login is recorded against the account it targeted, with no actor */
+func (s *AuthService) Login(ctx context.Context, input LoginInput) (result *LoginResult, err error) {
+	var actorID, targetID int64
+	defer func() {
+		metadata := map[string]any{"email": input.Email}
+		if result != nil && result.MFARequired {
+			metadata["mfa_required"] = true
+		}
+
+		s.Audit.Record(ctx, AuditEntry{
+			ActorID:    actorID,
+			Action:     AuditLogin,
+			TargetType: "user",
+			TargetID:   auditID(targetID),
+			Err:        err,
+			Metadata:   metadata,
+		})
+	}()
+
 	if input.Email == "" || input.Password == "" {
 		return nil, errors.New("invalid credentials")
 	}
 
+	if err := s.LoginLimiter.Check(ctx, input.Email, input.IP); err != nil {
+		return nil, err
+	}
+
+	var hash string
 	user, err := s.UserModel.FindByEmail(ctx, input.Email)
+	if err == nil {
+		hash = user.Password
+		targetID = user.ID
+	}
+
+	ok, needsRehash := s.Passwords.Verify(input.Password, hash)
+	if !ok {
+		if err := s.LoginLimiter.Fail(ctx, input.Email, input.IP); err != nil {
+			log.Println("Error recording failed login: ", err)
+		}
+		return nil, errors.New("invalid credentials")
+	}
+	actorID = user.ID
+
+	/* bcrypt hashes and outdated Argon2id parameters are upgraded while the plain password is known */
+	if needsRehash {
+		if hashed, err := s.Passwords.Hash(input.Password); err != nil {
+			log.Println("Error rehashing password: ", err)
+		} else if err := s.UserModel.UpdatePassword(ctx, user.ID, hashed); err != nil {
+			log.Println("Error storing rehashed password: ", err)
+		}
+	}
+
+	return s.completeLogin(ctx, user, input.SessionInfo)
+}
+
+/*
+ * completeLogin runs once the user is identified, by password or by an OIDC provider.
+ * A disabled account is only reported after that, so it does not reveal the account exists.
+ */
+func (s *AuthService) completeLogin(ctx context.Context, user *models.User, info SessionInfo) (*LoginResult, error) {
+	if user.DisabledAt != nil {
+		return nil, ErrAccountDisabled
+	}
+
+	mfaEnabled, err := s.MFA.Enabled(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if mfaEnabled {
+		mfaToken, expiresAt, err := s.TokenModel.GenerateMFAPendingToken(user.ID, MFAPendingDuration)
+		if err != nil {
+			return nil, err
+		}
+
+		return &LoginResult{MFARequired: true, MFAToken: mfaToken, MFAExpiresAt: &expiresAt}, nil
+	}
+
+	if err := s.LoginLimiter.Succeed(ctx, user.Email); err != nil {
+		log.Println("Error clearing failed logins: ", err)
+	}
+
+	token, err := s.issueTokens(ctx, user.ID, info)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoginResult{Token: token}, nil
+}
+
+/*
+ * LoginMFA is the second step of a 2FA login. Wrong codes count as failed logins
+ * for the account, so the six digits cannot be brute forced within the token lifetime.
+ */
+func (s *AuthService) LoginMFA(ctx context.Context, input LoginMFAInput) (_ *models.Token, err error) {
+	claims, err := s.TokenModel.ParseMFAPendingToken(input.MFAToken)
+	if err != nil {
+		return nil, errors.New("invalid credentials")
+	}
+
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{
+			ActorID:    claims.UserID,
+			Action:     AuditLoginMFA,
+			TargetType: "user",
+			TargetID:   auditID(claims.UserID),
+			Err:        err,
+		})
+	}()
+
+	user, err := s.UserModel.FindByID(ctx, claims.UserID)
 	if err != nil {
 		return nil, errors.New("invalid credentials")
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(input.Password)); err != nil {
+	if user.DisabledAt != nil {
+		return nil, ErrAccountDisabled
+	}
+
+	if err := s.LoginLimiter.Check(ctx, user.Email, input.IP); err != nil {
+		return nil, err
+	}
+
+	if err := s.MFA.Verify(ctx, user.ID, input.Code); err != nil {
+		if errors.Is(err, ErrInvalidMFACode) {
+			if err := s.LoginLimiter.Fail(ctx, user.Email, input.IP); err != nil {
+				log.Println("Error recording failed login: ", err)
+			}
+		}
 		return nil, errors.New("invalid credentials")
 	}
 
-	token, err := s.TokenModel.GenerateJWT(user.ID, TokenDuration)
+	if err := s.LoginLimiter.Succeed(ctx, user.Email); err != nil {
+		log.Println("Error clearing failed logins: ", err)
+	}
+
+	return s.issueTokens(ctx, user.ID, input.SessionInfo)
+}
+
+/*
+ * Refresh exchanges a refresh token for a new token pair and revokes the old one.
+ * Presenting a token that was already rotated means it leaked, so the whole family
+ * is revoked and every device holding it has to log in again.
+ */
+func (s *AuthService) Refresh(ctx context.Context, input RefreshInput) (*models.Token, error) {
+	if input.RefreshToken == "" {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	current, err := s.RefreshTokenModel.FindByHash(ctx, models.HashToken(input.RefreshToken))
+	if err != nil {
+		if !errors.Is(err, models.ErrRefreshTokenNotFound) {
+			log.Println("Error finding refresh token: ", err)
+		}
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if current.RevokedAt.Valid {
+		log.Println("Refresh token reuse detected, revoking family:", current.FamilyID)
+		s.Audit.Record(ctx, AuditEntry{
+			ActorID:    current.UserID,
+			Action:     AuditRefreshTokenReuse,
+			TargetType: "session",
+			TargetID:   current.FamilyID.String(),
+			Err:        ErrInvalidRefreshToken,
+		})
+
+		if err := s.RefreshTokenModel.RevokeFamily(ctx, current.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if time.Now().After(current.ExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	/* Disable revokes the tokens, this still holds for any issued or missed since */
+	user, err := s.UserModel.FindByID(ctx, current.UserID)
 	if err != nil {
 		return nil, err
 	}
 
+	if user.DisabledAt != nil {
+		if err := s.RefreshTokenModel.RevokeFamily(ctx, current.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, ErrAccountDisabled
+	}
+
+	raw, err := models.NewOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	next, err := s.RefreshTokenModel.Rotate(ctx, current, models.HashToken(raw), time.Now().Add(RefreshTokenDuration))
+	if err != nil {
+		if errors.Is(err, models.ErrRefreshTokenNotFound) {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+
+	roles, err := s.Authz.RoleNames(ctx, next.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := s.TokenModel.GenerateJWT(next.UserID, next.FamilyID, roles, TokenDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	token.RefreshToken = raw
+	token.RefreshExpiresAt = next.ExpiresAt
+
 	return token, nil
 }
 
-func (s *AuthService) Logout(ctx context.Context) error {
-	// TODO: implement refresh token invalidation or blacklist
+/*
+ * Logout denylists the presented access token and revokes its refresh token family.
+ * It is best effort on purpose: an already expired access token must not prevent
+ * the refresh token in the body from being revoked.
+ */
+func (s *AuthService) Logout(ctx context.Context, accessToken string, input LogoutInput) error {
+	if accessToken != "" {
+		claims, err := s.TokenModel.ParseJWT(ctx, accessToken)
+		if err == nil {
+			s.Audit.Record(ctx, AuditEntry{
+				ActorID:    claims.UserID,
+				Action:     AuditLogout,
+				TargetType: "session",
+				TargetID:   claims.SessionID,
+			})
+
+			if err := s.TokenModel.Revoke(ctx, claims); err != nil {
+				return err
+			}
+
+			if familyID, err := uuid.Parse(claims.SessionID); err == nil {
+				if err := s.RefreshTokenModel.RevokeFamily(ctx, familyID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if input.RefreshToken != "" {
+		current, err := s.RefreshTokenModel.FindByHash(ctx, models.HashToken(input.RefreshToken))
+		if err == nil {
+			return s.RefreshTokenModel.RevokeFamily(ctx, current.FamilyID)
+		}
+
+		if !errors.Is(err, models.ErrRefreshTokenNotFound) {
+			return err
+		}
+	}
+
 	return nil
 }
+
+/* auditID leaves target_id empty when the user is unknown, e.g. a login with a wrong email */
+func auditID(id int64) string {
+	if id == 0 {
+		return ""
+	}
+
+	return strconv.FormatInt(id, 10)
+}
+
+func isValidEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+/* issueTokens starts a new refresh token family, i.e. a new login session */
+func (s *AuthService) issueTokens(ctx context.Context, userID int64, info SessionInfo) (*models.Token, error) {
+	familyID := uuid.New()
+
+	if err := s.SessionModel.Insert(ctx, familyID, userID, info.UserAgent, info.IP); err != nil {
+		return nil, err
+	}
+
+	raw, err := models.NewOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	refresh, err := s.RefreshTokenModel.Insert(ctx, userID, familyID, models.HashToken(raw), time.Now().Add(RefreshTokenDuration))
+	if err != nil {
+		return nil, err
+	}
+
+	roles, err := s.Authz.RoleNames(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := s.TokenModel.GenerateJWT(userID, familyID, roles, TokenDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	token.RefreshToken = raw
+	token.RefreshExpiresAt = refresh.ExpiresAt
+
+	return token, nil
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"context"
+	"errors"
+
+	"github.com/VicAlexandre/pds-backend/internal/models"
+)
+
+/* permissions are seeded by the 011_create_rbac migration */
+const (
+	PermApostilaEdit   = "apostila:edit"
+	PermApostilaRender = "apostila:render"
+	PermUserAdmin      = "user:admin"
+)
+
+const RoleAdmin = "admin"
+
+var (
+	ErrForbidden       = errors.New("forbidden")
+	ErrRoleRequired    = errors.New("role required")
+	ErrLastAdmin       = errors.New("cannot remove the last admin")
+	ErrRoleNotAssigned = errors.New("user does not have this role")
+)
+
+type GrantRoleInput struct {
+	Role string `json:"role"`
+}
+
+type AuthzService struct {
+	RoleModel *models.RoleModel
+	UserModel *models.UserModel
+	Audit     *AuditService
+}
+
+func NewAuthzService(roleModel *models.RoleModel, userModel *models.UserModel, audit *AuditService) *AuthzService {
+	return &AuthzService{
+		RoleModel: roleModel,
+		UserModel: userModel,
+		Audit:     audit,
+	}
+}
+
+/* Can reads the roles from the database, so a revoked role takes effect on the next request */
+func (s *AuthzService) Can(ctx context.Context, userID int64, permission string) (bool, error) {
+	return s.RoleModel.HasPermission(ctx, userID, permission)
+}
+
+/* Require is Can for callers that only need an error, it returns ErrForbidden when denied */
+func (s *AuthzService) Require(ctx context.Context, userID int64, permission string) error {
+	ok, err := s.Can(ctx, userID, permission)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrForbidden
+	}
+
+	return nil
+}
+
+/* RoleNames is what goes into the access token claims */
+func (s *AuthzService) RoleNames(ctx context.Context, userID int64) ([]string, error) {
+	roles, err := s.RoleModel.ListForUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(roles))
+	for _, role := range roles {
+		names = append(names, role.Name)
+	}
+
+	return names, nil
+}
+
+func (s *AuthzService) ListRoles(ctx context.Context) ([]models.Role, error) {
+	return s.RoleModel.List(ctx)
+}
+
+func (s *AuthzService) UserRoles(ctx context.Context, userID int64) ([]models.UserRole, error) {
+	if _, err := s.UserModel.FindByID(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	return s.RoleModel.ListForUser(ctx, userID)
+}
+
+/* role changes are audited with the admin from the request context as the actor */
+func (s *AuthzService) GrantRole(ctx context.Context, userID int64, input GrantRoleInput) (err error) {
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{Action: AuditRoleGrant, TargetType: "user", TargetID: auditID(userID), Err: err, Metadata: map[string]any{"role": input.Role}})
+	}()
+
+	if input.Role == "" {
+		return ErrRoleRequired
+	}
+
+	return s.RoleModel.Grant(ctx, userID, input.Role)
+}
+
+func (s *AuthzService) RevokeRole(ctx context.Context, userID int64, role string) (err error) {
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{Action: AuditRoleRevoke, TargetType: "user", TargetID: auditID(userID), Err: err, Metadata: map[string]any{"role": role}})
+	}()
+
+	roles, err := s.RoleNames(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	assigned := false
+	for _, name := range roles {
+		assigned = assigned || name == role
+	}
+
+	if !assigned {
+		return ErrRoleNotAssigned
+	}
+
+	if role == RoleAdmin {
+		err := s.RoleModel.RevokeUnlessLast(ctx, userID, role)
+		if errors.Is(err, models.ErrLastRoleHolder) {
+			return ErrLastAdmin
+		}
+		return err
+	}
+
+	return s.RoleModel.Revoke(ctx, userID, role)
+}
@@ -0,0 +1,926 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf16"
+
+	"github.com/VicAlexandre/pds-backend/internal/models"
+	"github.com/google/uuid"
+)
+
+const (
+	collabMaxDocumentUnits = 4 << 20
+	collabMaxSessions      = 25
+	collabHistoryLength    = 1000
+	collabSendBuffer       = 256
+	collabSnapshotDelay    = 5 * time.Second
+	collabSaveTimeout      = 30 * time.Second
+	collabRecheckInterval  = 30 * time.Second
+	collabCheckTimeout     = 10 * time.Second
+	collabSaveAttempts     = 3
+)
+
+var (
+	ErrCollabRoomFull = errors.New("too many editors in this apostila")
+	ErrCollabReadOnly = errors.New("read-only session")
+	ErrCollabStaleRev = errors.New("revision is not in the room history")
+	ErrCollabTooLarge = errors.New("document is too large")
+	ErrCollabRevoked  = errors.New("access to the apostila was revoked")
+	ErrCollabCheck    = errors.New("could not check access, try again")
+	ErrCollabNoSaver  = errors.New("nobody who edited the apostila can still save it")
+	ErrCollabNotSaved = errors.New("could not save the document")
+)
+
+/*
+ * CollabHub keeps one room per apostila that is open in the editor. A room holds the
+ * document in memory, merges the operations of its sessions with OT and saves a
+ * snapshot a few seconds after the last change, and when the last session leaves.
+ * Rooms live in this process only, so every editor of an apostila must reach the same
+ * instance.
+ */
+type CollabHub struct {
+	Apostilas *ApostilaService
+
+	mu          sync.Mutex
+	rooms       map[uuid.UUID]*collabRoom
+	nextSession atomic.Int64
+}
+
+func NewCollabHub(apostilas *ApostilaService) *CollabHub {
+	return &CollabHub{
+		Apostilas: apostilas,
+		rooms:     make(map[uuid.UUID]*collabRoom),
+	}
+}
+
+/*
+ * CollabCredential tells if the login that opened the socket, a session or a personal
+ * access token, is still active and its account enabled. An error means it could not tell.
+ */
+type CollabCredential func(ctx context.Context) (bool, error)
+
+/* CollabResume is where a reconnecting client left off: the room it was in and the last revision it saw */
+type CollabResume struct {
+	Room string
+	Rev  int
+}
+
+/* CollabPresence is a session as the other editors see it, positions count UTF-16 code units */
+type CollabPresence struct {
+	Session      int64  `json:"session"`
+	UserID       int64  `json:"user_id"`
+	Name         string `json:"name"`
+	CanEdit      bool   `json:"can_edit"`
+	Position     int    `json:"position"`
+	SelectionEnd int    `json:"selection_end"`
+}
+
+/* collabHello is the first message of a session: a full snapshot, or the operations missed while away */
+type collabHello struct {
+	Type     string           `json:"type"`
+	Room     string           `json:"room"`
+	Rev      int              `json:"rev"`
+	Session  int64            `json:"session"`
+	CanEdit  bool             `json:"can_edit"`
+	Document *string          `json:"document,omitempty"`
+	Ops      []textOp         `json:"ops,omitempty"`
+	Presence []CollabPresence `json:"presence"`
+}
+
+type collabAck struct {
+	Type string `json:"type"`
+	Rev  int    `json:"rev"`
+}
+
+type collabOp struct {
+	Type    string `json:"type"`
+	Rev     int    `json:"rev"`
+	Session int64  `json:"session"`
+	UserID  int64  `json:"user_id"`
+	Ops     textOp `json:"ops"`
+}
+
+/* collabPeer announces a session that joined or moved its cursor */
+type collabPeer struct {
+	Type string         `json:"type"`
+	Peer CollabPresence `json:"peer"`
+}
+
+type collabLeave struct {
+	Type    string `json:"type"`
+	Session int64  `json:"session"`
+}
+
+type collabError struct {
+	Type  string `json:"type"`
+	Error string `json:"error"`
+}
+
+/* collabSaved tells the sessions the document is saved again after a failure */
+type collabSaved struct {
+	Type    string `json:"type"`
+	Version int64  `json:"version"`
+}
+
+type collabClientMessage struct {
+	Type         string `json:"type"`
+	Rev          int    `json:"rev"`
+	Ops          textOp `json:"ops"`
+	Position     int    `json:"position"`
+	SelectionEnd int    `json:"selection_end"`
+}
+
+type collabRoom struct {
+	hub   *CollabHub
+	id    uuid.UUID
+	epoch string
+
+	/* ready is closed once the document is loaded, loadErr tells if that failed */
+	ready   chan struct{}
+	loadErr error
+
+	/* done is closed with the room, it stops the access checks */
+	done chan struct{}
+
+	mu       sync.Mutex
+	doc      []uint16
+	rev      int
+	history  []textOp
+	sessions map[int64]*CollabSession
+	closed   bool
+
+	/* version is the stored version the document descends from and base its content, a save must still find it */
+	version int64
+	base    []uint16
+
+	/* the snapshot is saved as the latest editor who can still edit, editors has them latest first */
+	dirty      bool
+	editors    []int64
+	orgID      *int64
+	timer      *time.Timer
+	saveFailed bool
+
+	saveMu sync.Mutex
+}
+
+/* CollabSession is one connection to a room. Send delivers its outgoing messages and is closed when it is dropped */
+type CollabSession struct {
+	room       *collabRoom
+	send       chan []byte
+	presence   CollabPresence
+	orgID      *int64
+	credential CollabCredential
+	left       bool
+
+	/* checks numbers the access checks, settled is the newest one applied */
+	checks  atomic.Int64
+	settled int64
+}
+
+/* collabVerdict is the outcome of an access check, seq orders checks that ran in parallel */
+type collabVerdict struct {
+	seq     int64
+	open    bool
+	canEdit bool
+}
+
+func (s *CollabSession) Send() <-chan []byte {
+	return s.send
+}
+
+/*
+ * Join checks the user may open the apostila and adds a session to its room. Readers
+ * get a read-only session, editing takes what a save takes. With a resume that is
+ * still in the room history the session starts with the missed operations, otherwise
+ * with a snapshot of the document. The checks and credential run again before every
+ * edit and every collabRecheckInterval, a session that fails them is closed.
+ */
+func (h *CollabHub) Join(ctx context.Context, id uuid.UUID, userID int64, orgID *int64, resume CollabResume, credential CollabCredential) (*CollabSession, error) {
+	canEdit, err := h.Apostilas.collabAccess(ctx, id, userID, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := h.Apostilas.UserModel.FindByID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("CollabHub.Join: %w", err)
+	}
+
+	session := &CollabSession{
+		send:       make(chan []byte, collabSendBuffer),
+		orgID:      orgID,
+		credential: credential,
+		presence: CollabPresence{
+			Session: h.nextSession.Add(1),
+			UserID:  userID,
+			Name:    user.Name,
+			CanEdit: canEdit,
+		},
+	}
+
+	/* a room closing right now is gone from the hub once closed, the next try opens a new one */
+	for {
+		room, err := h.room(ctx, id, userID, orgID)
+		if err != nil {
+			return nil, err
+		}
+
+		ok, err := room.add(session, resume)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return session, nil
+		}
+	}
+}
+
+/* room returns the open room of the apostila, loading the document when there is none */
+func (h *CollabHub) room(ctx context.Context, id uuid.UUID, userID int64, orgID *int64) (*collabRoom, error) {
+	h.mu.Lock()
+	room, ok := h.rooms[id]
+	if !ok {
+		room = &collabRoom{
+			hub:      h,
+			id:       id,
+			epoch:    uuid.NewString(),
+			ready:    make(chan struct{}),
+			done:     make(chan struct{}),
+			sessions: make(map[int64]*CollabSession),
+		}
+		h.rooms[id] = room
+	}
+	h.mu.Unlock()
+
+	if !ok {
+		edited, err := h.stored(ctx, id, userID, orgID)
+		if err != nil {
+			room.loadErr = fmt.Errorf("CollabHub.room: %w", err)
+			h.mu.Lock()
+			delete(h.rooms, id)
+			h.mu.Unlock()
+		} else {
+			room.doc = utf16.Encode([]rune(edited.HTML))
+			room.base, room.version, room.orgID = room.doc, edited.Version, orgID
+			go room.watch()
+		}
+		close(room.ready)
+	}
+
+	select {
+	case <-room.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if room.loadErr != nil {
+		return nil, room.loadErr
+	}
+
+	return room, nil
+}
+
+/* stored reads the saved document, GetEditedHTMLByID hides read errors behind an empty one and only a loaded one has metadata */
+func (h *CollabHub) stored(ctx context.Context, id uuid.UUID, userID int64, orgID *int64) (*models.EditedApostilaHTML, error) {
+	edited, err := h.Apostilas.ApostilaModel.GetEditedHTMLByID(ctx, id, userID, orgID)
+	if err == nil && edited.Metadata == nil {
+		err = models.ErrApostilaNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return edited, nil
+}
+
+/* add puts the session in the room and sends it the hello, it returns false if the room closed */
+func (r *collabRoom) add(s *CollabSession, resume CollabResume) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return false, nil
+	}
+
+	if len(r.sessions) >= collabMaxSessions {
+		return false, ErrCollabRoomFull
+	}
+
+	presence := make([]CollabPresence, 0, len(r.sessions))
+	for _, other := range r.sessions {
+		presence = append(presence, other.presence)
+	}
+
+	hello := collabHello{
+		Type:     "snapshot",
+		Room:     r.epoch,
+		Rev:      r.rev,
+		Session:  s.presence.Session,
+		CanEdit:  s.presence.CanEdit,
+		Presence: presence,
+	}
+	if missed, ok := r.since(resume); ok {
+		hello.Type = "catchup"
+		hello.Ops = missed
+	} else {
+		doc := string(utf16.Decode(r.doc))
+		hello.Document = &doc
+	}
+
+	r.broadcast(collabPeer{Type: "join", Peer: s.presence}, nil)
+	s.room = r
+	r.sessions[s.presence.Session] = s
+	r.deliver(s, hello)
+
+	return true, nil
+}
+
+/*
+ * Handle processes a message from the client. Problems with a message are reported
+ * back to the client only, the session stays open. An operation waits for the access
+ * checks, which query the database and so run outside the room lock.
+ */
+func (s *CollabSession) Handle(data []byte) {
+	room := s.room
+
+	var msg collabClientMessage
+	parseErr := json.Unmarshal(data, &msg)
+
+	var verdict collabVerdict
+	var checkErr error
+	if parseErr == nil && msg.Type == "op" {
+		verdict, checkErr = room.check(s)
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if s.left {
+		return
+	}
+
+	if parseErr != nil {
+		room.deliver(s, collabError{Type: "error", Error: "invalid message"})
+		return
+	}
+
+	var err error
+	switch msg.Type {
+	case "op":
+		if checkErr != nil {
+			log.Println("Error checking collab access: ", checkErr)
+			err = ErrCollabCheck
+			break
+		}
+
+		room.settleLocked(s, verdict)
+		if s.left {
+			return
+		}
+		err = room.applyLocked(s, msg.Rev, msg.Ops)
+	case "cursor":
+		err = room.moveCursorLocked(s, msg.Rev, msg.Position, msg.SelectionEnd)
+	default:
+		err = fmt.Errorf("unknown message type %q", msg.Type)
+	}
+
+	if err != nil {
+		room.deliver(s, collabError{Type: "error", Error: err.Error()})
+	}
+}
+
+/* Leave removes the session from its room, the last one out saves the document */
+func (s *CollabSession) Leave() {
+	room := s.room
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	room.removeLocked(s)
+}
+
+/*
+ * applyLocked transforms an operation made at rev over the ones applied since, like
+ * the ot.js server, then applies it, acknowledges it to its author and relays it.
+ */
+func (r *collabRoom) applyLocked(s *CollabSession, rev int, op textOp) error {
+	if !s.presence.CanEdit {
+		return ErrCollabReadOnly
+	}
+
+	concurrent, ok := r.opsSince(rev)
+	if !ok {
+		return ErrCollabStaleRev
+	}
+
+	for _, other := range concurrent {
+		var err error
+		if op, _, err = transformOps(op, other); err != nil {
+			return err
+		}
+	}
+
+	doc, err := op.apply(r.doc)
+	if err != nil {
+		return err
+	}
+	if len(doc) > collabMaxDocumentUnits {
+		return ErrCollabTooLarge
+	}
+
+	r.commitLocked(op, doc)
+	r.editors = slices.DeleteFunc(r.editors, func(id int64) bool { return id == s.presence.UserID })
+	r.editors = slices.Insert(r.editors, 0, s.presence.UserID)
+	r.markDirtyLocked()
+
+	r.deliver(s, collabAck{Type: "ack", Rev: r.rev})
+	r.broadcast(collabOp{Type: "op", Rev: r.rev, Session: s.presence.Session, UserID: s.presence.UserID, Ops: op}, s)
+
+	return nil
+}
+
+/* commitLocked makes doc, the document after op, the room's next revision */
+func (r *collabRoom) commitLocked(op textOp, doc []uint16) {
+	r.doc = doc
+	r.rev++
+	r.history = append(r.history, op)
+	if len(r.history) > collabHistoryLength {
+		r.history = r.history[len(r.history)-collabHistoryLength:]
+	}
+
+	for _, other := range r.sessions {
+		other.presence.Position = transformIndex(other.presence.Position, op)
+		other.presence.SelectionEnd = transformIndex(other.presence.SelectionEnd, op)
+	}
+}
+
+/* moveCursorLocked brings a cursor sent at rev up to date with the document and relays it */
+func (r *collabRoom) moveCursorLocked(s *CollabSession, rev, position, selectionEnd int) error {
+	concurrent, ok := r.opsSince(rev)
+	if !ok {
+		return ErrCollabStaleRev
+	}
+
+	for _, op := range concurrent {
+		position = transformIndex(position, op)
+		selectionEnd = transformIndex(selectionEnd, op)
+	}
+
+	s.presence.Position = min(max(position, 0), len(r.doc))
+	s.presence.SelectionEnd = min(max(selectionEnd, 0), len(r.doc))
+
+	r.broadcast(collabPeer{Type: "cursor", Peer: s.presence}, s)
+
+	return nil
+}
+
+/* opsSince returns the operations applied after rev, if the room still has all of them */
+func (r *collabRoom) opsSince(rev int) ([]textOp, bool) {
+	if rev > r.rev || rev < r.rev-len(r.history) {
+		return nil, false
+	}
+
+	return r.history[len(r.history)-(r.rev-rev):], true
+}
+
+/* since returns the operations a reconnecting client missed */
+func (r *collabRoom) since(resume CollabResume) ([]textOp, bool) {
+	if resume.Room != r.epoch {
+		return nil, false
+	}
+
+	missed, ok := r.opsSince(resume.Rev)
+	if !ok {
+		return nil, false
+	}
+
+	return append([]textOp{}, missed...), true
+}
+
+/* broadcast sends msg to every session but except */
+func (r *collabRoom) broadcast(msg any, except *CollabSession) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("Error encoding collab message: ", err)
+		return
+	}
+
+	var slow []*CollabSession
+	for _, s := range r.sessions {
+		if s == except {
+			continue
+		}
+
+		select {
+		case s.send <- data:
+		default:
+			slow = append(slow, s)
+		}
+	}
+
+	/* a client that cannot keep up is dropped, it reconnects and catches up */
+	for _, s := range slow {
+		r.removeLocked(s)
+	}
+}
+
+func (r *collabRoom) deliver(s *CollabSession, msg any) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("Error encoding collab message: ", err)
+		return
+	}
+
+	select {
+	case s.send <- data:
+	default:
+		r.removeLocked(s)
+	}
+}
+
+func (r *collabRoom) removeLocked(s *CollabSession) {
+	if s.left {
+		return
+	}
+
+	s.left = true
+	close(s.send)
+	delete(r.sessions, s.presence.Session)
+
+	r.broadcast(collabLeave{Type: "leave", Session: s.presence.Session}, nil)
+
+	if len(r.sessions) == 0 {
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+		go r.release()
+	}
+}
+
+func (r *collabRoom) markDirtyLocked() {
+	r.dirty = true
+	if r.timer == nil {
+		r.timer = time.AfterFunc(collabSnapshotDelay, func() { r.flush() })
+		return
+	}
+	r.timer.Reset(collabSnapshotDelay)
+}
+
+/*
+ * release saves the document of a room nobody is in and closes it. The room stays
+ * in the hub while saving, so a session joining meanwhile does not load a stale copy.
+ * With nobody left to tell, a failed save is tried a few more times before giving up.
+ */
+func (r *collabRoom) release() {
+	for attempt := 1; !r.flush(); attempt++ {
+		if attempt == collabSaveAttempts {
+			log.Println("Error saving collab snapshot, changes to apostila lost: ", r.id)
+			break
+		}
+		time.Sleep(time.Duration(attempt) * collabSnapshotDelay)
+	}
+
+	r.hub.mu.Lock()
+	defer r.hub.mu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.sessions) > 0 || r.closed {
+		return
+	}
+
+	r.closed = true
+	close(r.done)
+	if r.hub.rooms[r.id] == r {
+		delete(r.hub.rooms, r.id)
+	}
+}
+
+/*
+ * flush saves the document as an autosave of the version the room descends from, so a
+ * save made elsewhere meanwhile is merged in rather than overwritten. When no editor can
+ * save it or the save fails, the sessions are told and it is tried again after
+ * collabSnapshotDelay. It reports whether the document is saved.
+ */
+func (r *collabRoom) flush() bool {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), collabSaveTimeout)
+	defer cancel()
+
+	err := r.save(ctx)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		log.Println("Error saving collab snapshot: ", err)
+
+		r.dirty = true
+		if !r.saveFailed {
+			r.saveFailed = true
+			r.broadcast(collabError{Type: "save_error", Error: ErrCollabNotSaved.Error()}, nil)
+		}
+		if len(r.sessions) > 0 {
+			r.markDirtyLocked()
+		}
+		return false
+	}
+
+	if r.saveFailed {
+		r.saveFailed = false
+		r.broadcast(collabSaved{Type: "saved", Version: r.version}, nil)
+	}
+	return true
+}
+
+/* save expects the room's version, on a conflict it merges the stored document and tries again */
+func (r *collabRoom) save(ctx context.Context) error {
+	for attempt := 0; attempt < collabSaveAttempts; attempt++ {
+		r.mu.Lock()
+		if !r.dirty {
+			r.mu.Unlock()
+			return nil
+		}
+		r.dirty = false
+		doc, version, orgID := r.doc, r.version, r.orgID
+		editors := slices.Clone(r.editors)
+		for _, s := range r.sessions {
+			if s.presence.CanEdit && !slices.Contains(editors, s.presence.UserID) {
+				editors = append(editors, s.presence.UserID)
+			}
+		}
+		r.mu.Unlock()
+
+		saverID, err := r.saver(ctx, editors, orgID)
+		if err != nil {
+			return err
+		}
+
+		var input EditedApostilaInput
+		input.Data.Id = r.id.String()
+		input.Data.Html = string(utf16.Decode(doc))
+		input.Autosave = true
+		input.Version = &version
+
+		saved, err := r.hub.Apostilas.EditApostila(ctx, input, saverID, orgID)
+		if err == nil {
+			r.mu.Lock()
+			r.base, r.version = doc, saved
+			r.mu.Unlock()
+			return nil
+		}
+		if !errors.Is(err, models.ErrVersionConflict) {
+			return fmt.Errorf("collabRoom.save: %w", err)
+		}
+
+		if err := r.rebase(ctx, saverID, orgID); err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("collabRoom.save: %w", models.ErrVersionConflict)
+}
+
+/* saver returns the first of the editors whose account is enabled and who can still edit the apostila */
+func (r *collabRoom) saver(ctx context.Context, editors []int64, orgID *int64) (int64, error) {
+	for _, userID := range editors {
+		user, err := r.hub.Apostilas.UserModel.FindByID(ctx, userID)
+		if errors.Is(err, models.ErrUserNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("collabRoom.saver: %w", err)
+		}
+		if user.DisabledAt != nil {
+			continue
+		}
+
+		canEdit, err := r.hub.Apostilas.collabAccess(ctx, r.id, userID, orgID)
+		if errors.Is(err, ErrForbidden) || errors.Is(err, models.ErrApostilaNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("collabRoom.saver: %w", err)
+		}
+		if canEdit {
+			return userID, nil
+		}
+	}
+
+	return 0, ErrCollabNoSaver
+}
+
+/*
+ * rebase merges the stored document, saved elsewhere since the room's version, into the
+ * room as an operation of its own. The sessions get it like any other, with session 0,
+ * and the next save keeps both sides.
+ */
+func (r *collabRoom) rebase(ctx context.Context, userID int64, orgID *int64) error {
+	stored, err := r.hub.stored(ctx, r.id, userID, orgID)
+	if err != nil {
+		return fmt.Errorf("collabRoom.rebase: %w", err)
+	}
+	storedDoc := utf16.Encode([]rune(stored.HTML))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, op, err := transformOps(diffOps(r.base, r.doc), diffOps(r.base, storedDoc))
+	if err != nil {
+		return fmt.Errorf("collabRoom.rebase: %w", err)
+	}
+
+	doc, err := op.apply(r.doc)
+	if err != nil {
+		return fmt.Errorf("collabRoom.rebase: %w", err)
+	}
+
+	r.base, r.version = storedDoc, stored.Version
+	r.commitLocked(op, doc)
+	r.dirty = true
+
+	r.broadcast(collabOp{Type: "op", Rev: r.rev, Ops: op}, nil)
+
+	return nil
+}
+
+/* watch checks every session again on a timer, a revoked share, session or account must not keep its socket */
+func (r *collabRoom) watch() {
+	ticker := time.NewTicker(collabRecheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+
+		r.mu.Lock()
+		sessions := make([]*CollabSession, 0, len(r.sessions))
+		for _, s := range r.sessions {
+			sessions = append(sessions, s)
+		}
+		r.mu.Unlock()
+
+		for _, s := range sessions {
+			r.recheck(s)
+		}
+	}
+}
+
+/* recheck checks the session and applies the verdict, a check that could not run leaves it as it is */
+func (r *collabRoom) recheck(s *CollabSession) {
+	verdict, err := r.check(s)
+	if err != nil {
+		log.Println("Error checking collab access: ", err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.settleLocked(s, verdict)
+}
+
+/* check runs the checks of Join again: the login must still be valid and the user still allowed in */
+func (r *collabRoom) check(s *CollabSession) (collabVerdict, error) {
+	verdict := collabVerdict{seq: s.checks.Add(1)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), collabCheckTimeout)
+	defer cancel()
+
+	valid, err := s.credential(ctx)
+	if err != nil || !valid {
+		return verdict, err
+	}
+
+	canEdit, err := r.hub.Apostilas.collabAccess(ctx, r.id, s.presence.UserID, s.orgID)
+	if errors.Is(err, ErrForbidden) || errors.Is(err, models.ErrApostilaNotFound) {
+		return verdict, nil
+	}
+	if err != nil {
+		return verdict, err
+	}
+
+	verdict.open, verdict.canEdit = true, canEdit
+	return verdict, nil
+}
+
+/*
+ * settleLocked closes the session or changes its editing rights as the verdict says.
+ * Checks run in parallel, one that started before the last applied is ignored.
+ */
+func (r *collabRoom) settleLocked(s *CollabSession, verdict collabVerdict) {
+	if s.left || verdict.seq <= s.settled {
+		return
+	}
+	s.settled = verdict.seq
+
+	if !verdict.open {
+		r.deliver(s, collabError{Type: "error", Error: ErrCollabRevoked.Error()})
+		r.removeLocked(s)
+		return
+	}
+
+	if verdict.canEdit != s.presence.CanEdit {
+		s.presence.CanEdit = verdict.canEdit
+		r.broadcast(collabPeer{Type: "access", Peer: s.presence}, nil)
+	}
+}
+
+/* dropUser closes the sessions of the user in the apostila's room right away, their permission is gone */
+func (h *CollabHub) dropUser(id uuid.UUID, userID int64) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	room := h.rooms[id]
+	h.mu.Unlock()
+	if room == nil {
+		return
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	for _, s := range room.sessions {
+		if s.presence.UserID == userID {
+			room.settleLocked(s, collabVerdict{seq: s.checks.Add(1)})
+		}
+	}
+	room.editors = slices.DeleteFunc(room.editors, func(id int64) bool { return id == userID })
+}
+
+/* recheckUser checks the sessions of the user in the apostila's room again, their permission level changed */
+func (h *CollabHub) recheckUser(id uuid.UUID, userID int64) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	room := h.rooms[id]
+	h.mu.Unlock()
+	if room == nil {
+		return
+	}
+
+	room.mu.Lock()
+	var sessions []*CollabSession
+	for _, s := range room.sessions {
+		if s.presence.UserID == userID {
+			sessions = append(sessions, s)
+		}
+	}
+	room.mu.Unlock()
+
+	for _, s := range sessions {
+		go room.recheck(s)
+	}
+}
+
+/*
+ * collabAccess lets in whoever can read the apostila. Editing also takes the editor
+ * permission, the edit permission of the role, the teacher or admin role in an
+ * organization and a verified email.
+ */
+func (s *ApostilaService) collabAccess(ctx context.Context, id uuid.UUID, userID int64, orgID *int64) (bool, error) {
+	apostila, err := s.GetApostila(ctx, id, userID, orgID)
+	if err != nil {
+		return false, err
+	}
+
+	if !models.AccessAtLeast(apostila.Access, models.PermissionEditor) {
+		return false, nil
+	}
+
+	checks := []func() error{
+		func() error { return s.Authz.Require(ctx, userID, PermApostilaEdit) },
+		func() error {
+			return s.requireWorkspaceRole(ctx, orgID, userID, models.OrgRoleAdmin, models.OrgRoleTeacher)
+		},
+		func() error { return s.EmailVerification.RequireVerified(ctx, s.VerificationPolicy, userID) },
+	}
+
+	for _, check := range checks {
+		err := check()
+		if errors.Is(err, ErrForbidden) || errors.Is(err, ErrEmailNotVerified) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,272 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+)
+
+var ErrInvalidOperation = errors.New("invalid operation")
+
+/*
+ * textOp is a text operation in the format of ot.js: a list of retains (positive ints),
+ * deletes (negative ints) and inserts (strings) that walks the whole document. Lengths
+ * count UTF-16 code units, like JavaScript strings, so browser editors need no conversion.
+ */
+type textOp struct {
+	comps  []opComp
+	base   int
+	target int
+}
+
+/* opComp is a retain when n > 0, a delete when n < 0 and an insert otherwise */
+type opComp struct {
+	n      int
+	insert []uint16
+}
+
+func (o *textOp) retain(n int) {
+	if n == 0 {
+		return
+	}
+	o.base += n
+	o.target += n
+	if last := len(o.comps) - 1; last >= 0 && o.comps[last].n > 0 {
+		o.comps[last].n += n
+		return
+	}
+	o.comps = append(o.comps, opComp{n: n})
+}
+
+/* insert keeps inserts before deletes at the same position, so equal operations have one form */
+func (o *textOp) insert(s []uint16) {
+	if len(s) == 0 {
+		return
+	}
+	o.target += len(s)
+	last := len(o.comps) - 1
+	switch {
+	case last >= 0 && o.comps[last].insert != nil:
+		o.comps[last].insert = append(o.comps[last].insert, s...)
+	case last >= 0 && o.comps[last].n < 0:
+		if last > 0 && o.comps[last-1].insert != nil {
+			o.comps[last-1].insert = append(o.comps[last-1].insert, s...)
+			return
+		}
+		del := o.comps[last]
+		o.comps[last] = opComp{insert: append([]uint16(nil), s...)}
+		o.comps = append(o.comps, del)
+	default:
+		o.comps = append(o.comps, opComp{insert: append([]uint16(nil), s...)})
+	}
+}
+
+func (o *textOp) delete(n int) {
+	if n == 0 {
+		return
+	}
+	o.base += n
+	if last := len(o.comps) - 1; last >= 0 && o.comps[last].n < 0 {
+		o.comps[last].n -= n
+		return
+	}
+	o.comps = append(o.comps, opComp{n: -n})
+}
+
+func (o *textOp) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return ErrInvalidOperation
+	}
+
+	*o = textOp{}
+	for _, r := range raw {
+		/* only a JSON string is an insert, null would decode as an empty one */
+		if len(r) > 0 && r[0] == '"' {
+			var s string
+			if err := json.Unmarshal(r, &s); err != nil {
+				return ErrInvalidOperation
+			}
+			o.insert(utf16.Encode([]rune(s)))
+			continue
+		}
+
+		var n int
+		if err := json.Unmarshal(r, &n); err != nil || n == 0 {
+			return ErrInvalidOperation
+		}
+		if n > 0 {
+			o.retain(n)
+		} else {
+			o.delete(-n)
+		}
+	}
+
+	return nil
+}
+
+func (o textOp) MarshalJSON() ([]byte, error) {
+	out := make([]any, 0, len(o.comps))
+	for _, c := range o.comps {
+		if c.insert != nil {
+			out = append(out, string(utf16.Decode(c.insert)))
+		} else {
+			out = append(out, c.n)
+		}
+	}
+
+	return json.Marshal(out)
+}
+
+/* apply returns the document after the operation, which must span all of it */
+func (o textOp) apply(doc []uint16) ([]uint16, error) {
+	if len(doc) != o.base {
+		return nil, fmt.Errorf("%w: spans %d code units, the document has %d", ErrInvalidOperation, o.base, len(doc))
+	}
+
+	out := make([]uint16, 0, o.target)
+	pos := 0
+	for _, c := range o.comps {
+		switch {
+		case c.insert != nil:
+			out = append(out, c.insert...)
+		case c.n > 0:
+			if c.n > len(doc)-pos {
+				return nil, fmt.Errorf("%w: retains past the end of the document", ErrInvalidOperation)
+			}
+			out = append(out, doc[pos:pos+c.n]...)
+			pos += c.n
+		default:
+			if -c.n > len(doc)-pos {
+				return nil, fmt.Errorf("%w: deletes past the end of the document", ErrInvalidOperation)
+			}
+			pos -= c.n
+		}
+	}
+
+	if pos != len(doc) {
+		return nil, fmt.Errorf("%w: does not span the document", ErrInvalidOperation)
+	}
+
+	return out, nil
+}
+
+/*
+ * transformOps returns a' and b' such that applying a then b' equals applying b then a'.
+ * It is the transform of ot.js: when both insert at the same place, a's text goes first.
+ */
+func transformOps(a, b textOp) (textOp, textOp, error) {
+	if a.base != b.base {
+		return textOp{}, textOp{}, fmt.Errorf("%w: concurrent operations span different documents", ErrInvalidOperation)
+	}
+
+	var aPrime, bPrime textOp
+	ca, cb := a.comps, b.comps
+	var opA, opB *opComp
+	next := func(comps *[]opComp) *opComp {
+		if len(*comps) == 0 {
+			return nil
+		}
+		c := (*comps)[0]
+		*comps = (*comps)[1:]
+		return &c
+	}
+	opA, opB = next(&ca), next(&cb)
+
+	for opA != nil || opB != nil {
+		if opA != nil && opA.insert != nil {
+			aPrime.insert(opA.insert)
+			bPrime.retain(len(opA.insert))
+			opA = next(&ca)
+			continue
+		}
+		if opB != nil && opB.insert != nil {
+			aPrime.retain(len(opB.insert))
+			bPrime.insert(opB.insert)
+			opB = next(&cb)
+			continue
+		}
+		if opA == nil || opB == nil {
+			return textOp{}, textOp{}, fmt.Errorf("%w: operation is too short", ErrInvalidOperation)
+		}
+
+		switch {
+		case opA.n > 0 && opB.n > 0:
+			m := min(opA.n, opB.n)
+			aPrime.retain(m)
+			bPrime.retain(m)
+			opA.n -= m
+			opB.n -= m
+		case opA.n < 0 && opB.n < 0:
+			m := min(-opA.n, -opB.n)
+			opA.n += m
+			opB.n += m
+		case opA.n < 0 && opB.n > 0:
+			m := min(-opA.n, opB.n)
+			aPrime.delete(m)
+			opA.n += m
+			opB.n -= m
+		default:
+			m := min(opA.n, -opB.n)
+			bPrime.delete(m)
+			opA.n -= m
+			opB.n += m
+		}
+
+		if opA.n == 0 {
+			opA = next(&ca)
+		}
+		if opB.n == 0 {
+			opB = next(&cb)
+		}
+	}
+
+	return aPrime, bPrime, nil
+}
+
+/*
+ * diffOps returns an operation that turns from into to, keeping their common start and
+ * end and replacing what is between. It turns a save made outside a room into an
+ * operation the room can merge.
+ */
+func diffOps(from, to []uint16) textOp {
+	prefix := 0
+	for prefix < len(from) && prefix < len(to) && from[prefix] == to[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(from)-prefix && suffix < len(to)-prefix && from[len(from)-1-suffix] == to[len(to)-1-suffix] {
+		suffix++
+	}
+
+	var o textOp
+	o.retain(prefix)
+	o.insert(to[prefix : len(to)-suffix])
+	o.delete(len(from) - prefix - suffix)
+	o.retain(suffix)
+
+	return o
+}
+
+/* transformIndex moves a cursor position over an operation applied before it */
+func transformIndex(index int, o textOp) int {
+	newIndex := index
+	for _, c := range o.comps {
+		switch {
+		case c.insert != nil:
+			newIndex += len(c.insert)
+		case c.n > 0:
+			index -= c.n
+		default:
+			newIndex -= min(index, -c.n)
+			index += c.n
+		}
+		if index < 0 {
+			break
+		}
+	}
+
+	return newIndex
+}
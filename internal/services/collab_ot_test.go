@@ -0,0 +1,386 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"testing"
+	"unicode/utf16"
+)
+
+func mustOp(t *testing.T, s string) textOp {
+	t.Helper()
+
+	var o textOp
+	if err := json.Unmarshal([]byte(s), &o); err != nil {
+		t.Fatalf("parsing %s: %v", s, err)
+	}
+
+	return o
+}
+
+func opJSON(t *testing.T, o textOp) string {
+	t.Helper()
+
+	b, err := json.Marshal(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+func applyString(t *testing.T, o textOp, doc string) string {
+	t.Helper()
+
+	out, err := o.apply(utf16.Encode([]rune(doc)))
+	if err != nil {
+		t.Fatalf("applying %s to %q: %v", opJSON(t, o), doc, err)
+	}
+
+	return string(utf16.Decode(out))
+}
+
+func TestTextOpJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{`[3]`, `[3]`},
+		{`[1, 2]`, `[3]`},
+		{`["a", "b"]`, `["ab"]`},
+		{`[-1, -2]`, `[-3]`},
+		{`[1, -2, "x"]`, `[1,"x",-2]`},
+		{`[1, -2, "x", -1, "y"]`, `[1,"xy",-3]`},
+		{`["é😀"]`, `["é😀"]`},
+		{`[]`, `[]`},
+	}
+
+	for _, tt := range tests {
+		if got := opJSON(t, mustOp(t, tt.in)); got != tt.want {
+			t.Errorf("round trip of %s = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{`[0]`, `[1.5]`, `[true]`, `{"ops": []}`, `[null]`} {
+		var o textOp
+		if err := json.Unmarshal([]byte(bad), &o); !errors.Is(err, ErrInvalidOperation) {
+			t.Errorf("parsing %s = %v, want ErrInvalidOperation", bad, err)
+		}
+	}
+}
+
+func TestTextOpLengthsCountUTF16(t *testing.T) {
+	/* the emoji is a surrogate pair, two code units like in JavaScript */
+	o := mustOp(t, `[1, "😀", -1]`)
+	if o.base != 2 || o.target != 3 {
+		t.Errorf("base, target = %d, %d, want 2, 3", o.base, o.target)
+	}
+
+	if got := applyString(t, mustOp(t, `[-2, 1]`), "😀a"); got != "a" {
+		t.Errorf("deleting the surrogate pair = %q, want %q", got, "a")
+	}
+}
+
+func TestTextOpApply(t *testing.T) {
+	tests := []struct {
+		op   string
+		doc  string
+		want string
+	}{
+		{`[3]`, "abc", "abc"},
+		{`["x", 3]`, "abc", "xabc"},
+		{`[3, "x"]`, "abc", "abcx"},
+		{`[1, -1, 1]`, "abc", "ac"},
+		{`[-3, "xyz"]`, "abc", "xyz"},
+		{`["x"]`, "", "x"},
+	}
+
+	for _, tt := range tests {
+		if got := applyString(t, mustOp(t, tt.op), tt.doc); got != tt.want {
+			t.Errorf("%s on %q = %q, want %q", tt.op, tt.doc, got, tt.want)
+		}
+	}
+}
+
+func TestTextOpApplyLengthMismatch(t *testing.T) {
+	tests := []struct {
+		op  string
+		doc string
+	}{
+		{`[2]`, "abc"},
+		{`[4]`, "abc"},
+		{`[1, -5]`, "abc"},
+		{`[-4]`, "abc"},
+		{`["x"]`, "abc"},
+		{`[1]`, ""},
+	}
+
+	for _, tt := range tests {
+		_, err := mustOp(t, tt.op).apply(utf16.Encode([]rune(tt.doc)))
+		if !errors.Is(err, ErrInvalidOperation) {
+			t.Errorf("%s on %q = %v, want ErrInvalidOperation", tt.op, tt.doc, err)
+		}
+	}
+}
+
+/* the expected a' and b' are the ones ot.js produces for the same pair */
+func TestTransformOps(t *testing.T) {
+	tests := []struct {
+		name       string
+		doc        string
+		a, b       string
+		wantAPrime string
+		wantBPrime string
+		want       string
+	}{
+		{
+			name: "concurrent inserts at the same index, a goes first",
+			doc:  "abc", a: `[1, "X", 2]`, b: `[1, "Y", 2]`,
+			wantAPrime: `[1,"X",3]`, wantBPrime: `[2,"Y",2]`,
+			want: "aXYbc",
+		},
+		{
+			name: "concurrent inserts at the start",
+			doc:  "abc", a: `["X", 3]`, b: `["Y", 3]`,
+			wantAPrime: `["X",4]`, wantBPrime: `[1,"Y",3]`,
+			want: "XYabc",
+		},
+		{
+			name: "concurrent inserts at the end",
+			doc:  "abc", a: `[3, "X"]`, b: `[3, "Y"]`,
+			wantAPrime: `[3,"X",1]`, wantBPrime: `[4,"Y"]`,
+			want: "abcXY",
+		},
+		{
+			name: "inserts at different places",
+			doc:  "abc", a: `["X", 3]`, b: `[3, "Y"]`,
+			wantAPrime: `["X",4]`, wantBPrime: `[4,"Y"]`,
+			want: "XabcY",
+		},
+		{
+			name: "overlapping deletes",
+			doc:  "abcdef", a: `[1, -3, 2]`, b: `[2, -3, 1]`,
+			wantAPrime: `[1,-1,1]`, wantBPrime: `[1,-1,1]`,
+			want: "af",
+		},
+		{
+			name: "the same delete",
+			doc:  "abc", a: `[1, -1, 1]`, b: `[1, -1, 1]`,
+			wantAPrime: `[2]`, wantBPrime: `[2]`,
+			want: "ac",
+		},
+		{
+			name: "one delete inside the other",
+			doc:  "abcdef", a: `[-6]`, b: `[2, -2, 2]`,
+			wantAPrime: `[-4]`, wantBPrime: `[]`,
+			want: "",
+		},
+		{
+			name: "insert inside a deleted range",
+			doc:  "abcdef", a: `[1, -3, 2]`, b: `[2, "X", 4]`,
+			wantAPrime: `[1,-1,1,-2,2]`, wantBPrime: `[1,"X",2]`,
+			want: "aXef",
+		},
+		{
+			name: "delete against a retain",
+			doc:  "abc", a: `[-1, 2]`, b: `[3]`,
+			wantAPrime: `[-1,2]`, wantBPrime: `[2]`,
+			want: "bc",
+		},
+		{
+			name: "replace against replace",
+			doc:  "abc", a: `[-3, "x"]`, b: `[-3, "y"]`,
+			wantAPrime: `["x",1]`, wantBPrime: `[1,"y"]`,
+			want: "xy",
+		},
+	}
+
+	for _, tt := range tests {
+		a, b := mustOp(t, tt.a), mustOp(t, tt.b)
+
+		aPrime, bPrime, err := transformOps(a, b)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if got := opJSON(t, aPrime); got != tt.wantAPrime {
+			t.Errorf("%s: a' = %s, want %s", tt.name, got, tt.wantAPrime)
+		}
+		if got := opJSON(t, bPrime); got != tt.wantBPrime {
+			t.Errorf("%s: b' = %s, want %s", tt.name, got, tt.wantBPrime)
+		}
+
+		viaA := applyString(t, bPrime, applyString(t, a, tt.doc))
+		viaB := applyString(t, aPrime, applyString(t, b, tt.doc))
+		if viaA != tt.want || viaB != tt.want {
+			t.Errorf("%s: a then b' = %q, b then a' = %q, want %q", tt.name, viaA, viaB, tt.want)
+		}
+	}
+}
+
+func TestTransformOpsLengthMismatch(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		{`[3]`, `[2]`},
+		{`[-3]`, `[2]`},
+		{`[1, -1]`, `[3]`},
+		{`["x"]`, `[1]`},
+	}
+
+	for _, tt := range tests {
+		if _, _, err := transformOps(mustOp(t, tt.a), mustOp(t, tt.b)); !errors.Is(err, ErrInvalidOperation) {
+			t.Errorf("transform(%s, %s) = %v, want ErrInvalidOperation", tt.a, tt.b, err)
+		}
+	}
+}
+
+/* a client op made at an older revision is transformed over each op it missed, as the room does */
+func TestTransformOverHistory(t *testing.T) {
+	doc := "hello"
+	history := []textOp{
+		mustOp(t, `["¡", 5]`),
+		mustOp(t, `[6, " world"]`),
+		mustOp(t, `[1, -1, 10]`),
+	}
+	client := mustOp(t, `[5, "!"]`)
+
+	server := doc
+	for _, h := range history {
+		server = applyString(t, h, server)
+	}
+
+	for _, h := range history {
+		var err error
+		client, _, err = transformOps(client, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := applyString(t, client, server); got != "¡ello! world" {
+		t.Errorf("got %q, want %q", got, "¡ello! world")
+	}
+}
+
+func TestTransformIndex(t *testing.T) {
+	tests := []struct {
+		name  string
+		index int
+		op    string
+		want  int
+	}{
+		{"insert before", 3, `["xy", 5]`, 5},
+		{"insert after", 1, `[3, "xy", 2]`, 1},
+		{"insert at the cursor pushes it", 2, `[2, "xy", 3]`, 4},
+		{"delete before", 4, `[-2, 3]`, 2},
+		{"delete after", 1, `[2, -3]`, 1},
+		{"delete around", 3, `[1, -4]`, 1},
+		{"retain only", 2, `[5]`, 2},
+	}
+
+	for _, tt := range tests {
+		if got := transformIndex(tt.index, mustOp(t, tt.op)); got != tt.want {
+			t.Errorf("%s: transformIndex(%d, %s) = %d, want %d", tt.name, tt.index, tt.op, got, tt.want)
+		}
+	}
+}
+
+func TestDiffOps(t *testing.T) {
+	tests := []struct {
+		from string
+		to   string
+		want string
+	}{
+		{"hello", "hello", `[5]`},
+		{"hello", "help", `[3, "p", -2]`},
+		{"world", "hello world", `["hello ", 5]`},
+		{"hello world", "hello", `[5, -6]`},
+		{"", "abc", `["abc"]`},
+		{"abc", "", `[-3]`},
+		{"aXa", "aYa", `[1, "Y", -1, 1]`},
+		{"aaa", "aaaa", `[3, "a"]`},
+	}
+
+	for _, tt := range tests {
+		o := diffOps(utf16.Encode([]rune(tt.from)), utf16.Encode([]rune(tt.to)))
+		if got := opJSON(t, o); got != opJSON(t, mustOp(t, tt.want)) {
+			t.Errorf("diffOps(%q, %q) = %s, want %s", tt.from, tt.to, got, tt.want)
+		}
+		if got := applyString(t, o, tt.from); got != tt.to {
+			t.Errorf("diffOps(%q, %q) applies to %q", tt.from, tt.to, got)
+		}
+	}
+}
+
+/* a save made outside the room is merged in as the room does on a version conflict */
+func TestDiffOpsMergesOutsideSave(t *testing.T) {
+	base := utf16.Encode([]rune("<p>one</p><p>two</p>"))
+	room := utf16.Encode([]rune("<p>one!</p><p>two</p>"))
+	stored := utf16.Encode([]rune("<p>one</p><p>two</p><p>three</p>"))
+
+	_, op, err := transformOps(diffOps(base, room), diffOps(base, stored))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := op.apply(room)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := string(utf16.Decode(merged)), "<p>one!</p><p>two</p><p>three</p>"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+/* randomOp builds an operation over a document of length n */
+func randomOp(rng *rand.Rand, n int) textOp {
+	var o textOp
+	for pos := 0; pos < n; {
+		k := 1 + rng.Intn(n-pos)
+		switch rng.Intn(3) {
+		case 0:
+			o.retain(k)
+			pos += k
+		case 1:
+			o.delete(k)
+			pos += k
+		default:
+			o.insert(utf16.Encode([]rune(string(rune('a' + rng.Intn(26))))))
+		}
+	}
+	if rng.Intn(2) == 0 {
+		o.insert([]uint16{'Z'})
+	}
+
+	return o
+}
+
+func TestTransformOpsConverges(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 2000; i++ {
+		doc := make([]uint16, rng.Intn(20))
+		for j := range doc {
+			doc[j] = uint16('A' + rng.Intn(26))
+		}
+
+		a, b := randomOp(rng, len(doc)), randomOp(rng, len(doc))
+		aPrime, bPrime, err := transformOps(a, b)
+		if err != nil {
+			t.Fatalf("transform(%s, %s): %v", opJSON(t, a), opJSON(t, b), err)
+		}
+
+		afterA, _ := a.apply(doc)
+		afterB, _ := b.apply(doc)
+		viaA, errA := bPrime.apply(afterA)
+		viaB, errB := aPrime.apply(afterB)
+		if errA != nil || errB != nil || string(utf16.Decode(viaA)) != string(utf16.Decode(viaB)) {
+			t.Fatalf("transform(%s, %s) does not converge on %q: %q (%v), %q (%v)",
+				opJSON(t, a), opJSON(t, b), string(utf16.Decode(doc)), string(utf16.Decode(viaA)), errA, string(utf16.Decode(viaB)), errB)
+		}
+	}
+}
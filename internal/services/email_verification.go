@@ -0,0 +1,142 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/VicAlexandre/pds-backend/internal/mailer"
+	"github.com/VicAlexandre/pds-backend/internal/models"
+)
+
+const (
+	VerificationTokenDuration  = 48 * time.Hour
+	VerificationResendCooldown = time.Minute
+)
+
+/* EmailVerificationPolicy decides what an account can do before its address is verified */
+type EmailVerificationPolicy string
+
+const (
+	EmailVerificationOff     EmailVerificationPolicy = "off"
+	EmailVerificationEnforce EmailVerificationPolicy = "enforce"
+)
+
+var (
+	ErrInvalidVerificationToken = errors.New("invalid or expired verification token")
+	ErrEmailAlreadyVerified     = errors.New("email already verified")
+	ErrEmailNotVerified         = errors.New("email address not verified")
+	ErrVerificationThrottled    = errors.New("verification email sent recently, try again later")
+)
+
+type VerifyEmailInput struct {
+	Token string `json:"token"`
+}
+
+type EmailVerificationService struct {
+	UserModel  *models.UserModel
+	TokenModel *models.JWTModel
+	Mailer     mailer.Mailer
+	BaseURL    string
+}
+
+func NewEmailVerificationService(userModel *models.UserModel, tokenModel *models.JWTModel, m mailer.Mailer, baseURL string) *EmailVerificationService {
+	return &EmailVerificationService{
+		UserModel:  userModel,
+		TokenModel: tokenModel,
+		Mailer:     m,
+		BaseURL:    baseURL,
+	}
+}
+
+/* SendAsync sends the verification email without holding up the request that triggered it */
+func (s *EmailVerificationService) SendAsync(ctx context.Context, user *models.User) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+
+		claimed, err := s.UserModel.ClaimVerificationSend(ctx, user.ID, VerificationResendCooldown)
+		if err != nil || !claimed {
+			log.Println("Skipping verification email for user", user.ID, err)
+			return
+		}
+
+		if err := s.send(ctx, user); err != nil {
+			log.Println("Error sending verification email: ", err)
+		}
+	}()
+}
+
+func (s *EmailVerificationService) Resend(ctx context.Context, userID int64) error {
+	user, err := s.UserModel.FindByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if user.EmailVerifiedAt != nil {
+		return ErrEmailAlreadyVerified
+	}
+
+	claimed, err := s.UserModel.ClaimVerificationSend(ctx, user.ID, VerificationResendCooldown)
+	if err != nil {
+		return err
+	}
+
+	if !claimed {
+		return ErrVerificationThrottled
+	}
+
+	return s.send(ctx, user)
+}
+
+func (s *EmailVerificationService) Verify(ctx context.Context, input VerifyEmailInput) error {
+	claims, err := s.TokenModel.ParseEmailVerificationToken(input.Token)
+	if err != nil {
+		return ErrInvalidVerificationToken
+	}
+
+	if err := s.UserModel.MarkEmailVerified(ctx, claims.UserID, claims.Email); err != nil {
+		log.Println("Error marking email as verified: ", err)
+		return ErrInvalidVerificationToken
+	}
+
+	return nil
+}
+
+/* RequireVerified enforces the policy for actions that need a verified address */
+func (s *EmailVerificationService) RequireVerified(ctx context.Context, policy EmailVerificationPolicy, userID int64) error {
+	if policy != EmailVerificationEnforce {
+		return nil
+	}
+
+	user, err := s.UserModel.FindByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if user.EmailVerifiedAt == nil {
+		return ErrEmailNotVerified
+	}
+
+	return nil
+}
+
+func (s *EmailVerificationService) send(ctx context.Context, user *models.User) error {
+	token, err := s.TokenModel.GenerateEmailVerificationToken(user.ID, user.Email, VerificationTokenDuration)
+	if err != nil {
+		return err
+	}
+
+	msg, err := mailer.Render("email_verification", user.Email, "Confirme seu e-mail", map[string]any{
+		"Name":      user.Name,
+		"Link":      s.BaseURL + "/verify-email?token=" + url.QueryEscape(token),
+		"ExpiresIn": "48 horas",
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.Mailer.Send(ctx, msg)
+}
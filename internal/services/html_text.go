@@ -0,0 +1,49 @@
+package services
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	headingPattern = regexp.MustCompile(`(?is)<h[1-6](?:\s[^>]*)?>(.*?)</h[1-6]\s*>`)
+	hiddenPattern  = regexp.MustCompile(`(?is)<!--.*?-->|<script\b.*?</script\s*>|<style\b.*?</style\s*>|<head\b.*?</head\s*>`)
+	controlPattern = regexp.MustCompile(`[\x00-\x08\x0b\x0c\x0e-\x1f\x7f]`)
+	tagPattern     = regexp.MustCompile(`(?s)<[^>]*>`)
+	spacePattern   = regexp.MustCompile(`\s+`)
+)
+
+/* firstHeading is the text of the first h1-h6 in the document, the default title of an apostila */
+func firstHeading(doc string) string {
+	m := headingPattern.FindStringSubmatch(doc)
+	if m == nil {
+		return ""
+	}
+
+	return truncateRunes(collapseSpaces(html.UnescapeString(tagPattern.ReplaceAllString(m[1], ""))), maxApostilaTitleLength)
+}
+
+/*
+ * plainText is what full-text search indexes: the visible text of the document, without
+ * scripts, styles and comments. Tags become spaces so block elements do not glue words.
+ */
+func plainText(doc string) string {
+	doc = hiddenPattern.ReplaceAllString(doc, " ")
+	doc = html.UnescapeString(tagPattern.ReplaceAllString(doc, " "))
+
+	return collapseSpaces(controlPattern.ReplaceAllString(doc, " "))
+}
+
+func collapseSpaces(s string) string {
+	return strings.TrimSpace(spacePattern.ReplaceAllString(s, " "))
+}
+
+func truncateRunes(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+
+	return strings.TrimSpace(string(r[:n]))
+}
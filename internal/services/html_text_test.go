@@ -0,0 +1,66 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestFirstHeading(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{"none", "<p>texto</p>", ""},
+		{"first of several", "<p>intro</p><h2>Frações</h2><h1>Outro</h1>", "Frações"},
+		{"attributes and inner tags", `<h1 class="t">Aula <em>1</em>:  <b>Soma</b></h1>`, "Aula 1: Soma"},
+		{"entities", "<h3>Pão &amp; Circo &lt;2&gt; &eacute; &#128512;</h3>", "Pão & Circo <2> é 😀"},
+		{"across lines", "<H1>\n  Título\n  longo\n</H1 >", "Título longo"},
+		{"not a heading", "<header>Cabeçalho</header><h1>Certo</h1>", "Certo"},
+	}
+
+	for _, tt := range tests {
+		if got := firstHeading(tt.doc); got != tt.want {
+			t.Errorf("%s: firstHeading = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+/* the default title is cut on a rune boundary, never in the middle of an accented letter */
+func TestFirstHeadingTruncatesRunes(t *testing.T) {
+	got := firstHeading("<h1>" + strings.Repeat("ção ", 100) + "</h1>")
+
+	if n := utf8.RuneCountInString(got); n > maxApostilaTitleLength {
+		t.Errorf("title has %d runes, want at most %d", n, maxApostilaTitleLength)
+	}
+	if !utf8.ValidString(got) || strings.HasSuffix(got, " ") {
+		t.Errorf("title %q is not valid, trimmed UTF-8", got)
+	}
+}
+
+func TestPlainText(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{"empty", "", ""},
+		{"blocks do not glue words", "<p>uma</p><p>duas</p><ul><li>três</li></ul>", "uma duas três"},
+		{"entities", "<p>Pão &amp; Circo &lt;b&gt; &quot;x&quot; &eacute; &#233; &#x1F600;&nbsp;fim</p>", "Pão & Circo <b> \"x\" é é 😀\u00a0fim"},
+		{"escaped tags stay text", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>", "<script>alert(1)</script>"},
+		{"script", "<p>antes</p><script type=\"text/javascript\">var senha = \"x\";</script><p>depois</p>", "antes depois"},
+		{"style", "<style>\np { color: red }\n</style><p>visível</p>", "visível"},
+		{"head", "<html><head><title>Meta</title></head><body><p>corpo</p></body></html>", "corpo"},
+		{"comment", "<p>a<!-- rascunho --></p><p>b</p>", "a b"},
+		{"uppercase and spaced closing tags", "<SCRIPT>x()</SCRIPT ><STYLE>y</Style\n><p>ok</p>", "ok"},
+		{"several scripts", "<script>a</script><p>meio</p><script>b</script>", "meio"},
+		{"control characters", "<p>a\x00b\x1fc</p>", "a b c"},
+	}
+
+	for _, tt := range tests {
+		if got := plainText(tt.doc); got != tt.want {
+			t.Errorf("%s: plainText = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VicAlexandre/pds-backend/internal/models"
+)
+
+/* AttemptStore is implemented by MemoryAttemptStore and models.LoginAttemptModel */
+type AttemptStore interface {
+	Get(ctx context.Context, key string, window time.Duration) (models.LoginAttempts, error)
+	Increment(ctx context.Context, key string, window time.Duration) (models.LoginAttempts, error)
+	Reset(ctx context.Context, key string) error
+}
+
+/*
+ * LockoutPolicy allows Threshold failures for free. From then on each failure locks
+ * the key for BaseDelay, doubling with every further failure up to MaxDelay.
+ */
+type LockoutPolicy struct {
+	Threshold int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+func (p LockoutPolicy) delay(failures int) time.Duration {
+	if failures < p.Threshold {
+		return 0
+	}
+
+	d := p.BaseDelay
+	for i := p.Threshold; i < failures && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+
+	return min(d, p.MaxDelay)
+}
+
+/* LockedError is returned by Login while the account or the client IP is locked out */
+type LockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("too many failed login attempts, try again in %d seconds", int(e.RetryAfter.Seconds()))
+}
+
+type LoginLimiter struct {
+	Store         AttemptStore
+	AccountPolicy LockoutPolicy
+	IPPolicy      LockoutPolicy
+	Window        time.Duration
+}
+
+func NewLoginLimiter(store AttemptStore) *LoginLimiter {
+	return &LoginLimiter{
+		Store:         store,
+		AccountPolicy: LockoutPolicy{Threshold: 5, BaseDelay: 30 * time.Second, MaxDelay: 15 * time.Minute},
+		IPPolicy:      LockoutPolicy{Threshold: 20, BaseDelay: 10 * time.Second, MaxDelay: 15 * time.Minute},
+		Window:        time.Hour,
+	}
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+/* Check returns a *LockedError when either the account or the IP is still locked */
+func (l *LoginLimiter) Check(ctx context.Context, email, ip string) error {
+	var retryAfter time.Duration
+
+	checks := []struct {
+		key    string
+		policy LockoutPolicy
+	}{
+		{accountKey(email), l.AccountPolicy},
+		{ipKey(ip), l.IPPolicy},
+	}
+
+	for _, c := range checks {
+		attempts, err := l.Store.Get(ctx, c.key, l.Window)
+		if err != nil {
+			return err
+		}
+
+		until := attempts.LastFailure.Add(c.policy.delay(attempts.Failures))
+		retryAfter = max(retryAfter, time.Until(until))
+	}
+
+	if retryAfter > 0 {
+		return &LockedError{RetryAfter: retryAfter.Truncate(time.Second) + time.Second}
+	}
+
+	return nil
+}
+
+func (l *LoginLimiter) Fail(ctx context.Context, email, ip string) error {
+	if _, err := l.Store.Increment(ctx, accountKey(email), l.Window); err != nil {
+		return err
+	}
+
+	_, err := l.Store.Increment(ctx, ipKey(ip), l.Window)
+	return err
+}
+
+/*
+ * Succeed only clears the account counter. The IP counter decays on its own, otherwise
+ * an attacker owning one account could reset it between guesses at other accounts.
+ */
+func (l *LoginLimiter) Succeed(ctx context.Context, email string) error {
+	return l.Store.Reset(ctx, accountKey(email))
+}
+
+/* Unlock is used by the password reset flow to lift an account lockout */
+func (l *LoginLimiter) Unlock(ctx context.Context, email string) error {
+	return l.Store.Reset(ctx, accountKey(email))
+}
+
+/* MemoryAttemptStore is enough for a single instance, counters are lost on restart */
+type MemoryAttemptStore struct {
+	mu        sync.Mutex
+	attempts  map[string]models.LoginAttempts
+	lastSweep time.Time
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{
+		attempts: make(map[string]models.LoginAttempts),
+	}
+}
+
+func (s *MemoryAttemptStore) Get(ctx context.Context, key string, window time.Duration) (models.LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts, ok := s.attempts[key]
+	if !ok || time.Since(attempts.LastFailure) > window {
+		return models.LoginAttempts{}, nil
+	}
+
+	return attempts, nil
+}
+
+func (s *MemoryAttemptStore) Increment(ctx context.Context, key string, window time.Duration) (models.LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > window {
+		for k, a := range s.attempts {
+			if now.Sub(a.LastFailure) > window {
+				delete(s.attempts, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	attempts := s.attempts[key]
+	if now.Sub(attempts.LastFailure) > window {
+		attempts.Failures = 0
+	}
+
+	attempts.Failures++
+	attempts.LastFailure = now
+	s.attempts[key] = attempts
+
+	return attempts, nil
+}
+
+func (s *MemoryAttemptStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.attempts, key)
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLockoutPolicyDelay(t *testing.T) {
+	policy := LockoutPolicy{Threshold: 5, BaseDelay: 30 * time.Second, MaxDelay: 15 * time.Minute}
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, 0},
+		{4, 0},
+		{5, 30 * time.Second},
+		{6, time.Minute},
+		{7, 2 * time.Minute},
+		{8, 4 * time.Minute},
+		{9, 8 * time.Minute},
+		{10, 15 * time.Minute},
+		{11, 15 * time.Minute},
+		{1000, 15 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := policy.delay(tt.failures); got != tt.want {
+			t.Errorf("delay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLockoutPolicyDelayBaseAboveMax(t *testing.T) {
+	policy := LockoutPolicy{Threshold: 1, BaseDelay: time.Hour, MaxDelay: time.Minute}
+
+	if got := policy.delay(1); got != time.Minute {
+		t.Errorf("delay(1) = %v, want the MaxDelay cap of %v", got, time.Minute)
+	}
+}
+
+func TestLoginLimiterLocksAccountAfterThreshold(t *testing.T) {
+	ctx := context.Background()
+	limiter := NewLoginLimiter(NewMemoryAttemptStore())
+
+	for i := 1; i < limiter.AccountPolicy.Threshold; i++ {
+		if err := limiter.Fail(ctx, "ana@ufal.br", "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := limiter.Check(ctx, "ana@ufal.br", "10.0.0.1"); err != nil {
+			t.Fatalf("locked after %d failures: %v", i, err)
+		}
+	}
+
+	if err := limiter.Fail(ctx, "ana@ufal.br", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	/* a different IP and a different case still hit the account lock */
+	err := limiter.Check(ctx, " ANA@ufal.br", "10.0.0.2")
+
+	var locked *LockedError
+	if !errors.As(err, &locked) {
+		t.Fatalf("Check() = %v, want a *LockedError", err)
+	}
+	if locked.RetryAfter <= 0 || locked.RetryAfter > limiter.AccountPolicy.BaseDelay+time.Second {
+		t.Errorf("RetryAfter = %v, want at most %v", locked.RetryAfter, limiter.AccountPolicy.BaseDelay+time.Second)
+	}
+
+	if err := limiter.Check(ctx, "bia@ufal.br", "10.0.0.1"); err != nil {
+		t.Errorf("other account locked: %v", err)
+	}
+}
+
+func TestLoginLimiterSucceedKeepsIPCounter(t *testing.T) {
+	ctx := context.Background()
+	limiter := NewLoginLimiter(NewMemoryAttemptStore())
+	limiter.IPPolicy = LockoutPolicy{Threshold: 3, BaseDelay: time.Minute, MaxDelay: time.Hour}
+
+	for range 3 {
+		if err := limiter.Fail(ctx, "ana@ufal.br", "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := limiter.Succeed(ctx, "ana@ufal.br"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := limiter.Check(ctx, "ana@ufal.br", "10.0.0.2"); err != nil {
+		t.Errorf("account still locked after Succeed: %v", err)
+	}
+
+	var locked *LockedError
+	if err := limiter.Check(ctx, "bia@ufal.br", "10.0.0.1"); !errors.As(err, &locked) {
+		t.Errorf("Check() = %v, want the IP to stay locked", err)
+	}
+}
+
+func TestMemoryAttemptStoreWindow(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryAttemptStore()
+
+	if _, err := store.Increment(ctx, "k", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	attempts, _ := store.Get(ctx, "k", time.Hour)
+	if attempts.Failures != 1 {
+		t.Fatalf("Failures = %d, want 1", attempts.Failures)
+	}
+
+	/* failures older than the window are forgotten */
+	attempts.LastFailure = time.Now().Add(-2 * time.Hour)
+	store.attempts["k"] = attempts
+
+	if attempts, _ := store.Get(ctx, "k", time.Hour); attempts.Failures != 0 {
+		t.Errorf("Get() after the window = %d failures, want 0", attempts.Failures)
+	}
+
+	attempts, _ = store.Increment(ctx, "k", time.Hour)
+	if attempts.Failures != 1 {
+		t.Errorf("Increment() after the window = %d failures, want 1", attempts.Failures)
+	}
+}
@@ -0,0 +1,208 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/VicAlexandre/pds-backend/internal/models"
+	"github.com/VicAlexandre/pds-backend/internal/totp"
+)
+
+const (
+	MFAIssuer          = "Apostilab"
+	MFAPendingDuration = 5 * time.Minute
+	recoveryCodeCount  = 10
+)
+
+var (
+	ErrMFAAlreadyEnabled = errors.New("two-factor authentication already enabled")
+	ErrMFANotEnabled     = errors.New("two-factor authentication not enabled")
+	ErrInvalidMFACode    = errors.New("invalid authentication code")
+)
+
+type MFAEnrollment struct {
+	Secret     string `json:"secret"`
+	OtpauthURI string `json:"otpauth_uri"`
+}
+
+type MFACodeInput struct {
+	Code string `json:"code"`
+}
+
+type RecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
+
+type MFAService struct {
+	MFAModel  *models.MFAModel
+	UserModel *models.UserModel
+}
+
+func NewMFAService(mfaModel *models.MFAModel, userModel *models.UserModel) *MFAService {
+	return &MFAService{
+		MFAModel:  mfaModel,
+		UserModel: userModel,
+	}
+}
+
+/* Enroll hands out a new secret, MFA only becomes active once Activate sees a valid code */
+func (s *MFAService) Enroll(ctx context.Context, userID int64) (*MFAEnrollment, error) {
+	user, err := s.UserModel.FindByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	enabled, err := s.Enabled(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if enabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.MFAModel.SavePendingSecret(ctx, userID, secret); err != nil {
+		return nil, err
+	}
+
+	return &MFAEnrollment{
+		Secret:     secret,
+		OtpauthURI: totp.URI(MFAIssuer, user.Email, secret),
+	}, nil
+}
+
+/* Activate checks the first code and returns the recovery codes, the only time they are shown */
+func (s *MFAService) Activate(ctx context.Context, userID int64, input MFACodeInput) (*RecoveryCodes, error) {
+	mfa, err := s.MFAModel.FindByUserID(ctx, userID)
+	if errors.Is(err, models.ErrMFANotFound) {
+		return nil, ErrMFANotEnabled
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if mfa.EnabledAt != nil {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	if err := s.checkTOTP(ctx, mfa, input.Code); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		hashes[i] = models.HashToken(code)
+	}
+
+	if err := s.MFAModel.Enable(ctx, userID, hashes); err != nil {
+		return nil, err
+	}
+
+	return &RecoveryCodes{Codes: codes}, nil
+}
+
+/* Disable needs a current code (or a recovery code), a stolen access token alone is not enough */
+func (s *MFAService) Disable(ctx context.Context, userID int64, input MFACodeInput) error {
+	if err := s.Verify(ctx, userID, input.Code); err != nil {
+		return err
+	}
+
+	return s.MFAModel.Disable(ctx, userID)
+}
+
+/* Enabled reports lookup errors instead of hiding them, a login must not skip 2FA on a DB hiccup */
+func (s *MFAService) Enabled(ctx context.Context, userID int64) (bool, error) {
+	mfa, err := s.MFAModel.FindByUserID(ctx, userID)
+	if errors.Is(err, models.ErrMFANotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return mfa.EnabledAt != nil, nil
+}
+
+/* Verify accepts either a TOTP code or one of the unused recovery codes */
+func (s *MFAService) Verify(ctx context.Context, userID int64, code string) error {
+	mfa, err := s.MFAModel.FindByUserID(ctx, userID)
+	if errors.Is(err, models.ErrMFANotFound) {
+		return ErrMFANotEnabled
+	}
+	if err != nil {
+		return err
+	}
+
+	if mfa.EnabledAt == nil {
+		return ErrMFANotEnabled
+	}
+
+	if err := s.checkTOTP(ctx, mfa, code); err == nil || !errors.Is(err, ErrInvalidMFACode) {
+		return err
+	}
+
+	used, err := s.MFAModel.UseRecoveryCode(ctx, userID, models.HashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+
+	if !used {
+		return ErrInvalidMFACode
+	}
+
+	return nil
+}
+
+func (s *MFAService) checkTOTP(ctx context.Context, mfa *models.MFA, code string) error {
+	step, ok := totp.Validate(mfa.Secret, code, time.Now())
+	if !ok {
+		return ErrInvalidMFACode
+	}
+
+	fresh, err := s.MFAModel.ConsumeStep(ctx, mfa.UserID, step)
+	if err != nil {
+		return err
+	}
+
+	if !fresh {
+		return ErrInvalidMFACode
+	}
+
+	return nil
+}
+
+/* recovery codes look like "ABCDE-FGHIJ", dashes and case are ignored when they are typed back */
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)[:10]
+
+	return code[:5] + "-" + code[5:], nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	if len(code) != 10 {
+		return code
+	}
+
+	return code[:5] + "-" + code[5:]
+}
@@ -0,0 +1,199 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/VicAlexandre/pds-backend/internal/models"
+	"github.com/VicAlexandre/pds-backend/internal/oidc"
+)
+
+const OIDCStateDuration = 10 * time.Minute
+
+var (
+	ErrUnknownProvider = errors.New("unknown identity provider")
+	ErrOIDCLoginFailed = errors.New("sign-in with identity provider failed")
+	ErrUnverifiedEmail = errors.New("identity provider did not verify the email address")
+	ErrUnverifiedLocal = errors.New("an account with this email exists but its address was never verified")
+)
+
+type OIDCCallbackInput struct {
+	Code  string `json:"code"`
+	State string `json:"state"`
+	SessionInfo
+}
+
+type OIDCProviderInfo struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+}
+
+type OIDCService struct {
+	Providers     map[string]*oidc.Provider
+	IdentityModel *models.IdentityModel
+	UserModel     *models.UserModel
+	Auth          *AuthService
+}
+
+func NewOIDCService(providers map[string]*oidc.Provider, identityModel *models.IdentityModel, userModel *models.UserModel, authService *AuthService) *OIDCService {
+	return &OIDCService{
+		Providers:     providers,
+		IdentityModel: identityModel,
+		UserModel:     userModel,
+		Auth:          authService,
+	}
+}
+
+func (s *OIDCService) ListProviders() []OIDCProviderInfo {
+	providers := make([]OIDCProviderInfo, 0, len(s.Providers))
+	for name, p := range s.Providers {
+		displayName := p.Config.DisplayName
+		if displayName == "" {
+			displayName = name
+		}
+		providers = append(providers, OIDCProviderInfo{Name: name, DisplayName: displayName})
+	}
+
+	sort.Slice(providers, func(i, j int) bool { return providers[i].Name < providers[j].Name })
+
+	return providers
+}
+
+/* AuthorizationURL starts a login: state, nonce and PKCE verifier stay server side until the callback */
+func (s *OIDCService) AuthorizationURL(ctx context.Context, providerName string) (string, error) {
+	provider, ok := s.Providers[providerName]
+	if !ok {
+		return "", ErrUnknownProvider
+	}
+
+	state, err := models.NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	nonce, err := models.NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	verifier, err := models.NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	loginState := models.OIDCLoginState{
+		Provider:     providerName,
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+	}
+	if err := s.IdentityModel.SaveLoginState(ctx, models.HashToken(state), loginState, time.Now().Add(OIDCStateDuration)); err != nil {
+		return "", err
+	}
+
+	return provider.AuthCodeURL(ctx, state, nonce, verifier)
+}
+
+/*
+ * Callback finishes a login. Known identities sign in directly; otherwise the identity
+ * is linked to the user with the same email, but only if both the provider and the
+ * local account verified that email, and a password-less user is created when there is none.
+ */
+func (s *OIDCService) Callback(ctx context.Context, providerName string, input OIDCCallbackInput) (result *LoginResult, err error) {
+	var userID int64
+	defer func() {
+		s.Auth.Audit.Record(ctx, AuditEntry{
+			ActorID:    userID,
+			Action:     AuditLoginOIDC,
+			TargetType: "user",
+			TargetID:   auditID(userID),
+			Err:        err,
+			Metadata:   map[string]any{"provider": providerName},
+		})
+	}()
+
+	provider, ok := s.Providers[providerName]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+
+	state, err := s.IdentityModel.ConsumeLoginState(ctx, models.HashToken(input.State))
+	if err != nil || state.Provider != providerName {
+		return nil, ErrOIDCLoginFailed
+	}
+
+	claims, err := provider.Exchange(ctx, input.Code, state.CodeVerifier, state.Nonce)
+	if err != nil {
+		log.Println("Error exchanging OIDC code: ", err)
+		return nil, ErrOIDCLoginFailed
+	}
+
+	user, err := s.resolveUser(ctx, providerName, claims)
+	if err != nil {
+		return nil, err
+	}
+	userID = user.ID
+
+	return s.Auth.completeLogin(ctx, user, input.SessionInfo)
+}
+
+func (s *OIDCService) resolveUser(ctx context.Context, providerName string, claims *oidc.IDTokenClaims) (*models.User, error) {
+	identity, err := s.IdentityModel.FindByProviderSubject(ctx, providerName, claims.Subject)
+	if err == nil {
+		return s.UserModel.FindByID(ctx, identity.UserID)
+	}
+
+	if !errors.Is(err, models.ErrIdentityNotFound) {
+		return nil, err
+	}
+
+	user, err := s.UserModel.FindByEmail(ctx, claims.Email)
+	if errors.Is(err, models.ErrUserNotFound) {
+		user = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := checkLink(claims, user); err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		name := claims.Name
+		if name == "" {
+			name = claims.Email
+		}
+
+		user, err = s.UserModel.InsertWithoutPassword(ctx, name, claims.Email)
+		if err != nil {
+			return nil, fmt.Errorf("creating user for %s identity: %w", providerName, err)
+		}
+	}
+
+	if err := s.IdentityModel.Insert(ctx, user.ID, providerName, claims.Subject, claims.Email); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+/*
+ * checkLink decides whether a new identity may sign in as user, the local account with
+ * the same email, or create one when user is nil. The provider must have verified the
+ * email, and so must the local account: anyone could have registered an unverified one
+ * with this address beforehand and set its password.
+ */
+func checkLink(claims *oidc.IDTokenClaims, user *models.User) error {
+	if claims.Email == "" || !claims.EmailVerified {
+		return ErrUnverifiedEmail
+	}
+
+	if user != nil && user.EmailVerifiedAt == nil {
+		return ErrUnverifiedLocal
+	}
+
+	return nil
+}
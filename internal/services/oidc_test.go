@@ -0,0 +1,36 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/VicAlexandre/pds-backend/internal/models"
+	"github.com/VicAlexandre/pds-backend/internal/oidc"
+)
+
+func TestCheckLink(t *testing.T) {
+	verifiedAt := time.Now()
+	verified := &models.User{ID: 1, Email: "ana@ufal.br", EmailVerifiedAt: &verifiedAt}
+	unverified := &models.User{ID: 2, Email: "ana@ufal.br"}
+
+	tests := []struct {
+		name   string
+		claims oidc.IDTokenClaims
+		user   *models.User
+		want   error
+	}{
+		{"new account", oidc.IDTokenClaims{Email: "ana@ufal.br", EmailVerified: true}, nil, nil},
+		{"verified local account", oidc.IDTokenClaims{Email: "ana@ufal.br", EmailVerified: true}, verified, nil},
+		{"unverified local account", oidc.IDTokenClaims{Email: "ana@ufal.br", EmailVerified: true}, unverified, ErrUnverifiedLocal},
+		{"provider did not verify", oidc.IDTokenClaims{Email: "ana@ufal.br"}, verified, ErrUnverifiedEmail},
+		{"provider did not verify new account", oidc.IDTokenClaims{Email: "ana@ufal.br"}, nil, ErrUnverifiedEmail},
+		{"no email", oidc.IDTokenClaims{EmailVerified: true}, nil, ErrUnverifiedEmail},
+	}
+
+	for _, tt := range tests {
+		if err := checkLink(&tt.claims, tt.user); !errors.Is(err, tt.want) {
+			t.Errorf("%s: checkLink = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,495 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VicAlexandre/pds-backend/internal/models"
+)
+
+/* origins added to an organization take at most this long to be accepted by CORS */
+const originCacheTTL = time.Minute
+
+var (
+	ErrLastOrgAdmin          = errors.New("cannot remove the last admin of the organization")
+	ErrApostilaQuotaExceeded = errors.New("organization apostila limit reached")
+)
+
+var (
+	slugPattern  = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,62}$`)
+	colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+)
+
+type CreateOrganizationInput struct {
+	Slug string `json:"slug"`
+	Name string `json:"name"`
+}
+
+/* nil fields are left untouched */
+type UpdateOrganizationInput struct {
+	Name     *string          `json:"name"`
+	Branding *models.Branding `json:"branding"`
+}
+
+/* the origins get credentialed CORS for every account, so only deployment admins set them */
+type SetAllowedOriginsInput struct {
+	AllowedOrigins []string `json:"allowed_origins"`
+}
+
+type AddMemberInput struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+type UpdateMemberInput struct {
+	Role string `json:"role"`
+}
+
+/* OrganizationBranding is public, the login page of a school is themed before anyone signs in */
+type OrganizationBranding struct {
+	Slug     string          `json:"slug"`
+	Name     string          `json:"name"`
+	Branding models.Branding `json:"branding"`
+}
+
+type OrganizationService struct {
+	OrganizationModel *models.OrganizationModel
+	UserModel         *models.UserModel
+	ApostilaModel     *models.ApostilaModel
+	Audit             *AuditService
+
+	originsMu       sync.Mutex
+	origins         map[string]bool
+	originsLoadedAt time.Time
+}
+
+func NewOrganizationService(organizationModel *models.OrganizationModel, userModel *models.UserModel, apostilaModel *models.ApostilaModel, audit *AuditService) *OrganizationService {
+	return &OrganizationService{
+		OrganizationModel: organizationModel,
+		UserModel:         userModel,
+		ApostilaModel:     apostilaModel,
+		Audit:             audit,
+	}
+}
+
+/* Create is an admin action, the creator becomes the first admin of the organization */
+func (s *OrganizationService) Create(ctx context.Context, userID int64, input CreateOrganizationInput) (_ *models.Organization, err error) {
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{Action: AuditOrgCreate, TargetType: "organization", TargetID: input.Slug, Err: err})
+	}()
+
+	input.Slug = strings.ToLower(strings.TrimSpace(input.Slug))
+	input.Name = strings.TrimSpace(input.Name)
+
+	var verr ValidationError
+	if !slugPattern.MatchString(input.Slug) {
+		verr.Add("slug", "use de 2 a 63 letras minúsculas, números e hífens")
+	}
+	if input.Name == "" {
+		verr.Add("name", "informe o nome da instituição")
+	}
+	if err := verr.Err(); err != nil {
+		return nil, err
+	}
+
+	return s.OrganizationModel.Insert(ctx, input.Slug, input.Name, userID)
+}
+
+func (s *OrganizationService) ListMine(ctx context.Context, userID int64) ([]models.OrganizationMembership, error) {
+	return s.OrganizationModel.ListForUser(ctx, userID)
+}
+
+func (s *OrganizationService) Get(ctx context.Context, userID int64, slug string) (*models.OrganizationMembership, error) {
+	org, role, err := s.membership(ctx, userID, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.OrganizationMembership{Organization: *org, Role: role}, nil
+}
+
+/* Update changes what the school manages itself, quotas and origins are set by the deployment admins */
+func (s *OrganizationService) Update(ctx context.Context, userID int64, slug string, input UpdateOrganizationInput) (_ *models.Organization, err error) {
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{Action: AuditOrgUpdate, TargetType: "organization", TargetID: slug, Err: err})
+	}()
+
+	org, err := s.requireAdmin(ctx, userID, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	var verr ValidationError
+	if input.Name != nil {
+		org.Name = strings.TrimSpace(*input.Name)
+		if org.Name == "" {
+			verr.Add("name", "informe o nome da instituição")
+		}
+	}
+	if input.Branding != nil {
+		org.Branding = *input.Branding
+		if org.Branding.LogoURL != "" && !isHTTPSURL(org.Branding.LogoURL) {
+			verr.Add("branding.logo_url", "use um endereço https")
+		}
+		for field, color := range map[string]string{
+			"branding.primary_color":   org.Branding.PrimaryColor,
+			"branding.secondary_color": org.Branding.SecondaryColor,
+		} {
+			if color != "" && !colorPattern.MatchString(color) {
+				verr.Add(field, "use uma cor no formato #RRGGBB")
+			}
+		}
+	}
+	if err := verr.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := s.OrganizationModel.Update(ctx, org); err != nil {
+		return nil, err
+	}
+
+	return s.OrganizationModel.FindBySlug(ctx, slug)
+}
+
+/*
+ * SetAllowedOrigins is an admin action: CORS answers these origins with credentials for
+ * any account, not only the members of the organization that registered them.
+ */
+func (s *OrganizationService) SetAllowedOrigins(ctx context.Context, slug string, input SetAllowedOriginsInput) (err error) {
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{Action: AuditOrgOrigins, TargetType: "organization", TargetID: slug, Err: err, Metadata: map[string]any{"allowed_origins": input.AllowedOrigins}})
+	}()
+
+	origins := []string{}
+	var verr ValidationError
+	for _, origin := range input.AllowedOrigins {
+		normalized, ok := normalizeOrigin(origin)
+		if !ok {
+			verr.Add("allowed_origins", "origem inválida: "+origin)
+			continue
+		}
+		origins = append(origins, normalized)
+	}
+	if err := verr.Err(); err != nil {
+		return err
+	}
+
+	org, err := s.OrganizationModel.FindBySlug(ctx, slug)
+	if err != nil {
+		return err
+	}
+
+	if err := s.OrganizationModel.UpdateAllowedOrigins(ctx, org.ID, origins); err != nil {
+		return err
+	}
+
+	s.invalidateOrigins()
+	return nil
+}
+
+func (s *OrganizationService) SetQuotas(ctx context.Context, slug string, quotas models.Quotas) (err error) {
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{Action: AuditOrgQuotas, TargetType: "organization", TargetID: slug, Err: err, Metadata: map[string]any{"quotas": quotas}})
+	}()
+
+	var verr ValidationError
+	if quotas.MaxApostilas != nil && *quotas.MaxApostilas < 0 {
+		verr.Add("max_apostilas", "o limite não pode ser negativo")
+	}
+	if quotas.MaxMembers != nil && *quotas.MaxMembers < 1 {
+		verr.Add("max_members", "o limite precisa ser de pelo menos 1")
+	}
+	if err := verr.Err(); err != nil {
+		return err
+	}
+
+	org, err := s.OrganizationModel.FindBySlug(ctx, slug)
+	if err != nil {
+		return err
+	}
+
+	return s.OrganizationModel.UpdateQuotas(ctx, org.ID, quotas)
+}
+
+/* Delete is an admin action and answers models.ErrOrganizationNotEmpty while the organization has apostilas */
+func (s *OrganizationService) Delete(ctx context.Context, slug string) (err error) {
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{Action: AuditOrgDelete, TargetType: "organization", TargetID: slug, Err: err})
+	}()
+
+	org, err := s.OrganizationModel.FindBySlug(ctx, slug)
+	if err != nil {
+		return err
+	}
+
+	if err := s.OrganizationModel.Delete(ctx, org.ID); err != nil {
+		return err
+	}
+
+	s.invalidateOrigins()
+	return nil
+}
+
+func (s *OrganizationService) Branding(ctx context.Context, slug string) (*OrganizationBranding, error) {
+	org, err := s.OrganizationModel.FindBySlug(ctx, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OrganizationBranding{Slug: org.Slug, Name: org.Name, Branding: org.Branding}, nil
+}
+
+func (s *OrganizationService) ListMembers(ctx context.Context, userID int64, slug string) ([]models.OrganizationMember, error) {
+	org, _, err := s.membership(ctx, userID, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.OrganizationModel.ListMembers(ctx, org.ID)
+}
+
+/* AddMember only adds existing accounts, the person has to sign up first */
+func (s *OrganizationService) AddMember(ctx context.Context, userID int64, slug string, input AddMemberInput) (err error) {
+	var memberID int64
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{Action: AuditOrgMemberAdd, TargetType: "organization", TargetID: slug, Err: err, Metadata: map[string]any{"user_id": memberID, "role": input.Role}})
+	}()
+
+	org, err := s.requireAdmin(ctx, userID, slug)
+	if err != nil {
+		return err
+	}
+
+	if err := validateOrgRole(input.Role); err != nil {
+		return err
+	}
+
+	user, err := s.UserModel.FindByEmail(ctx, strings.TrimSpace(input.Email))
+	if err != nil {
+		return err
+	}
+	memberID = user.ID
+
+	return s.OrganizationModel.AddMember(ctx, org.ID, user.ID, input.Role)
+}
+
+func (s *OrganizationService) UpdateMember(ctx context.Context, userID int64, slug string, memberID int64, input UpdateMemberInput) (err error) {
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{Action: AuditOrgMemberUpdate, TargetType: "organization", TargetID: slug, Err: err, Metadata: map[string]any{"user_id": memberID, "role": input.Role}})
+	}()
+
+	org, err := s.requireAdmin(ctx, userID, slug)
+	if err != nil {
+		return err
+	}
+
+	if err := validateOrgRole(input.Role); err != nil {
+		return err
+	}
+
+	if input.Role != models.OrgRoleAdmin {
+		if err := s.keepOneAdmin(ctx, org.ID, memberID); err != nil {
+			return err
+		}
+	}
+
+	return s.OrganizationModel.UpdateMemberRole(ctx, org.ID, memberID, input.Role)
+}
+
+/* RemoveMember is also how a member leaves, which needs no admin role */
+func (s *OrganizationService) RemoveMember(ctx context.Context, userID int64, slug string, memberID int64) (err error) {
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{Action: AuditOrgMemberRemove, TargetType: "organization", TargetID: slug, Err: err, Metadata: map[string]any{"user_id": memberID}})
+	}()
+
+	var org *models.Organization
+	if memberID == userID {
+		org, _, err = s.membership(ctx, userID, slug)
+	} else {
+		org, err = s.requireAdmin(ctx, userID, slug)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.keepOneAdmin(ctx, org.ID, memberID); err != nil {
+		return err
+	}
+
+	return s.OrganizationModel.RemoveMember(ctx, org.ID, memberID)
+}
+
+/* ResolveMembership implements auth.OrganizationResolver */
+func (s *OrganizationService) ResolveMembership(ctx context.Context, userID int64, slug string) (int64, bool, error) {
+	org, _, err := s.membership(ctx, userID, slug)
+	if errors.Is(err, models.ErrOrganizationNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	return org.ID, true, nil
+}
+
+/* RequireRole answers ErrForbidden unless the user has one of the roles in the organization */
+func (s *OrganizationService) RequireRole(ctx context.Context, orgID, userID int64, roles ...string) error {
+	role, err := s.OrganizationModel.MemberRole(ctx, orgID, userID)
+	if errors.Is(err, models.ErrNotMember) {
+		return ErrForbidden
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, allowed := range roles {
+		if role == allowed {
+			return nil
+		}
+	}
+
+	return ErrForbidden
+}
+
+/* CheckApostilaQuota is a soft limit, two creations racing for the last slot can both pass */
+func (s *OrganizationService) CheckApostilaQuota(ctx context.Context, orgID int64) error {
+	org, err := s.OrganizationModel.FindByID(ctx, orgID)
+	if err != nil {
+		return err
+	}
+
+	if org.Quotas.MaxApostilas == nil {
+		return nil
+	}
+
+	n, err := s.ApostilaModel.CountInOrganization(ctx, orgID)
+	if err != nil {
+		return err
+	}
+
+	if n >= *org.Quotas.MaxApostilas {
+		return ErrApostilaQuotaExceeded
+	}
+
+	return nil
+}
+
+/*
+ * AllowedOrigin is the CORS check for the origins registered by organizations. The
+ * list is cached, a failed reload keeps the previous one instead of locking browsers out.
+ */
+func (s *OrganizationService) AllowedOrigin(ctx context.Context, origin string) bool {
+	s.originsMu.Lock()
+	defer s.originsMu.Unlock()
+
+	if time.Since(s.originsLoadedAt) > originCacheTTL {
+		origins, err := s.OrganizationModel.AllowedOrigins(ctx)
+		if err != nil {
+			log.Println("Error loading organization origins: ", err)
+		} else {
+			s.origins = make(map[string]bool, len(origins))
+			for _, o := range origins {
+				s.origins[o] = true
+			}
+		}
+		s.originsLoadedAt = time.Now()
+	}
+
+	return s.origins[origin]
+}
+
+func (s *OrganizationService) invalidateOrigins() {
+	s.originsMu.Lock()
+	s.originsLoadedAt = time.Time{}
+	s.originsMu.Unlock()
+}
+
+/* membership hides organizations the user does not belong to behind ErrOrganizationNotFound */
+func (s *OrganizationService) membership(ctx context.Context, userID int64, slug string) (*models.Organization, string, error) {
+	org, err := s.OrganizationModel.FindBySlug(ctx, slug)
+	if err != nil {
+		return nil, "", err
+	}
+
+	role, err := s.OrganizationModel.MemberRole(ctx, org.ID, userID)
+	if errors.Is(err, models.ErrNotMember) {
+		return nil, "", models.ErrOrganizationNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	return org, role, nil
+}
+
+func (s *OrganizationService) requireAdmin(ctx context.Context, userID int64, slug string) (*models.Organization, error) {
+	org, role, err := s.membership(ctx, userID, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	if role != models.OrgRoleAdmin {
+		return nil, ErrForbidden
+	}
+
+	return org, nil
+}
+
+/* keepOneAdmin refuses to demote or remove memberID when it is the organization's only admin */
+func (s *OrganizationService) keepOneAdmin(ctx context.Context, orgID, memberID int64) error {
+	role, err := s.OrganizationModel.MemberRole(ctx, orgID, memberID)
+	if err != nil {
+		return err
+	}
+
+	if role != models.OrgRoleAdmin {
+		return nil
+	}
+
+	admins, err := s.OrganizationModel.CountMembersWithRole(ctx, orgID, models.OrgRoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	if admins <= 1 {
+		return ErrLastOrgAdmin
+	}
+
+	return nil
+}
+
+func validateOrgRole(role string) error {
+	switch role {
+	case models.OrgRoleAdmin, models.OrgRoleTeacher, models.OrgRoleStudent:
+		return nil
+	}
+
+	var verr ValidationError
+	verr.Add("role", "use admin, teacher ou student")
+	return verr.Err()
+}
+
+/* normalizeOrigin accepts scheme://host[:port] only, which is what browsers send in Origin */
+func normalizeOrigin(origin string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(origin))
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return "", false
+	}
+
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", false
+	}
+
+	return strings.ToLower(u.Scheme + "://" + u.Host), true
+}
+
+func isHTTPSURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.Scheme == "https" && u.Host != ""
+}
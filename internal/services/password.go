@@ -0,0 +1,78 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/VicAlexandre/pds-backend/internal/password"
+)
+
+/* PasswordService is the single place where passwords are checked against the policy and hashed */
+type PasswordService struct {
+	Hasher *password.Hasher
+	Policy *password.Policy
+
+	dummyHash string
+}
+
+func NewPasswordService(hasher *password.Hasher, policy *password.Policy) *PasswordService {
+	dummyHash, err := hasher.Hash("not a real password")
+	if err != nil {
+		log.Println("Error hashing dummy password: ", err)
+	}
+
+	return &PasswordService{
+		Hasher:    hasher,
+		Policy:    policy,
+		dummyHash: dummyHash,
+	}
+}
+
+/* Validate reports a policy violation as a ValidationError on the given field */
+func (s *PasswordService) Validate(field, plain string) error {
+	v := &ValidationError{}
+	s.check(v, field, plain)
+
+	return v.Err()
+}
+
+/* check adds a policy violation to v, in Portuguese like the other validation messages */
+func (s *PasswordService) check(v *ValidationError, field, plain string) {
+	err := s.Policy.Check(plain)
+	switch {
+	case err == nil:
+	case errors.Is(err, password.ErrTooShort):
+		v.Add(field, fmt.Sprintf("use pelo menos %d caracteres", s.Policy.MinLength))
+	case errors.Is(err, password.ErrTooLong):
+		v.Add(field, fmt.Sprintf("use no máximo %d caracteres", password.MaxLength))
+	case errors.Is(err, password.ErrCommon):
+		v.Add(field, "essa senha é muito comum ou já apareceu em vazamentos, escolha outra")
+	default:
+		v.Add(field, "senha inválida")
+	}
+}
+
+func (s *PasswordService) Hash(plain string) (string, error) {
+	return s.Hasher.Hash(plain)
+}
+
+/*
+ * Verify reports whether plain matches the stored hash and whether the hash should be
+ * replaced. An empty hash (unknown user or SSO-only account) is checked against a
+ * dummy hash, so the response time does not reveal which case it was.
+ */
+func (s *PasswordService) Verify(plain, hash string) (ok bool, needsRehash bool) {
+	if hash == "" {
+		s.Hasher.Verify(plain, s.dummyHash)
+		return false, false
+	}
+
+	ok, needsRehash, err := s.Hasher.Verify(plain, hash)
+	if err != nil {
+		log.Println("Error verifying password: ", err)
+		return false, false
+	}
+
+	return ok, needsRehash
+}
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/VicAlexandre/pds-backend/internal/mailer"
+	"github.com/VicAlexandre/pds-backend/internal/models"
+)
+
+const (
+	ResetTokenDuration = time.Hour
+	/* ResetEmailCooldown keeps ForgotPassword from mail bombing an address or killing the link just sent */
+	ResetEmailCooldown = 5 * time.Minute
+)
+
+var (
+	ErrInvalidResetToken = errors.New("invalid or expired reset token")
+)
+
+type ForgotPasswordInput struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordInput struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type PasswordResetService struct {
+	UserModel          *models.UserModel
+	PasswordResetModel *models.PasswordResetModel
+	RefreshTokenModel  *models.RefreshTokenModel
+	PATModel           *models.PersonalAccessTokenModel
+	LoginLimiter       *LoginLimiter
+	Mailer             mailer.Mailer
+	BaseURL            string
+	Passwords          *PasswordService
+	Audit              *AuditService
+}
+
+func NewPasswordResetService(userModel *models.UserModel, passwordResetModel *models.PasswordResetModel, refreshTokenModel *models.RefreshTokenModel, patModel *models.PersonalAccessTokenModel, loginLimiter *LoginLimiter, m mailer.Mailer, baseURL string, passwords *PasswordService, audit *AuditService) *PasswordResetService {
+	return &PasswordResetService{
+		UserModel:          userModel,
+		PasswordResetModel: passwordResetModel,
+		RefreshTokenModel:  refreshTokenModel,
+		PATModel:           patModel,
+		LoginLimiter:       loginLimiter,
+		Mailer:             m,
+		BaseURL:            baseURL,
+		Passwords:          passwords,
+		Audit:              audit,
+	}
+}
+
+/*
+ * ForgotPassword never tells the caller whether the email exists. The lookup and
+ * the mail are done in the background so the response time does not leak it either,
+ * and a request within ResetEmailCooldown of the last link is silently dropped.
+ */
+func (s *PasswordResetService) ForgotPassword(ctx context.Context, input ForgotPasswordInput) error {
+	if input.Email == "" {
+		return errors.New("email required")
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+
+		if err := s.sendResetEmail(ctx, input.Email); err != nil {
+			log.Println("Error sending password reset email: ", err)
+		}
+	}()
+
+	return nil
+}
+
+func (s *PasswordResetService) sendResetEmail(ctx context.Context, email string) error {
+	user, err := s.UserModel.FindByEmail(ctx, email)
+	if err != nil {
+		return nil
+	}
+
+	/* a throttled call must leave the pending link alone, Insert would invalidate it */
+	claimed, err := s.UserModel.ClaimPasswordResetSend(ctx, user.ID, ResetEmailCooldown)
+	if err != nil || !claimed {
+		return err
+	}
+
+	return s.mailResetLink(ctx, user)
+}
+
+func (s *PasswordResetService) mailResetLink(ctx context.Context, user *models.User) error {
+	raw, err := models.NewOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	if err := s.PasswordResetModel.Insert(ctx, user.ID, user.Email, models.HashToken(raw), time.Now().Add(ResetTokenDuration)); err != nil {
+		return err
+	}
+
+	msg, err := mailer.Render("password_reset", user.Email, "Redefinição de senha", map[string]any{
+		"Name":      user.Name,
+		"Link":      s.BaseURL + "/reset-password?token=" + raw,
+		"ExpiresIn": "1 hora",
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.Mailer.Send(ctx, msg)
+}
+
+/*
+ * ForceReset is the admin action for a compromised or stuck account: the current
+ * password stops working, every session and token is revoked and a reset link is
+ * sent. Unlike ForgotPassword it runs in the request, so the admin sees mail failures.
+ */
+func (s *PasswordResetService) ForceReset(ctx context.Context, userID int64) (err error) {
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{Action: AuditPasswordForceReset, TargetType: "user", TargetID: auditID(userID), Err: err})
+	}()
+
+	user, err := s.UserModel.FindByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.UserModel.ClearPassword(ctx, userID); err != nil {
+		return err
+	}
+
+	if err := s.RefreshTokenModel.RevokeAllForUser(ctx, userID); err != nil {
+		return err
+	}
+
+	if err := s.PATModel.RevokeAllForUser(ctx, userID); err != nil {
+		return err
+	}
+
+	return s.mailResetLink(ctx, user)
+}
+
+/*
+ * ResetPassword consumes the token, sets the new password, marks the email verified,
+ * ends every existing session and lifts a login lockout on the account. The token is
+ * only good while the account still has the email it was mailed to.
+ */
+func (s *PasswordResetService) ResetPassword(ctx context.Context, input ResetPasswordInput) (err error) {
+	var userID int64
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{ActorID: userID, Action: AuditPasswordReset, TargetType: "user", TargetID: auditID(userID), Err: err})
+	}()
+
+	if input.Token == "" {
+		return ErrInvalidResetToken
+	}
+
+	if err := s.Passwords.Validate("password", input.Password); err != nil {
+		return err
+	}
+
+	userID, email, err := s.PasswordResetModel.Consume(ctx, models.HashToken(input.Token))
+	if errors.Is(err, models.ErrResetTokenInvalid) {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+
+	hashed, err := s.Passwords.Hash(input.Password)
+	if err != nil {
+		return err
+	}
+
+	/* the email changing between Consume and here makes the link as invalid as before */
+	err = s.UserModel.ResetPassword(ctx, userID, email, hashed)
+	if errors.Is(err, models.ErrResetTokenInvalid) {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.RefreshTokenModel.RevokeAllForUser(ctx, userID); err != nil {
+		return err
+	}
+
+	if err := s.PATModel.RevokeAllForUser(ctx, userID); err != nil {
+		return err
+	}
+
+	/* proving control of the mailbox is how a locked out account gets back in */
+	return s.LoginLimiter.Unlock(ctx, email)
+}
@@ -0,0 +1,43 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/VicAlexandre/pds-backend/internal/password"
+)
+
+func TestPasswordValidateMessages(t *testing.T) {
+	s := &PasswordService{Policy: password.NewPolicy(8)}
+
+	tests := []struct {
+		name     string
+		password string
+		want     string
+	}{
+		{"ok", "correct horse battery", ""},
+		{"too short", "abc", "use pelo menos 8 caracteres"},
+		{"too long", strings.Repeat("a", password.MaxLength+1), "use no máximo 256 caracteres"},
+		{"common", "password123", "essa senha é muito comum ou já apareceu em vazamentos, escolha outra"},
+	}
+
+	for _, tt := range tests {
+		err := s.Validate("password", tt.password)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: Validate = %v, want nil", tt.name, err)
+			}
+			continue
+		}
+
+		var verr *ValidationError
+		if !errors.As(err, &verr) || len(verr.Errors) != 1 {
+			t.Errorf("%s: Validate = %v, want one field error", tt.name, err)
+			continue
+		}
+		if fe := verr.Errors[0]; fe.Field != "password" || fe.Message != tt.want {
+			t.Errorf("%s: got %s: %q, want password: %q", tt.name, fe.Field, fe.Message, tt.want)
+		}
+	}
+}
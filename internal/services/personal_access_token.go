@@ -0,0 +1,95 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/VicAlexandre/pds-backend/internal/models"
+)
+
+/* scopes a personal access token can carry, login sessions are not limited by them */
+const (
+	ScopeRead   = "read"
+	ScopeWrite  = "write"
+	ScopeRender = "render"
+)
+
+var validScopes = []string{ScopeRead, ScopeWrite, ScopeRender}
+
+var (
+	ErrTokenNameRequired = errors.New("token name required")
+	ErrInvalidScope      = errors.New("scopes must be one or more of read, write, render")
+	ErrInvalidExpiry     = errors.New("expires_at must be in the future")
+)
+
+/* ExpiresAt is optional, a token without it is valid until revoked */
+type CreatePersonalAccessTokenInput struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+/* CreatedPersonalAccessToken is the only response that carries the raw token */
+type CreatedPersonalAccessToken struct {
+	*models.PersonalAccessToken
+	Token string `json:"token"`
+}
+
+type PersonalAccessTokenService struct {
+	PATModel *models.PersonalAccessTokenModel
+}
+
+func NewPersonalAccessTokenService(patModel *models.PersonalAccessTokenModel) *PersonalAccessTokenService {
+	return &PersonalAccessTokenService{
+		PATModel: patModel,
+	}
+}
+
+func (s *PersonalAccessTokenService) Create(ctx context.Context, userID int64, input CreatePersonalAccessTokenInput) (*CreatedPersonalAccessToken, error) {
+	name := strings.TrimSpace(input.Name)
+	if name == "" {
+		return nil, ErrTokenNameRequired
+	}
+
+	if len(input.Scopes) == 0 {
+		return nil, ErrInvalidScope
+	}
+
+	var scopes []string
+	for _, scope := range input.Scopes {
+		if !slices.Contains(validScopes, scope) {
+			return nil, ErrInvalidScope
+		}
+
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	if input.ExpiresAt != nil && !input.ExpiresAt.After(time.Now()) {
+		return nil, ErrInvalidExpiry
+	}
+
+	raw, err := models.NewPersonalAccessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := s.PATModel.Insert(ctx, userID, name, models.HashToken(raw), scopes, input.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CreatedPersonalAccessToken{PersonalAccessToken: token, Token: raw}, nil
+}
+
+func (s *PersonalAccessTokenService) List(ctx context.Context, userID int64) ([]models.PersonalAccessToken, error) {
+	return s.PATModel.ListByUser(ctx, userID)
+}
+
+func (s *PersonalAccessTokenService) Revoke(ctx context.Context, userID, id int64) error {
+	return s.PATModel.Revoke(ctx, userID, id)
+}
@@ -0,0 +1,487 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/VicAlexandre/pds-backend/internal/mailer"
+	"github.com/VicAlexandre/pds-backend/internal/models"
+	"github.com/chromedp/chromedp"
+)
+
+const (
+	/* erasures are done in small batches so one run never holds the database for long */
+	erasureBatchSize = 50
+
+	/* ExportTimeout bounds one export, a pending export older than that was lost and may be restarted */
+	ExportTimeout   = 30 * time.Minute
+	ExportRetention = 7 * 24 * time.Hour
+)
+
+/* ExportManifest is the index of the archive. PDF is empty when the apostila has no HTML yet */
+type ExportManifest struct {
+	GeneratedAt time.Time                `json:"generated_at"`
+	Apostilas   []ExportManifestApostila `json:"apostilas"`
+}
+
+type ExportManifestApostila struct {
+	ID             string `json:"id"`
+	OrganizationID *int64 `json:"organization_id"`
+	CreatedAt      string `json:"created_at"`
+	EditedAt       string `json:"edited_at"`
+	HTML           string `json:"html,omitempty"`
+	PDF            string `json:"pdf,omitempty"`
+}
+
+type exportProfile struct {
+	User                 *models.User                    `json:"user"`
+	Roles                []models.UserRole               `json:"roles"`
+	Identities           []models.Identity               `json:"identities"`
+	Sessions             []models.Session                `json:"sessions"`
+	PersonalAccessTokens []models.PersonalAccessToken    `json:"personal_access_tokens"`
+	DeletionRequest      *models.DeletionRequest         `json:"deletion_request"`
+	Organizations        []models.OrganizationMembership `json:"organizations"`
+	SharedApostilas      []models.SharedPermission       `json:"shared_apostilas"`
+}
+
+/*
+ * PrivacyService answers LGPD data subject requests: the data export and the
+ * account erasure, which only runs after a grace period the user can cancel in.
+ */
+type PrivacyService struct {
+	UserModel            *models.UserModel
+	RoleModel            *models.RoleModel
+	IdentityModel        *models.IdentityModel
+	SessionModel         *models.SessionModel
+	PATModel             *models.PersonalAccessTokenModel
+	ApostilaModel        *models.ApostilaModel
+	DeletionRequestModel *models.DeletionRequestModel
+	LoginLimiter         *LoginLimiter
+	Passwords            *PasswordService
+	Mailer               mailer.Mailer
+	BaseURL              string
+	GracePeriod          time.Duration
+	Audit                *AuditService
+	OrganizationModel    *models.OrganizationModel
+	DataExportModel      *models.DataExportModel
+}
+
+func NewPrivacyService(userModel *models.UserModel, roleModel *models.RoleModel, identityModel *models.IdentityModel, sessionModel *models.SessionModel, patModel *models.PersonalAccessTokenModel, apostilaModel *models.ApostilaModel, deletionRequestModel *models.DeletionRequestModel, loginLimiter *LoginLimiter, passwords *PasswordService, m mailer.Mailer, baseURL string, gracePeriod time.Duration, audit *AuditService, organizationModel *models.OrganizationModel, dataExportModel *models.DataExportModel) *PrivacyService {
+	return &PrivacyService{
+		UserModel:            userModel,
+		RoleModel:            roleModel,
+		IdentityModel:        identityModel,
+		SessionModel:         sessionModel,
+		PATModel:             patModel,
+		ApostilaModel:        apostilaModel,
+		DeletionRequestModel: deletionRequestModel,
+		LoginLimiter:         loginLimiter,
+		Passwords:            passwords,
+		Mailer:               m,
+		BaseURL:              baseURL,
+		GracePeriod:          gracePeriod,
+		Audit:                audit,
+		OrganizationModel:    organizationModel,
+		DataExportModel:      dataExportModel,
+	}
+}
+
+/*
+ * RequestExport starts building the archive in the background: rendering a PDF per
+ * apostila takes far longer than a request may. The user is mailed when it is done,
+ * and ExportStatus and ExportArchive follow it meanwhile.
+ */
+func (s *PrivacyService) RequestExport(ctx context.Context, userID int64) (*models.DataExport, error) {
+	export, err := s.DataExportModel.Start(ctx, userID, ExportTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	go s.runExport(context.WithoutCancel(ctx), export)
+
+	return export, nil
+}
+
+func (s *PrivacyService) ExportStatus(ctx context.Context, userID int64) (*models.DataExport, error) {
+	return s.DataExportModel.FindByUser(ctx, userID)
+}
+
+func (s *PrivacyService) ExportArchive(ctx context.Context, userID int64) ([]byte, error) {
+	return s.DataExportModel.Archive(ctx, userID)
+}
+
+/* runExport records the outcome with its own deadline, the build may have used up ExportTimeout */
+func (s *PrivacyService) runExport(ctx context.Context, export *models.DataExport) {
+	userID := export.UserID
+
+	var err error
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{ActorID: userID, Action: AuditDataExport, TargetType: "user", TargetID: auditID(userID), Err: err})
+	}()
+
+	buildCtx, cancel := context.WithTimeout(ctx, ExportTimeout)
+	defer cancel()
+
+	var archive bytes.Buffer
+	err = s.writeExport(buildCtx, userID, &archive)
+
+	ctx, cancel = context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	if err != nil {
+		log.Println("Error building data export for user", userID, ": ", err)
+		if ferr := s.DataExportModel.Fail(ctx, export, err.Error()); ferr != nil {
+			log.Println("Error recording failed data export: ", ferr)
+		}
+	} else if ferr := s.DataExportModel.Finish(ctx, export, archive.Bytes(), time.Now().Add(ExportRetention)); ferr != nil {
+		err = ferr
+		log.Println("Error storing data export: ", err)
+		return
+	}
+
+	if merr := s.mailExport(ctx, userID, err); merr != nil {
+		log.Println("Error sending data export email: ", merr)
+	}
+}
+
+func (s *PrivacyService) mailExport(ctx context.Context, userID int64, exportErr error) error {
+	user, err := s.UserModel.FindByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	subject := "Seus dados estão prontos"
+	if exportErr != nil {
+		subject = "Não foi possível exportar seus dados"
+	}
+
+	msg, err := mailer.Render("data_export", user.Email, subject, map[string]any{
+		"Name":      user.Name,
+		"Failed":    exportErr != nil,
+		"Link":      s.BaseURL + "/account/export",
+		"ExpiresIn": "7 dias",
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.Mailer.Send(ctx, msg)
+}
+
+/*
+ * writeExport writes a zip with profile.json, the user's audit events, and the HTML
+ * and PDF of every apostila. A PDF that cannot be rendered fails the whole export,
+ * an archive missing some of them would not be the complete copy the user asked for.
+ */
+func (s *PrivacyService) writeExport(ctx context.Context, userID int64, w io.Writer) error {
+	profile, err := s.profile(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	events, err := s.auditEvents(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	apostilas, err := s.ApostilaModel.ListAllByUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	/* one browser for the whole export, each apostila is rendered in a new tab of it */
+	browser, closeBrowser := chromedp.NewContext(ctx)
+	defer closeBrowser()
+	browserStarted := false
+
+	zw := zip.NewWriter(w)
+
+	if err := writeZipJSON(zw, "profile.json", profile); err != nil {
+		return err
+	}
+
+	if err := writeZipJSON(zw, "audit_events.json", events); err != nil {
+		return err
+	}
+
+	manifest := ExportManifest{GeneratedAt: time.Now().UTC(), Apostilas: []ExportManifestApostila{}}
+	for _, apostila := range apostilas {
+		entry := ExportManifestApostila{
+			ID:             apostila.Id.String(),
+			OrganizationID: apostila.OrganizationID,
+			CreatedAt:      apostila.CreatedAt,
+			EditedAt:       apostila.EditedAt,
+		}
+
+		if apostila.EditedHTML != "" {
+			entry.HTML = "apostilas/" + entry.ID + ".html"
+			if err := writeZipFile(zw, entry.HTML, []byte(apostila.EditedHTML)); err != nil {
+				return err
+			}
+
+			if !browserStarted {
+				if err := chromedp.Run(browser); err != nil {
+					return fmt.Errorf("starting browser: %w", err)
+				}
+				browserStarted = true
+			}
+
+			pdf, err := renderPDF(browser, apostila.EditedHTML)
+			if err != nil {
+				return fmt.Errorf("rendering apostila %s: %w", entry.ID, err)
+			}
+
+			entry.PDF = "apostilas/" + entry.ID + ".pdf"
+			if err := writeZipFile(zw, entry.PDF, pdf); err != nil {
+				return err
+			}
+		}
+
+		manifest.Apostilas = append(manifest.Apostilas, entry)
+	}
+
+	if err := writeZipJSON(zw, "manifest.json", manifest); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+func (s *PrivacyService) profile(ctx context.Context, userID int64) (*exportProfile, error) {
+	user, err := s.UserModel.FindByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	roles, err := s.RoleModel.ListForUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	identities, err := s.IdentityModel.ListByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := s.SessionModel.ListActive(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := s.PATModel.ListByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := s.DeletionRequestModel.FindByUser(ctx, userID)
+	if err != nil && !errors.Is(err, models.ErrDeletionRequestNotFound) {
+		return nil, err
+	}
+
+	organizations, err := s.OrganizationModel.ListForUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := s.ApostilaModel.ListPermissionsOfUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &exportProfile{
+		User:                 user,
+		Roles:                roles,
+		Identities:           identities,
+		Sessions:             sessions,
+		PersonalAccessTokens: tokens,
+		DeletionRequest:      request,
+		Organizations:        organizations,
+		SharedApostilas:      shared,
+	}, nil
+}
+
+/* auditEvents merges what the user did with what was done to the account, e.g. failed logins */
+func (s *PrivacyService) auditEvents(ctx context.Context, userID int64) ([]*models.AuditEvent, error) {
+	seen := map[int64]bool{}
+	events := []*models.AuditEvent{}
+	collect := func(e *models.AuditEvent) error {
+		if !seen[e.ID] {
+			seen[e.ID] = true
+			events = append(events, e)
+		}
+		return nil
+	}
+
+	if err := s.Audit.Each(ctx, models.AuditFilter{ActorID: &userID}, collect); err != nil {
+		return nil, err
+	}
+
+	if err := s.Audit.Each(ctx, models.AuditFilter{TargetType: "user", TargetID: auditID(userID)}, collect); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].ID > events[j].ID })
+
+	return events, nil
+}
+
+type DeleteUserInput struct {
+	Password string `json:"password"`
+}
+
+/*
+ * RequestDeletion schedules the erasure after the grace period and mails the user,
+ * so a stolen session cannot quietly delete an account. Accounts that only sign in
+ * through an OIDC provider have no password to confirm with.
+ */
+func (s *PrivacyService) RequestDeletion(ctx context.Context, userID int64, input DeleteUserInput) (_ *models.DeletionRequest, err error) {
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{ActorID: userID, Action: AuditDeletionRequest, TargetType: "user", TargetID: auditID(userID), Err: err})
+	}()
+
+	user, err := s.UserModel.FindByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Password != "" {
+		if ok, _ := s.Passwords.Verify(input.Password, user.Password); !ok {
+			return nil, ErrInvalidPassword
+		}
+	}
+
+	request, err := s.DeletionRequestModel.Insert(ctx, userID, time.Now().Add(s.GracePeriod))
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := mailer.Render("account_deletion", user.Email, "Exclusão da conta", map[string]any{
+		"Name":         user.Name,
+		"ScheduledFor": request.ScheduledFor.Format("02/01/2006"),
+		"Link":         s.BaseURL + "/account",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Mailer.Send(ctx, msg); err != nil {
+		log.Println("Error sending account deletion email: ", err)
+	}
+
+	return request, nil
+}
+
+func (s *PrivacyService) DeletionStatus(ctx context.Context, userID int64) (*models.DeletionRequest, error) {
+	return s.DeletionRequestModel.FindByUser(ctx, userID)
+}
+
+func (s *PrivacyService) CancelDeletion(ctx context.Context, userID int64) (err error) {
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{ActorID: userID, Action: AuditDeletionCancel, TargetType: "user", TargetID: auditID(userID), Err: err})
+	}()
+
+	return s.DeletionRequestModel.Delete(ctx, userID)
+}
+
+/*
+ * EraseDue deletes the accounts whose grace period is over. Every row tied to the
+ * user goes through ON DELETE CASCADE; the login attempt counters are keyed by email
+ * and are cleared separately. Audit events stay, but lose the id, IPs and email of the
+ * account; only the user.erase event itself still says which id was erased.
+ */
+func (s *PrivacyService) EraseDue(ctx context.Context) error {
+	userIDs, err := s.DeletionRequestModel.ListDue(ctx, erasureBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		if err := s.erase(ctx, userID); err != nil {
+			log.Println("Error erasing account", userID, ": ", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *PrivacyService) erase(ctx context.Context, userID int64) (err error) {
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{Action: AuditUserErase, TargetType: "user", TargetID: auditID(userID), Err: err})
+	}()
+
+	return s.Erase(ctx, userID)
+}
+
+/*
+ * Erase deletes the account now, for the scheduled erasure and for admins. The last
+ * enabled admin is refused with ErrLastAdmin, the system would be left without one.
+ */
+func (s *PrivacyService) Erase(ctx context.Context, userID int64) error {
+	user, err := s.UserModel.FindByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	/* before the delete, so a failure leaves the request in place and the next run retries both */
+	if err := s.LoginLimiter.Unlock(ctx, user.Email); err != nil {
+		return err
+	}
+
+	err = s.UserModel.EraseUnlessLast(ctx, userID, user.Email, RoleAdmin)
+	if errors.Is(err, models.ErrLastRoleHolder) {
+		return ErrLastAdmin
+	}
+	return err
+}
+
+/* RunErasure calls EraseDue every interval until ctx is done */
+func (s *PrivacyService) RunErasure(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.EraseDue(ctx); err != nil {
+			log.Println("Error running account erasure: ", err)
+		}
+
+		if err := s.DataExportModel.DeleteExpired(ctx); err != nil {
+			log.Println("Error deleting expired data exports: ", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v any) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", name, err)
+	}
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(v)
+}
+
+func writeZipFile(zw *zip.Writer, name string, data []byte) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", name, err)
+	}
+
+	_, err = f.Write(data)
+	return err
+}
@@ -0,0 +1,138 @@
+package services
+
+import "regexp"
+
+/* above this many block pairs the changed middle of two revisions is shown as replaced whole */
+const maxDiffCells = 4_000_000
+
+const (
+	DiffEqual  = "equal"
+	DiffInsert = "insert"
+	DiffDelete = "delete"
+)
+
+/* blockStartPattern marks where a new block of the document begins */
+var blockStartPattern = regexp.MustCompile(`(?i)<(?:p|h[1-6]|li|ul|ol|table|tr|div|section|article|header|footer|blockquote|pre|figure|img|hr|details|summary)\b`)
+
+/* DiffChange is a run of consecutive blocks, Text is their visible text for editors that do not render HTML */
+type DiffChange struct {
+	Op   string   `json:"op"`
+	HTML []string `json:"html"`
+	Text []string `json:"text"`
+}
+
+type RevisionDiff struct {
+	From    int64        `json:"from"`
+	To      int64        `json:"to"`
+	Changes []DiffChange `json:"changes"`
+}
+
+/*
+ * diffBlocks compares two documents block by block (paragraphs, headings, list items,
+ * table rows...) rather than line by line, the HTML the editor saves has no useful lines.
+ */
+func diffBlocks(from, to string) []DiffChange {
+	a, b := splitBlocks(from), splitBlocks(to)
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var changes []DiffChange
+	emit := func(op string, block string) {
+		if n := len(changes); n > 0 && changes[n-1].Op == op {
+			changes[n-1].HTML = append(changes[n-1].HTML, block)
+			changes[n-1].Text = append(changes[n-1].Text, plainText(block))
+			return
+		}
+		changes = append(changes, DiffChange{Op: op, HTML: []string{block}, Text: []string{plainText(block)}})
+	}
+
+	for _, block := range a[:prefix] {
+		emit(DiffEqual, block)
+	}
+
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(midA)*len(midB) > maxDiffCells {
+		for _, block := range midA {
+			emit(DiffDelete, block)
+		}
+		for _, block := range midB {
+			emit(DiffInsert, block)
+		}
+	} else {
+		diffLCS(midA, midB, emit)
+	}
+
+	for _, block := range a[len(a)-suffix:] {
+		emit(DiffEqual, block)
+	}
+
+	if changes == nil {
+		changes = []DiffChange{}
+	}
+
+	return changes
+}
+
+/* diffLCS walks the longest common subsequence table, deletions before insertions at each step */
+func diffLCS(a, b []string, emit func(op string, block string)) {
+	n, m := len(a), len(b)
+	lcs := make([][]int32, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, m+1)
+	}
+
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && a[i] == b[j]:
+			emit(DiffEqual, a[i])
+			i++
+			j++
+		case j == m || (i < n && lcs[i+1][j] >= lcs[i][j+1]):
+			emit(DiffDelete, a[i])
+			i++
+		default:
+			emit(DiffInsert, b[j])
+			j++
+		}
+	}
+}
+
+/* splitBlocks cuts the document before every block tag, whitespace is collapsed so reindenting is not a change */
+func splitBlocks(doc string) []string {
+	doc = hiddenPattern.ReplaceAllString(doc, "")
+
+	blocks := []string{}
+	last := 0
+	add := func(block string) {
+		if block = collapseSpaces(block); block != "" {
+			blocks = append(blocks, block)
+		}
+	}
+
+	for _, loc := range blockStartPattern.FindAllStringIndex(doc, -1) {
+		add(doc[last:loc[0]])
+		last = loc[0]
+	}
+	add(doc[last:])
+
+	return blocks
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffBlocks(t *testing.T) {
+	tests := []struct {
+		name string
+		from string
+		to   string
+		want []DiffChange
+	}{
+		{"both empty", "", "", []DiffChange{}},
+		{"unchanged", "<p>a</p><p>b</p>", "<p>a</p>\n  <p>b</p>", []DiffChange{
+			{Op: DiffEqual, HTML: []string{"<p>a</p>", "<p>b</p>"}, Text: []string{"a", "b"}},
+		}},
+		{"from empty", "", "<h1>T</h1><p>a</p>", []DiffChange{
+			{Op: DiffInsert, HTML: []string{"<h1>T</h1>", "<p>a</p>"}, Text: []string{"T", "a"}},
+		}},
+		{"to empty", "<h1>T</h1><p>a</p>", "", []DiffChange{
+			{Op: DiffDelete, HTML: []string{"<h1>T</h1>", "<p>a</p>"}, Text: []string{"T", "a"}},
+		}},
+		{"insert only", "<p>a</p><p>c</p>", "<p>a</p><p>b</p><p>b2</p><p>c</p>", []DiffChange{
+			{Op: DiffEqual, HTML: []string{"<p>a</p>"}, Text: []string{"a"}},
+			{Op: DiffInsert, HTML: []string{"<p>b</p>", "<p>b2</p>"}, Text: []string{"b", "b2"}},
+			{Op: DiffEqual, HTML: []string{"<p>c</p>"}, Text: []string{"c"}},
+		}},
+		{"delete only", "<p>a</p><p>b</p><p>c</p><p>d</p>", "<p>a</p><p>d</p>", []DiffChange{
+			{Op: DiffEqual, HTML: []string{"<p>a</p>"}, Text: []string{"a"}},
+			{Op: DiffDelete, HTML: []string{"<p>b</p>", "<p>c</p>"}, Text: []string{"b", "c"}},
+			{Op: DiffEqual, HTML: []string{"<p>d</p>"}, Text: []string{"d"}},
+		}},
+		{"replace", "<p>a</p><p>b</p>", "<p>a</p><p>x</p>", []DiffChange{
+			{Op: DiffEqual, HTML: []string{"<p>a</p>"}, Text: []string{"a"}},
+			{Op: DiffDelete, HTML: []string{"<p>b</p>"}, Text: []string{"b"}},
+			{Op: DiffInsert, HTML: []string{"<p>x</p>"}, Text: []string{"x"}},
+		}},
+		{"multi-byte", "<p>Introdução</p><p>Exercícios 😀</p>", "<p>Introdução</p><p>Exercícios 😀✍️</p>", []DiffChange{
+			{Op: DiffEqual, HTML: []string{"<p>Introdução</p>"}, Text: []string{"Introdução"}},
+			{Op: DiffDelete, HTML: []string{"<p>Exercícios 😀</p>"}, Text: []string{"Exercícios 😀"}},
+			{Op: DiffInsert, HTML: []string{"<p>Exercícios 😀✍️</p>"}, Text: []string{"Exercícios 😀✍️"}},
+		}},
+		{"entities in text", "<p>a &amp; b</p>", "<p>a &amp; b</p><p>&lt;c&gt;</p>", []DiffChange{
+			{Op: DiffEqual, HTML: []string{"<p>a &amp; b</p>"}, Text: []string{"a & b"}},
+			{Op: DiffInsert, HTML: []string{"<p>&lt;c&gt;</p>"}, Text: []string{"<c>"}},
+		}},
+		{"hidden content ignored", "<p>a</p>", "<p>a</p><!-- note --><script>x()</script>", []DiffChange{
+			{Op: DiffEqual, HTML: []string{"<p>a</p>"}, Text: []string{"a"}},
+		}},
+	}
+
+	for _, tt := range tests {
+		if got := diffBlocks(tt.from, tt.to); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: diffBlocks = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+/* past maxDiffCells the changed middle is shown as deleted and inserted whole, the unchanged ends still match */
+func TestDiffBlocksLargeMiddle(t *testing.T) {
+	from, to := "<h1>T</h1>", "<h1>T</h1>"
+	for i := range 2001 {
+		from += "<p>a" + string(rune('0'+i%10)) + "</p>"
+		to += "<p>b" + string(rune('0'+i%10)) + "</p>"
+	}
+
+	changes := diffBlocks(from, to)
+	if len(changes) != 3 || changes[0].Op != DiffEqual || changes[1].Op != DiffDelete || changes[2].Op != DiffInsert {
+		t.Fatalf("got %d changes, want equal, delete and insert", len(changes))
+	}
+	if len(changes[1].HTML) != 2001 || len(changes[2].HTML) != 2001 {
+		t.Errorf("deleted %d and inserted %d blocks, want 2001 each", len(changes[1].HTML), len(changes[2].HTML))
+	}
+}
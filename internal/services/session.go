@@ -0,0 +1,51 @@
+package services
+
+import (
+	"context"
+
+	"github.com/VicAlexandre/pds-backend/internal/models"
+	"github.com/google/uuid"
+)
+
+type SessionService struct {
+	SessionModel *models.SessionModel
+}
+
+func NewSessionService(sessionModel *models.SessionModel) *SessionService {
+	return &SessionService{
+		SessionModel: sessionModel,
+	}
+}
+
+/* List flags the session the request was made from so clients can label it */
+func (s *SessionService) List(ctx context.Context, userID int64, currentID string) ([]models.Session, error) {
+	sessions, err := s.SessionModel.ListActive(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID.String() == currentID
+	}
+
+	return sessions, nil
+}
+
+func (s *SessionService) Revoke(ctx context.Context, userID int64, sessionID string) error {
+	id, err := uuid.Parse(sessionID)
+	if err != nil {
+		return models.ErrSessionNotFound
+	}
+
+	return s.SessionModel.Revoke(ctx, userID, id)
+}
+
+/* RevokeOthers keeps the caller signed in, they can log out separately */
+func (s *SessionService) RevokeOthers(ctx context.Context, userID int64, currentID string) error {
+	id, err := uuid.Parse(currentID)
+	if err != nil {
+		return models.ErrSessionNotFound
+	}
+
+	return s.SessionModel.RevokeAllExcept(ctx, userID, id)
+}
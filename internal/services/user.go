@@ -2,31 +2,200 @@ package services
 
 import (
 	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
 
+	"github.com/VicAlexandre/pds-backend/internal/mailer"
 	"github.com/VicAlexandre/pds-backend/internal/models"
+	"github.com/google/uuid"
 )
 
+var (
+	ErrInvalidPassword = errors.New("current password is incorrect")
+	ErrNameRequired    = errors.New("name cannot be empty")
+)
+
+/* nil fields are left untouched, changing the email asks for the current password */
+type UpdateUserInput struct {
+	Name            *string `json:"name"`
+	Email           *string `json:"email"`
+	CurrentPassword string  `json:"current_password"`
+}
+
+type ChangePasswordInput struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
 type UserService struct {
-	UserModel  *models.UserModel
-	TokenModel *models.JWTModel
+	UserModel         *models.UserModel
+	IdentityModel     *models.IdentityModel
+	RefreshTokenModel *models.RefreshTokenModel
+	EmailVerification *EmailVerificationService
+	Passwords         *PasswordService
+	Audit             *AuditService
+	Mailer            mailer.Mailer
+	BaseURL           string
 }
 
-func NewUserService(userModel *models.UserModel) *UserService {
+func NewUserService(userModel *models.UserModel, identityModel *models.IdentityModel, refreshTokenModel *models.RefreshTokenModel, emailVerification *EmailVerificationService, passwords *PasswordService, audit *AuditService, m mailer.Mailer, baseURL string) *UserService {
 	return &UserService{
-		UserModel: userModel,
+		UserModel:         userModel,
+		IdentityModel:     identityModel,
+		RefreshTokenModel: refreshTokenModel,
+		EmailVerification: emailVerification,
+		Passwords:         passwords,
+		Audit:             audit,
+		Mailer:            m,
+		BaseURL:           baseURL,
 	}
 }
 
-func (s *UserService) GetUserByID(ctx context.Context, token string) (*models.User, error) {
-	claims, err := s.TokenModel.ParseJWT(token)
+func (s *UserService) GetUserByID(ctx context.Context, userID int64) (*models.User, error) {
+	userData, err := s.UserModel.FindByID(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
 
-	userData, err := s.UserModel.FindByID(ctx, claims.UserID)
+	return userData, nil
+}
+
+/*
+ * UpdateUser changes name and/or email. A new email needs the current password, since
+ * whoever holds the email holds the account through a password reset; it goes back to
+ * unverified, gets a new link, and the old address is told about the change.
+ */
+func (s *UserService) UpdateUser(ctx context.Context, userID int64, input UpdateUserInput) (_ *models.User, err error) {
+	user, err := s.UserModel.FindByID(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
 
-	return userData, nil
+	name, email := user.Name, user.Email
+
+	if input.Name != nil {
+		name = strings.TrimSpace(*input.Name)
+		if name == "" {
+			return nil, ErrNameRequired
+		}
+	}
+
+	if input.Email != nil {
+		email = models.NormalizeEmail(*input.Email)
+	}
+
+	emailChanged := email != user.Email
+	if emailChanged {
+		defer func() {
+			s.Audit.Record(ctx, AuditEntry{ActorID: userID, Action: AuditEmailChange, TargetType: "user", TargetID: auditID(userID), Err: err})
+		}()
+
+		if !isValidEmail(email) {
+			return nil, ErrInvalidEmail
+		}
+
+		if err := s.verifyPassword(ctx, user, input.CurrentPassword); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.UserModel.UpdateProfile(ctx, userID, name, email); err != nil {
+		return nil, err
+	}
+
+	updated, err := s.UserModel.FindByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if emailChanged {
+		s.EmailVerification.SendAsync(ctx, updated)
+		s.notifyEmailChange(ctx, user, updated.Email)
+	}
+
+	return updated, nil
+}
+
+/* notifyEmailChange warns the old address, the only way its owner learns of a takeover */
+func (s *UserService) notifyEmailChange(ctx context.Context, user *models.User, newEmail string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+
+		msg, err := mailer.Render("email_changed", user.Email, "E-mail da conta alterado", map[string]any{
+			"Name":     user.Name,
+			"NewEmail": newEmail,
+		})
+		if err == nil {
+			err = s.Mailer.Send(ctx, msg)
+		}
+		if err != nil {
+			log.Println("Error sending email change notice: ", err)
+		}
+	}()
+}
+
+/* ChangePassword keeps the current session and revokes every other one */
+func (s *UserService) ChangePassword(ctx context.Context, userID int64, sessionID string, input ChangePasswordInput) (err error) {
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{ActorID: userID, Action: AuditPasswordChange, TargetType: "user", TargetID: auditID(userID), Err: err})
+	}()
+
+	if err := s.Passwords.Validate("new_password", input.NewPassword); err != nil {
+		return err
+	}
+
+	if err := s.checkPassword(ctx, userID, input.CurrentPassword); err != nil {
+		return err
+	}
+
+	hashed, err := s.Passwords.Hash(input.NewPassword)
+	if err != nil {
+		return err
+	}
+
+	if err := s.UserModel.UpdatePassword(ctx, userID, hashed); err != nil {
+		return err
+	}
+
+	familyID, err := uuid.Parse(sessionID)
+	if err != nil {
+		return s.RefreshTokenModel.RevokeAllForUser(ctx, userID)
+	}
+
+	return s.RefreshTokenModel.RevokeAllForUserExcept(ctx, userID, familyID)
+}
+
+func (s *UserService) checkPassword(ctx context.Context, userID int64, password string) error {
+	user, err := s.UserModel.FindByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	return s.verifyPassword(ctx, user, password)
+}
+
+/*
+ * verifyPassword lets accounts without a password through only when they sign in with
+ * SSO and have none to give. A password cleared by ForceReset is set again by the link.
+ */
+func (s *UserService) verifyPassword(ctx context.Context, user *models.User, password string) error {
+	if user.Password == "" {
+		identities, err := s.IdentityModel.ListByUser(ctx, user.ID)
+		if err != nil {
+			return err
+		}
+		if len(identities) == 0 {
+			return ErrInvalidPassword
+		}
+		return nil
+	}
+
+	if ok, _ := s.Passwords.Verify(password, user.Password); !ok {
+		return ErrInvalidPassword
+	}
+
+	return nil
 }
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"context"
+	"errors"
+
+	"github.com/VicAlexandre/pds-backend/internal/auth"
+	"github.com/VicAlexandre/pds-backend/internal/models"
+)
+
+var ErrSelfAction = errors.New("admins cannot disable or delete their own account")
+
+/*
+ * UserAdminService backs the /v1/admin/users routes. Every action is audited with
+ * the admin from the request context as the actor.
+ */
+type UserAdminService struct {
+	UserModel         *models.UserModel
+	RefreshTokenModel *models.RefreshTokenModel
+	PasswordReset     *PasswordResetService
+	Privacy           *PrivacyService
+	Audit             *AuditService
+}
+
+func NewUserAdminService(userModel *models.UserModel, refreshTokenModel *models.RefreshTokenModel, passwordReset *PasswordResetService, privacy *PrivacyService, audit *AuditService) *UserAdminService {
+	return &UserAdminService{
+		UserModel:         userModel,
+		RefreshTokenModel: refreshTokenModel,
+		PasswordReset:     passwordReset,
+		Privacy:           privacy,
+		Audit:             audit,
+	}
+}
+
+func (s *UserAdminService) List(ctx context.Context, filter models.UserFilter) ([]models.UserSummary, error) {
+	return s.UserModel.List(ctx, filter)
+}
+
+/*
+ * Disable ends every session right away. Personal access tokens are kept but rejected
+ * while the account is disabled, so CI jobs resume once it is enabled again. The last
+ * enabled admin cannot be disabled.
+ */
+func (s *UserAdminService) Disable(ctx context.Context, userID int64) (err error) {
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{Action: AuditUserDisable, TargetType: "user", TargetID: auditID(userID), Err: err})
+	}()
+
+	if err := s.checkTarget(ctx, userID); err != nil {
+		return err
+	}
+
+	err = s.UserModel.DisableUnlessLast(ctx, userID, RoleAdmin)
+	if errors.Is(err, models.ErrLastRoleHolder) {
+		return ErrLastAdmin
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.RefreshTokenModel.RevokeAllForUser(ctx, userID)
+}
+
+func (s *UserAdminService) Enable(ctx context.Context, userID int64) (err error) {
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{Action: AuditUserEnable, TargetType: "user", TargetID: auditID(userID), Err: err})
+	}()
+
+	if _, err := s.UserModel.FindByID(ctx, userID); err != nil {
+		return err
+	}
+
+	return s.UserModel.SetDisabled(ctx, userID, false)
+}
+
+func (s *UserAdminService) ForcePasswordReset(ctx context.Context, userID int64) error {
+	return s.PasswordReset.ForceReset(ctx, userID)
+}
+
+/*
+ * Delete does not ask for a password like the self-service deletion, the admin check
+ * stands in for it. It erases the account as the scheduled erasure does, audit log included.
+ */
+func (s *UserAdminService) Delete(ctx context.Context, userID int64) (err error) {
+	defer func() {
+		s.Audit.Record(ctx, AuditEntry{Action: AuditUserDelete, TargetType: "user", TargetID: auditID(userID), Err: err, Metadata: map[string]any{"by_admin": true}})
+	}()
+
+	if err := s.checkTarget(ctx, userID); err != nil {
+		return err
+	}
+
+	return s.Privacy.Erase(ctx, userID)
+}
+
+/* an admin locking themselves out could leave the system without any admin */
+func (s *UserAdminService) checkTarget(ctx context.Context, userID int64) error {
+	if actorID, _ := auth.UserIDFromContext(ctx); actorID == userID {
+		return ErrSelfAction
+	}
+
+	_, err := s.UserModel.FindByID(ctx, userID)
+	return err
+}
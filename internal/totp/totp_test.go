@@ -0,0 +1,103 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+/* the SHA1 seed of RFC 6238 appendix B, "12345678901234567890" in base32 */
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+/* RFC 6238 lists 8 digit codes, a 6 digit code is their last six digits */
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestCodeAtRFC6238(t *testing.T) {
+	for _, v := range rfcVectors {
+		got, err := CodeAt(rfcSecret, Step(time.Unix(v.unix, 0)))
+		if err != nil {
+			t.Fatalf("CodeAt(%d): %v", v.unix, err)
+		}
+		if got != v.code {
+			t.Errorf("CodeAt(%d) = %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestCodeAtLowercaseSecret(t *testing.T) {
+	got, err := CodeAt(strings.ToLower(rfcSecret), Step(time.Unix(59, 0)))
+	if err != nil || got != "287082" {
+		t.Errorf("CodeAt(lowercase) = %q, %v, want 287082", got, err)
+	}
+}
+
+func TestCodeAtInvalidSecret(t *testing.T) {
+	if _, err := CodeAt("not base32!", 1); err == nil {
+		t.Error("CodeAt accepted an invalid secret")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	at := time.Unix(1111111111, 0)
+	step := Step(at)
+
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", "050471", step, true},
+		{"spaces are ignored", " 050 471 ", step, true},
+		{"previous step", mustCode(t, step-1), step - 1, true},
+		{"next step", mustCode(t, step+1), step + 1, true},
+		{"two steps back", mustCode(t, step-2), 0, false},
+		{"two steps ahead", mustCode(t, step+2), 0, false},
+		{"wrong code", "000000", 0, false},
+		{"too short", "05047", 0, false},
+		{"8 digit code", "14050471", 0, false},
+	}
+
+	for _, tt := range tests {
+		gotStep, gotOK := Validate(rfcSecret, tt.code, at)
+		if gotStep != tt.wantStep || gotOK != tt.wantOK {
+			t.Errorf("%s: Validate(%q) = %d, %v, want %d, %v", tt.name, tt.code, gotStep, gotOK, tt.wantStep, tt.wantOK)
+		}
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(secret) != 32 {
+		t.Errorf("len(secret) = %d, want 32 base32 characters for 20 bytes", len(secret))
+	}
+
+	if _, err := CodeAt(secret, 1); err != nil {
+		t.Errorf("generated secret does not decode: %v", err)
+	}
+}
+
+func mustCode(t *testing.T, step int64) string {
+	t.Helper()
+
+	code, err := CodeAt(rfcSecret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return code
+}
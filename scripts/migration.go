@@ -6,8 +6,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 func main() {
@@ -72,6 +73,595 @@ func main() {
 			)
 			`,
 		},
+		{
+			version: "003_create_refresh_tokens",
+			query: `
+				CREATE TABLE IF NOT EXISTS refresh_tokens (
+					id SERIAL PRIMARY KEY,
+					user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					family_id UUID NOT NULL,
+					token_hash TEXT NOT NULL UNIQUE,
+					expires_at TIMESTAMPTZ NOT NULL,
+					revoked_at TIMESTAMPTZ,
+					replaced_by INTEGER REFERENCES refresh_tokens(id),
+					created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+				);
+				CREATE INDEX IF NOT EXISTS refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+				CREATE INDEX IF NOT EXISTS refresh_tokens_user_id_idx ON refresh_tokens (user_id)
+			`,
+		},
+		{
+			version: "004_create_revoked_access_tokens",
+			query: `
+				CREATE TABLE IF NOT EXISTS revoked_access_tokens (
+					jti UUID PRIMARY KEY,
+					expires_at TIMESTAMPTZ NOT NULL,
+					revoked_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+				)
+			`,
+		},
+		{
+			version: "005_create_password_reset_tokens",
+			query: `
+				CREATE TABLE IF NOT EXISTS password_reset_tokens (
+					id SERIAL PRIMARY KEY,
+					user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					token_hash TEXT NOT NULL UNIQUE,
+					expires_at TIMESTAMPTZ NOT NULL,
+					used_at TIMESTAMPTZ,
+					created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+				);
+				CREATE INDEX IF NOT EXISTS password_reset_tokens_user_id_idx ON password_reset_tokens (user_id)
+			`,
+		},
+		{
+			version: "006_add_users_email_verification",
+			query: `
+				ALTER TABLE users
+					ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMPTZ,
+					ADD COLUMN IF NOT EXISTS verification_sent_at TIMESTAMPTZ
+			`,
+		},
+		{
+			version: "007_apostilas_cascade_user_delete",
+			query: `
+				ALTER TABLE apostilas
+					DROP CONSTRAINT IF EXISTS apostilas_user_id_fkey,
+					ADD CONSTRAINT apostilas_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			`,
+		},
+		{
+			version: "008_create_login_attempts",
+			query: `
+				CREATE TABLE IF NOT EXISTS login_attempts (
+					key TEXT PRIMARY KEY,
+					failures INTEGER NOT NULL,
+					last_failure_at TIMESTAMPTZ NOT NULL
+				)
+			`,
+		},
+		{
+			version: "009_create_mfa",
+			query: `
+				CREATE TABLE IF NOT EXISTS user_mfa (
+					user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+					secret TEXT NOT NULL,
+					enabled_at TIMESTAMPTZ,
+					last_used_step BIGINT NOT NULL DEFAULT 0,
+					created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+				);
+				CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+					id SERIAL PRIMARY KEY,
+					user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					code_hash TEXT NOT NULL,
+					used_at TIMESTAMPTZ
+				);
+				CREATE INDEX IF NOT EXISTS mfa_recovery_codes_user_id_idx ON mfa_recovery_codes (user_id)
+			`,
+		},
+		{
+			version: "010_create_oidc_identities",
+			query: `
+				ALTER TABLE users ALTER COLUMN password DROP NOT NULL;
+				CREATE TABLE IF NOT EXISTS user_identities (
+					id SERIAL PRIMARY KEY,
+					user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					provider TEXT NOT NULL,
+					subject TEXT NOT NULL,
+					email TEXT,
+					created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+					UNIQUE (provider, subject)
+				);
+				CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities (user_id);
+				CREATE TABLE IF NOT EXISTS oidc_login_states (
+					state_hash TEXT PRIMARY KEY,
+					provider TEXT NOT NULL,
+					code_verifier TEXT NOT NULL,
+					nonce TEXT NOT NULL,
+					expires_at TIMESTAMPTZ NOT NULL
+				)
+			`,
+		},
+		{
+			version: "011_create_rbac",
+			query: `
+				CREATE TABLE IF NOT EXISTS roles (
+					id SERIAL PRIMARY KEY,
+					name TEXT NOT NULL UNIQUE
+				);
+				CREATE TABLE IF NOT EXISTS permissions (
+					id SERIAL PRIMARY KEY,
+					name TEXT NOT NULL UNIQUE
+				);
+				CREATE TABLE IF NOT EXISTS role_permissions (
+					role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+					permission_id INTEGER NOT NULL REFERENCES permissions(id) ON DELETE CASCADE,
+					PRIMARY KEY (role_id, permission_id)
+				);
+				CREATE TABLE IF NOT EXISTS user_roles (
+					user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+					created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+					PRIMARY KEY (user_id, role_id)
+				);
+				INSERT INTO roles (name) VALUES ('admin'), ('teacher'), ('student') ON CONFLICT DO NOTHING;
+				INSERT INTO permissions (name) VALUES ('apostila:edit'), ('apostila:render'), ('user:admin') ON CONFLICT DO NOTHING;
+				INSERT INTO role_permissions (role_id, permission_id)
+					SELECT r.id, p.id FROM roles r, permissions p
+					WHERE (r.name = 'admin')
+						OR (r.name = 'teacher' AND p.name IN ('apostila:edit', 'apostila:render'))
+						OR (r.name = 'student' AND p.name = 'apostila:render')
+					ON CONFLICT DO NOTHING;
+				INSERT INTO user_roles (user_id, role_id)
+					SELECT u.id, r.id FROM users u, roles r WHERE r.name = 'teacher'
+					ON CONFLICT DO NOTHING
+			`,
+		},
+		{
+			version: "012_create_personal_access_tokens",
+			query: `
+				CREATE TABLE IF NOT EXISTS personal_access_tokens (
+					id SERIAL PRIMARY KEY,
+					user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					name TEXT NOT NULL,
+					token_hash TEXT NOT NULL UNIQUE,
+					scopes TEXT[] NOT NULL,
+					expires_at TIMESTAMPTZ,
+					last_used_at TIMESTAMPTZ,
+					revoked_at TIMESTAMPTZ,
+					created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+				);
+				CREATE INDEX IF NOT EXISTS personal_access_tokens_user_id_idx ON personal_access_tokens (user_id)
+			`,
+		},
+		{
+			version: "013_create_sessions",
+			query: `
+				CREATE TABLE IF NOT EXISTS sessions (
+					id UUID PRIMARY KEY,
+					user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					user_agent TEXT,
+					ip TEXT,
+					created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+					last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+					revoked_at TIMESTAMPTZ
+				);
+				CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
+				INSERT INTO sessions (id, user_id, created_at, last_seen_at)
+					SELECT family_id, user_id, MIN(created_at), MAX(created_at)
+					FROM refresh_tokens
+					GROUP BY family_id, user_id
+					ON CONFLICT DO NOTHING
+			`,
+		},
+		{
+			version: "014_create_audit_events",
+			query: `
+				CREATE TABLE IF NOT EXISTS audit_events (
+					id BIGSERIAL PRIMARY KEY,
+					occurred_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+					actor_id INTEGER,
+					action TEXT NOT NULL,
+					target_type TEXT,
+					target_id TEXT,
+					ip TEXT,
+					request_id TEXT,
+					outcome TEXT NOT NULL CHECK (outcome IN ('success', 'failure')),
+					metadata JSONB NOT NULL DEFAULT '{}'
+				);
+				CREATE INDEX IF NOT EXISTS audit_events_occurred_at_idx ON audit_events (occurred_at);
+				CREATE INDEX IF NOT EXISTS audit_events_actor_id_idx ON audit_events (actor_id);
+				CREATE INDEX IF NOT EXISTS audit_events_action_idx ON audit_events (action);
+				CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+				BEGIN
+					RAISE EXCEPTION 'audit_events is append-only';
+				END;
+				$$ LANGUAGE plpgsql;
+				CREATE OR REPLACE TRIGGER audit_events_no_update
+					BEFORE UPDATE OR DELETE ON audit_events
+					FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+				CREATE OR REPLACE TRIGGER audit_events_no_truncate
+					BEFORE TRUNCATE ON audit_events
+					FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only()
+			`,
+		},
+		{
+			version: "015_users_disabled_at",
+			query: `
+				ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMPTZ;
+				CREATE INDEX IF NOT EXISTS apostilas_user_id_idx ON apostilas (user_id)
+			`,
+		},
+		{
+			version: "016_create_account_deletion_requests",
+			query: `
+				CREATE TABLE IF NOT EXISTS account_deletion_requests (
+					user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+					requested_at TIMESTAMPTZ NOT NULL,
+					scheduled_for TIMESTAMPTZ NOT NULL
+				);
+				CREATE INDEX IF NOT EXISTS account_deletion_requests_scheduled_for_idx ON account_deletion_requests (scheduled_for)
+			`,
+		},
+		{
+			version: "017_create_organizations",
+			query: `
+				CREATE TABLE IF NOT EXISTS organizations (
+					id SERIAL PRIMARY KEY,
+					slug TEXT NOT NULL UNIQUE,
+					name TEXT NOT NULL,
+					allowed_origins TEXT[] NOT NULL DEFAULT '{}',
+					branding JSONB NOT NULL DEFAULT '{}',
+					max_apostilas INTEGER,
+					max_members INTEGER,
+					created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+					updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+				);
+				CREATE TABLE IF NOT EXISTS organization_members (
+					organization_id INTEGER NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+					user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					role TEXT NOT NULL CHECK (role IN ('admin', 'teacher', 'student')),
+					created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+					PRIMARY KEY (organization_id, user_id)
+				);
+				CREATE INDEX IF NOT EXISTS organization_members_user_id_idx ON organization_members (user_id);
+				ALTER TABLE apostilas ADD COLUMN IF NOT EXISTS organization_id INTEGER REFERENCES organizations(id);
+				CREATE INDEX IF NOT EXISTS apostilas_organization_id_idx ON apostilas (organization_id)
+			`,
+		},
+		{
+			version: "018_apostilas_listing_indexes",
+			query: `
+				CREATE INDEX IF NOT EXISTS apostilas_user_created_idx ON apostilas (user_id, organization_id, created_at, id);
+				CREATE INDEX IF NOT EXISTS apostilas_user_updated_idx ON apostilas (user_id, organization_id, updated_at, id);
+				DROP INDEX IF EXISTS apostilas_user_id_idx
+			`,
+		},
+		{
+			version: "019_apostila_metadata",
+			query: `
+				ALTER TABLE apostilas
+					ADD COLUMN IF NOT EXISTS title TEXT,
+					ADD COLUMN IF NOT EXISTS heading TEXT NOT NULL DEFAULT '',
+					ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '',
+					ADD COLUMN IF NOT EXISTS subject TEXT NOT NULL DEFAULT '',
+					ADD COLUMN IF NOT EXISTS grade_level TEXT NOT NULL DEFAULT '',
+					ADD COLUMN IF NOT EXISTS language TEXT NOT NULL DEFAULT 'pt-BR';
+				UPDATE apostilas
+					SET heading = COALESCE(btrim(regexp_replace(regexp_replace(
+						substring(edited_html from '(?i)<h[1-6][^>]*?>(.*?)</h[1-6]>'), '<[^>]*>', '', 'g'), '\s+', ' ', 'g')), '')
+					WHERE edited_html IS NOT NULL AND heading = '';
+				CREATE INDEX IF NOT EXISTS apostilas_user_subject_idx ON apostilas (user_id, subject);
+				CREATE TABLE IF NOT EXISTS apostila_tags (
+					apostila_id UUID NOT NULL REFERENCES apostilas(id) ON DELETE CASCADE,
+					tag TEXT NOT NULL,
+					PRIMARY KEY (apostila_id, tag)
+				);
+				CREATE INDEX IF NOT EXISTS apostila_tags_tag_idx ON apostila_tags (tag)
+			`,
+		},
+		{
+			version: "020_apostilas_full_text_search",
+			query: `
+				CREATE EXTENSION IF NOT EXISTS unaccent;
+				DO $$
+				BEGIN
+					IF NOT EXISTS (SELECT 1 FROM pg_ts_config WHERE cfgname = 'portuguese_unaccent') THEN
+						CREATE TEXT SEARCH CONFIGURATION portuguese_unaccent (COPY = portuguese);
+						ALTER TEXT SEARCH CONFIGURATION portuguese_unaccent
+							ALTER MAPPING FOR hword, hword_part, word WITH unaccent, portuguese_stem;
+					END IF;
+				END
+				$$;
+				ALTER TABLE apostilas
+					ADD COLUMN IF NOT EXISTS content_text TEXT NOT NULL DEFAULT '',
+					ADD COLUMN IF NOT EXISTS search_vector TSVECTOR NOT NULL DEFAULT ''::tsvector;
+				UPDATE apostilas
+					SET content_text = btrim(regexp_replace(regexp_replace(regexp_replace(edited_html,
+						'(?i)<(script|style|head)[^>]*?>.*?</\1>', ' ', 'g'), '<[^>]*>', ' ', 'g'), '\s+', ' ', 'g'))
+					WHERE edited_html IS NOT NULL AND content_text = '';
+				UPDATE apostilas a
+					SET search_vector =
+						setweight(to_tsvector('portuguese_unaccent', COALESCE(NULLIF(a.title, ''), a.heading)), 'A') ||
+						setweight(to_tsvector('portuguese_unaccent', a.subject || ' ' ||
+							array_to_string(ARRAY(SELECT t.tag FROM apostila_tags t WHERE t.apostila_id = a.id), ' ')), 'B') ||
+						setweight(to_tsvector('portuguese_unaccent', a.description), 'C') ||
+						setweight(to_tsvector('portuguese_unaccent', a.content_text), 'D');
+				CREATE INDEX IF NOT EXISTS apostilas_search_vector_idx ON apostilas USING GIN (search_vector)
+			`,
+		},
+		{
+			version: "021_create_apostila_revisions",
+			query: `
+				CREATE TABLE IF NOT EXISTS apostila_revisions (
+					id BIGSERIAL PRIMARY KEY,
+					apostila_id UUID NOT NULL REFERENCES apostilas(id) ON DELETE CASCADE,
+					author_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+					html TEXT NOT NULL,
+					content_hash TEXT NOT NULL,
+					autosave BOOLEAN NOT NULL DEFAULT FALSE,
+					restored_from BIGINT REFERENCES apostila_revisions(id) ON DELETE SET NULL,
+					created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+				);
+				CREATE INDEX IF NOT EXISTS apostila_revisions_apostila_id_idx ON apostila_revisions (apostila_id, id);
+				CREATE INDEX IF NOT EXISTS apostila_revisions_autosave_idx ON apostila_revisions (created_at) WHERE autosave;
+				INSERT INTO apostila_revisions (apostila_id, author_id, html, content_hash, created_at)
+					SELECT a.id, a.user_id, a.edited_html, encode(sha256(convert_to(a.edited_html, 'UTF8')), 'hex'), a.updated_at
+					FROM apostilas a
+					WHERE a.edited_html IS NOT NULL
+						AND NOT EXISTS (SELECT 1 FROM apostila_revisions r WHERE r.apostila_id = a.id)
+			`,
+		},
+		{
+			version: "022_apostilas_version",
+			query: `
+				ALTER TABLE apostilas ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1
+			`,
+		},
+		{
+			version: "023_apostila_permissions",
+			query: `
+				CREATE TABLE IF NOT EXISTS apostila_permissions (
+					apostila_id UUID NOT NULL REFERENCES apostilas(id) ON DELETE CASCADE,
+					user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					level TEXT NOT NULL CHECK (level IN ('viewer', 'commenter', 'editor')),
+					granted_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+					created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+					updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+					PRIMARY KEY (apostila_id, user_id)
+				);
+				CREATE INDEX IF NOT EXISTS apostila_permissions_user_idx ON apostila_permissions (user_id);
+				CREATE TABLE IF NOT EXISTS apostila_invites (
+					id BIGSERIAL PRIMARY KEY,
+					apostila_id UUID NOT NULL REFERENCES apostilas(id) ON DELETE CASCADE,
+					email TEXT NOT NULL,
+					level TEXT NOT NULL CHECK (level IN ('viewer', 'commenter', 'editor')),
+					token_hash TEXT NOT NULL UNIQUE,
+					invited_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+					created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+					expires_at TIMESTAMPTZ NOT NULL
+				);
+				CREATE UNIQUE INDEX IF NOT EXISTS apostila_invites_email_idx ON apostila_invites (apostila_id, lower(email))
+			`,
+		},
+		{
+			version: "024_add_users_password_reset_sent_at",
+			query: `
+				ALTER TABLE users
+					ADD COLUMN IF NOT EXISTS password_reset_sent_at TIMESTAMPTZ
+			`,
+		},
+		{
+			version: "025_users_email_case_insensitive",
+			query: `
+				DO $$
+				DECLARE
+					duplicates TEXT;
+				BEGIN
+					SELECT string_agg(format('%s (ids %s)', normalized, ids), ', ')
+					INTO duplicates
+					FROM (
+						SELECT lower(trim(email)) AS normalized, string_agg(id::text, ', ' ORDER BY id) AS ids
+						FROM users
+						GROUP BY lower(trim(email))
+						HAVING count(*) > 1
+					) d;
+
+					IF duplicates IS NOT NULL THEN
+						RAISE EXCEPTION 'accounts differ only in email case or spaces, merge or rename them first: %', duplicates;
+					END IF;
+				END
+				$$;
+				UPDATE users SET email = lower(trim(email)) WHERE email <> lower(trim(email));
+				CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_idx ON users (lower(email))
+			`,
+		},
+		{
+			version: "026_create_data_exports",
+			query: `
+				CREATE TABLE IF NOT EXISTS data_exports (
+					user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+					status TEXT NOT NULL CHECK (status IN ('pending', 'ready', 'failed')),
+					error TEXT,
+					archive BYTEA,
+					requested_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+					finished_at TIMESTAMPTZ,
+					expires_at TIMESTAMPTZ
+				)
+			`,
+		},
+		{
+			version: "027_audit_events_anonymise",
+			query: `
+				CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+				BEGIN
+					IF TG_OP = 'UPDATE'
+						AND NEW.id = OLD.id
+						AND NEW.occurred_at = OLD.occurred_at
+						AND NEW.action = OLD.action
+						AND NEW.target_type IS NOT DISTINCT FROM OLD.target_type
+						AND NEW.request_id IS NOT DISTINCT FROM OLD.request_id
+						AND NEW.outcome = OLD.outcome
+						AND (NEW.actor_id IS NULL OR NEW.actor_id = OLD.actor_id)
+						AND (NEW.target_id IS NULL OR NEW.target_id = OLD.target_id)
+						AND (NEW.ip IS NULL OR NEW.ip = OLD.ip)
+						AND NEW.metadata IN (OLD.metadata, OLD.metadata - 'email', OLD.metadata - 'user_id', OLD.metadata - ARRAY['email', 'user_id'])
+					THEN
+						RETURN NEW;
+					END IF;
+
+					RAISE EXCEPTION 'audit_events is append-only';
+				END;
+				$$ LANGUAGE plpgsql;
+				CREATE OR REPLACE FUNCTION audit_events_anonymise(p_user_id INTEGER, p_email TEXT) RETURNS void AS $$
+					UPDATE audit_events
+					SET actor_id = NULLIF(actor_id, p_user_id),
+						ip = CASE WHEN actor_id = p_user_id THEN NULL ELSE ip END,
+						target_id = CASE WHEN target_type = 'user' AND target_id = p_user_id::text THEN NULL ELSE target_id END,
+						metadata = CASE
+							WHEN lower(metadata->>'email') = lower(p_email) AND metadata->>'user_id' = p_user_id::text THEN metadata - ARRAY['email', 'user_id']
+							WHEN lower(metadata->>'email') = lower(p_email) THEN metadata - 'email'
+							WHEN metadata->>'user_id' = p_user_id::text THEN metadata - 'user_id'
+							ELSE metadata
+						END
+					WHERE actor_id = p_user_id
+						OR (target_type = 'user' AND target_id = p_user_id::text)
+						OR lower(metadata->>'email') = lower(p_email)
+						OR metadata->>'user_id' = p_user_id::text
+				$$ LANGUAGE sql
+			`,
+		},
+		{
+			version: "028_audit_events_anonymise_only_through_function",
+			query: `
+				CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+				BEGIN
+					IF TG_OP = 'UPDATE'
+						AND current_setting('audit_events.anonymise', true) = 'on'
+						AND NEW.id = OLD.id
+						AND NEW.occurred_at = OLD.occurred_at
+						AND NEW.action = OLD.action
+						AND NEW.target_type IS NOT DISTINCT FROM OLD.target_type
+						AND NEW.request_id IS NOT DISTINCT FROM OLD.request_id
+						AND NEW.outcome = OLD.outcome
+						AND (NEW.actor_id IS NULL OR NEW.actor_id = OLD.actor_id)
+						AND (NEW.target_id IS NULL OR NEW.target_id = OLD.target_id)
+						AND (NEW.ip IS NULL OR NEW.ip = OLD.ip)
+						AND NEW.metadata IN (OLD.metadata, OLD.metadata - 'email', OLD.metadata - 'user_id', OLD.metadata - ARRAY['email', 'user_id'])
+					THEN
+						RETURN NEW;
+					END IF;
+
+					RAISE EXCEPTION 'audit_events is append-only';
+				END;
+				$$ LANGUAGE plpgsql;
+				CREATE OR REPLACE FUNCTION audit_events_anonymise(p_user_id INTEGER, p_email TEXT) RETURNS void
+				SECURITY DEFINER SET search_path = public AS $$
+				BEGIN
+					PERFORM set_config('audit_events.anonymise', 'on', true);
+
+					UPDATE audit_events
+					SET actor_id = NULLIF(actor_id, p_user_id),
+						ip = CASE WHEN actor_id = p_user_id THEN NULL ELSE ip END,
+						target_id = CASE WHEN target_type = 'user' AND target_id = p_user_id::text THEN NULL ELSE target_id END,
+						metadata = CASE
+							WHEN lower(metadata->>'email') = lower(p_email) AND metadata->>'user_id' = p_user_id::text THEN metadata - ARRAY['email', 'user_id']
+							WHEN lower(metadata->>'email') = lower(p_email) THEN metadata - 'email'
+							WHEN metadata->>'user_id' = p_user_id::text THEN metadata - 'user_id'
+							ELSE metadata
+						END
+					WHERE actor_id = p_user_id
+						OR (target_type = 'user' AND target_id = p_user_id::text)
+						OR lower(metadata->>'email') = lower(p_email)
+						OR metadata->>'user_id' = p_user_id::text;
+
+					PERFORM set_config('audit_events.anonymise', 'off', true);
+				END;
+				$$ LANGUAGE plpgsql;
+				REVOKE UPDATE, DELETE, TRUNCATE ON audit_events FROM PUBLIC
+			`,
+		},
+		{
+			version: "029_password_reset_tokens_email",
+			query: `
+				ALTER TABLE password_reset_tokens
+					ADD COLUMN IF NOT EXISTS email TEXT;
+				UPDATE password_reset_tokens SET used_at = NOW() WHERE email IS NULL AND used_at IS NULL
+			`,
+		},
+		{
+			version: "030_audit_events_owned_by_audit_role",
+			query: `
+				DO $$
+				BEGIN
+					IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'pds_audit') THEN
+						CREATE ROLE pds_audit NOLOGIN;
+					END IF;
+				END
+				$$;
+				CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+				BEGIN
+					IF TG_OP = 'UPDATE'
+						AND current_user = (SELECT pg_get_userbyid(relowner) FROM pg_class WHERE oid = TG_RELID)
+						AND NEW.id = OLD.id
+						AND NEW.occurred_at = OLD.occurred_at
+						AND NEW.action = OLD.action
+						AND NEW.target_type IS NOT DISTINCT FROM OLD.target_type
+						AND NEW.request_id IS NOT DISTINCT FROM OLD.request_id
+						AND NEW.outcome = OLD.outcome
+						AND (NEW.actor_id IS NULL OR NEW.actor_id = OLD.actor_id)
+						AND (NEW.target_id IS NULL OR NEW.target_id = OLD.target_id)
+						AND (NEW.ip IS NULL OR NEW.ip = OLD.ip)
+						AND NEW.metadata IN (OLD.metadata, OLD.metadata - 'email', OLD.metadata - 'user_id', OLD.metadata - ARRAY['email', 'user_id'])
+					THEN
+						RETURN NEW;
+					END IF;
+
+					RAISE EXCEPTION 'audit_events is append-only';
+				END;
+				$$ LANGUAGE plpgsql;
+				CREATE OR REPLACE FUNCTION audit_events_anonymise(p_user_id INTEGER, p_email TEXT) RETURNS void
+				SECURITY DEFINER SET search_path = public AS $$
+					UPDATE audit_events
+					SET actor_id = NULLIF(actor_id, p_user_id),
+						ip = CASE WHEN actor_id = p_user_id THEN NULL ELSE ip END,
+						target_id = CASE WHEN target_type = 'user' AND target_id = p_user_id::text THEN NULL ELSE target_id END,
+						metadata = CASE
+							WHEN lower(metadata->>'email') = lower(p_email) AND metadata->>'user_id' = p_user_id::text THEN metadata - ARRAY['email', 'user_id']
+							WHEN lower(metadata->>'email') = lower(p_email) THEN metadata - 'email'
+							WHEN metadata->>'user_id' = p_user_id::text THEN metadata - 'user_id'
+							ELSE metadata
+						END
+					WHERE actor_id = p_user_id
+						OR (target_type = 'user' AND target_id = p_user_id::text)
+						OR lower(metadata->>'email') = lower(p_email)
+						OR metadata->>'user_id' = p_user_id::text
+				$$ LANGUAGE sql;
+				ALTER TABLE audit_events OWNER TO pds_audit;
+				ALTER FUNCTION audit_events_append_only() OWNER TO pds_audit;
+				ALTER FUNCTION audit_events_anonymise(INTEGER, TEXT) OWNER TO pds_audit;
+				REVOKE ALL ON audit_events FROM PUBLIC;
+				REVOKE ALL ON FUNCTION audit_events_anonymise(INTEGER, TEXT) FROM PUBLIC;
+				GRANT SELECT, INSERT ON audit_events TO :app_role;
+				GRANT USAGE ON SEQUENCE audit_events_id_seq TO :app_role;
+				GRANT EXECUTE ON FUNCTION audit_events_anonymise(INTEGER, TEXT) TO :app_role
+			`,
+		},
+		{
+			version: "031_apostilas_organization_restrict",
+			query: `
+				ALTER TABLE apostilas
+					DROP CONSTRAINT IF EXISTS apostilas_organization_id_fkey,
+					ADD CONSTRAINT apostilas_organization_id_fkey
+						FOREIGN KEY (organization_id) REFERENCES organizations(id) ON DELETE RESTRICT
+			`,
+		},
+	}
+
+	/* the role the API logs in as, by default the one running the migrations */
+	appRole := "CURRENT_USER"
+	if role := os.Getenv("DATABASE_APP_ROLE"); role != "" {
+		appRole = pq.QuoteIdentifier(role)
 	}
 
 	for _, m := range migrations {
@@ -86,7 +676,7 @@ func main() {
 		}
 
 		fmt.Printf("Applying migration %s...\n", m.version)
-		_, err = db.ExecContext(ctx, m.query)
+		_, err = db.ExecContext(ctx, strings.ReplaceAll(m.query, ":app_role", appRole))
 		if err != nil {
 			log.Fatalf("Failed migration %s: %v\n", m.version, err)
 		}